@@ -4,13 +4,14 @@ import (
 	b64 "encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/fatih/structs"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 const (
@@ -47,6 +48,12 @@ type Counter struct {
 	TotalLatency int64   `json:"total_latency"`
 	Latency      float64 `json:"latency"`
 
+	// Sketches of the latencies, used to compute the percentiles
+	LatencySketch              *LatencySketch     `json:"latency_sketch,omitempty"`
+	UpstreamLatencySketch      *LatencySketch     `json:"upstream_latency_sketch,omitempty"`
+	LatencyPercentiles         LatencyPercentiles `json:"latency_percentiles"`
+	UpstreamLatencyPercentiles LatencyPercentiles `json:"upstream_latency_percentiles"`
+
 	ErrorMap  map[string]int `json:"error_map"`
 	ErrorList []ErrorData    `json:"error_list"`
 }
@@ -68,31 +75,59 @@ type AnalyticsRecordAggregate struct {
 	APIID    map[string]*Counter
 	OauthIDs map[string]*Counter
 	Geo      map[string]*Counter
+	Regions  map[string]*Counter
+	ASNs     map[string]*Counter
 	Tags     map[string]*Counter
 
+	UserAgents map[string]*Counter
+	Devices    map[string]*Counter
+
+	Methods       map[string]*Counter
+	StatusClasses map[string]*Counter
+	Hosts         map[string]*Counter
+
 	Endpoints map[string]*Counter
 
 	Lists struct {
 		APIKeys       []Counter
 		APIID         []Counter
+		Versions      []Counter
 		OauthIDs      []Counter
 		Geo           []Counter
+		Regions       []Counter
+		ASNs          []Counter
 		Tags          []Counter
+		UserAgents    []Counter
+		Devices       []Counter
+		Methods       []Counter
+		StatusClasses []Counter
+		Hosts         []Counter
 		Errors        []Counter
 		Endpoints     []Counter
 		KeyEndpoint   map[string][]Counter `bson:"keyendpoints"`
 		OauthEndpoint map[string][]Counter `bson:"oauthendpoints"`
 		APIEndpoint   []Counter            `bson:"apiendpoints"`
+
+		ApiVersions      map[string][]Counter `bson:"apiversions"`
+		ApiStatusClasses map[string][]Counter `bson:"apistatusclasses"`
 	}
 
 	KeyEndpoint   map[string]map[string]*Counter `bson:"keyendpoints"`
 	OauthEndpoint map[string]map[string]*Counter `bson:"oauthendpoints"`
 	ApiEndpoint   map[string]*Counter            `bson:"apiendpoints"`
 
+	// Versions and status classes per API ID
+	ApiVersions      map[string]map[string]*Counter `bson:"apiversions"`
+	ApiStatusClasses map[string]map[string]*Counter `bson:"apistatusclasses"`
+
 	Total Counter
 
 	ExpireAt time.Time `bson:"expireAt" json:"expireAt"`
 	LastTime time.Time
+
+	// Granularity is the size of the bucket in seconds. It is only set when the aggregation
+	// granularity is configured, documents without it are hourly or per minute.
+	Granularity int `bson:"granularity,omitempty" json:"granularity,omitempty"`
 }
 
 func (f AnalyticsRecordAggregate) New() AnalyticsRecordAggregate {
@@ -103,11 +138,20 @@ func (f AnalyticsRecordAggregate) New() AnalyticsRecordAggregate {
 	thisF.APIKeys = make(map[string]*Counter)
 	thisF.OauthIDs = make(map[string]*Counter)
 	thisF.Geo = make(map[string]*Counter)
+	thisF.Regions = make(map[string]*Counter)
+	thisF.ASNs = make(map[string]*Counter)
 	thisF.Tags = make(map[string]*Counter)
+	thisF.UserAgents = make(map[string]*Counter)
+	thisF.Devices = make(map[string]*Counter)
+	thisF.Methods = make(map[string]*Counter)
+	thisF.StatusClasses = make(map[string]*Counter)
+	thisF.Hosts = make(map[string]*Counter)
 	thisF.Endpoints = make(map[string]*Counter)
 	thisF.KeyEndpoint = make(map[string]map[string]*Counter)
 	thisF.OauthEndpoint = make(map[string]map[string]*Counter)
 	thisF.ApiEndpoint = make(map[string]*Counter)
+	thisF.ApiVersions = make(map[string]map[string]*Counter)
+	thisF.ApiStatusClasses = make(map[string]map[string]*Counter)
 
 	return thisF
 }
@@ -145,10 +189,25 @@ func (f *AnalyticsRecordAggregate) generateBSONFromProperty(parent, thisUnit str
 	newUpdate["$max"].(bson.M)[constructor+"maxupstreamlatency"] = incVal.MaxUpstreamLatency
 	newUpdate["$inc"].(bson.M)[constructor+"totalupstreamlatency"] = incVal.TotalUpstreamLatency
 	newUpdate["$inc"].(bson.M)[constructor+"totallatency"] = incVal.TotalLatency
+	incSketch(constructor+"latencysketch.", incVal.LatencySketch, newUpdate)
+	incSketch(constructor+"upstreamlatencysketch.", incVal.UpstreamLatencySketch, newUpdate)
 
 	return newUpdate
 }
 
+// incSketch merges the sketch in the stored one by incrementing each of its buckets
+func incSketch(constructor string, sketch *LatencySketch, newUpdate bson.M) {
+	if sketch == nil {
+		return
+	}
+
+	newUpdate["$inc"].(bson.M)[constructor+"count"] = sketch.Count
+	newUpdate["$inc"].(bson.M)[constructor+"zeros"] = sketch.Zeros
+	for k, v := range sketch.Buckets {
+		newUpdate["$inc"].(bson.M)[constructor+"buckets."+k] = v
+	}
+}
+
 func (f *AnalyticsRecordAggregate) generateSetterForTime(parent, thisUnit string, realTime float64, newUpdate bson.M) bson.M {
 
 	constructor := parent + "." + thisUnit + "."
@@ -168,6 +227,8 @@ func (f *AnalyticsRecordAggregate) latencySetter(parent, thisUnit string, newUpd
 		counter.Latency = 0.0
 		counter.UpstreamLatency = 0.0
 	}
+	counter.LatencyPercentiles = counter.LatencySketch.Percentiles()
+	counter.UpstreamLatencyPercentiles = counter.UpstreamLatencySketch.Percentiles()
 
 	constructor := parent + "." + thisUnit + "."
 	if parent == "" {
@@ -175,6 +236,8 @@ func (f *AnalyticsRecordAggregate) latencySetter(parent, thisUnit string, newUpd
 	}
 	newUpdate["$set"].(bson.M)[constructor+"latency"] = counter.Latency
 	newUpdate["$set"].(bson.M)[constructor+"upstreamlatency"] = counter.UpstreamLatency
+	newUpdate["$set"].(bson.M)[constructor+"latencypercentiles"] = counter.LatencyPercentiles
+	newUpdate["$set"].(bson.M)[constructor+"upstreamlatencypercentiles"] = counter.UpstreamLatencyPercentiles
 
 	return newUpdate
 }
@@ -210,10 +273,38 @@ func (f *AnalyticsRecordAggregate) AsChange() bson.M {
 		newUpdate = f.generateBSONFromProperty("geo", thisUnit, incVal, newUpdate)
 	}
 
+	for thisUnit, incVal := range f.Regions {
+		newUpdate = f.generateBSONFromProperty("regions", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.ASNs {
+		newUpdate = f.generateBSONFromProperty("asns", thisUnit, incVal, newUpdate)
+	}
+
 	for thisUnit, incVal := range f.Tags {
 		newUpdate = f.generateBSONFromProperty("tags", thisUnit, incVal, newUpdate)
 	}
 
+	for thisUnit, incVal := range f.UserAgents {
+		newUpdate = f.generateBSONFromProperty("useragents", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.Devices {
+		newUpdate = f.generateBSONFromProperty("devices", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.Methods {
+		newUpdate = f.generateBSONFromProperty("methods", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.StatusClasses {
+		newUpdate = f.generateBSONFromProperty("statusclasses", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.Hosts {
+		newUpdate = f.generateBSONFromProperty("hosts", thisUnit, incVal, newUpdate)
+	}
+
 	for thisUnit, incVal := range f.Endpoints {
 		newUpdate = f.generateBSONFromProperty("endpoints", thisUnit, incVal, newUpdate)
 	}
@@ -236,6 +327,20 @@ func (f *AnalyticsRecordAggregate) AsChange() bson.M {
 		newUpdate = f.generateBSONFromProperty("apiendpoints", thisUnit, incVal, newUpdate)
 	}
 
+	for thisUnit, incVal := range f.ApiVersions {
+		parent := "apiversions." + thisUnit
+		for k, v := range incVal {
+			newUpdate = f.generateBSONFromProperty(parent, k, v, newUpdate)
+		}
+	}
+
+	for thisUnit, incVal := range f.ApiStatusClasses {
+		parent := "apistatusclasses." + thisUnit
+		for k, v := range incVal {
+			newUpdate = f.generateBSONFromProperty(parent, k, v, newUpdate)
+		}
+	}
+
 	newUpdate = f.generateBSONFromProperty("", "total", &f.Total, newUpdate)
 
 	asTime := f.TimeStamp
@@ -247,6 +352,9 @@ func (f *AnalyticsRecordAggregate) AsChange() bson.M {
 	newUpdate["$set"].(bson.M)["timeid.day"] = newTime.Day()
 	newUpdate["$set"].(bson.M)["timeid.hour"] = newTime.Hour()
 	newUpdate["$set"].(bson.M)["lasttime"] = f.LastTime
+	if f.Granularity > 0 {
+		newUpdate["$set"].(bson.M)["granularity"] = f.Granularity
+	}
 
 	return newUpdate
 }
@@ -280,10 +388,16 @@ func (f *AnalyticsRecordAggregate) getRecords(fieldName string, data map[string]
 		if incVal.Hits > 0 {
 			newTime = incVal.TotalRequestTime / float64(incVal.Hits)
 		}
+		incVal.RequestTime = newTime
 		f.SetErrorList(fieldName, thisUnit, incVal, newUpdate)
 		newUpdate = f.generateSetterForTime(fieldName, thisUnit, newTime, newUpdate)
 		newUpdate = f.latencySetter(fieldName, thisUnit, newUpdate, incVal)
-		result = append(result, *incVal)
+
+		// The lists only need the percentiles, the sketches are kept in the dimension itself
+		record := *incVal
+		record.LatencySketch = nil
+		record.UpstreamLatencySketch = nil
+		result = append(result, record)
 	}
 
 	return result
@@ -297,39 +411,88 @@ func (f *AnalyticsRecordAggregate) AsTimeUpdate() bson.M {
 	// We need to create lists of API data so that we can aggregate across the list
 	// in order to present top-20 style lists of APIs, Tokens etc.
 	//apis := make([]Counter, 0)
-	newUpdate["$set"].(bson.M)["lists.apiid"] = f.getRecords("apiid", f.APIID, newUpdate)
+	f.Lists.APIID = f.getRecords("apiid", f.APIID, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.apiid"] = f.Lists.APIID
+
+	f.Lists.Errors = f.getRecords("errors", f.Errors, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.errors"] = f.Lists.Errors
+
+	f.Lists.Versions = f.getRecords("versions", f.Versions, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.versions"] = f.Lists.Versions
 
-	newUpdate["$set"].(bson.M)["lists.errors"] = f.getRecords("errors", f.Errors, newUpdate)
+	f.Lists.APIKeys = f.getRecords("apikeys", f.APIKeys, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.apikeys"] = f.Lists.APIKeys
 
-	newUpdate["$set"].(bson.M)["lists.versions"] = f.getRecords("versions", f.Versions, newUpdate)
+	f.Lists.OauthIDs = f.getRecords("oauthids", f.OauthIDs, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.oauthids"] = f.Lists.OauthIDs
 
-	newUpdate["$set"].(bson.M)["lists.apikeys"] = f.getRecords("apikeys", f.APIKeys, newUpdate)
+	f.Lists.Geo = f.getRecords("geo", f.Geo, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.geo"] = f.Lists.Geo
 
-	newUpdate["$set"].(bson.M)["lists.oauthids"] = f.getRecords("oauthids", f.OauthIDs, newUpdate)
+	f.Lists.Regions = f.getRecords("regions", f.Regions, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.regions"] = f.Lists.Regions
 
-	newUpdate["$set"].(bson.M)["lists.geo"] = f.getRecords("geo", f.Geo, newUpdate)
+	f.Lists.ASNs = f.getRecords("asns", f.ASNs, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.asns"] = f.Lists.ASNs
 
-	newUpdate["$set"].(bson.M)["lists.tags"] = f.getRecords("tags", f.Tags, newUpdate)
+	f.Lists.Tags = f.getRecords("tags", f.Tags, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.tags"] = f.Lists.Tags
 
-	newUpdate["$set"].(bson.M)["lists.endpoints"] = f.getRecords("endpoints", f.Endpoints, newUpdate)
+	f.Lists.UserAgents = f.getRecords("useragents", f.UserAgents, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.useragents"] = f.Lists.UserAgents
 
+	f.Lists.Devices = f.getRecords("devices", f.Devices, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.devices"] = f.Lists.Devices
+
+	f.Lists.Methods = f.getRecords("methods", f.Methods, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.methods"] = f.Lists.Methods
+
+	f.Lists.StatusClasses = f.getRecords("statusclasses", f.StatusClasses, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.statusclasses"] = f.Lists.StatusClasses
+
+	f.Lists.Hosts = f.getRecords("hosts", f.Hosts, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.hosts"] = f.Lists.Hosts
+
+	f.Lists.Endpoints = f.getRecords("endpoints", f.Endpoints, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.endpoints"] = f.Lists.Endpoints
+
+	f.Lists.KeyEndpoint = make(map[string][]Counter)
 	for thisUnit, incVal := range f.KeyEndpoint {
 		parent := "lists.keyendpoints." + thisUnit
-		newUpdate["$set"].(bson.M)[parent] = f.getRecords("keyendpoints."+thisUnit, incVal, newUpdate)
+		f.Lists.KeyEndpoint[thisUnit] = f.getRecords("keyendpoints."+thisUnit, incVal, newUpdate)
+		newUpdate["$set"].(bson.M)[parent] = f.Lists.KeyEndpoint[thisUnit]
 	}
 
+	f.Lists.OauthEndpoint = make(map[string][]Counter)
 	for thisUnit, incVal := range f.OauthEndpoint {
 		parent := "lists.oauthendpoints." + thisUnit
-		newUpdate["$set"].(bson.M)[parent] = f.getRecords("oauthendpoints."+thisUnit, incVal, newUpdate)
+		f.Lists.OauthEndpoint[thisUnit] = f.getRecords("oauthendpoints."+thisUnit, incVal, newUpdate)
+		newUpdate["$set"].(bson.M)[parent] = f.Lists.OauthEndpoint[thisUnit]
+	}
+
+	f.Lists.APIEndpoint = f.getRecords("apiendpoints", f.ApiEndpoint, newUpdate)
+	newUpdate["$set"].(bson.M)["lists.apiendpoints"] = f.Lists.APIEndpoint
+
+	f.Lists.ApiVersions = make(map[string][]Counter)
+	for thisUnit, incVal := range f.ApiVersions {
+		parent := "lists.apiversions." + thisUnit
+		f.Lists.ApiVersions[thisUnit] = f.getRecords("apiversions."+thisUnit, incVal, newUpdate)
+		newUpdate["$set"].(bson.M)[parent] = f.Lists.ApiVersions[thisUnit]
 	}
 
-	newUpdate["$set"].(bson.M)["lists.apiendpoints"] = f.getRecords("apiendpoints", f.ApiEndpoint, newUpdate)
+	f.Lists.ApiStatusClasses = make(map[string][]Counter)
+	for thisUnit, incVal := range f.ApiStatusClasses {
+		parent := "lists.apistatusclasses." + thisUnit
+		f.Lists.ApiStatusClasses[thisUnit] = f.getRecords("apistatusclasses."+thisUnit, incVal, newUpdate)
+		newUpdate["$set"].(bson.M)[parent] = f.Lists.ApiStatusClasses[thisUnit]
+	}
 
 	var newTime float64
 
 	if f.Total.Hits > 0 {
 		newTime = f.Total.TotalRequestTime / float64(f.Total.Hits)
 	}
+	f.Total.RequestTime = newTime
 	f.SetErrorList("", "total", &f.Total, newUpdate)
 	newUpdate = f.generateSetterForTime("", "total", newTime, newUpdate)
 	newUpdate = f.latencySetter("", "total", newUpdate, &f.Total)
@@ -353,8 +516,22 @@ func (f *AnalyticsRecordAggregate) DiscardAggregations(fields []string) {
 			f.OauthIDs = make(map[string]*Counter)
 		case "Geo", "geo":
 			f.Geo = make(map[string]*Counter)
+		case "Regions", "regions":
+			f.Regions = make(map[string]*Counter)
+		case "ASNs", "asns":
+			f.ASNs = make(map[string]*Counter)
 		case "Tags", "tags":
 			f.Tags = make(map[string]*Counter)
+		case "UserAgents", "useragents":
+			f.UserAgents = make(map[string]*Counter)
+		case "Devices", "devices":
+			f.Devices = make(map[string]*Counter)
+		case "Methods", "methods":
+			f.Methods = make(map[string]*Counter)
+		case "StatusClasses", "statusclasses":
+			f.StatusClasses = make(map[string]*Counter)
+		case "Hosts", "hosts":
+			f.Hosts = make(map[string]*Counter)
 		case "Endpoints", "endpoints":
 			f.Endpoints = make(map[string]*Counter)
 		case "KeyEndpoint", "keyendpint":
@@ -363,6 +540,10 @@ func (f *AnalyticsRecordAggregate) DiscardAggregations(fields []string) {
 			f.OauthEndpoint = make(map[string]map[string]*Counter)
 		case "ApiEndpoint", "apiendpoint":
 			f.ApiEndpoint = make(map[string]*Counter)
+		case "ApiVersions", "apiversions":
+			f.ApiVersions = make(map[string]map[string]*Counter)
+		case "ApiStatusClasses", "apistatusclasses":
+			f.ApiStatusClasses = make(map[string]map[string]*Counter)
 		default:
 			log.WithFields(logrus.Fields{
 				"prefix": MongoAggregatePrefix,
@@ -372,6 +553,75 @@ func (f *AnalyticsRecordAggregate) DiscardAggregations(fields []string) {
 	}
 }
 
+// DimensionCounter is a counter of the aggregate with the dimension it belongs to
+type DimensionCounter struct {
+	// Name of the dimension as stored by the Mongo aggregate pump, total for the totals
+	Dimension string
+	// Key of the counter in the dimension, the nested dimensions use parent:key and the total has none
+	Name    string
+	Counter *Counter
+}
+
+// Flatten returns the counters of all the dimensions and the total, sorted by dimension and name
+func (f *AnalyticsRecordAggregate) Flatten() []DimensionCounter {
+	dimensions := map[string]map[string]*Counter{
+		"apiid":         f.APIID,
+		"errors":        f.Errors,
+		"versions":      f.Versions,
+		"apikeys":       f.APIKeys,
+		"oauthids":      f.OauthIDs,
+		"geo":           f.Geo,
+		"regions":       f.Regions,
+		"asns":          f.ASNs,
+		"tags":          f.Tags,
+		"useragents":    f.UserAgents,
+		"devices":       f.Devices,
+		"methods":       f.Methods,
+		"statusclasses": f.StatusClasses,
+		"hosts":         f.Hosts,
+		"endpoints":     f.Endpoints,
+		"apiendpoints":  f.ApiEndpoint,
+	}
+	nested := map[string]map[string]map[string]*Counter{
+		"keyendpoints":     f.KeyEndpoint,
+		"oauthendpoints":   f.OauthEndpoint,
+		"apiversions":      f.ApiVersions,
+		"apistatusclasses": f.ApiStatusClasses,
+	}
+
+	var counters []DimensionCounter
+	for dimension, values := range dimensions {
+		for name, counter := range values {
+			counters = append(counters, DimensionCounter{Dimension: dimension, Name: name, Counter: counter})
+		}
+	}
+	for dimension, parents := range nested {
+		for parent, values := range parents {
+			for name, counter := range values {
+				counters = append(counters, DimensionCounter{Dimension: dimension, Name: parent + ":" + name, Counter: counter})
+			}
+		}
+	}
+	counters = append(counters, DimensionCounter{Dimension: "total", Counter: &f.Total})
+
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Dimension != counters[j].Dimension {
+			return counters[i].Dimension < counters[j].Dimension
+		}
+		return counters[i].Name < counters[j].Name
+	})
+	return counters
+}
+
+// sketchDimensions returns the set of the dimensions, named as in Flatten, whose counters keep a latency sketch
+func sketchDimensions(dimensions []string) map[string]bool {
+	sketches := make(map[string]bool, len(dimensions))
+	for _, dimension := range dimensions {
+		sketches[strings.ToLower(dimension)] = true
+	}
+	return sketches
+}
+
 func doHash(in string) string {
 	sEnc := b64.StdEncoding.EncodeToString([]byte(in))
 	search := strings.TrimRight(sEnc, "=")
@@ -393,6 +643,14 @@ func ignoreTag(tag string, ignoreTagPrefixList []string) bool {
 	return false
 }
 
+// responseCodeClass returns the class of the response code, e.g. "2xx", or an empty string for invalid codes
+func responseCodeClass(code int) string {
+	if code < 100 || code > 599 {
+		return ""
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
 func replaceUnsupportedChars(path string) string {
 	result := path
 
@@ -404,9 +662,54 @@ func replaceUnsupportedChars(path string) string {
 	return result
 }
 
-// AggregateData calculates aggregated data, returns map orgID => aggregated analytics data
+// AggregateData calculates aggregated data, returns map orgID => aggregated analytics data.
+// Every organisation has a single aggregate, in the bucket of its first record, as expected by MDCB.
+// Only the total has latency sketches.
 func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, storeAnalyticPerMinute bool) map[string]AnalyticsRecordAggregate {
+	return AggregateDataWithLatencySketches(data, trackAllPaths, ignoreTagPrefixList, storeAnalyticPerMinute, nil)
+}
+
+// AggregateDataWithLatencySketches is AggregateData with latency sketches on the counters of the given
+// dimensions, named as in Flatten, besides the total
+func AggregateDataWithLatencySketches(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, storeAnalyticPerMinute bool, latencySketchDimensions []string) map[string]AnalyticsRecordAggregate {
+	granularity := time.Hour
+	if storeAnalyticPerMinute {
+		granularity = time.Minute
+	}
+
+	analyticsPerOrg := aggregateData(data, trackAllPaths, ignoreTagPrefixList, latencySketchDimensions, granularity, false)
+	for orgID, aggregate := range analyticsPerOrg {
+		aggregate.Granularity = 0
+		analyticsPerOrg[orgID] = aggregate
+	}
+
+	return analyticsPerOrg
+}
+
+// AggregateDataWithGranularity calculates aggregated data in buckets of the given size (see Granularities),
+// returns an aggregate per organisation and bucket, sorted by organisation and timestamp. The counters of
+// latencySketchDimensions have latency sketches besides the total.
+func AggregateDataWithGranularity(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, latencySketchDimensions []string, granularity time.Duration) []AnalyticsRecordAggregate {
+	analyticsPerBucket := aggregateData(data, trackAllPaths, ignoreTagPrefixList, latencySketchDimensions, granularity, true)
+
+	aggregates := make([]AnalyticsRecordAggregate, 0, len(analyticsPerBucket))
+	for _, aggregate := range analyticsPerBucket {
+		aggregates = append(aggregates, aggregate)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		if aggregates[i].OrgID != aggregates[j].OrgID {
+			return aggregates[i].OrgID < aggregates[j].OrgID
+		}
+		return aggregates[i].TimeStamp.Before(aggregates[j].TimeStamp)
+	})
+
+	return aggregates
+}
+
+// aggregateData aggregates the records per organisation or, with perBucket, per organisation and bucket
+func aggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, latencySketchDimensions []string, granularity time.Duration, perBucket bool) map[string]AnalyticsRecordAggregate {
 	analyticsPerOrg := make(map[string]AnalyticsRecordAggregate)
+	sketches := sketchDimensions(latencySketchDimensions)
 
 	for _, v := range data {
 		thisV := v.(AnalyticsRecord)
@@ -416,26 +719,29 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 			continue
 		}
 
-		thisAggregate, found := analyticsPerOrg[orgID]
+		key := orgID
+		if perBucket {
+			key += "@" + strconv.FormatInt(TruncateTimestamp(thisV.TimeStamp, granularity).Unix(), 10)
+		}
+		thisAggregate, found := analyticsPerOrg[key]
 
 		if !found {
 			thisAggregate = AnalyticsRecordAggregate{}.New()
 
-			// Set the hourly timestamp & expiry
+			// Set the bucket timestamp & expiry
 			asTime := thisV.TimeStamp
-			if storeAnalyticPerMinute {
-				thisAggregate.TimeStamp = time.Date(asTime.Year(), asTime.Month(), asTime.Day(), asTime.Hour(), asTime.Minute(), 0, 0, asTime.Location())
-			} else {
-				thisAggregate.TimeStamp = time.Date(asTime.Year(), asTime.Month(), asTime.Day(), asTime.Hour(), 0, 0, 0, asTime.Location())
-			}
+			thisAggregate.TimeStamp = TruncateTimestamp(asTime, granularity)
+			thisAggregate.Granularity = int(granularity / time.Second)
 			thisAggregate.ExpireAt = thisV.ExpireAt
-			thisAggregate.TimeID.Year = asTime.Year()
-			thisAggregate.TimeID.Month = int(asTime.Month())
-			thisAggregate.TimeID.Day = asTime.Day()
-			thisAggregate.TimeID.Hour = asTime.Hour()
+			thisAggregate.TimeID.Year = thisAggregate.TimeStamp.Year()
+			thisAggregate.TimeID.Month = int(thisAggregate.TimeStamp.Month())
+			thisAggregate.TimeID.Day = thisAggregate.TimeStamp.Day()
+			thisAggregate.TimeID.Hour = thisAggregate.TimeStamp.Hour()
 			thisAggregate.OrgID = orgID
 			thisAggregate.LastTime = thisV.TimeStamp
 			thisAggregate.Total.ErrorMap = make(map[string]int)
+			thisAggregate.Total.LatencySketch = NewLatencySketch()
+			thisAggregate.Total.UpstreamLatencySketch = NewLatencySketch()
 		}
 
 		// Always update the last timestamp
@@ -483,7 +789,12 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 				MinLatency:           thisV.Latency.Total,
 				TotalLatency:         thisV.Latency.Total,
 				ErrorMap:             make(map[string]int),
+
+				LatencySketch:         NewLatencySketch(),
+				UpstreamLatencySketch: NewLatencySketch(),
 			}
+			thisCounter.LatencySketch.Add(thisV.Latency.Total)
+			thisCounter.UpstreamLatencySketch.Add(thisV.Latency.Upstream)
 			thisAggregate.Total.Hits++
 			thisAggregate.Total.TotalRequestTime += float64(thisV.RequestTime)
 
@@ -503,6 +814,8 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 			thisAggregate.Total.TotalLatency += thisV.Latency.Total
 			thisAggregate.Total.TotalUpstreamLatency += thisV.Latency.Upstream
+			thisAggregate.Total.LatencySketch.Merge(thisCounter.LatencySketch)
+			thisAggregate.Total.UpstreamLatencySketch.Merge(thisCounter.UpstreamLatencySketch)
 
 			if thisAggregate.Total.MaxLatency < thisV.Latency.Total {
 				thisAggregate.Total.MaxLatency = thisV.Latency.Total
@@ -537,13 +850,19 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 			for key, value := range vAsMap {
 
 				// Mini function to handle incrementing a specific counter in our object
-				IncrementOrSetUnit := func(c *Counter) *Counter {
+				IncrementOrSetUnit := func(dimension string, c *Counter) *Counter {
 					if c == nil {
 						newCounter := thisCounter
 						newCounter.ErrorMap = make(map[string]int)
 						for k, v := range thisCounter.ErrorMap {
 							newCounter.ErrorMap[k] = v
 						}
+						// only the opted-in dimensions get a copy of the sketches, see latency_sketch_dimensions
+						newCounter.LatencySketch, newCounter.UpstreamLatencySketch = nil, nil
+						if sketches[dimension] {
+							newCounter.LatencySketch = thisCounter.LatencySketch.Copy()
+							newCounter.UpstreamLatencySketch = thisCounter.UpstreamLatencySketch.Copy()
+						}
 						c = &newCounter
 					} else {
 						c.Hits += thisCounter.Hits
@@ -575,6 +894,16 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 						c.TotalLatency += thisCounter.TotalLatency
 						c.TotalUpstreamLatency += thisCounter.TotalUpstreamLatency
+						if sketches[dimension] {
+							if c.LatencySketch == nil {
+								c.LatencySketch = NewLatencySketch()
+							}
+							c.LatencySketch.Merge(thisCounter.LatencySketch)
+							if c.UpstreamLatencySketch == nil {
+								c.UpstreamLatencySketch = NewLatencySketch()
+							}
+							c.UpstreamLatencySketch.Merge(thisCounter.UpstreamLatencySketch)
+						}
 
 					}
 
@@ -583,7 +912,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 				switch key {
 				case "APIID":
-					c := IncrementOrSetUnit(thisAggregate.APIID[value.(string)])
+					c := IncrementOrSetUnit("apiid", thisAggregate.APIID[value.(string)])
 					if value.(string) != "" {
 						thisAggregate.APIID[value.(string)] = c
 						thisAggregate.APIID[value.(string)].Identifier = thisV.APIID
@@ -593,25 +922,77 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 				case "ResponseCode":
 					errAsStr := strconv.Itoa(value.(int))
 					if errAsStr != "" {
-						c := IncrementOrSetUnit(thisAggregate.Errors[errAsStr])
+						c := IncrementOrSetUnit("errors", thisAggregate.Errors[errAsStr])
 						if c.ErrorTotal > 0 {
 							thisAggregate.Errors[errAsStr] = c
 							thisAggregate.Errors[errAsStr].Identifier = errAsStr
 						}
 					}
+
+					if statusClass := responseCodeClass(value.(int)); statusClass != "" {
+						c := IncrementOrSetUnit("statusclasses", thisAggregate.StatusClasses[statusClass])
+						thisAggregate.StatusClasses[statusClass] = c
+						thisAggregate.StatusClasses[statusClass].Identifier = statusClass
+						thisAggregate.StatusClasses[statusClass].HumanIdentifier = statusClass
+
+						if thisV.APIID != "" {
+							data := thisAggregate.ApiStatusClasses[thisV.APIID]
+							if data == nil {
+								data = make(map[string]*Counter)
+							}
+
+							c = IncrementOrSetUnit("apistatusclasses", data[statusClass])
+							c.Identifier = statusClass
+							c.HumanIdentifier = statusClass
+							data[statusClass] = c
+							thisAggregate.ApiStatusClasses[thisV.APIID] = data
+						}
+					}
 					break
 				case "APIVersion":
 					versionStr := doHash(thisV.APIID + ":" + value.(string))
-					c := IncrementOrSetUnit(thisAggregate.Versions[versionStr])
+					c := IncrementOrSetUnit("versions", thisAggregate.Versions[versionStr])
 					if value.(string) != "" {
 						thisAggregate.Versions[versionStr] = c
 						thisAggregate.Versions[versionStr].Identifier = value.(string)
 						thisAggregate.Versions[versionStr].HumanIdentifier = value.(string)
+
+						if thisV.APIID != "" {
+							fixedVersion := replaceUnsupportedChars(value.(string))
+							data := thisAggregate.ApiVersions[thisV.APIID]
+							if data == nil {
+								data = make(map[string]*Counter)
+							}
+
+							c = IncrementOrSetUnit("apiversions", data[fixedVersion])
+							c.Identifier = value.(string)
+							c.HumanIdentifier = value.(string)
+							data[fixedVersion] = c
+							thisAggregate.ApiVersions[thisV.APIID] = data
+						}
+					}
+					break
+				case "Method":
+					if value.(string) != "" {
+						method := strings.ToUpper(value.(string))
+						c := IncrementOrSetUnit("methods", thisAggregate.Methods[method])
+						thisAggregate.Methods[method] = c
+						thisAggregate.Methods[method].Identifier = method
+						thisAggregate.Methods[method].HumanIdentifier = method
+					}
+					break
+				case "Host":
+					if value.(string) != "" {
+						fixedHost := replaceUnsupportedChars(value.(string))
+						c := IncrementOrSetUnit("hosts", thisAggregate.Hosts[fixedHost])
+						thisAggregate.Hosts[fixedHost] = c
+						thisAggregate.Hosts[fixedHost].Identifier = value.(string)
+						thisAggregate.Hosts[fixedHost].HumanIdentifier = value.(string)
 					}
 					break
 				case "APIKey":
 					if value.(string) != "" {
-						c := IncrementOrSetUnit(thisAggregate.APIKeys[value.(string)])
+						c := IncrementOrSetUnit("apikeys", thisAggregate.APIKeys[value.(string)])
 						thisAggregate.APIKeys[value.(string)] = c
 						thisAggregate.APIKeys[value.(string)].Identifier = value.(string)
 						thisAggregate.APIKeys[value.(string)].HumanIdentifier = thisV.Alias
@@ -624,7 +1005,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 								data = make(map[string]*Counter)
 							}
 
-							c = IncrementOrSetUnit(data[keyStr])
+							c = IncrementOrSetUnit("keyendpoints", data[keyStr])
 							c.Identifier = keyStr
 							c.HumanIdentifier = keyStr
 							data[keyStr] = c
@@ -635,7 +1016,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					break
 				case "OauthID":
 					if value.(string) != "" {
-						c := IncrementOrSetUnit(thisAggregate.OauthIDs[value.(string)])
+						c := IncrementOrSetUnit("oauthids", thisAggregate.OauthIDs[value.(string)])
 						thisAggregate.OauthIDs[value.(string)] = c
 						thisAggregate.OauthIDs[value.(string)].Identifier = value.(string)
 
@@ -647,7 +1028,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 								data = make(map[string]*Counter)
 							}
 
-							c = IncrementOrSetUnit(data[keyStr])
+							c = IncrementOrSetUnit("oauthendpoints", data[keyStr])
 							c.Identifier = keyStr
 							c.HumanIdentifier = keyStr
 							data[keyStr] = c
@@ -656,18 +1037,36 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					}
 					break
 				case "Geo":
-					c := IncrementOrSetUnit(thisAggregate.Geo[thisV.Geo.Country.ISOCode])
+					c := IncrementOrSetUnit("geo", thisAggregate.Geo[thisV.Geo.Country.ISOCode])
 					if thisV.Geo.Country.ISOCode != "" {
 						thisAggregate.Geo[thisV.Geo.Country.ISOCode] = c
 						thisAggregate.Geo[thisV.Geo.Country.ISOCode].Identifier = thisV.Geo.Country.ISOCode
 						thisAggregate.Geo[thisV.Geo.Country.ISOCode].HumanIdentifier = thisV.Geo.Country.ISOCode
 					}
+
+					if region := thisV.Geo.Region(); region != "" {
+						c := IncrementOrSetUnit("regions", thisAggregate.Regions[region])
+						thisAggregate.Regions[region] = c
+						thisAggregate.Regions[region].Identifier = region
+						thisAggregate.Regions[region].HumanIdentifier = region
+						if len(thisV.Geo.Subdivisions) > 0 && thisV.Geo.Subdivisions[0].Names["en"] != "" {
+							thisAggregate.Regions[region].HumanIdentifier = thisV.Geo.Subdivisions[0].Names["en"]
+						}
+					}
+
+					if thisV.Geo.ASN.Number != 0 {
+						asn := "AS" + strconv.FormatUint(uint64(thisV.Geo.ASN.Number), 10)
+						c := IncrementOrSetUnit("asns", thisAggregate.ASNs[asn])
+						thisAggregate.ASNs[asn] = c
+						thisAggregate.ASNs[asn].Identifier = asn
+						thisAggregate.ASNs[asn].HumanIdentifier = thisV.Geo.ASN.Organization
+					}
 					break
 
 				case "Tags":
 					for _, thisTag := range thisV.Tags {
 						if !ignoreTag(thisTag, ignoreTagPrefixList) {
-							c := IncrementOrSetUnit(thisAggregate.Tags[thisTag])
+							c := IncrementOrSetUnit("tags", thisAggregate.Tags[thisTag])
 							thisAggregate.Tags[thisTag] = c
 							thisAggregate.Tags[thisTag].Identifier = thisTag
 							thisAggregate.Tags[thisTag].HumanIdentifier = thisTag
@@ -675,17 +1074,34 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					}
 					break
 
+				case "UserAgentInfo":
+					if thisV.UserAgentInfo.Browser != "" {
+						browser := replaceUnsupportedChars(thisV.UserAgentInfo.Browser)
+						c := IncrementOrSetUnit("useragents", thisAggregate.UserAgents[browser])
+						thisAggregate.UserAgents[browser] = c
+						thisAggregate.UserAgents[browser].Identifier = thisV.UserAgentInfo.Browser
+						thisAggregate.UserAgents[browser].HumanIdentifier = thisV.UserAgentInfo.Browser
+					}
+
+					if thisV.UserAgentInfo.DeviceType != "" {
+						c := IncrementOrSetUnit("devices", thisAggregate.Devices[thisV.UserAgentInfo.DeviceType])
+						thisAggregate.Devices[thisV.UserAgentInfo.DeviceType] = c
+						thisAggregate.Devices[thisV.UserAgentInfo.DeviceType].Identifier = thisV.UserAgentInfo.DeviceType
+						thisAggregate.Devices[thisV.UserAgentInfo.DeviceType].HumanIdentifier = thisV.UserAgentInfo.DeviceType
+					}
+					break
+
 				case "TrackPath":
 					log.Debug("TrackPath=", value.(bool))
 					if value.(bool) {
 						fixedPath := replaceUnsupportedChars(thisV.Path)
-						c := IncrementOrSetUnit(thisAggregate.Endpoints[fixedPath])
+						c := IncrementOrSetUnit("endpoints", thisAggregate.Endpoints[fixedPath])
 						thisAggregate.Endpoints[fixedPath] = c
 						thisAggregate.Endpoints[fixedPath].Identifier = thisV.Path
 						thisAggregate.Endpoints[fixedPath].HumanIdentifier = thisV.Path
 
 						keyStr := hex.EncodeToString([]byte(thisV.APIID + ":" + thisV.APIVersion + ":" + thisV.Path))
-						c = IncrementOrSetUnit(thisAggregate.ApiEndpoint[keyStr])
+						c = IncrementOrSetUnit("apiendpoints", thisAggregate.ApiEndpoint[keyStr])
 						thisAggregate.ApiEndpoint[keyStr] = c
 						thisAggregate.ApiEndpoint[keyStr].Identifier = keyStr
 						thisAggregate.ApiEndpoint[keyStr].HumanIdentifier = thisV.Path
@@ -696,7 +1112,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 		}
 
-		analyticsPerOrg[orgID] = thisAggregate
+		analyticsPerOrg[key] = thisAggregate
 
 	}
 
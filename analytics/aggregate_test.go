@@ -0,0 +1,61 @@
+package analytics
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateData_RequestDimensions(t *testing.T) {
+	data := []interface{}{
+		AnalyticsRecord{OrgID: "org", APIID: "api1", APIVersion: "v1.0", Method: "GET", Host: "api.example.com", ResponseCode: 200},
+		AnalyticsRecord{OrgID: "org", APIID: "api1", APIVersion: "v2", Method: "post", Host: "api.example.com", ResponseCode: 201},
+		AnalyticsRecord{OrgID: "org", APIID: "api1", APIVersion: "v2", Method: "GET", Host: "other.example.com", ResponseCode: 404},
+		AnalyticsRecord{OrgID: "org", APIID: "api2", APIVersion: "v1.0", Method: "GET", Host: "api.example.com", ResponseCode: 503},
+	}
+
+	aggregate := AggregateData(data, false, nil, false)["org"]
+
+	tcs := []struct {
+		testName string
+		counters map[string]*Counter
+		key      string
+		hits     int
+	}{
+		{"method GET", aggregate.Methods, "GET", 3},
+		{"method POST", aggregate.Methods, "POST", 1},
+		{"status class 2xx", aggregate.StatusClasses, "2xx", 2},
+		{"status class 4xx", aggregate.StatusClasses, "4xx", 1},
+		{"status class 5xx", aggregate.StatusClasses, "5xx", 1},
+		{"host", aggregate.Hosts, replaceUnsupportedChars("api.example.com"), 3},
+		{"api1 version v1.0", aggregate.ApiVersions["api1"], replaceUnsupportedChars("v1.0"), 1},
+		{"api1 version v2", aggregate.ApiVersions["api1"], "v2", 2},
+		{"api2 version v1.0", aggregate.ApiVersions["api2"], replaceUnsupportedChars("v1.0"), 1},
+		{"api1 status class 2xx", aggregate.ApiStatusClasses["api1"], "2xx", 2},
+		{"api2 status class 5xx", aggregate.ApiStatusClasses["api2"], "5xx", 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			c := tc.counters[tc.key]
+			if c == nil || c.Hits != tc.hits {
+				t.Fatalf("expected %d hits, got %+v", tc.hits, c)
+			}
+		})
+	}
+
+	if aggregate.Hosts[replaceUnsupportedChars("api.example.com")].Identifier != "api.example.com" {
+		t.Errorf("expected the host identifier to be kept")
+	}
+
+	change := aggregate.AsChange()
+	if change["$inc"].(bson.M)["apistatusclasses.api1.2xx.hits"] != 2 {
+		t.Errorf("expected the api status classes to be incremented, got %+v", change["$inc"])
+	}
+
+	aggregate.DiscardAggregations([]string{"methods", "statusclasses", "hosts", "apiversions", "apistatusclasses"})
+	if len(aggregate.Methods) != 0 || len(aggregate.StatusClasses) != 0 || len(aggregate.Hosts) != 0 ||
+		len(aggregate.ApiVersions) != 0 || len(aggregate.ApiStatusClasses) != 0 {
+		t.Errorf("expected the dimensions to be discarded")
+	}
+}
@@ -54,6 +54,8 @@ type AnalyticsRecord struct {
 	Alias         string
 	TrackPath     bool
 	ExpireAt      time.Time `bson:"expireAt" json:"expireAt"`
+	// UserAgentInfo is last so the CSV columns of the other fields keep their position
+	UserAgentInfo UserAgentInfo
 }
 
 type GeoData struct {
@@ -71,6 +73,34 @@ type GeoData struct {
 		Longitude float64 `maxminddb:"longitude"`
 		TimeZone  string  `maxminddb:"time_zone"`
 	} `maxminddb:"location"`
+
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+
+	// ASN is only filled when the pump is configured with a GeoLite2/GeoIP2 ASN database
+	ASN struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	} `maxminddb:"asn"`
+}
+
+// Region returns the ISO code of the top level subdivision (state, province...) prefixed
+// with the country ISO code, e.g. "US-CA". It returns an empty string if the region is unknown.
+func (g GeoData) Region() string {
+	if len(g.Subdivisions) == 0 || g.Subdivisions[0].ISOCode == "" {
+		return ""
+	}
+	region := g.Subdivisions[0].ISOCode
+	if g.Country.ISOCode == "" {
+		return region
+	}
+	return g.Country.ISOCode + "-" + region
 }
 
 func (a *AnalyticsRecord) GetFieldNames() []string {
@@ -79,6 +109,10 @@ func (a *AnalyticsRecord) GetFieldNames() []string {
 
 	for i := 0; i < val.NumField(); i++ {
 		typeField := val.Type().Field(i)
+		if typeField.Type == userAgentInfoType {
+			fields = append(fields, userAgentInfoFieldNames()...)
+			continue
+		}
 		fields = append(fields, typeField.Name)
 	}
 
@@ -107,6 +141,9 @@ func (a *AnalyticsRecord) GetLineValues() []string {
 		case "time.Month":
 			tmpVal := valueField.Interface().(time.Month)
 			thisVal = tmpVal.String()
+		case userAgentInfoType.String():
+			fields = append(fields, valueField.Interface().(UserAgentInfo).lineValues()...)
+			continue
 		default:
 			thisVal = valueField.String()
 		}
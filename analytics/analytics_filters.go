@@ -10,18 +10,33 @@ type AnalyticsFilters struct {
 }
 
 func (filters AnalyticsFilters) ShouldFilter(record AnalyticsRecord) bool {
+	return filters.shouldFilter(record.APIID, record.OrgID, record.ResponseCode)
+}
+
+// ShouldFilterUptime applies the filters to the uptime checks, the response code being the one of the checked host
+func (filters AnalyticsFilters) ShouldFilterUptime(record UptimeReportData) bool {
+	return filters.shouldFilter(record.APIID, record.OrgID, record.ResponseCode)
+}
+
+// ShouldFilterUptimeEvent applies the API and organisation filters to the outage events, which have no response code
+func (filters AnalyticsFilters) ShouldFilterUptimeEvent(event UptimeEvent) bool {
+	filters.ResponseCodes, filters.SkippedResponseCodes = nil, nil
+	return filters.shouldFilter(event.APIID, event.OrgID, 0)
+}
+
+func (filters AnalyticsFilters) shouldFilter(apiID, orgID string, responseCode int) bool {
 	switch {
-	case len(filters.SkippedAPIIDs) > 0 && stringInSlice(record.APIID, filters.SkippedAPIIDs):
+	case len(filters.SkippedAPIIDs) > 0 && stringInSlice(apiID, filters.SkippedAPIIDs):
 		return true
-	case len(filters.SkippedOrgsIDs) > 0 && stringInSlice(record.OrgID, filters.SkippedOrgsIDs):
+	case len(filters.SkippedOrgsIDs) > 0 && stringInSlice(orgID, filters.SkippedOrgsIDs):
 		return true
-	case len(filters.SkippedResponseCodes) > 0 && intInSlice(record.ResponseCode, filters.SkippedResponseCodes):
+	case len(filters.SkippedResponseCodes) > 0 && intInSlice(responseCode, filters.SkippedResponseCodes):
 		return true
-	case len(filters.APIIDs) > 0 && !stringInSlice(record.APIID, filters.APIIDs):
+	case len(filters.APIIDs) > 0 && !stringInSlice(apiID, filters.APIIDs):
 		return true
-	case len(filters.OrgsIDs) > 0 && !stringInSlice(record.OrgID, filters.OrgsIDs):
+	case len(filters.OrgsIDs) > 0 && !stringInSlice(orgID, filters.OrgsIDs):
 		return true
-	case len(filters.ResponseCodes) > 0 && !intInSlice(record.ResponseCode, filters.ResponseCodes):
+	case len(filters.ResponseCodes) > 0 && !intInSlice(responseCode, filters.ResponseCodes):
 		return true
 	}
 	return false
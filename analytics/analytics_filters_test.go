@@ -116,3 +116,31 @@ func TestHasFilter(t *testing.T) {
 	}
 
 }
+
+func TestShouldFilterUptime(t *testing.T) {
+	record := UptimeReportData{
+		APIID:        "apiid123",
+		OrgID:        "orgid123",
+		ResponseCode: 200,
+	}
+
+	tcs := []struct {
+		testName string
+		filter   AnalyticsFilters
+		expected bool
+	}{
+		{"no filter", AnalyticsFilters{}, false},
+		{"api_ids", AnalyticsFilters{APIIDs: []string{"apiid123"}}, false},
+		{"other api_ids", AnalyticsFilters{APIIDs: []string{"apiid321"}}, true},
+		{"skip_org_ids", AnalyticsFilters{SkippedOrgsIDs: []string{"orgid123"}}, true},
+		{"response_codes", AnalyticsFilters{ResponseCodes: []int{500}}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			if shouldFilter := tc.filter.ShouldFilterUptime(record); shouldFilter != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, shouldFilter)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package analytics
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	geoIPPrefix                = "geoip"
+	defaultGeoIPCacheSize      = 10000
+	defaultGeoIPReloadInterval = 60
+)
+
+// GeoIPConfig configures the enrichment of the analytics records with a local MaxMind database
+type GeoIPConfig struct {
+	Enabled bool `json:"enabled"`
+	// Path to a GeoLite2/GeoIP2 City (or Country) .mmdb file
+	CityDBPath string `json:"city_db_path"`
+	// Path to a GeoLite2/GeoIP2 ASN .mmdb file
+	ASNDBPath string `json:"asn_db_path"`
+	// Number of IP addresses kept in the lookup cache. Defaults to 10000, -1 disables the cache
+	CacheSize int `json:"cache_size"`
+	// Seconds between checks for database file changes. Defaults to 60, -1 disables the reload
+	ReloadInterval int `json:"reload_interval"`
+}
+
+type geoIPReader interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+type geoIPDatabase struct {
+	path    string
+	modTime time.Time
+	reader  geoIPReader
+}
+
+// GeoIPEnricher fills the Geo information of the analytics records based on their IPAddress
+type GeoIPEnricher struct {
+	conf  GeoIPConfig
+	mu    sync.RWMutex
+	city  *geoIPDatabase
+	asn   *geoIPDatabase
+	cache *lruCache
+	stop  chan struct{}
+	// closed makes Close idempotent, the watcher being stopped once
+	closed sync.Once
+	log    *logrus.Entry
+}
+
+var openGeoIPReader = func(path string) (geoIPReader, error) {
+	return maxminddb.Open(path)
+}
+
+// NewGeoIPEnricher opens the configured databases and starts watching them for changes
+func NewGeoIPEnricher(conf GeoIPConfig) (*GeoIPEnricher, error) {
+	if conf.CityDBPath == "" && conf.ASNDBPath == "" {
+		return nil, errors.New("at least one of city_db_path and asn_db_path must be set")
+	}
+
+	if conf.CacheSize == 0 {
+		conf.CacheSize = defaultGeoIPCacheSize
+	}
+	if conf.ReloadInterval == 0 {
+		conf.ReloadInterval = defaultGeoIPReloadInterval
+	}
+
+	e := &GeoIPEnricher{
+		conf:  conf,
+		cache: newLRUCache(conf.CacheSize),
+		stop:  make(chan struct{}),
+		log:   log.WithField("prefix", geoIPPrefix),
+	}
+
+	var err error
+	if conf.CityDBPath != "" {
+		if e.city, err = openGeoIPDatabase(conf.CityDBPath); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ASNDBPath != "" {
+		if e.asn, err = openGeoIPDatabase(conf.ASNDBPath); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+
+	if conf.ReloadInterval > 0 {
+		go e.watch(time.Duration(conf.ReloadInterval) * time.Second)
+	}
+
+	return e, nil
+}
+
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := openGeoIPReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geoIPDatabase{path: path, modTime: info.ModTime(), reader: reader}, nil
+}
+
+func (e *GeoIPEnricher) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.reload()
+		}
+	}
+}
+
+// reload swaps the databases whose file changed since they were opened and flushes the cache
+func (e *GeoIPEnricher) reload() {
+	e.mu.RLock()
+	databases := []*geoIPDatabase{e.city, e.asn}
+	e.mu.RUnlock()
+
+	for i, db := range databases {
+		if db == nil {
+			continue
+		}
+
+		info, err := os.Stat(db.path)
+		if err != nil || info.ModTime().Equal(db.modTime) {
+			continue
+		}
+
+		newDB, err := openGeoIPDatabase(db.path)
+		if err != nil {
+			e.log.WithError(err).Error("Couldn't reload GeoIP database ", db.path)
+			continue
+		}
+
+		e.mu.Lock()
+		if i == 0 {
+			e.city = newDB
+		} else {
+			e.asn = newDB
+		}
+		e.mu.Unlock()
+
+		db.reader.Close()
+		e.cache.Purge()
+		e.log.Info("Reloaded GeoIP database ", db.path)
+	}
+}
+
+// Enrich fills the Geo fields of the record which weren't already set by the gateway
+func (e *GeoIPEnricher) Enrich(record *AnalyticsRecord) {
+	if record.IPAddress == "" {
+		return
+	}
+
+	var geo GeoData
+	if cached, found := e.cache.Get(record.IPAddress); found {
+		geo = cached.(GeoData)
+	} else {
+		var err error
+		geo, err = e.lookup(record.IPAddress)
+		if err != nil {
+			e.log.WithError(err).Debug("Couldn't lookup IP address ", record.IPAddress)
+			return
+		}
+		e.cache.Add(record.IPAddress, geo)
+	}
+
+	mergeGeoData(&record.Geo, geo)
+}
+
+func (e *GeoIPEnricher) lookup(address string) (GeoData, error) {
+	geo := GeoData{}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return geo, errors.New("invalid IP address")
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.city != nil {
+		if err := e.city.reader.Lookup(ip, &geo); err != nil {
+			return geo, err
+		}
+	}
+
+	if e.asn != nil {
+		if err := e.asn.reader.Lookup(ip, &geo.ASN); err != nil {
+			return geo, err
+		}
+	}
+
+	return geo, nil
+}
+
+// Close stops the database watcher and releases the databases
+func (e *GeoIPEnricher) Close() {
+	e.closed.Do(func() {
+		close(e.stop)
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.city != nil {
+			e.city.reader.Close()
+		}
+		if e.asn != nil {
+			e.asn.reader.Close()
+		}
+	})
+}
+
+// mergeGeoData copies the looked up values in the fields of dst which are empty
+func mergeGeoData(dst *GeoData, src GeoData) {
+	if dst.Country.ISOCode == "" {
+		dst.Country = src.Country
+	}
+	if dst.City.GeoNameID == 0 && len(dst.City.Names) == 0 {
+		dst.City = src.City
+	}
+	if dst.Location.Latitude == 0 && dst.Location.Longitude == 0 && dst.Location.TimeZone == "" {
+		dst.Location = src.Location
+	}
+	if len(dst.Subdivisions) == 0 {
+		dst.Subdivisions = src.Subdivisions
+	}
+	if dst.Postal.Code == "" {
+		dst.Postal = src.Postal
+	}
+	if dst.ASN.Number == 0 {
+		dst.ASN = src.ASN
+	}
+}
@@ -0,0 +1,137 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+type fakeGeoIPReader struct {
+	lookups int
+	country string
+	asn     uint
+}
+
+func (r *fakeGeoIPReader) Lookup(ip net.IP, result interface{}) error {
+	r.lookups++
+	switch res := result.(type) {
+	case *GeoData:
+		res.Country.ISOCode = r.country
+		res.Subdivisions = append(res.Subdivisions, struct {
+			ISOCode string            `maxminddb:"iso_code"`
+			Names   map[string]string `maxminddb:"names"`
+		}{ISOCode: "CA"})
+		res.Postal.Code = "94043"
+	default:
+		asn := result.(*struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		})
+		asn.Number = r.asn
+		asn.Organization = "Example Org"
+	}
+	return nil
+}
+
+func (r *fakeGeoIPReader) Close() error {
+	return nil
+}
+
+func newTestGeoIPEnricher(t *testing.T, reader *fakeGeoIPReader) *GeoIPEnricher {
+	f, err := ioutil.TempFile("", "geoip-*.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	openReader := openGeoIPReader
+	openGeoIPReader = func(path string) (geoIPReader, error) {
+		return reader, nil
+	}
+	t.Cleanup(func() { openGeoIPReader = openReader })
+
+	e, err := NewGeoIPEnricher(GeoIPConfig{CityDBPath: f.Name(), ASNDBPath: f.Name(), CacheSize: 1, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+func TestGeoIPEnricher_Enrich(t *testing.T) {
+	reader := &fakeGeoIPReader{country: "US", asn: 15169}
+	e := newTestGeoIPEnricher(t, reader)
+
+	record := AnalyticsRecord{IPAddress: "8.8.8.8"}
+	e.Enrich(&record)
+
+	if record.Geo.Country.ISOCode != "US" || record.Geo.Postal.Code != "94043" {
+		t.Fatalf("record not enriched with city data: %+v", record.Geo)
+	}
+	if record.Geo.Region() != "US-CA" {
+		t.Fatalf("expected region US-CA, got %q", record.Geo.Region())
+	}
+	if record.Geo.ASN.Number != 15169 || record.Geo.ASN.Organization != "Example Org" {
+		t.Fatalf("record not enriched with ASN data: %+v", record.Geo.ASN)
+	}
+
+	// values set by the gateway must be kept
+	record = AnalyticsRecord{IPAddress: "8.8.8.8"}
+	record.Geo.Country.ISOCode = "GB"
+	e.Enrich(&record)
+	if record.Geo.Country.ISOCode != "GB" {
+		t.Fatalf("country set by the gateway was overridden: %s", record.Geo.Country.ISOCode)
+	}
+}
+
+func TestGeoIPEnricher_Cache(t *testing.T) {
+	reader := &fakeGeoIPReader{country: "US"}
+	e := newTestGeoIPEnricher(t, reader)
+
+	for i := 0; i < 3; i++ {
+		e.Enrich(&AnalyticsRecord{IPAddress: "8.8.8.8"})
+	}
+	// one lookup per database
+	if reader.lookups != 2 {
+		t.Fatalf("expected cached lookups, got %d database lookups", reader.lookups)
+	}
+
+	e.Enrich(&AnalyticsRecord{IPAddress: "1.1.1.1"})
+	if e.cache.Len() != 1 {
+		t.Fatalf("cache should be limited to 1 entry, has %d", e.cache.Len())
+	}
+
+	e.Enrich(&AnalyticsRecord{IPAddress: "not an ip"})
+	if reader.lookups != 4 {
+		t.Fatalf("invalid IP addresses shouldn't be looked up, got %d database lookups", reader.lookups)
+	}
+}
+
+func TestAggregateData_GeoDimensions(t *testing.T) {
+	record := AnalyticsRecord{OrgID: "org", APIID: "api", ResponseCode: 200}
+	record.Geo.Country.ISOCode = "US"
+	record.Geo.Subdivisions = append(record.Geo.Subdivisions, struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	}{ISOCode: "CA", Names: map[string]string{"en": "California"}})
+	record.Geo.ASN.Number = 15169
+	record.Geo.ASN.Organization = "Google LLC"
+
+	aggregate := AggregateData([]interface{}{record, record}, false, nil, false)["org"]
+
+	if c := aggregate.Regions["US-CA"]; c == nil || c.Hits != 2 || c.HumanIdentifier != "California" {
+		t.Fatalf("unexpected region counter: %+v", c)
+	}
+	if c := aggregate.ASNs["AS15169"]; c == nil || c.Hits != 2 || c.HumanIdentifier != "Google LLC" {
+		t.Fatalf("unexpected ASN counter: %+v", c)
+	}
+}
+
+func TestGeoIPEnricher_CloseTwice(t *testing.T) {
+	e := newTestGeoIPEnricher(t, &fakeGeoIPReader{})
+	e.Close()
+	e.Close()
+}
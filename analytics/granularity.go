@@ -0,0 +1,197 @@
+package analytics
+
+import (
+	"fmt"
+	"time"
+)
+
+// Granularities are the supported sizes of the aggregation buckets
+var Granularities = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+// ParseGranularity returns the bucket size of one of the supported granularities (1m, 5m, 15m, 1h, 1d)
+func ParseGranularity(granularity string) (time.Duration, error) {
+	d, ok := Granularities[granularity]
+	if !ok {
+		return 0, fmt.Errorf("unsupported granularity %q, must be one of 1m, 5m, 15m, 1h or 1d", granularity)
+	}
+	return d, nil
+}
+
+// TruncateTimestamp returns the start of the bucket of the given granularity containing t.
+// Buckets are aligned on the start of the day in the location of t.
+func TruncateTimestamp(t time.Time, granularity time.Duration) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if granularity >= 24*time.Hour {
+		return day
+	}
+	return day.Add(t.Sub(day) / granularity * granularity)
+}
+
+// Merge adds the values of other to the counter
+func (c *Counter) Merge(other *Counter) {
+	if other == nil {
+		return
+	}
+
+	if c.Identifier == "" {
+		c.Identifier = other.Identifier
+	}
+	if c.HumanIdentifier == "" {
+		c.HumanIdentifier = other.HumanIdentifier
+	}
+	if c.LastTime.Before(other.LastTime) {
+		c.LastTime = other.LastTime
+	}
+
+	// don't update min latency in case of errors
+	if other.Hits != other.ErrorTotal {
+		if c.Hits == c.ErrorTotal || c.MinLatency > other.MinLatency {
+			c.MinLatency = other.MinLatency
+		}
+		if c.Hits == c.ErrorTotal || c.MinUpstreamLatency > other.MinUpstreamLatency {
+			c.MinUpstreamLatency = other.MinUpstreamLatency
+		}
+	}
+	if c.MaxLatency < other.MaxLatency {
+		c.MaxLatency = other.MaxLatency
+	}
+	if c.MaxUpstreamLatency < other.MaxUpstreamLatency {
+		c.MaxUpstreamLatency = other.MaxUpstreamLatency
+	}
+
+	c.Hits += other.Hits
+	c.Success += other.Success
+	c.ErrorTotal += other.ErrorTotal
+	if c.ErrorMap == nil {
+		c.ErrorMap = make(map[string]int)
+	}
+	for k, v := range other.ErrorMap {
+		c.ErrorMap[k] += v
+	}
+	c.TotalRequestTime += other.TotalRequestTime
+	if c.Hits > 0 {
+		c.RequestTime = c.TotalRequestTime / float64(c.Hits)
+	}
+
+	c.OpenConnections += other.OpenConnections
+	c.ClosedConnections += other.ClosedConnections
+	c.BytesIn += other.BytesIn
+	c.BytesOut += other.BytesOut
+
+	c.TotalLatency += other.TotalLatency
+	c.TotalUpstreamLatency += other.TotalUpstreamLatency
+
+	if other.LatencySketch != nil {
+		if c.LatencySketch == nil {
+			c.LatencySketch = NewLatencySketch()
+		}
+		c.LatencySketch.Merge(other.LatencySketch)
+	}
+	if other.UpstreamLatencySketch != nil {
+		if c.UpstreamLatencySketch == nil {
+			c.UpstreamLatencySketch = NewLatencySketch()
+		}
+		c.UpstreamLatencySketch.Merge(other.UpstreamLatencySketch)
+	}
+}
+
+// applyChange adds the counter as AsChange does in MongoDB: the identifiers, last time and connection
+// counters are replaced rather than merged
+func (c *Counter) applyChange(other *Counter) {
+	c.Merge(other)
+
+	c.Identifier = other.Identifier
+	c.HumanIdentifier = other.HumanIdentifier
+	c.LastTime = other.LastTime
+	c.OpenConnections = other.OpenConnections
+	c.ClosedConnections = other.ClosedConnections
+	c.BytesIn = other.BytesIn
+	c.BytesOut = other.BytesOut
+}
+
+func mergeCounters(dst map[string]*Counter, src map[string]*Counter, merge func(c, other *Counter)) {
+	for k, v := range src {
+		c, found := dst[k]
+		if !found {
+			c = &Counter{}
+			dst[k] = c
+		}
+		merge(c, v)
+	}
+}
+
+func mergeNestedCounters(dst map[string]map[string]*Counter, src map[string]map[string]*Counter, merge func(c, other *Counter)) {
+	for k, v := range src {
+		if dst[k] == nil {
+			dst[k] = make(map[string]*Counter)
+		}
+		mergeCounters(dst[k], v, merge)
+	}
+}
+
+// dimensions returns the counters of the aggregate by reference, so they can be created when missing
+func (f *AnalyticsRecordAggregate) dimensions() ([]*map[string]*Counter, []*map[string]map[string]*Counter) {
+	return []*map[string]*Counter{
+		&f.APIID, &f.Errors, &f.Versions, &f.APIKeys, &f.OauthIDs, &f.Geo, &f.Regions, &f.ASNs, &f.Tags,
+		&f.UserAgents, &f.Devices, &f.Methods, &f.StatusClasses, &f.Hosts, &f.Endpoints, &f.ApiEndpoint,
+	}, []*map[string]map[string]*Counter{
+		&f.KeyEndpoint, &f.OauthEndpoint, &f.ApiVersions, &f.ApiStatusClasses,
+	}
+}
+
+func (f *AnalyticsRecordAggregate) mergeDimensions(other *AnalyticsRecordAggregate, merge func(c, other *Counter)) {
+	dst, dstNested := f.dimensions()
+	src, srcNested := other.dimensions()
+
+	for i := range dst {
+		if *dst[i] == nil {
+			*dst[i] = make(map[string]*Counter)
+		}
+		mergeCounters(*dst[i], *src[i], merge)
+	}
+	for i := range dstNested {
+		if *dstNested[i] == nil {
+			*dstNested[i] = make(map[string]map[string]*Counter)
+		}
+		mergeNestedCounters(*dstNested[i], *srcNested[i], merge)
+	}
+
+	merge(&f.Total, &other.Total)
+}
+
+// Merge adds the counters of other to the aggregate, e.g. to roll up several fine-grained
+// aggregates in a coarser one. The timestamp and granularity of f are kept.
+func (f *AnalyticsRecordAggregate) Merge(other AnalyticsRecordAggregate) {
+	f.mergeDimensions(&other, (*Counter).Merge)
+
+	if f.OrgID == "" {
+		f.OrgID = other.OrgID
+	}
+	if f.LastTime.Before(other.LastTime) {
+		f.LastTime = other.LastTime
+	}
+	if f.ExpireAt.Before(other.ExpireAt) {
+		f.ExpireAt = other.ExpireAt
+	}
+}
+
+// Apply adds the change to the aggregate as its AsChange update does in MongoDB, so the stored document
+// is known without reading it back. Unlike Merge, the last values of the change replace the stored ones.
+func (f *AnalyticsRecordAggregate) Apply(change AnalyticsRecordAggregate) {
+	f.mergeDimensions(&change, (*Counter).applyChange)
+
+	if f.OrgID == "" {
+		f.OrgID = change.OrgID
+	}
+	f.LastTime = change.LastTime
+	f.ExpireAt = change.ExpireAt
+	if change.Granularity > 0 {
+		f.Granularity = change.Granularity
+	}
+}
@@ -0,0 +1,181 @@
+package analytics
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTruncateTimestamp(t *testing.T) {
+	ts := time.Date(2021, 6, 15, 10, 47, 31, 0, time.UTC)
+
+	tcs := []struct {
+		granularity string
+		expected    time.Time
+	}{
+		{"1m", time.Date(2021, 6, 15, 10, 47, 0, 0, time.UTC)},
+		{"5m", time.Date(2021, 6, 15, 10, 45, 0, 0, time.UTC)},
+		{"15m", time.Date(2021, 6, 15, 10, 45, 0, 0, time.UTC)},
+		{"1h", time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)},
+		{"1d", time.Date(2021, 6, 15, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tcs {
+		granularity, err := ParseGranularity(tc.granularity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := TruncateTimestamp(ts, granularity); !got.Equal(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.granularity, tc.expected, got)
+		}
+	}
+
+	if _, err := ParseGranularity("2h"); err == nil {
+		t.Error("expected an error for an unsupported granularity")
+	}
+}
+
+func TestAggregateDataWithGranularity(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	data := []interface{}{}
+	for i := 0; i < 4; i++ {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org",
+			APIID:        "api",
+			ResponseCode: 200,
+			TimeStamp:    start.Add(time.Duration(i) * 2 * time.Minute),
+			Latency:      Latency{Total: int64(10 * (i + 1))},
+		})
+	}
+
+	aggregate := AggregateDataWithGranularity(data, false, nil, nil, 15*time.Minute)[0]
+	if !aggregate.TimeStamp.Equal(start) || aggregate.Granularity != 900 {
+		t.Fatalf("unexpected bucket %v of %d seconds", aggregate.TimeStamp, aggregate.Granularity)
+	}
+
+	if legacy := AggregateData(data, false, nil, true)["org"]; legacy.Granularity != 0 {
+		t.Errorf("expected no granularity for the legacy aggregation, got %d", legacy.Granularity)
+	}
+}
+
+func TestAggregateDataWithGranularity_Buckets(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 3, 0, 0, time.UTC)
+	data := []interface{}{}
+	for i := 0; i < 6; i++ {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org",
+			APIID:        "api",
+			ResponseCode: 200,
+			TimeStamp:    start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	data = append(data, AnalyticsRecord{OrgID: "other", APIID: "api", ResponseCode: 200, TimeStamp: start})
+
+	// the records from 10:05 are in the next bucket
+	aggregates := AggregateDataWithGranularity(data, false, nil, nil, 5*time.Minute)
+	if len(aggregates) != 3 {
+		t.Fatalf("expected 3 aggregates, got %d", len(aggregates))
+	}
+	for i, expected := range []struct {
+		orgID     string
+		timestamp time.Time
+		hits      int
+	}{
+		{"org", time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC), 2},
+		{"org", time.Date(2021, 6, 15, 10, 5, 0, 0, time.UTC), 4},
+		{"other", time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC), 1},
+	} {
+		aggregate := aggregates[i]
+		if aggregate.OrgID != expected.orgID || !aggregate.TimeStamp.Equal(expected.timestamp) || aggregate.Total.Hits != expected.hits {
+			t.Errorf("expected %d hits of %s at %v, got %d hits of %s at %v", expected.hits, expected.orgID, expected.timestamp,
+				aggregate.Total.Hits, aggregate.OrgID, aggregate.TimeStamp)
+		}
+		if aggregate.TimeID.Hour != 10 || aggregate.APIID["api"].Hits != expected.hits {
+			t.Errorf("unexpected counters of the %v bucket", aggregate.TimeStamp)
+		}
+	}
+}
+
+func TestAnalyticsRecordAggregate_Merge(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	data := []interface{}{}
+	for i := 0; i < 10; i++ {
+		responseCode := 200
+		if i == 1 {
+			responseCode = 500
+		}
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org",
+			APIID:        "api",
+			ResponseCode: responseCode,
+			TimeStamp:    start.Add(time.Duration(i) * 5 * time.Minute),
+			Latency:      Latency{Total: int64(10 * (i + 1))},
+		})
+	}
+
+	hourly := AggregateDataWithGranularity(data, false, nil, nil, time.Hour)[0]
+
+	rolled := AnalyticsRecordAggregate{}.New()
+	rolled.TimeStamp = start
+	for _, fine := range AggregateDataWithGranularity(data, false, nil, nil, 5*time.Minute) {
+		rolled.Merge(fine)
+	}
+
+	for name, pair := range map[string][2]*Counter{
+		"total": {&hourly.Total, &rolled.Total},
+		"api":   {hourly.APIID["api"], rolled.APIID["api"]},
+	} {
+		expected, got := pair[0], pair[1]
+		if got.Hits != expected.Hits || got.ErrorTotal != expected.ErrorTotal || got.ErrorMap["500"] != expected.ErrorMap["500"] {
+			t.Errorf("%s: expected %d hits and %d errors, got %+v", name, expected.Hits, expected.ErrorTotal, got)
+		}
+		if got.TotalLatency != expected.TotalLatency || got.MaxLatency != expected.MaxLatency || got.MinLatency != expected.MinLatency {
+			t.Errorf("%s: expected latencies %d/%d/%d, got %d/%d/%d", name, expected.TotalLatency, expected.MinLatency, expected.MaxLatency,
+				got.TotalLatency, got.MinLatency, got.MaxLatency)
+		}
+		if got.LatencySketch.Percentiles() != expected.LatencySketch.Percentiles() {
+			t.Errorf("%s: expected percentiles %+v, got %+v", name, expected.LatencySketch.Percentiles(), got.LatencySketch.Percentiles())
+		}
+	}
+}
+
+func TestAnalyticsRecordAggregate_Apply(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	data := []interface{}{}
+	for i := 0; i < 10; i++ {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org",
+			APIID:        "api",
+			APIName:      "API " + strconv.Itoa(i),
+			ResponseCode: 200,
+			TimeStamp:    start.Add(time.Duration(i) * time.Minute),
+			Latency:      Latency{Total: int64(10 * (i + 1))},
+			RequestTime:  int64(10 * (i + 1)),
+		})
+	}
+
+	hourly := AggregateDataWithGranularity(data, false, nil, nil, time.Hour)[0]
+
+	stored := AggregateDataWithGranularity(data[:5], false, nil, nil, time.Hour)[0]
+	change := AggregateDataWithGranularity(data[5:], false, nil, nil, time.Hour)[0]
+	stored.Apply(change)
+	stored.AsTimeUpdate()
+
+	api := stored.APIID["api"]
+	if api.Hits != hourly.APIID["api"].Hits || api.TotalLatency != hourly.APIID["api"].TotalLatency {
+		t.Errorf("expected the counters to be added, got %+v", api)
+	}
+	// like $set, the last values replace the stored ones
+	if api.HumanIdentifier != "API 9" || !stored.LastTime.Equal(data[9].(AnalyticsRecord).TimeStamp) {
+		t.Errorf("expected the last values of the change, got %s and %v", api.HumanIdentifier, stored.LastTime)
+	}
+	if api.RequestTime != 55 || stored.Total.RequestTime != 55 || api.Latency != 55 {
+		t.Errorf("expected the averages to be set, got %v, %v and %v", api.RequestTime, stored.Total.RequestTime, api.Latency)
+	}
+	if len(stored.Lists.APIID) != 1 || stored.Lists.APIID[0].Hits != 10 || stored.Lists.APIID[0].LatencySketch != nil {
+		t.Errorf("expected the lists to be set, got %+v", stored.Lists.APIID)
+	}
+	if stored.Total.LatencyPercentiles != hourly.Total.LatencySketch.Percentiles() {
+		t.Errorf("expected percentiles %+v, got %+v", hourly.Total.LatencySketch.Percentiles(), stored.Total.LatencyPercentiles)
+	}
+}
@@ -0,0 +1,130 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// SketchRelativeAccuracy is the maximum relative error of the quantiles computed from a LatencySketch
+const SketchRelativeAccuracy = 0.02
+
+var (
+	sketchGamma    = (1 + SketchRelativeAccuracy) / (1 - SketchRelativeAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// LatencySketch is a DDSketch-like histogram of latencies with logarithmic buckets.
+// Two sketches are merged by adding their bucket counts, so they can be accumulated with
+// $inc in MongoDB and across purges or pumps without losing accuracy.
+// Buckets are keyed by their index as a string, so they can be stored as a document.
+type LatencySketch struct {
+	Buckets map[string]int64 `json:"buckets"`
+	Zeros   int64            `json:"zeros"`
+	Count   int64            `json:"count"`
+}
+
+// LatencyPercentiles are the percentiles computed from a LatencySketch
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{Buckets: make(map[string]int64)}
+}
+
+func sketchIndex(value int64) string {
+	return strconv.Itoa(int(math.Ceil(math.Log(float64(value)) / sketchLogGamma)))
+}
+
+func sketchValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+// Add records a latency in the sketch
+func (s *LatencySketch) Add(value int64) {
+	if s.Buckets == nil {
+		s.Buckets = make(map[string]int64)
+	}
+
+	s.Count++
+	if value <= 0 {
+		s.Zeros++
+		return
+	}
+	s.Buckets[sketchIndex(value)]++
+}
+
+// Merge adds the counts of other to the sketch
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	if other == nil {
+		return
+	}
+	if s.Buckets == nil {
+		s.Buckets = make(map[string]int64)
+	}
+
+	s.Count += other.Count
+	s.Zeros += other.Zeros
+	for k, v := range other.Buckets {
+		s.Buckets[k] += v
+	}
+}
+
+// Copy returns a deep copy of the sketch
+func (s *LatencySketch) Copy() *LatencySketch {
+	if s == nil {
+		return nil
+	}
+	newSketch := NewLatencySketch()
+	newSketch.Merge(s)
+	return newSketch
+}
+
+// Quantile returns an approximation of the q-quantile (0 <= q <= 1) of the recorded latencies
+func (s *LatencySketch) Quantile(q float64) float64 {
+	if s == nil || s.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Count-1)
+	if rank < float64(s.Zeros) {
+		return 0
+	}
+
+	indexes := make([]int, 0, len(s.Buckets))
+	for k := range s.Buckets {
+		index, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	cumulative := float64(s.Zeros)
+	for _, index := range indexes {
+		cumulative += float64(s.Buckets[strconv.Itoa(index)])
+		if cumulative > rank {
+			return sketchValue(index)
+		}
+	}
+
+	if len(indexes) == 0 {
+		return 0
+	}
+	return sketchValue(indexes[len(indexes)-1])
+}
+
+// Percentiles computes the p50, p90, p95 and p99 of the recorded latencies
+func (s *LatencySketch) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		P50: s.Quantile(0.5),
+		P90: s.Quantile(0.9),
+		P95: s.Quantile(0.95),
+		P99: s.Quantile(0.99),
+	}
+}
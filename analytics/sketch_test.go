@@ -0,0 +1,118 @@
+package analytics
+
+import (
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLatencySketch_Quantile(t *testing.T) {
+	sketch := NewLatencySketch()
+	for i := int64(1); i <= 1000; i++ {
+		sketch.Add(i)
+	}
+
+	tcs := []struct {
+		q        float64
+		expected float64
+	}{
+		{0.5, 500},
+		{0.9, 900},
+		{0.95, 950},
+		{0.99, 990},
+	}
+
+	for _, tc := range tcs {
+		got := sketch.Quantile(tc.q)
+		if math.Abs(got-tc.expected)/tc.expected > SketchRelativeAccuracy {
+			t.Errorf("quantile %v: expected ~%v, got %v", tc.q, tc.expected, got)
+		}
+	}
+
+	if got := NewLatencySketch().Quantile(0.5); got != 0 {
+		t.Errorf("expected 0 for an empty sketch, got %v", got)
+	}
+}
+
+func TestLatencySketch_Merge(t *testing.T) {
+	full := NewLatencySketch()
+	first := NewLatencySketch()
+	second := NewLatencySketch()
+	for i := int64(0); i < 500; i++ {
+		full.Add(i)
+		if i%2 == 0 {
+			first.Add(i)
+		} else {
+			second.Add(i)
+		}
+	}
+
+	first.Merge(second)
+	if first.Count != full.Count || first.Zeros != full.Zeros {
+		t.Fatalf("expected count %d and zeros %d, got %d and %d", full.Count, full.Zeros, first.Count, first.Zeros)
+	}
+	if first.Percentiles() != full.Percentiles() {
+		t.Errorf("merged percentiles %+v differ from %+v", first.Percentiles(), full.Percentiles())
+	}
+}
+
+func TestAggregateData_LatencyPercentiles(t *testing.T) {
+	data := []interface{}{}
+	for i := int64(1); i <= 100; i++ {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org",
+			APIID:        "api",
+			ResponseCode: 200,
+			Latency:      Latency{Total: i * 10, Upstream: i},
+		})
+	}
+
+	aggregate := AggregateDataWithLatencySketches(data, false, nil, false, []string{"apiid"})["org"]
+
+	for name, counter := range map[string]*Counter{"total": &aggregate.Total, "api": aggregate.APIID["api"]} {
+		if counter.LatencySketch == nil || counter.LatencySketch.Count != 100 {
+			t.Fatalf("%s: unexpected latency sketch %+v", name, counter.LatencySketch)
+		}
+		if counter.UpstreamLatencySketch == nil || counter.UpstreamLatencySketch.Count != 100 {
+			t.Fatalf("%s: unexpected upstream latency sketch %+v", name, counter.UpstreamLatencySketch)
+		}
+	}
+
+	change := aggregate.AsChange()
+	if change["$inc"].(bson.M)["apiid.api.latencysketch.count"] != int64(100) {
+		t.Errorf("expected the sketch count to be incremented, got %+v", change["$inc"])
+	}
+
+	aggregate.AsTimeUpdate()
+	p99 := aggregate.APIID["api"].LatencyPercentiles.P99
+	if math.Abs(p99-990)/990 > SketchRelativeAccuracy {
+		t.Errorf("expected p99 ~990, got %v", p99)
+	}
+	p50 := aggregate.Total.UpstreamLatencyPercentiles.P50
+	if math.Abs(p50-50)/50 > SketchRelativeAccuracy {
+		t.Errorf("expected upstream p50 ~50, got %v", p50)
+	}
+}
+
+func TestAggregateDataWithLatencySketches(t *testing.T) {
+	record := AnalyticsRecord{OrgID: "org", APIID: "api", APIKey: "key", Path: "/get", ResponseCode: 200, Latency: Latency{Total: 10}}
+	aggregate := AggregateDataWithLatencySketches([]interface{}{record, record}, true, nil, false, []string{"APIID"})["org"]
+
+	if aggregate.Total.LatencySketch.Count != 2 || aggregate.APIID["api"].LatencySketch.Count != 2 {
+		t.Fatal("expected the total and the opted-in dimension to have their sketches")
+	}
+	for _, c := range aggregate.Flatten() {
+		if c.Dimension != "total" && c.Dimension != "apiid" && (c.Counter.LatencySketch != nil || c.Counter.UpstreamLatencySketch != nil) {
+			t.Errorf("expected no sketches for %s %s", c.Dimension, c.Name)
+		}
+	}
+	if AggregateData([]interface{}{record}, true, nil, false)["org"].APIID["api"].LatencySketch != nil {
+		t.Error("expected only the total to have sketches by default")
+	}
+
+	change := aggregate.AsChange()
+	if _, found := change["$inc"].(bson.M)["apikeys.key.latencysketch.count"]; found {
+		t.Error("expected no sketch update for the api keys")
+	}
+}
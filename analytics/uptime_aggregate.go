@@ -0,0 +1,195 @@
+package analytics
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UptimeAggregationConfig enables the rollups of the uptime checks and the detection of the outages
+type UptimeAggregationConfig struct {
+	Enabled bool `json:"enabled"`
+	// Granularities of the rollups, among 1m, 5m, 15m, 1h and 1d. Defaults to ["1h", "1d"]
+	Granularities []string `json:"granularities"`
+	// Number of consecutive failed checks of a host starting an outage. Defaults to 3
+	OutageThreshold int `json:"outage_threshold"`
+	// Number of consecutive successful checks of a host ending an outage. Defaults to 1
+	RecoveryThreshold int `json:"recovery_threshold"`
+	// Identifies the pump in the key of its outage state, so the pumps sharing a Redis keep their own.
+	// Defaults to the hostname
+	InstanceID string `json:"instance_id"`
+}
+
+// UptimeAggregate is the rollup of the checks of a host of an API over a bucket of the granularity
+type UptimeAggregate struct {
+	OrgID       string    `json:"org_id"`
+	APIID       string    `json:"api_id"`
+	URL         string    `json:"url"`
+	Granularity string    `json:"granularity"`
+	TimeStamp   time.Time `json:"timestamp"`
+	LastTime    time.Time `json:"last_time"`
+
+	Checks       int64 `json:"checks"`
+	Failures     int64 `json:"failures"`
+	TCPErrors    int64 `json:"tcp_errors"`
+	ServerErrors int64 `json:"server_errors"`
+	// Percentage of the successful checks
+	Availability float64 `json:"availability"`
+
+	// Latencies in milliseconds of the checks which reached the host, the failed connections have none
+	TotalLatency int64   `json:"total_latency"`
+	MinLatency   int64   `json:"min_latency"`
+	MaxLatency   int64   `json:"max_latency"`
+	Latency      float64 `json:"latency"`
+	// P95 of the latency, computed from the sketch
+	LatencyP95    float64        `json:"latency_p95"`
+	LatencySketch *LatencySketch `json:"latency_sketch,omitempty"`
+}
+
+// Add records the check in the aggregate
+func (a *UptimeAggregate) Add(record UptimeReportData) {
+	if a.LatencySketch == nil {
+		a.LatencySketch = NewLatencySketch()
+	}
+
+	a.Checks++
+	if !record.Up() {
+		a.Failures++
+	}
+	if record.TCPError {
+		a.TCPErrors++
+	}
+	if record.ServerError {
+		a.ServerErrors++
+	}
+	if record.TimeStamp.After(a.LastTime) {
+		a.LastTime = record.TimeStamp
+	}
+
+	if record.TCPError {
+		return
+	}
+	if a.LatencySketch.Count == 0 || record.RequestTime < a.MinLatency {
+		a.MinLatency = record.RequestTime
+	}
+	if record.RequestTime > a.MaxLatency {
+		a.MaxLatency = record.RequestTime
+	}
+	a.TotalLatency += record.RequestTime
+	a.LatencySketch.Add(record.RequestTime)
+}
+
+// Compute sets the availability, the average latency and the p95 from the counters
+func (a *UptimeAggregate) Compute() {
+	a.Availability = 0
+	if a.Checks > 0 {
+		a.Availability = 100 * float64(a.Checks-a.Failures) / float64(a.Checks)
+	}
+
+	a.Latency, a.LatencyP95 = 0, 0
+	if a.LatencySketch != nil && a.LatencySketch.Count > 0 {
+		a.Latency = float64(a.TotalLatency) / float64(a.LatencySketch.Count)
+		a.LatencyP95 = a.LatencySketch.Percentiles().P95
+	}
+}
+
+// Query returns the query of the stored aggregate
+func (a *UptimeAggregate) Query() bson.M {
+	return bson.M{
+		"orgid":       a.OrgID,
+		"apiid":       a.APIID,
+		"url":         a.URL,
+		"granularity": a.Granularity,
+		"timestamp":   a.TimeStamp,
+	}
+}
+
+// AsChange returns the update merging the aggregate in the stored one
+func (a *UptimeAggregate) AsChange() bson.M {
+	update := bson.M{
+		"$inc": bson.M{
+			"checks":       a.Checks,
+			"failures":     a.Failures,
+			"tcperrors":    a.TCPErrors,
+			"servererrors": a.ServerErrors,
+			"totallatency": a.TotalLatency,
+		},
+		"$max": bson.M{
+			"lasttime": a.LastTime,
+		},
+	}
+	// the min and max are only known when a check reached the host
+	if a.LatencySketch != nil && a.LatencySketch.Count > 0 {
+		update["$min"] = bson.M{"minlatency": a.MinLatency}
+		update["$max"].(bson.M)["maxlatency"] = a.MaxLatency
+	}
+	incSketch("latencysketch.", a.LatencySketch, update)
+
+	return update
+}
+
+// AsTimeUpdate returns the update of the computed fields of the stored aggregate
+func (a *UptimeAggregate) AsTimeUpdate() bson.M {
+	a.Compute()
+
+	return bson.M{
+		"$set": bson.M{
+			"availability": a.Availability,
+			"latency":      a.Latency,
+			"latencyp95":   a.LatencyP95,
+		},
+	}
+}
+
+// AggregateUptimeData rolls the checks up per organisation, API, host and bucket of every granularity.
+// The buckets are aligned in UTC.
+func AggregateUptimeData(data []UptimeReportData, granularities []string) ([]UptimeAggregate, error) {
+	sizes := make(map[string]time.Duration, len(granularities))
+	for _, granularity := range granularities {
+		size, err := ParseGranularity(granularity)
+		if err != nil {
+			return nil, err
+		}
+		sizes[granularity] = size
+	}
+
+	aggregates := make(map[string]*UptimeAggregate)
+	for _, record := range data {
+		for granularity, size := range sizes {
+			timestamp := TruncateTimestamp(record.TimeStamp.UTC(), size)
+			key := fmt.Sprintf("%s|%s|%s|%s|%d", record.OrgID, record.APIID, record.URL, granularity, timestamp.Unix())
+
+			aggregate, found := aggregates[key]
+			if !found {
+				aggregate = &UptimeAggregate{
+					OrgID:         record.OrgID,
+					APIID:         record.APIID,
+					URL:           record.URL,
+					Granularity:   granularity,
+					TimeStamp:     timestamp,
+					LatencySketch: NewLatencySketch(),
+				}
+				aggregates[key] = aggregate
+			}
+			aggregate.Add(record)
+		}
+	}
+
+	result := make([]UptimeAggregate, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		aggregate.Compute()
+		result = append(result, *aggregate)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].TimeStamp.Equal(result[j].TimeStamp) {
+			return result[i].TimeStamp.Before(result[j].TimeStamp)
+		}
+		if result[i].Granularity != result[j].Granularity {
+			return result[i].Granularity < result[j].Granularity
+		}
+		return result[i].APIID+result[i].URL < result[j].APIID+result[j].URL
+	})
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAggregateUptimeData(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	var data []UptimeReportData
+	for i := 0; i < 20; i++ {
+		data = append(data, UptimeReportData{
+			OrgID:       "org1",
+			APIID:       "api1",
+			URL:         "http://upstream",
+			RequestTime: int64(10 * (i + 1)),
+			TimeStamp:   start.Add(time.Duration(i) * 5 * time.Minute),
+		})
+	}
+	// a refused connection and a 500 in the second hour
+	data[15].TCPError, data[15].RequestTime = true, 0
+	data[16].ServerError = true
+
+	aggregates, err := AggregateUptimeData(data, []string{"1h", "1d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregates) != 3 {
+		t.Fatalf("expected 2 hourly and 1 daily aggregates, got %d", len(aggregates))
+	}
+
+	day := aggregates[0]
+	if day.Granularity != "1d" || !day.TimeStamp.Equal(time.Date(2021, 6, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the daily aggregate first, got %+v", day)
+	}
+	if day.Checks != 20 || day.Failures != 2 || day.TCPErrors != 1 || day.ServerErrors != 1 || day.Availability != 90 {
+		t.Errorf("unexpected counters %+v", day)
+	}
+	// the refused connection has no latency
+	if day.MinLatency != 10 || day.MaxLatency != 200 || day.LatencySketch.Count != 19 {
+		t.Errorf("unexpected latencies %+v", day)
+	}
+	if day.LatencyP95 < 185 || day.LatencyP95 > 205 {
+		t.Errorf("unexpected p95 %v", day.LatencyP95)
+	}
+
+	secondHour := aggregates[2]
+	if secondHour.Granularity != "1h" || secondHour.Checks != 8 || secondHour.Availability != 75 {
+		t.Errorf("unexpected second hour %+v", secondHour)
+	}
+
+	if _, err := AggregateUptimeData(data, []string{"2h"}); err == nil {
+		t.Error("expected an error for an unsupported granularity")
+	}
+}
+
+func TestUptimeAggregate_AsChange(t *testing.T) {
+	aggregate := UptimeAggregate{}
+	aggregate.Add(UptimeReportData{TCPError: true})
+
+	change := aggregate.AsChange()
+	if change["$inc"].(bson.M)["failures"] != int64(1) {
+		t.Errorf("expected the failure to be counted, got %v", change)
+	}
+	// without latency the stored min isn't lowered to 0
+	if _, found := change["$min"]; found {
+		t.Errorf("expected no $min without latency, got %v", change)
+	}
+
+	// the stored document only has the counters after the first upsert
+	stored := UptimeAggregate{Checks: 4, Failures: 1, TotalLatency: 60, LatencySketch: NewLatencySketch()}
+	for _, latency := range []int64{10, 20, 30} {
+		stored.LatencySketch.Add(latency)
+	}
+	set := stored.AsTimeUpdate()["$set"].(bson.M)
+	if set["availability"] != 75.0 || set["latency"] != 20.0 {
+		t.Errorf("unexpected computed fields %v", set)
+	}
+}
@@ -1,6 +1,9 @@
 package analytics
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 type UptimeReportData struct {
 	URL          string
@@ -18,3 +21,31 @@ type UptimeReportData struct {
 	APIID        string
 	OrgID        string
 }
+
+// Up returns whether the check of the host succeeded
+func (u *UptimeReportData) Up() bool {
+	return !u.TCPError && !u.ServerError
+}
+
+func (u *UptimeReportData) GetFieldNames() []string {
+	return []string{"URL", "RequestTime", "ResponseCode", "TCPError", "ServerError", "Day", "Month", "Year", "Hour", "Minute", "TimeStamp", "ExpireAt", "APIID", "OrgID"}
+}
+
+func (u *UptimeReportData) GetLineValues() []string {
+	return []string{
+		u.URL,
+		strconv.FormatInt(u.RequestTime, 10),
+		strconv.Itoa(u.ResponseCode),
+		strconv.FormatBool(u.TCPError),
+		strconv.FormatBool(u.ServerError),
+		strconv.Itoa(u.Day),
+		u.Month.String(),
+		strconv.Itoa(u.Year),
+		strconv.Itoa(u.Hour),
+		strconv.Itoa(u.Minute),
+		u.TimeStamp.String(),
+		u.ExpireAt.String(),
+		u.APIID,
+		u.OrgID,
+	}
+}
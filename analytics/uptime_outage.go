@@ -0,0 +1,200 @@
+package analytics
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	UptimeOutageStarted  = "outage_started"
+	UptimeOutageResolved = "outage_resolved"
+
+	defaultOutageThreshold   = 3
+	defaultRecoveryThreshold = 1
+)
+
+// UptimeEvent is emitted when a host of an API starts failing its checks, and when it recovers
+type UptimeEvent struct {
+	// outage_started or outage_resolved
+	Event string `json:"event"`
+	OrgID string `json:"org_id"`
+	APIID string `json:"api_id"`
+	URL   string `json:"url"`
+	// Time of the first failed check of the outage
+	StartedAt time.Time `json:"started_at"`
+	// Time of the first successful check after the outage, only set once resolved
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// Duration of the outage in seconds, only set once resolved
+	Duration float64 `json:"duration,omitempty"`
+	// Number of failed checks since the outage started
+	Failures int `json:"failures"`
+	// Result of the last failed check
+	ResponseCode int  `json:"response_code"`
+	TCPError     bool `json:"tcp_error"`
+	ServerError  bool `json:"server_error"`
+}
+
+type uptimeHostState struct {
+	outage    bool
+	failures  int
+	successes int
+	startedAt time.Time
+	// first successful check of the recovery
+	recoveredAt time.Time
+	lastFailure UptimeReportData
+}
+
+// OutageDetector follows the consecutive failed and successful checks of every host across the purges
+type OutageDetector struct {
+	outageThreshold   int
+	recoveryThreshold int
+
+	mu    sync.Mutex
+	hosts map[string]*uptimeHostState
+}
+
+// NewOutageDetector returns a detector starting an outage after outageThreshold consecutive failed checks
+// of a host, and ending it after recoveryThreshold consecutive successful ones. Zero values use the defaults.
+func NewOutageDetector(outageThreshold, recoveryThreshold int) *OutageDetector {
+	if outageThreshold <= 0 {
+		outageThreshold = defaultOutageThreshold
+	}
+	if recoveryThreshold <= 0 {
+		recoveryThreshold = defaultRecoveryThreshold
+	}
+
+	return &OutageDetector{
+		outageThreshold:   outageThreshold,
+		recoveryThreshold: recoveryThreshold,
+		hosts:             make(map[string]*uptimeHostState),
+	}
+}
+
+// Detect processes the checks in time order and returns the outages started and resolved by them
+func (d *OutageDetector) Detect(data []UptimeReportData) []UptimeEvent {
+	checks := append([]UptimeReportData{}, data...)
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].TimeStamp.Before(checks[j].TimeStamp) })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var events []UptimeEvent
+	for _, check := range checks {
+		key := check.OrgID + "|" + check.APIID + "|" + check.URL
+		st, found := d.hosts[key]
+		if !found {
+			// the healthy hosts aren't tracked
+			if check.Up() {
+				continue
+			}
+			st = &uptimeHostState{}
+			d.hosts[key] = st
+		}
+
+		if !check.Up() {
+			if st.failures == 0 {
+				st.startedAt = check.TimeStamp
+			}
+			st.failures++
+			st.successes = 0
+			st.lastFailure = check
+
+			if !st.outage && st.failures >= d.outageThreshold {
+				st.outage = true
+				events = append(events, st.event(UptimeOutageStarted))
+			}
+			continue
+		}
+
+		if !st.outage {
+			delete(d.hosts, key)
+			continue
+		}
+
+		if st.successes == 0 {
+			st.recoveredAt = check.TimeStamp
+		}
+		st.successes++
+		if st.successes >= d.recoveryThreshold {
+			events = append(events, st.event(UptimeOutageResolved))
+			delete(d.hosts, key)
+		}
+	}
+	return events
+}
+
+// uptimeHostSnapshot is the persisted state of a host, so the outages survive a restart of the pump
+type uptimeHostSnapshot struct {
+	Outage      bool             `json:"outage"`
+	Failures    int              `json:"failures"`
+	Successes   int              `json:"successes"`
+	StartedAt   time.Time        `json:"started_at"`
+	RecoveredAt time.Time        `json:"recovered_at"`
+	LastFailure UptimeReportData `json:"last_failure"`
+}
+
+// State returns the JSON encoded state of the tracked hosts, to be restored with Restore
+func (d *OutageDetector) State() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snapshot := make(map[string]uptimeHostSnapshot, len(d.hosts))
+	for key, st := range d.hosts {
+		snapshot[key] = uptimeHostSnapshot{
+			Outage:      st.outage,
+			Failures:    st.failures,
+			Successes:   st.successes,
+			StartedAt:   st.startedAt,
+			RecoveredAt: st.recoveredAt,
+			LastFailure: st.lastFailure,
+		}
+	}
+	return json.Marshal(snapshot)
+}
+
+// Restore replaces the tracked hosts with the state returned by State
+func (d *OutageDetector) Restore(state []byte) error {
+	var snapshot map[string]uptimeHostSnapshot
+	if err := json.Unmarshal(state, &snapshot); err != nil {
+		return err
+	}
+
+	hosts := make(map[string]*uptimeHostState, len(snapshot))
+	for key, st := range snapshot {
+		hosts[key] = &uptimeHostState{
+			outage:      st.Outage,
+			failures:    st.Failures,
+			successes:   st.Successes,
+			startedAt:   st.StartedAt,
+			recoveredAt: st.RecoveredAt,
+			lastFailure: st.LastFailure,
+		}
+	}
+
+	d.mu.Lock()
+	d.hosts = hosts
+	d.mu.Unlock()
+	return nil
+}
+
+func (st *uptimeHostState) event(name string) UptimeEvent {
+	event := UptimeEvent{
+		Event:        name,
+		OrgID:        st.lastFailure.OrgID,
+		APIID:        st.lastFailure.APIID,
+		URL:          st.lastFailure.URL,
+		StartedAt:    st.startedAt,
+		Failures:     st.failures,
+		ResponseCode: st.lastFailure.ResponseCode,
+		TCPError:     st.lastFailure.TCPError,
+		ServerError:  st.lastFailure.ServerError,
+	}
+	if name == UptimeOutageResolved {
+		resolvedAt := st.recoveredAt
+		event.ResolvedAt = &resolvedAt
+		event.Duration = resolvedAt.Sub(st.startedAt).Seconds()
+	}
+	return event
+}
@@ -0,0 +1,77 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutageDetector_Detect(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	check := func(minute int, up bool) UptimeReportData {
+		return UptimeReportData{
+			OrgID:       "org1",
+			APIID:       "api1",
+			URL:         "http://upstream",
+			TimeStamp:   start.Add(time.Duration(minute) * time.Minute),
+			TCPError:    !up,
+			RequestTime: 10,
+		}
+	}
+
+	d := NewOutageDetector(3, 2)
+
+	// two failures aren't an outage
+	if events := d.Detect([]UptimeReportData{check(0, false), check(1, false), check(2, true)}); len(events) != 0 {
+		t.Fatalf("expected no event, got %v", events)
+	}
+
+	// the checks are processed in time order, and the outage continues across purges
+	events := d.Detect([]UptimeReportData{check(5, false), check(3, false), check(4, false)})
+	if len(events) != 1 || events[0].Event != UptimeOutageStarted || !events[0].StartedAt.Equal(check(3, false).TimeStamp) || !events[0].TCPError {
+		t.Fatalf("expected the outage to start at minute 3, got %+v", events)
+	}
+
+	// a failure during the recovery restarts it
+	if events := d.Detect([]UptimeReportData{check(6, true), check(7, false), check(8, true)}); len(events) != 0 {
+		t.Fatalf("expected the outage to go on, got %v", events)
+	}
+
+	events = d.Detect([]UptimeReportData{check(9, true)})
+	if len(events) != 1 || events[0].Event != UptimeOutageResolved {
+		t.Fatalf("expected the outage to be resolved, got %+v", events)
+	}
+	resolved := events[0]
+	if !resolved.ResolvedAt.Equal(check(8, true).TimeStamp) || resolved.Duration != 300 || resolved.Failures != 4 {
+		t.Errorf("unexpected resolution %+v", resolved)
+	}
+
+	if len(d.hosts) != 0 {
+		t.Errorf("expected the healthy hosts not to be tracked, got %v", d.hosts)
+	}
+}
+
+func TestOutageDetector_Restore(t *testing.T) {
+	start := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	check := func(minute int, up bool) UptimeReportData {
+		return UptimeReportData{OrgID: "org1", APIID: "api1", URL: "http://upstream", TimeStamp: start.Add(time.Duration(minute) * time.Minute), TCPError: !up}
+	}
+
+	d := NewOutageDetector(2, 1)
+	if events := d.Detect([]UptimeReportData{check(0, false), check(1, false)}); len(events) != 1 {
+		t.Fatalf("expected the outage to start, got %v", events)
+	}
+	state, err := d.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted pump resolves the outage opened before the restart
+	restarted := NewOutageDetector(2, 1)
+	if err := restarted.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	events := restarted.Detect([]UptimeReportData{check(2, true)})
+	if len(events) != 1 || events[0].Event != UptimeOutageResolved || !events[0].StartedAt.Equal(start) || events[0].Failures != 2 {
+		t.Errorf("expected the restored outage to be resolved, got %+v", events)
+	}
+}
@@ -0,0 +1,124 @@
+package analytics
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mssola/user_agent"
+)
+
+const defaultUserAgentCacheSize = 10000
+
+// Device types detected from the user agent
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+var tabletRegex = regexp.MustCompile(`(?i)ipad|tablet|kindle|silk|playbook`)
+
+// UserAgentConfig configures the parsing of the records UserAgent
+type UserAgentConfig struct {
+	Enabled bool `json:"enabled"`
+	// Number of user agents kept in the parsing cache. Defaults to 10000, -1 disables the cache
+	CacheSize int `json:"cache_size"`
+}
+
+// UserAgentInfo holds the client dimensions parsed from the UserAgent of a record
+type UserAgentInfo struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	DeviceType     string
+	Bot            bool
+}
+
+var userAgentInfoType = reflect.TypeOf(UserAgentInfo{})
+
+// userAgentInfoFieldNames are the CSV columns of the UserAgentInfo, flattened with the UserAgent prefix
+func userAgentInfoFieldNames() []string {
+	names := make([]string, userAgentInfoType.NumField())
+	for i := range names {
+		names[i] = "UserAgent" + userAgentInfoType.Field(i).Name
+	}
+	return names
+}
+
+func (u UserAgentInfo) lineValues() []string {
+	return []string{u.Browser, u.BrowserVersion, u.OS, u.OSVersion, u.DeviceType, strconv.FormatBool(u.Bot)}
+}
+
+// UserAgentParser fills the UserAgentInfo of the analytics records
+type UserAgentParser struct {
+	cache *lruCache
+}
+
+func NewUserAgentParser(conf UserAgentConfig) *UserAgentParser {
+	if conf.CacheSize == 0 {
+		conf.CacheSize = defaultUserAgentCacheSize
+	}
+	return &UserAgentParser{cache: newLRUCache(conf.CacheSize)}
+}
+
+// Enrich parses the UserAgent of the record into its UserAgentInfo
+func (p *UserAgentParser) Enrich(record *AnalyticsRecord) {
+	if record.UserAgent == "" {
+		return
+	}
+
+	if cached, found := p.cache.Get(record.UserAgent); found {
+		record.UserAgentInfo = cached.(UserAgentInfo)
+		return
+	}
+
+	info := ParseUserAgent(record.UserAgent)
+	p.cache.Add(record.UserAgent, info)
+	record.UserAgentInfo = info
+}
+
+func normalizeOSName(name string) string {
+	switch name {
+	case "iPhone OS", "OS", "CPU OS":
+		return "iOS"
+	case "Mac OS X", "Intel Mac OS X":
+		return "macOS"
+	}
+	return name
+}
+
+// ParseUserAgent extracts the browser, OS and device type of an User-Agent header value
+func ParseUserAgent(ua string) UserAgentInfo {
+	info := UserAgentInfo{}
+	if strings.TrimSpace(ua) == "" {
+		return info
+	}
+
+	parsed := user_agent.New(ua)
+	info.Browser, info.BrowserVersion = parsed.Browser()
+	osInfo := parsed.OSInfo()
+	info.OS, info.OSVersion = normalizeOSName(osInfo.Name), osInfo.Version
+	info.Bot = parsed.Bot()
+
+	switch {
+	case info.Bot:
+		info.DeviceType = DeviceBot
+	case parsed.Mozilla() == "":
+		// curl, SDKs and other non browser clients
+		info.DeviceType = DeviceOther
+	case tabletRegex.MatchString(ua), info.OS == "Android" && !strings.Contains(ua, "Mobile"):
+		// Android tablets don't include Mobile in their user agent
+		info.DeviceType = DeviceTablet
+	case parsed.Mobile():
+		info.DeviceType = DeviceMobile
+	default:
+		info.DeviceType = DeviceDesktop
+	}
+
+	return info
+}
@@ -0,0 +1,76 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tcs := []struct {
+		ua      string
+		browser string
+		os      string
+		device  string
+		bot     bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36", "Chrome", "Windows", DeviceDesktop, false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.1 Mobile/15E148 Safari/604.1", "Safari", "iOS", DeviceMobile, false},
+		{"Mozilla/5.0 (iPad; CPU OS 14_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.1 Mobile/15E148 Safari/604.1", "Safari", "iOS", DeviceTablet, false},
+		{"Mozilla/5.0 (Linux; Android 11; SM-T870) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.120 Safari/537.36", "Chrome", "Android", DeviceTablet, false},
+		{"Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.120 Mobile Safari/537.36", "Chrome", "Android", DeviceMobile, false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Googlebot", "", DeviceBot, true},
+		{"curl/7.64.1", "curl", "", DeviceOther, false},
+		{"", "", "", "", false},
+	}
+
+	for _, tc := range tcs {
+		info := ParseUserAgent(tc.ua)
+		if info.Browser != tc.browser || info.OS != tc.os || info.DeviceType != tc.device || info.Bot != tc.bot {
+			t.Errorf("unexpected parsing of %q: %+v", tc.ua, info)
+		}
+	}
+}
+
+func TestAggregateData_UserAgentDimensions(t *testing.T) {
+	parser := NewUserAgentParser(UserAgentConfig{})
+
+	data := []interface{}{}
+	for _, ua := range []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
+		"Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.120 Mobile Safari/537.36",
+		"curl/7.64.1",
+	} {
+		record := AnalyticsRecord{OrgID: "org", ResponseCode: 200, UserAgent: ua}
+		parser.Enrich(&record)
+		data = append(data, record)
+	}
+
+	aggregate := AggregateData(data, false, nil, false)["org"]
+
+	if c := aggregate.UserAgents["Chrome"]; c == nil || c.Hits != 2 {
+		t.Fatalf("unexpected user agent counter: %+v", c)
+	}
+	for _, device := range []string{DeviceDesktop, DeviceMobile, DeviceOther} {
+		if c := aggregate.Devices[device]; c == nil || c.Hits != 1 {
+			t.Fatalf("unexpected %s device counter: %+v", device, c)
+		}
+	}
+}
+
+func TestAnalyticsRecord_UserAgentInfoColumns(t *testing.T) {
+	record := AnalyticsRecord{Method: "GET", Alias: "alias"}
+	record.UserAgentInfo = UserAgentInfo{Browser: "Firefox", OS: "Linux", DeviceType: DeviceDesktop}
+
+	names, values := record.GetFieldNames(), record.GetLineValues()
+	if len(names) != len(values) {
+		t.Fatalf("%d columns for %d values", len(names), len(values))
+	}
+	// the columns of the other fields are unchanged, the user agent ones being last
+	if names[0] != "Method" || names[len(names)-7] != "ExpireAt" || names[len(names)-6] != "UserAgentBrowser" {
+		t.Errorf("unexpected columns %v", names)
+	}
+	expected := []string{"Firefox", "", "Linux", "", DeviceDesktop, "false"}
+	if got := values[len(values)-6:]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
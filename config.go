@@ -22,20 +22,26 @@ type PumpConfig struct {
 }
 
 type TykPumpConfiguration struct {
-	PurgeDelay              int                        `json:"purge_delay"`
-	PurgeChunk              int64                      `json:"purge_chunk"`
-	StorageExpirationTime   int64                      `json:"storage_expiration_time"`
-	DontPurgeUptimeData     bool                       `json:"dont_purge_uptime_data"`
-	UptimePumpConfig        map[string]interface{}     `json:"uptime_pump_config"`
-	Pumps                   map[string]PumpConfig      `json:"pumps"`
-	AnalyticsStorageType    string                     `json:"analytics_storage_type"`
-	AnalyticsStorageConfig  storage.RedisStorageConfig `json:"analytics_storage_config"`
-	StatsdConnectionString  string                     `json:"statsd_connection_string"`
-	StatsdPrefix            string                     `json:"statsd_prefix"`
-	LogLevel                string                     `json:"log_level"`
-	HealthCheckEndpointName string                     `json:"health_check_endpoint_name"`
-	HealthCheckEndpointPort int                        `json:"health_check_endpoint_port"`
-	OmitDetailedRecording   bool                       `json:"omit_detailed_recording"`
+	PurgeDelay              int                               `json:"purge_delay"`
+	PurgeChunk              int64                             `json:"purge_chunk"`
+	StorageExpirationTime   int64                             `json:"storage_expiration_time"`
+	DontPurgeUptimeData     bool                              `json:"dont_purge_uptime_data"`
+	UptimePumpConfig        map[string]interface{}            `json:"uptime_pump_config"`
+	UptimePumps             map[string]PumpConfig             `json:"uptime_pumps"`
+	UptimeAggregation       analytics.UptimeAggregationConfig `json:"uptime_aggregation"`
+	Pumps                   map[string]PumpConfig             `json:"pumps"`
+	AnalyticsStorageType    string                            `json:"analytics_storage_type"`
+	AnalyticsStorageConfig  storage.RedisStorageConfig        `json:"analytics_storage_config"`
+	StatsdConnectionString  string                            `json:"statsd_connection_string"`
+	StatsdPrefix            string                            `json:"statsd_prefix"`
+	LogLevel                string                            `json:"log_level"`
+	HealthCheckEndpointName string                            `json:"health_check_endpoint_name"`
+	HealthCheckEndpointPort int                               `json:"health_check_endpoint_port"`
+	AdminAPIEnable          bool                              `json:"admin_api_enable"`
+	AdminAPISecret          string                            `json:"admin_api_secret"`
+	OmitDetailedRecording   bool                              `json:"omit_detailed_recording"`
+	GeoIP                   analytics.GeoIPConfig             `json:"geoip"`
+	UserAgentParsing        analytics.UserAgentConfig         `json:"user_agent_parsing"`
 }
 
 func LoadConfig(filePath *string, configStruct *TykPumpConfiguration) {
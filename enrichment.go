@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+var enrichmentPrefix = "enrichment"
+
+var GeoIPEnricher *analytics.GeoIPEnricher
+var UserAgentParser *analytics.UserAgentParser
+
+func setupEnrichment() {
+	if SystemConfig.GeoIP.Enabled {
+		var err error
+		GeoIPEnricher, err = analytics.NewGeoIPEnricher(SystemConfig.GeoIP)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": enrichmentPrefix,
+			}).Error("GeoIP enrichment init error (skipping): ", err)
+		} else {
+			log.WithFields(logrus.Fields{
+				"prefix": enrichmentPrefix,
+			}).Info("GeoIP enrichment enabled")
+		}
+	}
+
+	if SystemConfig.UserAgentParsing.Enabled {
+		UserAgentParser = analytics.NewUserAgentParser(SystemConfig.UserAgentParsing)
+		log.WithFields(logrus.Fields{
+			"prefix": enrichmentPrefix,
+		}).Info("User agent parsing enabled")
+	}
+}
+
+// enrichRecord adds the information computed by the pump to a decoded record, before it's sent to the pumps
+func enrichRecord(record *analytics.AnalyticsRecord) {
+	if GeoIPEnricher != nil {
+		GeoIPEnricher.Enrich(record)
+	}
+
+	if UserAgentParser != nil {
+		UserAgentParser.Enrich(record)
+	}
+}
+
+// closeEnrichment releases the GeoIP databases once the records are purged
+func closeEnrichment() {
+	if GeoIPEnricher != nil {
+		GeoIPEnricher.Close()
+	}
+}
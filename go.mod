@@ -16,22 +16,29 @@ require (
 	github.com/fatih/structs v1.1.0
 	github.com/go-ole/go-ole v1.2.4 // indirect
 	github.com/go-redis/redis/v8 v8.3.1
+	github.com/go-sql-driver/mysql v1.7.1
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/gocraft/health v0.0.0-20170925182251-8675af27fef0
 	github.com/gocraft/web v0.0.0-20190207150652-9707327fb69b
+	github.com/golang/snappy v0.0.3
 	github.com/gomodule/redigo v0.0.0-20190226174433-b47395aa1766 // indirect
 	github.com/googleapis/gax-go v2.0.2+incompatible // indirect
 	github.com/influxdata/influxdb v1.8.3
 	github.com/jehiah/go-strftime v0.0.0-20151206194810-2efbe75097a5 // indirect
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.9
 	github.com/lintianzhi/graylogd v0.0.0-20180503131252-dc68342f04dc // indirect
 	github.com/logzio/logzio-go v0.0.0-20200316143903-ac8fc0e2910e
-	github.com/lonelycode/mgohacks v0.0.0-20150820024025-f9c291f7e57e
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/moesif/moesifapi-go v1.0.6
+	github.com/mssola/user_agent v0.5.3
 	github.com/olivere/elastic v6.2.31+incompatible // indirect
+	github.com/olivere/elastic/v7 v7.0.31
+	github.com/oschwald/maxminddb-golang v1.5.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/quipo/statsd v0.0.0-20160923160612-75b7afedf0d2
 	github.com/ricochet2200/go-disk-usage v0.0.0-20150921141558-f0d1b743428f // indirect
 	github.com/robertkowalski/graylog-golang v0.0.0-20151121031040-e5295cfa2827
@@ -42,12 +49,14 @@ require (
 	github.com/shirou/gopsutil v3.20.11+incompatible // indirect
 	github.com/sirupsen/logrus v1.4.2
 	github.com/syndtr/goleveldb v0.0.0-20190318030020-c3a204f8e965 // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	github.com/xtgo/uuid v0.0.0-20140804021211-a0b114877d4c // indirect
-	golang.org/x/sys v0.0.0-20210113131315-ba0562f347e0 // indirect
+	go.mongodb.org/mongo-driver v1.11.9
 	golang.org/x/tools v0.0.0-20200623185156-456ad74e1464 // indirect
 	google.golang.org/api v0.24.0 // indirect
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
-	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/olivere/elastic.v2 v2.0.61 // indirect
 	gopkg.in/olivere/elastic.v3 v3.0.56
 	gopkg.in/olivere/elastic.v5 v5.0.85
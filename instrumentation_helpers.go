@@ -5,6 +5,7 @@ import (
 	"runtime/debug"
 	"time"
 
+	"github.com/TykTechnologies/tyk-pump/pumps"
 	"github.com/TykTechnologies/tyk/rpc"
 
 	"github.com/gocraft/health"
@@ -45,6 +46,7 @@ func SetupInstrumentation() {
 	instrument.AddSink(statsdSink)
 
 	rpc.Instrument = instrument
+	pumps.Instrument = instrument
 
 	MonitorApplicationInstrumentation()
 }
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/TykTechnologies/logrus"
 	prefixed "github.com/TykTechnologies/logrus-prefixed-formatter"
@@ -26,7 +28,8 @@ var SystemConfig TykPumpConfiguration
 var AnalyticsStore storage.AnalyticsStorage
 var UptimeStorage storage.AnalyticsStorage
 var Pumps []pumps.Pump
-var UptimePump pumps.MongoPump
+var UptimePumps []pumps.UptimePump
+var UptimeOutages *analytics.OutageDetector
 
 var log = logger.GetLogger()
 
@@ -146,22 +149,153 @@ func initialisePumps() {
 		}
 		i++
 	}
+}
+
+func initialiseUptimePumps() {
+	if SystemConfig.DontPurgeUptimeData {
+		return
+	}
+
+	uptimePumps := SystemConfig.UptimePumps
+	if len(uptimePumps) == 0 {
+		// the Dashboard reads the uptime data written by the mongo pump
+		uptimePumps = map[string]PumpConfig{"mongo": {Meta: SystemConfig.UptimePumpConfig}}
+	}
+
+	UptimePumps = make([]pumps.UptimePump, 0, len(uptimePumps))
+	for key, pmp := range uptimePumps {
+		pumpTypeName := pmp.Type
+		if pumpTypeName == "" {
+			pumpTypeName = key
+		}
+
+		pmpType, err := pumps.GetUptimePumpByName(pumpTypeName)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Uptime pump load error (skipping): ", err)
+			continue
+		}
 
-	if !SystemConfig.DontPurgeUptimeData {
+		thisPmp := pmpType.New().(pumps.UptimePump)
+		thisPmp.SetFilters(pmp.Filters)
+		thisPmp.SetTimeout(pmp.Timeout)
+		if initErr := thisPmp.Init(pmp.Meta); initErr != nil {
+			log.Error("Uptime pump init error (skipping): ", initErr)
+			continue
+		}
 		log.WithFields(logrus.Fields{
 			"prefix": mainPrefix,
-		}).Info("'dont_purge_uptime_data' set to false, attempting to start Uptime pump! ", UptimePump.GetName())
-		UptimePump = pumps.MongoPump{}
-		UptimePump.Init(SystemConfig.UptimePumpConfig)
+		}).Info("Init Uptime Pump: ", key)
+		UptimePumps = append(UptimePumps, thisPmp)
+	}
+
+	setupUptimeAggregation()
+}
+
+func setupUptimeAggregation() {
+	conf := &SystemConfig.UptimeAggregation
+	if !conf.Enabled {
+		return
+	}
+
+	if len(conf.Granularities) == 0 {
+		conf.Granularities = []string{"1h", "1d"}
+	}
+	for _, granularity := range conf.Granularities {
+		if _, err := analytics.ParseGranularity(granularity); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Uptime aggregation init error (skipping): ", err)
+			conf.Enabled = false
+			return
+		}
+	}
+
+	UptimeOutages = analytics.NewOutageDetector(conf.OutageThreshold, conf.RecoveryThreshold)
+	uptimeOutagesKeyName = uptimeOutagesKey(conf.InstanceID)
+	loadUptimeOutages()
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Info("Uptime aggregation enabled, granularities: ", strings.Join(conf.Granularities, ", "))
+}
+
+// uptimeOutagesKeyPrefix stores the open outages of each pump in the uptime storage, so they are resolved after a restart
+const uptimeOutagesKeyPrefix = "pump-uptime-outages"
+
+// uptimeOutagesKeyName is the key of the outages detected by this pump
+var uptimeOutagesKeyName = uptimeOutagesKeyPrefix
+
+// uptimeOutagesKey returns the key of the outages detected by the pump instance, its hostname by default
+func uptimeOutagesKey(instanceID string) string {
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+	if instanceID == "" {
+		return uptimeOutagesKeyPrefix
+	}
+	return uptimeOutagesKeyPrefix + "-" + instanceID
+}
+
+// outageStateStore is implemented by the uptime storages able to persist the state of the outage detector
+type outageStateStore interface {
+	GetKey(keyName string) (string, error)
+	SetKey(keyName, session string, timeout int64) error
+}
+
+func loadUptimeOutages() {
+	store, ok := UptimeStorage.(outageStateStore)
+	if !ok {
+		return
+	}
+
+	state, err := store.GetKey(uptimeOutagesKeyName)
+	if err == storage.ErrKeyNotFound && uptimeOutagesKeyName != uptimeOutagesKeyPrefix {
+		// the outages saved before the keys were namespaced per instance
+		state, err = store.GetKey(uptimeOutagesKeyPrefix)
+	}
+	if err == storage.ErrKeyNotFound {
+		return
+	}
+	if err == nil {
+		err = UptimeOutages.Restore([]byte(state))
+	}
+	if err != nil {
 		log.WithFields(logrus.Fields{
 			"prefix": mainPrefix,
-		}).Info("Init Uptime Pump: ", UptimePump.GetName())
+		}).Error("Couldn't restore the uptime outages: ", err)
+	}
+}
+
+func saveUptimeOutages() {
+	store, ok := UptimeStorage.(outageStateStore)
+	if !ok {
+		return
 	}
 
+	state, err := UptimeOutages.State()
+	if err == nil {
+		err = store.SetKey(uptimeOutagesKeyName, string(state), 0)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Error("Couldn't save the uptime outages: ", err)
+	}
 }
 
-func StartPurgeLoop(secInterval int, chunkSize int64, expire time.Duration, omitDetails bool) {
-	for range time.Tick(time.Duration(secInterval) * time.Second) {
+// StartPurgeLoop purges the analytics every secInterval seconds until stop is closed
+func StartPurgeLoop(stop <-chan struct{}, secInterval int, chunkSize int64, expire time.Duration, omitDetails bool) {
+	ticker := time.NewTicker(time.Duration(secInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
 		job := instrument.NewJob("PumpRecordsPurge")
 		startTime := time.Now()
 
@@ -194,6 +328,7 @@ func StartPurgeLoop(secInterval int, chunkSize int64, expire time.Duration, omit
 							decoded.RawRequest = ""
 							decoded.RawResponse = ""
 						}
+						enrichRecord(&decoded)
 						keys[i] = interface{}(decoded)
 						job.Event("record")
 					}
@@ -206,12 +341,27 @@ func StartPurgeLoop(secInterval int, chunkSize int64, expire time.Duration, omit
 		job.Timing("purge_time_all", time.Since(startTime).Nanoseconds())
 
 		if !SystemConfig.DontPurgeUptimeData {
-			UptimeValues := UptimeStorage.GetAndDeleteSet(storage.UptimeAnalytics_KEYNAME, chunkSize, expire)
-			UptimePump.WriteUptimeData(UptimeValues)
+			purgeUptimeData(chunkSize, expire, job, startTime, int(secInterval))
 		}
 	}
 }
 
+// purgeUptimeData writes the uptime checks to the uptime pumps. They are still purged when none could be
+// initialised, so they don't pile up in Redis.
+func purgeUptimeData(chunkSize int64, expire time.Duration, job *health.Job, startTime time.Time, purgeDelay int) {
+	UptimeValues := UptimeStorage.GetAndDeleteSet(storage.UptimeAnalytics_KEYNAME, chunkSize, expire)
+	if len(UptimeValues) == 0 {
+		return
+	}
+	if len(UptimePumps) == 0 {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Warning("No uptime pump initialised, dropping ", len(UptimeValues), " uptime records")
+		return
+	}
+	writeUptimeToPumps(decodeUptimeData(UptimeValues), job, startTime, purgeDelay)
+}
+
 func writeToPumps(keys []interface{}, job *health.Job, startTime time.Time, purgeDelay int) {
 	// Send to pumps
 	if Pumps != nil {
@@ -228,6 +378,95 @@ func writeToPumps(keys []interface{}, job *health.Job, startTime time.Time, purg
 	}
 }
 
+// decodeUptimeData decodes the uptime checks once for all the uptime pumps
+func decodeUptimeData(values []interface{}) []analytics.UptimeReportData {
+	data := make([]analytics.UptimeReportData, 0, len(values))
+	for _, v := range values {
+		decoded := analytics.UptimeReportData{}
+		if err := msgpack.Unmarshal([]byte(v.(string)), &decoded); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Couldn't unmarshal uptime data:", err)
+			continue
+		}
+		data = append(data, decoded)
+	}
+	return data
+}
+
+func writeUptimeToPumps(data []analytics.UptimeReportData, job *health.Job, startTime time.Time, purgeDelay int) {
+	var events []analytics.UptimeEvent
+	if UptimeOutages != nil {
+		events = UptimeOutages.Detect(data)
+		saveUptimeOutages()
+		for _, event := range events {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+				"api_id": event.APIID,
+				"url":    event.URL,
+			}).Warning("Uptime ", event.Event, " after ", event.Failures, " failed checks")
+			if job != nil {
+				job.EventKv("uptime_"+event.Event, health.Kvs{"api_id": event.APIID, "org_id": event.OrgID})
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(UptimePumps))
+	for _, pmp := range UptimePumps {
+		go execUptimePumpWriting(&wg, pmp, data, events, purgeDelay, startTime, job)
+	}
+	wg.Wait()
+}
+
+// writeUptime writes the checks to the pump, then their rollups and the outage events if it supports them
+func writeUptime(ctx context.Context, pmp pumps.UptimePump, data []analytics.UptimeReportData, events []analytics.UptimeEvent) error {
+	data = filterUptimeData(pmp, data)
+	if err := pmp.WriteUptimeData(ctx, data); err != nil {
+		return err
+	}
+
+	if aggregatePump, ok := pmp.(pumps.UptimeAggregatePump); ok && SystemConfig.UptimeAggregation.Enabled && len(data) > 0 {
+		aggregates, err := analytics.AggregateUptimeData(data, SystemConfig.UptimeAggregation.Granularities)
+		if err != nil {
+			return err
+		}
+		if err := aggregatePump.WriteUptimeAggregates(ctx, aggregates); err != nil {
+			return err
+		}
+	}
+
+	if eventPump, ok := pmp.(pumps.UptimeEventPump); ok && len(events) > 0 {
+		filters := pmp.GetFilters()
+		filtered := make([]analytics.UptimeEvent, 0, len(events))
+		for _, event := range events {
+			if !filters.ShouldFilterUptimeEvent(event) {
+				filtered = append(filtered, event)
+			}
+		}
+		if len(filtered) > 0 {
+			return eventPump.WriteUptimeEvents(ctx, filtered)
+		}
+	}
+	return nil
+}
+
+func filterUptimeData(pump pumps.UptimePump, data []analytics.UptimeReportData) []analytics.UptimeReportData {
+	filters := pump.GetFilters()
+	if !filters.HasFilter() {
+		return data
+	}
+
+	// the data is shared by the pumps, so it's filtered into a new slice
+	filtered := make([]analytics.UptimeReportData, 0, len(data))
+	for _, record := range data {
+		if !filters.ShouldFilterUptime(record) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
 func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
 	filters := pump.GetFilters()
 	if !filters.HasFilter() && !pump.GetOmitDetailedRecording() {
@@ -253,6 +492,21 @@ func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
 }
 
 func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, purgeDelay int, startTime time.Time, job *health.Job) {
+	execWriting(wg, pmp, func(ctx context.Context) error {
+		filteredKeys := filterData(pmp, *keys)
+
+		return pmp.WriteData(ctx, filteredKeys)
+	}, purgeDelay, startTime, job, "purge_time_"+pmp.GetName())
+}
+
+func execUptimePumpWriting(wg *sync.WaitGroup, pmp pumps.UptimePump, data []analytics.UptimeReportData, events []analytics.UptimeEvent, purgeDelay int, startTime time.Time, job *health.Job) {
+	execWriting(wg, pmp, func(ctx context.Context) error {
+		return writeUptime(ctx, pmp, data, events)
+	}, purgeDelay, startTime, job, "purge_time_uptime_"+pmp.GetName())
+}
+
+// execWriting runs the write of the pump, cancelling it after the timeout of the pump
+func execWriting(wg *sync.WaitGroup, pmp pumps.Pump, write func(ctx context.Context) error, purgeDelay int, startTime time.Time, job *health.Job, timing string) {
 	timer := time.AfterFunc(time.Duration(purgeDelay)*time.Second, func() {
 		if pmp.GetTimeout() == 0 {
 			log.WithFields(logrus.Fields{
@@ -285,11 +539,9 @@ func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, pu
 
 	defer cancel()
 
-	go func(ch chan error, ctx context.Context, pmp pumps.Pump, keys *[]interface{}) {
-		filteredKeys := filterData(pmp, *keys)
-
-		ch <- pmp.WriteData(ctx, filteredKeys)
-	}(ch, ctx, pmp, keys)
+	go func(ch chan error, ctx context.Context) {
+		ch <- write(ctx)
+	}(ch, ctx)
 
 	select {
 	case err := <-ch:
@@ -311,14 +563,14 @@ func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, pu
 		}
 	}
 	if job != nil {
-		job.Timing("purge_time_"+pmp.GetName(), time.Since(startTime).Nanoseconds())
+		job.Timing(timing, time.Since(startTime).Nanoseconds())
 	}
 }
 
 func main() {
 	Init()
 	SetupInstrumentation()
-	go server.ServeHealthCheck(SystemConfig.HealthCheckEndpointName, SystemConfig.HealthCheckEndpointPort)
+	go server.ServeHealthCheck(SystemConfig.HealthCheckEndpointName, SystemConfig.HealthCheckEndpointPort, SystemConfig.AdminAPIEnable, SystemConfig.AdminAPISecret)
 
 	// Store version which will be read by dashboard and sent to
 	// vclu(version check and licecnse utilisation) service
@@ -329,6 +581,10 @@ func main() {
 
 	// prime the pumps
 	initialisePumps()
+	initialiseUptimePumps()
+
+	// load the record enrichment stages
+	setupEnrichment()
 
 	if *demoMode != "" {
 		log.Warning("BUILDING DEMO DATA AND EXITING...")
@@ -352,5 +608,42 @@ func main() {
 		"prefix": mainPrefix,
 	}).Infof("Starting purge loop @%d, chunk size %d", SystemConfig.PurgeDelay, SystemConfig.PurgeChunk)
 
-	StartPurgeLoop(SystemConfig.PurgeDelay, SystemConfig.PurgeChunk, time.Duration(SystemConfig.StorageExpirationTime)*time.Second, SystemConfig.OmitDetailedRecording)
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Info("Received ", sig, ", stopping the purge loop")
+		close(stop)
+	}()
+
+	StartPurgeLoop(stop, SystemConfig.PurgeDelay, SystemConfig.PurgeChunk, time.Duration(SystemConfig.StorageExpirationTime)*time.Second, SystemConfig.OmitDetailedRecording)
+	shutdownPumps()
+	closeEnrichment()
+}
+
+// shutdownPumps lets the pumps flush their buffered records and release their resources once the purges are done
+func shutdownPumps() {
+	shutdown := func(pmp pumps.Pump) {
+		sp, ok := pmp.(pumps.ShutdownPump)
+		if !ok {
+			return
+		}
+		if err := sp.Shutdown(); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Error shutting down ", pmp.GetName(), ": ", err)
+		}
+	}
+
+	for _, pmp := range Pumps {
+		if pmp != nil {
+			shutdown(pmp)
+		}
+	}
+	for _, pmp := range UptimePumps {
+		shutdown(pmp)
+	}
 }
@@ -8,6 +8,8 @@ import (
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/TykTechnologies/tyk-pump/pumps"
+	"github.com/TykTechnologies/tyk-pump/storage"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 )
 
 type MockedPump struct {
@@ -117,3 +119,171 @@ func TestWriteDataWithFilters(t *testing.T) {
 		t.Fatal("MockedPump with filter should have 3 requests")
 	}
 }
+
+type MockedUptimePump struct {
+	MockedPump
+	Uptime []analytics.UptimeReportData
+}
+
+func (p *MockedUptimePump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	p.Uptime = append(p.Uptime, data...)
+	return nil
+}
+
+func TestWriteUptimeData(t *testing.T) {
+	values := make([]interface{}, 0, 3)
+	for _, record := range []analytics.UptimeReportData{{APIID: "api1", OrgID: "org1"}, {APIID: "api2", OrgID: "org1"}, {APIID: "api1", OrgID: "org2"}} {
+		encoded, err := msgpack.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, string(encoded))
+	}
+	values = append(values, "not msgpack")
+
+	data := decodeUptimeData(values)
+	if len(data) != 3 {
+		t.Fatalf("expected 3 decoded records, got %d", len(data))
+	}
+
+	all := &MockedUptimePump{}
+	filtered := &MockedUptimePump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{APIIDs: []string{"api1"}, SkippedOrgsIDs: []string{"org2"}})
+	UptimePumps = []pumps.UptimePump{all, filtered}
+
+	writeUptimeToPumps(data, instrument.NewJob("TestJob"), time.Now(), 2)
+
+	if len(all.Uptime) != 3 {
+		t.Errorf("expected 3 uptime records, got %d", len(all.Uptime))
+	}
+	if len(filtered.Uptime) != 1 || filtered.Uptime[0].APIID != "api1" || filtered.Uptime[0].OrgID != "org1" {
+		t.Errorf("expected the uptime record of api1 and org1, got %v", filtered.Uptime)
+	}
+}
+
+type MockedOutagePump struct {
+	MockedUptimePump
+	Aggregates []analytics.UptimeAggregate
+	Events     []analytics.UptimeEvent
+}
+
+func (p *MockedOutagePump) WriteUptimeAggregates(ctx context.Context, aggregates []analytics.UptimeAggregate) error {
+	p.Aggregates = append(p.Aggregates, aggregates...)
+	return nil
+}
+
+func (p *MockedOutagePump) WriteUptimeEvents(ctx context.Context, events []analytics.UptimeEvent) error {
+	p.Events = append(p.Events, events...)
+	return nil
+}
+
+func TestWriteUptimeAggregation(t *testing.T) {
+	SystemConfig.UptimeAggregation = analytics.UptimeAggregationConfig{Enabled: true, OutageThreshold: 2}
+	setupUptimeAggregation()
+	defer func() {
+		SystemConfig.UptimeAggregation = analytics.UptimeAggregationConfig{}
+		UptimeOutages = nil
+	}()
+
+	all := &MockedOutagePump{}
+	filtered := &MockedOutagePump{}
+	filtered.SetFilters(analytics.AnalyticsFilters{SkippedAPIIDs: []string{"api2"}})
+	UptimePumps = []pumps.UptimePump{all, filtered}
+
+	now := time.Now()
+	data := []analytics.UptimeReportData{
+		{APIID: "api1", URL: "http://upstream1", TimeStamp: now},
+		{APIID: "api2", URL: "http://upstream2", TimeStamp: now, TCPError: true},
+		{APIID: "api2", URL: "http://upstream2", TimeStamp: now.Add(time.Second), TCPError: true},
+	}
+	writeUptimeToPumps(data, instrument.NewJob("TestJob"), time.Now(), 2)
+
+	// an hourly and a daily aggregate per host
+	if len(all.Aggregates) != 4 || len(filtered.Aggregates) != 2 {
+		t.Errorf("expected 4 and 2 aggregates, got %d and %d", len(all.Aggregates), len(filtered.Aggregates))
+	}
+	if len(all.Events) != 1 || all.Events[0].Event != analytics.UptimeOutageStarted || all.Events[0].APIID != "api2" {
+		t.Errorf("expected the outage of api2, got %v", all.Events)
+	}
+	if len(filtered.Events) != 0 {
+		t.Errorf("expected the outage of api2 to be filtered, got %v", filtered.Events)
+	}
+}
+
+// MockedOutageStateStorage keeps the outage states by key
+type MockedOutageStateStorage struct {
+	MockedUptimeStorage
+	Keys map[string]string
+}
+
+func (s *MockedOutageStateStorage) GetKey(keyName string) (string, error) {
+	value, found := s.Keys[keyName]
+	if !found {
+		return "", storage.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (s *MockedOutageStateStorage) SetKey(keyName, session string, timeout int64) error {
+	s.Keys[keyName] = session
+	return nil
+}
+
+func TestUptimeOutagesState(t *testing.T) {
+	previous := UptimeStorage
+	defer func() {
+		UptimeStorage = previous
+		UptimeOutages = nil
+		uptimeOutagesKeyName = uptimeOutagesKeyPrefix
+	}()
+
+	// the state of the previous versions is restored, then saved in the key of the instance
+	detector := analytics.NewOutageDetector(1, 1)
+	detector.Detect([]analytics.UptimeReportData{{APIID: "api1", URL: "http://upstream1", TimeStamp: time.Now(), TCPError: true}})
+	state, err := detector.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MockedOutageStateStorage{Keys: map[string]string{uptimeOutagesKeyPrefix: string(state)}}
+	UptimeStorage = store
+
+	UptimeOutages = analytics.NewOutageDetector(1, 1)
+	uptimeOutagesKeyName = uptimeOutagesKey("pump-1")
+	loadUptimeOutages()
+	saveUptimeOutages()
+
+	if store.Keys["pump-uptime-outages-pump-1"] != string(state) {
+		t.Errorf("expected the outages to be saved in the key of the instance, got %v", store.Keys)
+	}
+}
+
+type MockedUptimeStorage struct {
+	Values []interface{}
+}
+
+func (s *MockedUptimeStorage) Init(config interface{}) error { return nil }
+func (s *MockedUptimeStorage) GetName() string               { return "Mocked Storage" }
+func (s *MockedUptimeStorage) Connect() bool                 { return true }
+func (s *MockedUptimeStorage) GetAndDeleteSet(setName string, chunkSize int64, expire time.Duration) []interface{} {
+	values := s.Values
+	s.Values = nil
+	return values
+}
+
+func TestPurgeUptimeDataWithoutPumps(t *testing.T) {
+	encoded, err := msgpack.Marshal(analytics.UptimeReportData{APIID: "api1", OrgID: "org1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MockedUptimeStorage{Values: []interface{}{string(encoded)}}
+	UptimeStorage, UptimePumps = store, nil
+	defer func() {
+		UptimeStorage = nil
+	}()
+
+	purgeUptimeData(10, time.Minute, instrument.NewJob("TestJob"), time.Now(), 2)
+
+	if len(store.Values) != 0 {
+		t.Errorf("expected the uptime records to be purged, got %v", store.Values)
+	}
+}
@@ -0,0 +1,303 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
+)
+
+// ClickHousePump inserts the analytics records in a ClickHouse table through the HTTP interface
+type ClickHousePump struct {
+	conf   *ClickHouseConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+type ClickHouseConf struct {
+	// URL of the HTTP interface. Defaults to http://localhost:8123
+	URL      string `mapstructure:"url"`
+	Database string `mapstructure:"database"`
+	// Defaults to tyk_analytics
+	TableName string `mapstructure:"table_name"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+	// Maximum number of records of an insert. Defaults to 10000
+	BatchSize int `mapstructure:"batch_size"`
+	// Creates the MergeTree table at start up if it doesn't exist
+	CreateTable bool `mapstructure:"create_table"`
+	// Partitions the created table by day instead of by month
+	PartitionByDay bool `mapstructure:"partition_by_day"`
+	// Days the records are kept in the created table, forever when 0
+	TTLDays int `mapstructure:"ttl_days"`
+	// Lets ClickHouse buffer the inserts, see async_insert
+	AsyncInsert bool `mapstructure:"async_insert"`
+	// Returns before the buffered inserts are written, their errors are then only logged by ClickHouse
+	AsyncInsertNoWait bool `mapstructure:"async_insert_no_wait"`
+	// Compresses the inserts with gzip
+	Compress bool `mapstructure:"compress"`
+	// Timeout of every request in seconds. Defaults to 30
+	RequestTimeout        int    `mapstructure:"request_timeout"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+var clickHousePrefix = "clickhouse-pump"
+
+const (
+	defaultClickHouseURL            = "http://localhost:8123"
+	defaultClickHouseDatabase       = "default"
+	defaultClickHouseTableName      = "tyk_analytics"
+	defaultClickHouseBatchSize      = 10000
+	defaultClickHouseRequestTimeout = 30
+)
+
+// clickHouseLowCardinality are the columns with few distinct values, stored as LowCardinality
+var clickHouseLowCardinality = map[string]bool{
+	"org_id":             true,
+	"api_id":             true,
+	"api_name":           true,
+	"api_version":        true,
+	"method":             true,
+	"host":               true,
+	"geo_country":        true,
+	"geo_region":         true,
+	"user_agent_browser": true,
+	"user_agent_os":      true,
+	"user_agent_device":  true,
+}
+
+// clickHouseColumns are the columns of the created table, those of the canonical record of the serializers
+// inserted with the JSONEachRow format. The timestamps in milliseconds are read as DateTime64(3).
+var clickHouseColumns = getClickHouseColumns()
+
+func getClickHouseColumns() [][2]string {
+	fields := serializer.Fields()
+	columns := make([][2]string, len(fields))
+	for i, f := range fields {
+		var columnType string
+		switch f.Kind {
+		case reflect.String:
+			columnType = "String"
+			if clickHouseLowCardinality[f.Name] {
+				columnType = "LowCardinality(String)"
+			}
+		case reflect.Int64:
+			columnType = "Int64"
+			if f.Logical == "timestamp-millis" {
+				columnType = "DateTime64(3, 'UTC')"
+			}
+		case reflect.Float64:
+			columnType = "Float64"
+		case reflect.Bool:
+			columnType = "Bool"
+		case reflect.Slice:
+			columnType = "Array(String)"
+		}
+		columns[i] = [2]string{f.Name, columnType}
+	}
+	return columns
+}
+
+func (c *ClickHousePump) New() Pump {
+	newPump := ClickHousePump{}
+	return &newPump
+}
+
+func (c *ClickHousePump) GetName() string {
+	return "ClickHouse Pump"
+}
+
+func (c *ClickHousePump) Init(config interface{}) error {
+	c.conf = &ClickHouseConf{}
+	c.log = log.WithField("prefix", clickHousePrefix)
+
+	if err := mapstructure.Decode(config, &c.conf); err != nil {
+		return err
+	}
+	if c.conf.URL == "" {
+		c.conf.URL = defaultClickHouseURL
+	}
+	if _, err := url.Parse(c.conf.URL); err != nil {
+		return err
+	}
+	if c.conf.Database == "" {
+		c.conf.Database = defaultClickHouseDatabase
+	}
+	if c.conf.TableName == "" {
+		c.conf.TableName = defaultClickHouseTableName
+	}
+	if c.conf.BatchSize <= 0 {
+		c.conf.BatchSize = defaultClickHouseBatchSize
+	}
+	if c.conf.RequestTimeout <= 0 {
+		c.conf.RequestTimeout = defaultClickHouseRequestTimeout
+	}
+	if c.conf.TTLDays < 0 {
+		return errors.New("ttl_days can't be negative")
+	}
+
+	tlsConfig, err := getTLSConfig(c.conf.SSLCAFile, "", "", c.conf.SSLInsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	c.client = &http.Client{
+		Timeout: time.Duration(c.conf.RequestTimeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	if c.conf.CreateTable {
+		if err := c.exec(context.Background(), c.createTableQuery(), nil, nil); err != nil {
+			return fmt.Errorf("creating the ClickHouse table: %v", err)
+		}
+	}
+
+	c.log.Info(c.GetName() + " Initialized")
+	return nil
+}
+
+// table returns the quoted name of the table
+func (c *ClickHousePump) table() string {
+	return clickHouseQuote(c.conf.Database) + "." + clickHouseQuote(c.conf.TableName)
+}
+
+func clickHouseQuote(identifier string) string {
+	return "`" + strings.Replace(identifier, "`", "\\`", -1) + "`"
+}
+
+func (c *ClickHousePump) createTableQuery() string {
+	columns := make([]string, len(clickHouseColumns))
+	for i, column := range clickHouseColumns {
+		columns[i] = clickHouseQuote(column[0]) + " " + column[1]
+	}
+
+	partition := "toYYYYMM(timestamp)"
+	if c.conf.PartitionByDay {
+		partition = "toYYYYMMDD(timestamp)"
+	}
+	query := "CREATE TABLE IF NOT EXISTS " + c.table() + " (" + strings.Join(columns, ", ") + ")" +
+		" ENGINE = MergeTree PARTITION BY " + partition + " ORDER BY (org_id, api_id, timestamp)"
+	if c.conf.TTLDays > 0 {
+		query += fmt.Sprintf(" TTL toDateTime(timestamp) + INTERVAL %d DAY", c.conf.TTLDays)
+	}
+	return query
+}
+
+func (c *ClickHousePump) insertQuery() string {
+	columns := make([]string, len(clickHouseColumns))
+	for i, column := range clickHouseColumns {
+		columns[i] = clickHouseQuote(column[0])
+	}
+	return "INSERT INTO " + c.table() + " (" + strings.Join(columns, ", ") + ") FORMAT JSONEachRow"
+}
+
+func (c *ClickHousePump) WriteData(ctx context.Context, data []interface{}) error {
+	c.log.Debug("Attempting to write ", len(data), " records...")
+
+	records := make([]serializer.Record, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		records = append(records, serializer.NewRecord(record))
+	}
+
+	settings := url.Values{}
+	if c.conf.AsyncInsert {
+		settings.Set("async_insert", "1")
+		settings.Set("wait_for_async_insert", "1")
+		if c.conf.AsyncInsertNoWait {
+			settings.Set("wait_for_async_insert", "0")
+		}
+	}
+
+	for start := 0; start < len(records); start += c.conf.BatchSize {
+		end := start + c.conf.BatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+		for i := range records[start:end] {
+			if err := encoder.Encode(&records[start+i]); err != nil {
+				return err
+			}
+		}
+
+		if err := c.exec(ctx, c.insertQuery(), settings, body.Bytes()); err != nil {
+			c.log.Error("Failed to insert the records: ", err)
+			return err
+		}
+		c.log.Debug("Inserted ", end-start, " records")
+	}
+
+	c.log.Info("Purged ", len(records), " records...")
+	return nil
+}
+
+// exec runs the query with the settings, the body holding the rows of an insert
+func (c *ClickHousePump) exec(ctx context.Context, query string, settings url.Values, body []byte) error {
+	params := url.Values{}
+	for name, values := range settings {
+		params[name] = values
+	}
+	params.Set("query", query)
+
+	var reader io.Reader = bytes.NewReader(body)
+	if c.conf.Compress && len(body) > 0 {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		reader = &compressed
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(c.conf.URL, "/")+"/?"+params.Encode(), reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.conf.Compress && len(body) > 0 {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.conf.Username != "" {
+		req.Header.Set("X-ClickHouse-User", c.conf.Username)
+		req.Header.Set("X-ClickHouse-Key", c.conf.Password)
+	}
+	req.Header.Set("X-ClickHouse-Database", c.conf.Database)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// ClickHouse returns the exception in the body
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("ClickHouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,163 @@
+package pumps
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+type clickHouseRequest struct {
+	query    string
+	settings map[string]string
+	rows     []map[string]interface{}
+}
+
+// clickHouseStandIn records the queries sent to the HTTP interface, failing the inserts when fail is set
+func clickHouseStandIn(t *testing.T, fail bool) (*httptest.Server, func() []clickHouseRequest) {
+	var mu sync.Mutex
+	var requests []clickHouseRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ClickHouse-User") != "tyk" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req := clickHouseRequest{query: r.URL.Query().Get("query"), settings: map[string]string{}}
+		for name := range r.URL.Query() {
+			req.settings[name] = r.URL.Query().Get(name)
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			row := map[string]interface{}{}
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Error(err)
+			}
+			req.rows = append(req.rows, row)
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		if fail && strings.HasPrefix(req.query, "INSERT") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Code: 60. DB::Exception: Table default.tyk_analytics doesn't exist."))
+		}
+	}))
+
+	return server, func() []clickHouseRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]clickHouseRequest{}, requests...)
+	}
+}
+
+func TestClickHousePump_WriteData(t *testing.T) {
+	server, requests := clickHouseStandIn(t, false)
+	defer server.Close()
+
+	c := &ClickHousePump{}
+	err := c.Init(map[string]interface{}{
+		"url":              server.URL,
+		"username":         "tyk",
+		"password":         "secret",
+		"batch_size":       2,
+		"create_table":     true,
+		"partition_by_day": true,
+		"ttl_days":         30,
+		"async_insert":     true,
+		"compress":         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2020, 3, 1, 10, 15, 30, 123000000, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: ts, OrgID: "org1", APIID: "api1", ResponseCode: 200, Tags: []string{"a"}},
+		analytics.AnalyticsRecord{TimeStamp: ts, OrgID: "org1", APIID: "api1", ResponseCode: 500},
+		analytics.AnalyticsRecord{TimeStamp: ts, OrgID: "org1", APIID: "api2", ResponseCode: 404, Latency: analytics.Latency{Total: 12}},
+	}
+	if err := c.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("expected the table creation and 2 inserts, got %d requests", len(reqs))
+	}
+
+	create := reqs[0].query
+	for _, expected := range []string{
+		"CREATE TABLE IF NOT EXISTS `default`.`tyk_analytics`",
+		"`timestamp` DateTime64(3, 'UTC')",
+		"`org_id` LowCardinality(String)",
+		"`geo_latitude` Float64",
+		"`user_agent_bot` Bool",
+		"`tags` Array(String)",
+		"ENGINE = MergeTree PARTITION BY toYYYYMMDD(timestamp) ORDER BY (org_id, api_id, timestamp)",
+		"TTL toDateTime(timestamp) + INTERVAL 30 DAY",
+	} {
+		if !strings.Contains(create, expected) {
+			t.Errorf("expected %q in %s", expected, create)
+		}
+	}
+
+	insert := reqs[1]
+	if !strings.HasPrefix(insert.query, "INSERT INTO `default`.`tyk_analytics` (`timestamp`, `method`") || !strings.HasSuffix(insert.query, "FORMAT JSONEachRow") {
+		t.Errorf("unexpected insert %s", insert.query)
+	}
+	if insert.settings["async_insert"] != "1" || insert.settings["wait_for_async_insert"] != "1" {
+		t.Errorf("unexpected settings %v", insert.settings)
+	}
+	if len(insert.rows) != 2 || len(reqs[2].rows) != 1 {
+		t.Fatalf("expected batches of 2 and 1 records, got %d and %d", len(insert.rows), len(reqs[2].rows))
+	}
+	row := insert.rows[0]
+	// the timestamps are inserted in milliseconds
+	if row["timestamp"] != float64(1583057730123) || row["api_id"] != "api1" || row["response_code"] != float64(200) {
+		t.Errorf("unexpected row %v", row)
+	}
+	if tags, _ := insert.rows[1]["tags"].([]interface{}); tags == nil || len(tags) != 0 {
+		t.Errorf("expected empty tags, got %v", insert.rows[1]["tags"])
+	}
+	if reqs[2].rows[0]["latency_total"] != float64(12) {
+		t.Errorf("unexpected row %v", reqs[2].rows[0])
+	}
+}
+
+func TestClickHousePump_WriteDataError(t *testing.T) {
+	server, _ := clickHouseStandIn(t, true)
+	defer server.Close()
+
+	c := &ClickHousePump{}
+	if err := c.Init(map[string]interface{}{"url": server.URL, "username": "tyk", "password": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.WriteData(context.Background(), []interface{}{analytics.AnalyticsRecord{OrgID: "org1"}})
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("expected the ClickHouse exception, got %v", err)
+	}
+}
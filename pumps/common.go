@@ -1,10 +1,21 @@
 package pumps
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
 	"github.com/TykTechnologies/logrus"
+	"github.com/gocraft/health"
+
 	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
 )
 
+// Instrument is the stream the pumps send their metrics to, set when the instrumentation is enabled
+var Instrument *health.Stream
+
 type CommonPumpConfig struct {
 	filters               analytics.AnalyticsFilters
 	timeout               int
@@ -32,3 +43,44 @@ func (p *CommonPumpConfig) SetOmitDetailedRecording(OmitDetailedRecording bool)
 func (p *CommonPumpConfig) GetOmitDetailedRecording() bool {
 	return p.OmitDetailedRecording
 }
+
+// getTLSConfig returns the TLS configuration of the HTTP clients of the pumps, verifying the server
+// with the CA of caFile when set and authenticating with the client certificate when set
+func getTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// getJSONSerializer returns the serializer of the pumps sending the records as JSON documents, or nil when
+// their serialization isn't configured. Their transports are text, so only the canonical json format is
+// supported, without the Confluent framing.
+func getJSONSerializer(conf serializer.Config) (serializer.Serializer, error) {
+	if conf.Format == "" {
+		return nil, nil
+	}
+	if conf.Format != serializer.FormatJSON || conf.ConfluentFraming || conf.SchemaRegistry.URL != "" {
+		return nil, errors.New("serialization only supports the json format, without confluent_framing or schema_registry")
+	}
+	return serializer.NewSerializer(conf.Format)
+}
@@ -59,22 +59,9 @@ func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	fname := fmt.Sprintf("%d-%s-%d-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour())
 	fname = path.Join(c.csvConf.CSVDir, fname)
 
-	var outfile *os.File
-	var appendHeader bool
-
-	if _, err := os.Stat(fname); os.IsNotExist(err) {
-		var createErr error
-		outfile, createErr = os.Create(fname)
-		if createErr != nil {
-			c.log.Error("Failed to create new CSV file: ", createErr)
-		}
-		appendHeader = true
-	} else {
-		var appendErr error
-		outfile, appendErr = os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0600)
-		if appendErr != nil {
-			c.log.Error("Failed to open CSV file: ", appendErr)
-		}
+	outfile, appendHeader, err := c.openFile(fname)
+	if err != nil {
+		return err
 	}
 
 	defer outfile.Close()
@@ -119,3 +106,61 @@ func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	c.log.Info("Purged ", len(data), " records...")
 	return nil
 }
+
+// WriteUptimeData appends the uptime checks to the hourly uptime-*.csv files
+func (c *CSVPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	c.log.Debug("Attempting to write ", len(data), " uptime records...")
+
+	curtime := time.Now()
+	fname := fmt.Sprintf("uptime-%d-%s-%d-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour())
+	fname = path.Join(c.csvConf.CSVDir, fname)
+
+	outfile, appendHeader, err := c.openFile(fname)
+	if err != nil {
+		return err
+	}
+
+	defer outfile.Close()
+	writer := csv.NewWriter(outfile)
+
+	if appendHeader {
+		startRecord := analytics.UptimeReportData{}
+		if err := writer.Write(startRecord.GetFieldNames()); err != nil {
+			c.log.Error("Failed to write file headers: ", err)
+			return err
+		}
+	}
+
+	for i := range data {
+		if err := writer.Write(data[i].GetLineValues()); err != nil {
+			c.log.Error("File write failed:", err)
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		c.log.Error("File write failed:", err)
+		return err
+	}
+	c.log.Info("Purged ", len(data), " uptime records...")
+	return nil
+}
+
+// openFile opens the file for appending, creating it if needed. It returns true if the headers must be written.
+func (c *CSVPump) openFile(fname string) (*os.File, bool, error) {
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		outfile, createErr := os.Create(fname)
+		if createErr != nil {
+			c.log.Error("Failed to create new CSV file: ", createErr)
+			return nil, false, createErr
+		}
+		return outfile, true, nil
+	}
+
+	outfile, appendErr := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0600)
+	if appendErr != nil {
+		c.log.Error("Failed to open CSV file: ", appendErr)
+		return nil, false, appendErr
+	}
+	return outfile, false, nil
+}
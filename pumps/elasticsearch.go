@@ -2,6 +2,7 @@ package pumps
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/mitchellh/mapstructure"
+	elasticv7 "github.com/olivere/elastic/v7"
 	elasticv3 "gopkg.in/olivere/elastic.v3"
 	elasticv5 "gopkg.in/olivere/elastic.v5"
 	elasticv6 "gopkg.in/olivere/elastic.v6"
@@ -30,6 +32,7 @@ var elasticsearchPrefix = "elasticsearch-pump"
 
 type ElasticsearchConf struct {
 	IndexName          string                  `mapstructure:"index_name"`
+	UptimeIndexName    string                  `mapstructure:"uptime_index_name"`
 	ElasticsearchURL   string                  `mapstructure:"elasticsearch_url"`
 	EnableSniffing     bool                    `mapstructure:"use_sniffing"`
 	DocumentType       string                  `mapstructure:"document_type"`
@@ -44,6 +47,21 @@ type ElasticsearchConf struct {
 	AuthAPIKey         string                  `mapstructure:"auth_api_key"`
 	Username           string                  `mapstructure:"auth_basic_username"`
 	Password           string                  `mapstructure:"auth_basic_password"`
+	// Period of the rolling indexes: hour, day, week or month. Defaults to day
+	RollingIndexPeriod string `mapstructure:"rolling_index_period"`
+	// Install an index template with the mappings of the analytics fields, requires version 7, 8 or opensearch
+	IndexTemplate ElasticsearchTemplateConfig `mapstructure:"index_template"`
+	// Write to the data stream named index_name, requires version 7, 8 or opensearch
+	DataStream bool `mapstructure:"data_stream"`
+	// ILM policy referenced by the index template
+	ILMPolicy string `mapstructure:"ilm_policy"`
+	// File the items which failed and can't be retried are appended to, as JSON lines
+	DeadLetterPath string `mapstructure:"dead_letter_path"`
+	// TLS settings, used when the URL scheme is https
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
 }
 
 type ElasticsearchBulkConfig struct {
@@ -51,33 +69,57 @@ type ElasticsearchBulkConfig struct {
 	FlushInterval int `mapstructure:"flush_interval"`
 	BulkActions   int `mapstructure:"bulk_actions"`
 	BulkSize      int `mapstructure:"bulk_size"`
+	// Number of retries of the items failing with a retryable status (429, 503...). Defaults to 3, -1 disables the retries
+	MaxRetries int `mapstructure:"max_retries"`
+	// Initial delay in milliseconds before retrying a failed item, doubled on each retry. Defaults to 1000
+	RetryBackoff int `mapstructure:"retry_backoff"`
 }
 
 type ElasticsearchOperator interface {
 	processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error
+	// indexDocument adds the document to the bulk, or writes it right away if the bulk is disabled
+	indexDocument(ctx context.Context, indexName, id string, doc map[string]interface{}, esConf *ElasticsearchConf) error
+	// lostItems returns the number of bulk items which failed for good
+	lostItems() uint64
+	// close requeues the pending retries, flushes the bulk and stops the bulk processor
+	close() error
 }
 
 type Elasticsearch3Operator struct {
 	esClient      *elasticv3.Client
 	bulkProcessor *elasticv3.BulkProcessor
+	bulkHandler   *elasticsearchBulkHandler
 	log           *logrus.Entry
 }
 
 type Elasticsearch5Operator struct {
 	esClient      *elasticv5.Client
 	bulkProcessor *elasticv5.BulkProcessor
+	bulkHandler   *elasticsearchBulkHandler
 	log           *logrus.Entry
 }
 
 type Elasticsearch6Operator struct {
 	esClient      *elasticv6.Client
 	bulkProcessor *elasticv6.BulkProcessor
+	bulkHandler   *elasticsearchBulkHandler
+	log           *logrus.Entry
+}
+
+// Elasticsearch7Operator uses the typeless APIs of Elasticsearch 7. It is also used for
+// Elasticsearch 8 and OpenSearch, which reject document types.
+type Elasticsearch7Operator struct {
+	esClient      *elasticv7.Client
+	bulkProcessor *elasticv7.BulkProcessor
+	bulkHandler   *elasticsearchBulkHandler
 	log           *logrus.Entry
 }
 
 type ApiKeyTransport struct {
 	APIKey   string
 	APIKeyID string
+	// Transport used to send the requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
 }
 
 //RoundTrip for ApiKeyTransport auth
@@ -87,20 +129,54 @@ func (t *ApiKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	r.Header.Set("Authorization", "ApiKey "+key)
 
+	if t.Transport != nil {
+		return t.Transport.RoundTrip(r)
+	}
 	return http.DefaultTransport.RoundTrip(r)
 }
 
+func getElasticsearchTLSConfig(conf ElasticsearchConf) (*tls.Config, error) {
+	return getTLSConfig(conf.SSLCAFile, conf.SSLCertFile, conf.SSLKeyFile, conf.SSLInsecureSkipVerify)
+}
+
+func getElasticsearchHTTPClient(conf ElasticsearchConf) (*http.Client, error) {
+	useTLS := conf.SSLCAFile != "" || conf.SSLCertFile != "" || conf.SSLKeyFile != "" || conf.SSLInsecureSkipVerify
+	useAPIKey := conf.AuthAPIKey != "" && conf.AuthAPIKeyID != ""
+	if !useTLS && !useAPIKey {
+		return http.DefaultClient, nil
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if useTLS {
+		tlsConfig, err := getElasticsearchTLSConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+		httpTransport.TLSClientConfig = tlsConfig
+		transport = httpTransport
+	}
+
+	if useAPIKey {
+		transport = &ApiKeyTransport{APIKey: conf.AuthAPIKey, APIKeyID: conf.AuthAPIKeyID, Transport: transport}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
 func (e *ElasticsearchPump) getOperator() (ElasticsearchOperator, error) {
 	conf := *e.esConf
 	var err error
 
 	urls := strings.Split(conf.ElasticsearchURL, ",")
 
-	httpClient := http.DefaultClient
+	httpClient, err := getElasticsearchHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
 	if conf.AuthAPIKey != "" && conf.AuthAPIKeyID != "" {
 		conf.Username = ""
 		conf.Password = ""
-		httpClient = &http.Client{Transport: &ApiKeyTransport{APIKey: conf.AuthAPIKey, APIKeyID: conf.AuthAPIKeyID}}
 	}
 
 	switch conf.Version {
@@ -130,6 +206,13 @@ func (e *ElasticsearchPump) getOperator() (ElasticsearchOperator, error) {
 			p = p.BulkSize(conf.BulkConfig.BulkSize)
 		}
 
+		op.bulkHandler = newElasticsearchBulkHandler(e.log, &conf, func(request bulkableRequest) {
+			op.bulkProcessor.Add(request.(elasticv3.BulkableRequest))
+		})
+		p = p.After(func(executionID int64, requests []elasticv3.BulkableRequest, response *elasticv3.BulkResponse, err error) {
+			op.bulkHandler.handle(bulkResults(requests, response, err))
+		})
+
 		op.bulkProcessor, err = p.Do()
 		op.log = e.log
 		return op, err
@@ -159,6 +242,13 @@ func (e *ElasticsearchPump) getOperator() (ElasticsearchOperator, error) {
 			p = p.BulkSize(conf.BulkConfig.BulkSize)
 		}
 
+		op.bulkHandler = newElasticsearchBulkHandler(e.log, &conf, func(request bulkableRequest) {
+			op.bulkProcessor.Add(request.(elasticv5.BulkableRequest))
+		})
+		p = p.After(func(executionID int64, requests []elasticv5.BulkableRequest, response *elasticv5.BulkResponse, err error) {
+			op.bulkHandler.handle(bulkResults(requests, response, err))
+		})
+
 		op.bulkProcessor, err = p.Do(context.Background())
 		op.log = e.log
 		return op, err
@@ -188,6 +278,62 @@ func (e *ElasticsearchPump) getOperator() (ElasticsearchOperator, error) {
 			p = p.BulkSize(conf.BulkConfig.BulkSize)
 		}
 
+		// The retries of the failed items are handled by the bulk handler
+		p = p.RetryItemStatusCodes()
+
+		op.bulkHandler = newElasticsearchBulkHandler(e.log, &conf, func(request bulkableRequest) {
+			op.bulkProcessor.Add(request.(elasticv6.BulkableRequest))
+		})
+		p = p.After(func(executionID int64, requests []elasticv6.BulkableRequest, response *elasticv6.BulkResponse, err error) {
+			op.bulkHandler.handle(bulkResults(requests, response, err))
+		})
+
+		op.bulkProcessor, err = p.Do(context.Background())
+		op.log = e.log
+		return op, err
+	case "7", "8", "opensearch":
+		op := new(Elasticsearch7Operator)
+
+		op.esClient, err = elasticv7.NewClient(elasticv7.SetURL(urls...), elasticv7.SetSniff(conf.EnableSniffing), elasticv7.SetBasicAuth(conf.Username, conf.Password), elasticv7.SetHttpClient(httpClient))
+
+		if err != nil {
+			return op, err
+		}
+		op.log = e.log
+
+		if conf.IndexTemplate.Enabled || conf.DataStream {
+			if err = op.installTemplate(context.Background(), &conf); err != nil {
+				return op, err
+			}
+		}
+		// Setup a bulk processor
+		p := op.esClient.BulkProcessor().Name("TykPumpESv7BackgroundProcessor")
+		if conf.BulkConfig.Workers != 0 {
+			p = p.Workers(conf.BulkConfig.Workers)
+		}
+
+		if conf.BulkConfig.FlushInterval != 0 {
+			p = p.FlushInterval(time.Duration(conf.BulkConfig.FlushInterval) * time.Second)
+		}
+
+		if conf.BulkConfig.BulkActions != 0 {
+			p = p.BulkActions(conf.BulkConfig.BulkActions)
+		}
+
+		if conf.BulkConfig.BulkSize != 0 {
+			p = p.BulkSize(conf.BulkConfig.BulkSize)
+		}
+
+		// The retries of the failed items are handled by the bulk handler
+		p = p.RetryItemStatusCodes()
+
+		op.bulkHandler = newElasticsearchBulkHandler(e.log, &conf, func(request bulkableRequest) {
+			op.bulkProcessor.Add(request.(elasticv7.BulkableRequest))
+		})
+		p = p.After(func(executionID int64, requests []elasticv7.BulkableRequest, response *elasticv7.BulkResponse, err error) {
+			op.bulkHandler.handle(bulkResults(requests, response, err))
+		})
+
 		op.bulkProcessor, err = p.Do(context.Background())
 		op.log = e.log
 		return op, err
@@ -221,6 +367,10 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 		e.esConf.IndexName = "tyk_analytics"
 	}
 
+	if "" == e.esConf.UptimeIndexName {
+		e.esConf.UptimeIndexName = "tyk_uptime"
+	}
+
 	if "" == e.esConf.ElasticsearchURL {
 		e.esConf.ElasticsearchURL = "http://localhost:9200"
 	}
@@ -233,9 +383,9 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 	case "":
 		e.esConf.Version = "3"
 		log.Info("Version not specified, defaulting to 3. If you are importing to Elasticsearch 5, please specify \"version\" = \"5\"")
-	case "3", "5", "6":
+	case "3", "5", "6", "7", "8", "opensearch":
 	default:
-		err := errors.New("Only 3, 5, 6 are valid values for this field")
+		err := errors.New("Only 3, 5, 6, 7, 8 and opensearch are valid values for this field")
 		e.log.Fatal("Invalid version: ", err)
 	}
 
@@ -244,8 +394,31 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 
 	e.log.Info("Elasticsearch URL: ", printableURL)
 	e.log.Info("Elasticsearch Index: ", e.esConf.IndexName)
-	if e.esConf.RollingIndex {
-		e.log.Info("Index will have date appended to it in the format ", e.esConf.IndexName, "-YYYY.MM.DD")
+	switch e.esConf.RollingIndexPeriod {
+	case "", "day", "hour", "week", "month":
+	default:
+		e.log.Fatal("Invalid rolling_index_period: only hour, day, week and month are valid values for this field")
+	}
+
+	if e.esConf.IndexTemplate.Name == "" {
+		e.esConf.IndexTemplate.Name = defaultElasticsearchTemplateName
+	}
+
+	if e.esConf.IndexTemplate.Enabled || e.esConf.DataStream {
+		switch e.esConf.Version {
+		case "7", "8", "opensearch":
+		default:
+			e.log.Fatal("Index templates and data streams require version 7, 8 or opensearch")
+		}
+		if e.esConf.DataStream && e.esConf.IndexTemplate.Legacy {
+			e.log.Fatal("Data streams require a composable index template, legacy can't be set")
+		}
+	}
+
+	if e.esConf.DataStream {
+		e.log.Info("Data will be written to the data stream ", e.esConf.IndexName)
+	} else if e.esConf.RollingIndex {
+		e.log.Info("Index will have date appended to it in the format ", e.esConf.IndexName, "-", getIndexSuffix(e.esConf.RollingIndexPeriod, time.Now()))
 	}
 
 	e.connect()
@@ -273,24 +446,113 @@ func (e *ElasticsearchPump) WriteData(ctx context.Context, data []interface{}) e
 		e.connect()
 		e.WriteData(ctx, data)
 	} else {
+		// the bulk items are sent in the background, their failures are logged and counted by the bulk handler
 		if len(data) > 0 {
-			e.operator.processData(ctx, data, e.esConf)
+			if err := e.operator.processData(ctx, data, e.esConf); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func getIndexName(esConf *ElasticsearchConf) string {
-	indexName := esConf.IndexName
+// Shutdown sends the pending retries and the buffered bulk items before stopping the bulk processor
+func (e *ElasticsearchPump) Shutdown() error {
+	if e.operator == nil {
+		return nil
+	}
+	// the flush is synchronous, so the items failing from then on are those of the shutdown
+	lost := e.operator.lostItems()
+	if err := e.operator.close(); err != nil {
+		return err
+	}
+	if failures := e.operator.lostItems() - lost; failures > 0 {
+		return fmt.Errorf("%d bulk items failed while flushing", failures)
+	}
+	return nil
+}
+
+// WriteUptimeData indexes the uptime checks in uptime_index_name, which supports the same placeholders and rolling as index_name
+func (e *ElasticsearchPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	e.log.Debug("Attempting to write ", len(data), " uptime records...")
+
+	if e.operator == nil {
+		e.log.Debug("Connecting to analytics store")
+		e.connect()
+	}
+
+	failed := 0
+	for _, record := range data {
+		if ctx.Err() != nil {
+			break
+		}
+
+		mapping, id := getUptimeDocument(record, e.esConf.GenerateID)
+		if err := e.operator.indexDocument(ctx, resolveIndexName(e.esConf, e.esConf.UptimeIndexName, record.OrgID, record.APIID, record.TimeStamp), id, mapping, e.esConf); err != nil {
+			e.log.Error("Error while writing ", record, err)
+			failed++
+		}
+	}
+	e.log.Info("Purged ", len(data), " uptime records...")
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uptime records couldn't be written", failed, len(data))
+	}
+	return ctx.Err()
+}
+
+// getUptimeDocument returns the document of the uptime check, and its id if generateID is set
+func getUptimeDocument(record analytics.UptimeReportData, generateID bool) (map[string]interface{}, string) {
+	mapping := getUptimeMapping(record)
+	delete(mapping, "timestamp")
+	mapping["@timestamp"] = record.TimeStamp
+
+	if generateID {
+		hasher := murmur3.New64()
+		hasher.Write([]byte(fmt.Sprintf("%d%s%s%s", record.TimeStamp.UnixNano(), record.URL, record.APIID, record.OrgID)))
+
+		return mapping, string(hasher.Sum(nil))
+	}
+
+	return mapping, ""
+}
+
+func getIndexName(esConf *ElasticsearchConf, record analytics.AnalyticsRecord) string {
+	return resolveIndexName(esConf, esConf.IndexName, record.OrgID, record.APIID, record.TimeStamp)
+}
 
-	if esConf.RollingIndex {
-		currentTime := time.Now()
-		//This formats the date to be YYYY.MM.DD but Golang makes you use a specific date for its date formatting
-		indexName += "-" + currentTime.Format("2006.01.02")
+// resolveIndexName returns the index of a document from the indexName template, the rolling indexes being
+// the ones of its timestamp so the late records are written in the index of their period
+func resolveIndexName(esConf *ElasticsearchConf, indexName, orgID, apiID string, timestamp time.Time) string {
+	// index names must be lowercase
+	indexName = strings.Replace(indexName, "{org_id}", strings.ToLower(orgID), -1)
+	indexName = strings.Replace(indexName, "{api_id}", strings.ToLower(apiID), -1)
+
+	// data streams handle the rollover themselves
+	if esConf.RollingIndex && !esConf.DataStream {
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		indexName += "-" + getIndexSuffix(esConf.RollingIndexPeriod, timestamp)
 	}
 	return indexName
 }
 
+func getIndexSuffix(period string, currentTime time.Time) string {
+	//This formats the date to be YYYY.MM.DD but Golang makes you use a specific date for its date formatting
+	switch period {
+	case "hour":
+		return currentTime.Format("2006.01.02.15")
+	case "week":
+		year, week := currentTime.ISOWeek()
+		return fmt.Sprintf("%d.w%02d", year, week)
+	case "month":
+		return currentTime.Format("2006.01")
+	default:
+		return currentTime.Format("2006.01.02")
+	}
+}
+
 func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, generateID bool, decodeBase64 bool) (map[string]interface{}, string) {
 	record := datum
 
@@ -324,6 +586,14 @@ func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, genera
 			mapping["raw_response"] = record.RawResponse
 		}
 		mapping["user_agent"] = record.UserAgent
+		if record.UserAgentInfo.DeviceType != "" {
+			mapping["user_agent_browser"] = record.UserAgentInfo.Browser
+			mapping["user_agent_browser_version"] = record.UserAgentInfo.BrowserVersion
+			mapping["user_agent_os"] = record.UserAgentInfo.OS
+			mapping["user_agent_os_version"] = record.UserAgentInfo.OSVersion
+			mapping["user_agent_device"] = record.UserAgentInfo.DeviceType
+			mapping["user_agent_bot"] = record.UserAgentInfo.Bot
+		}
 	}
 
 	if generateID {
@@ -337,7 +607,8 @@ func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, genera
 }
 
 func (e Elasticsearch3Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
+	failed := 0
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
@@ -351,24 +622,30 @@ func (e Elasticsearch3Operator) processData(ctx context.Context, data []interfac
 		}
 
 		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		indexName := getIndexName(esConf, d)
 
 		if !esConf.DisableBulk {
-			r := elasticv3.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv3.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).DoC(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).DoC(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
+				failed++
 			}
 		}
 	}
 	e.log.Info("Purged ", len(data), " records...")
 
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records couldn't be written", failed, len(data))
+	}
 	return nil
 }
 
 func (e Elasticsearch5Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
+	failed := 0
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
@@ -382,24 +659,30 @@ func (e Elasticsearch5Operator) processData(ctx context.Context, data []interfac
 		}
 
 		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		indexName := getIndexName(esConf, d)
 
 		if !esConf.DisableBulk {
-			r := elasticv5.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv5.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
+				failed++
 			}
 		}
 	}
 	e.log.Info("Purged ", len(data), " records...")
 
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records couldn't be written", failed, len(data))
+	}
 	return nil
 }
 
 func (e Elasticsearch6Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
+	failed := 0
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
@@ -413,18 +696,161 @@ func (e Elasticsearch6Operator) processData(ctx context.Context, data []interfac
 		}
 
 		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		indexName := getIndexName(esConf, d)
 
 		if !esConf.DisableBulk {
-			r := elasticv6.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv6.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
+				failed++
 			}
 		}
 	}
 	e.log.Info("Purged ", len(data), " records...")
 
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records couldn't be written", failed, len(data))
+	}
 	return nil
 }
+
+func (e Elasticsearch7Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
+	index := e.esClient.Index()
+	failed := 0
+
+	for dataIndex := range data {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			continue
+		}
+
+		d, ok := data[dataIndex].(analytics.AnalyticsRecord)
+		if !ok {
+			e.log.Error("Error while writing ", data[dataIndex], ": data not of type analytics.AnalyticsRecord")
+			continue
+		}
+
+		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		indexName := getIndexName(esConf, d)
+
+		if !esConf.DisableBulk {
+			// data streams only accept the create operation
+			if esConf.DataStream {
+				e.bulkProcessor.Add(elasticv7.NewBulkCreateRequest().Index(indexName).Id(id).Doc(mapping))
+			} else {
+				e.bulkProcessor.Add(elasticv7.NewBulkIndexRequest().Index(indexName).Id(id).Doc(mapping))
+			}
+		} else {
+			req := index.Index(indexName).BodyJson(mapping).Id(id)
+			if esConf.DataStream {
+				req = req.OpType("create")
+			}
+			_, err := req.Do(ctx)
+			if err != nil {
+				e.log.Error("Error while writing ", data[dataIndex], err)
+				failed++
+			}
+		}
+	}
+	e.log.Info("Purged ", len(data), " records...")
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records couldn't be written", failed, len(data))
+	}
+	return nil
+}
+
+func (e Elasticsearch3Operator) indexDocument(ctx context.Context, indexName, id string, doc map[string]interface{}, esConf *ElasticsearchConf) error {
+	if !esConf.DisableBulk {
+		e.bulkProcessor.Add(elasticv3.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(doc))
+		return nil
+	}
+	_, err := e.esClient.Index().Index(indexName).BodyJson(doc).Type(esConf.DocumentType).Id(id).DoC(ctx)
+	return err
+}
+
+func (e Elasticsearch5Operator) indexDocument(ctx context.Context, indexName, id string, doc map[string]interface{}, esConf *ElasticsearchConf) error {
+	if !esConf.DisableBulk {
+		e.bulkProcessor.Add(elasticv5.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(doc))
+		return nil
+	}
+	_, err := e.esClient.Index().Index(indexName).BodyJson(doc).Type(esConf.DocumentType).Id(id).Do(ctx)
+	return err
+}
+
+func (e Elasticsearch6Operator) indexDocument(ctx context.Context, indexName, id string, doc map[string]interface{}, esConf *ElasticsearchConf) error {
+	if !esConf.DisableBulk {
+		e.bulkProcessor.Add(elasticv6.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(doc))
+		return nil
+	}
+	_, err := e.esClient.Index().Index(indexName).BodyJson(doc).Type(esConf.DocumentType).Id(id).Do(ctx)
+	return err
+}
+
+func (e Elasticsearch7Operator) indexDocument(ctx context.Context, indexName, id string, doc map[string]interface{}, esConf *ElasticsearchConf) error {
+	if !esConf.DisableBulk {
+		// data streams only accept the create operation
+		if esConf.DataStream {
+			e.bulkProcessor.Add(elasticv7.NewBulkCreateRequest().Index(indexName).Id(id).Doc(doc))
+		} else {
+			e.bulkProcessor.Add(elasticv7.NewBulkIndexRequest().Index(indexName).Id(id).Doc(doc))
+		}
+		return nil
+	}
+	req := e.esClient.Index().Index(indexName).BodyJson(doc).Id(id)
+	if esConf.DataStream {
+		req = req.OpType("create")
+	}
+	_, err := req.Do(ctx)
+	return err
+}
+
+func (e Elasticsearch3Operator) lostItems() uint64 {
+	return e.bulkHandler.lostItems()
+}
+
+func (e Elasticsearch3Operator) close() error {
+	e.bulkHandler.drain()
+	if err := e.bulkProcessor.Flush(); err != nil {
+		return err
+	}
+	return e.bulkProcessor.Close()
+}
+
+func (e Elasticsearch5Operator) lostItems() uint64 {
+	return e.bulkHandler.lostItems()
+}
+
+func (e Elasticsearch5Operator) close() error {
+	e.bulkHandler.drain()
+	if err := e.bulkProcessor.Flush(); err != nil {
+		return err
+	}
+	return e.bulkProcessor.Close()
+}
+
+func (e Elasticsearch6Operator) lostItems() uint64 {
+	return e.bulkHandler.lostItems()
+}
+
+func (e Elasticsearch6Operator) close() error {
+	e.bulkHandler.drain()
+	if err := e.bulkProcessor.Flush(); err != nil {
+		return err
+	}
+	return e.bulkProcessor.Close()
+}
+
+func (e Elasticsearch7Operator) lostItems() uint64 {
+	return e.bulkHandler.lostItems()
+}
+
+func (e Elasticsearch7Operator) close() error {
+	e.bulkHandler.drain()
+	if err := e.bulkProcessor.Flush(); err != nil {
+		return err
+	}
+	return e.bulkProcessor.Close()
+}
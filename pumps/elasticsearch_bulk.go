@@ -0,0 +1,304 @@
+package pumps
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/gocraft/health"
+)
+
+const (
+	defaultElasticsearchMaxRetries   = 3
+	defaultElasticsearchRetryBackoff = 1000
+	maxElasticsearchRetryBackoff     = time.Minute
+)
+
+// Status codes of the bulk items which are worth retrying
+var retryableElasticsearchStatuses = map[int]bool{
+	408: true,
+	429: true,
+	502: true,
+	503: true,
+	504: true,
+	507: true,
+}
+
+type bulkableRequest interface {
+	Source() ([]string, error)
+}
+
+// bulkItemResult is the version independent outcome of a bulk item
+type bulkItemResult struct {
+	request   bulkableRequest
+	index     string
+	status    int
+	errorType string
+	reason    string
+}
+
+func (r bulkItemResult) failed() bool {
+	return r.status < 200 || r.status > 299 || r.errorType != ""
+}
+
+func (r bulkItemResult) retryable() bool {
+	// status 0 means the whole bulk request failed, e.g. connection errors
+	return r.status == 0 || retryableElasticsearchStatuses[r.status]
+}
+
+// elasticsearchBulkHandler handles the results of the bulk processors: it logs and counts the failed
+// items, retries the retryable ones with an exponential backoff and writes the others to the dead letter file
+type elasticsearchBulkHandler struct {
+	log          *logrus.Entry
+	maxRetries   int
+	retryBackoff time.Duration
+	retry        func(request bulkableRequest)
+
+	attempts sync.Map
+
+	// pending retries, requeued right away by drain
+	retryMu sync.Mutex
+	retries map[*time.Timer]bulkableRequest
+	drained bool
+
+	deadLetterMu   sync.Mutex
+	deadLetterPath string
+
+	failed       uint64
+	retried      uint64
+	deadLettered uint64
+	// items which failed and won't be retried
+	lost uint64
+}
+
+func newElasticsearchBulkHandler(log *logrus.Entry, conf *ElasticsearchConf, retry func(request bulkableRequest)) *elasticsearchBulkHandler {
+	maxRetries := conf.BulkConfig.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultElasticsearchMaxRetries
+	}
+	retryBackoff := conf.BulkConfig.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultElasticsearchRetryBackoff
+	}
+
+	return &elasticsearchBulkHandler{
+		log:            log,
+		maxRetries:     maxRetries,
+		retryBackoff:   time.Duration(retryBackoff) * time.Millisecond,
+		retry:          retry,
+		retries:        map[*time.Timer]bulkableRequest{},
+		deadLetterPath: conf.DeadLetterPath,
+	}
+}
+
+func (h *elasticsearchBulkHandler) handle(results []bulkItemResult) {
+	var job *health.Job
+	if Instrument != nil {
+		job = Instrument.NewJob("ElasticsearchBulk")
+	}
+
+	for _, result := range results {
+		if !result.failed() {
+			h.attempts.Delete(result.request)
+			continue
+		}
+
+		atomic.AddUint64(&h.failed, 1)
+		if job != nil {
+			job.EventKv("item_failed", health.Kvs{"status": statusLabel(result.status), "type": result.errorType})
+		}
+
+		attempt := 0
+		if value, found := h.attempts.Load(result.request); found {
+			attempt = value.(int)
+		}
+
+		backoff := h.retryBackoff << uint(attempt)
+		if backoff > maxElasticsearchRetryBackoff {
+			backoff = maxElasticsearchRetryBackoff
+		}
+		if result.retryable() && h.maxRetries > 0 && attempt < h.maxRetries && h.scheduleRetry(result.request, backoff) {
+			h.attempts.Store(result.request, attempt+1)
+			atomic.AddUint64(&h.retried, 1)
+			if job != nil {
+				job.Event("item_retried")
+			}
+
+			h.log.WithFields(logrus.Fields{
+				"index":  result.index,
+				"status": result.status,
+				"reason": result.reason,
+			}).Warning("Bulk item failed, retrying in ", backoff)
+			continue
+		}
+
+		h.attempts.Delete(result.request)
+		atomic.AddUint64(&h.lost, 1)
+		h.log.WithFields(logrus.Fields{
+			"index":  result.index,
+			"status": result.status,
+			"type":   result.errorType,
+			"reason": result.reason,
+		}).Error("Bulk item failed")
+
+		if h.deadLetterPath != "" {
+			if err := h.writeDeadLetter(result); err != nil {
+				h.log.WithError(err).Error("Couldn't write the failed item to the dead letter file")
+				continue
+			}
+			atomic.AddUint64(&h.deadLettered, 1)
+			if job != nil {
+				job.Event("item_dead_lettered")
+			}
+		}
+	}
+
+	if job != nil {
+		job.Gauge("items_failed_total", float64(atomic.LoadUint64(&h.failed)))
+		job.Gauge("items_retried_total", float64(atomic.LoadUint64(&h.retried)))
+		job.Gauge("items_dead_lettered_total", float64(atomic.LoadUint64(&h.deadLettered)))
+		job.Gauge("items_lost_total", float64(atomic.LoadUint64(&h.lost)))
+	}
+}
+
+// scheduleRetry retries the request after the backoff, it returns false once the handler is drained
+func (h *elasticsearchBulkHandler) scheduleRetry(request bulkableRequest, backoff time.Duration) bool {
+	h.retryMu.Lock()
+	defer h.retryMu.Unlock()
+	if h.drained {
+		return false
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		h.retryMu.Lock()
+		_, pending := h.retries[timer]
+		delete(h.retries, timer)
+		h.retryMu.Unlock()
+
+		if pending {
+			h.retry(request)
+		}
+	})
+	h.retries[timer] = request
+	return true
+}
+
+// drain requeues the pending retries right away, the failures of the items are final from then on
+func (h *elasticsearchBulkHandler) drain() {
+	h.retryMu.Lock()
+	h.drained = true
+	retries := h.retries
+	h.retries = map[*time.Timer]bulkableRequest{}
+	h.retryMu.Unlock()
+
+	for timer, request := range retries {
+		timer.Stop()
+		h.retry(request)
+	}
+}
+
+// lostItems returns the number of items which failed for good
+func (h *elasticsearchBulkHandler) lostItems() uint64 {
+	return atomic.LoadUint64(&h.lost)
+}
+
+// writeDeadLetter appends the failed item to the dead letter file as a JSON line
+func (h *elasticsearchBulkHandler) writeDeadLetter(result bulkItemResult) error {
+	source, err := result.request.Source()
+	if err != nil {
+		return err
+	}
+
+	var document json.RawMessage
+	if len(source) > 0 {
+		document = json.RawMessage(source[len(source)-1])
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"timestamp": time.Now(),
+		"index":     result.index,
+		"status":    result.status,
+		"type":      result.errorType,
+		"reason":    result.reason,
+		"document":  document,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.deadLetterMu.Lock()
+	defer h.deadLetterMu.Unlock()
+
+	f, err := os.OpenFile(h.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "request_failed"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// bulkResponse is the subset of the bulk responses of every client version the results are read from
+type bulkResponse struct {
+	Items []map[string]struct {
+		Index  string `json:"_index"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulkResults returns the results of the items of a bulk, requests being the slice of bulkable requests
+// and response the bulk response of the client version in use
+func bulkResults(requests interface{}, response interface{}, err error) []bulkItemResult {
+	value := reflect.ValueOf(requests)
+	results := make([]bulkItemResult, value.Len())
+	for i := range results {
+		results[i].request = value.Index(i).Interface().(bulkableRequest)
+	}
+	if err != nil {
+		for i := range results {
+			results[i].reason = err.Error()
+		}
+		return results
+	}
+
+	var decoded bulkResponse
+	if raw, err := json.Marshal(response); err == nil {
+		json.Unmarshal(raw, &decoded)
+	}
+	if decoded.Items == nil {
+		return nil
+	}
+
+	for i := range results {
+		if i >= len(decoded.Items) {
+			break
+		}
+		for _, item := range decoded.Items[i] {
+			results[i].index = item.Index
+			results[i].status = item.Status
+			if item.Error != nil {
+				results[i].errorType = item.Error.Type
+				results[i].reason = item.Error.Reason
+			}
+		}
+	}
+	return results
+}
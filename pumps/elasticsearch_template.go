@@ -0,0 +1,175 @@
+package pumps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	elasticv7 "github.com/olivere/elastic/v7"
+)
+
+const defaultElasticsearchTemplateName = "tyk_analytics"
+
+type ElasticsearchTemplateConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Name of the template. Defaults to tyk_analytics
+	Name string `mapstructure:"name"`
+	// Install a legacy template (_template API) instead of a composable one, for Elasticsearch < 7.8
+	Legacy bool `mapstructure:"legacy"`
+}
+
+// getTemplateMappings returns the mappings of the fields generated by getMapping
+func getTemplateMappings() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	long := map[string]interface{}{"type": "long"}
+	text := map[string]interface{}{"type": "text"}
+
+	return map[string]interface{}{
+		"dynamic": true,
+		"properties": map[string]interface{}{
+			"@timestamp":       map[string]interface{}{"type": "date"},
+			"http_method":      keyword,
+			"request_uri":      keyword,
+			"request_uri_full": keyword,
+			"response_code":    long,
+			// the gateway may send an empty address
+			"ip_address":      map[string]interface{}{"type": "ip", "ignore_malformed": true},
+			"api_key":         keyword,
+			"api_version":     keyword,
+			"api_name":        keyword,
+			"api_id":          keyword,
+			"org_id":          keyword,
+			"oauth_id":        keyword,
+			"request_time_ms": long,
+			"alias":           keyword,
+			"content_length":  long,
+			"tags":            keyword,
+			"raw_request":     text,
+			"raw_response":    text,
+			"user_agent": map[string]interface{}{
+				"type":   "text",
+				"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 512}},
+			},
+			"user_agent_browser":         keyword,
+			"user_agent_browser_version": keyword,
+			"user_agent_os":              keyword,
+			"user_agent_os_version":      keyword,
+			"user_agent_device":          keyword,
+			"user_agent_bot":             map[string]interface{}{"type": "boolean"},
+		},
+	}
+}
+
+// getIndexPattern returns the pattern matching all the indexes the pump writes to
+func getIndexPattern(esConf *ElasticsearchConf) string {
+	pattern := strings.Replace(esConf.IndexName, "{org_id}", "*", -1)
+	pattern = strings.Replace(pattern, "{api_id}", "*", -1)
+	if esConf.RollingIndex && !esConf.DataStream {
+		pattern += "-*"
+	}
+	return pattern
+}
+
+// getIndexTemplate renders the template of the configuration, with the hash of its content in its _meta, the
+// mappings' one for the legacy templates which have none
+func getIndexTemplate(esConf *ElasticsearchConf) (map[string]interface{}, string) {
+	settings := map[string]interface{}{}
+	if esConf.ILMPolicy != "" {
+		settings["index.lifecycle.name"] = esConf.ILMPolicy
+	}
+
+	if esConf.IndexTemplate.Legacy {
+		mappings := getTemplateMappings()
+		template := map[string]interface{}{
+			"index_patterns": []string{getIndexPattern(esConf)},
+			"settings":       settings,
+			"mappings":       mappings,
+		}
+		hash := templateHash(template)
+		mappings["_meta"] = map[string]interface{}{"managed_by": "tyk-pump", "hash": hash}
+		return template, hash
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{getIndexPattern(esConf)},
+		"priority":       200,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": getTemplateMappings(),
+		},
+	}
+	if esConf.DataStream {
+		template["data_stream"] = map[string]interface{}{}
+	}
+	hash := templateHash(template)
+	template["_meta"] = map[string]interface{}{"managed_by": "tyk-pump", "hash": hash}
+	return template, hash
+}
+
+// templateHash returns the SHA-256 of the JSON of the template, whose maps are encoded with sorted keys
+func templateHash(template map[string]interface{}) string {
+	data, _ := json.Marshal(template)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// metaHash returns the hash of the _meta of an installed template, if any
+func metaHash(meta interface{}) string {
+	if meta, ok := meta.(map[string]interface{}); ok {
+		hash, _ := meta["hash"].(string)
+		return hash
+	}
+	return ""
+}
+
+// installTemplate puts the index template unless the installed one has the same hash, so the changes of the
+// mappings and of the configuration (index_name, rolling_index, data_stream, ilm_policy) are applied at startup
+func (e Elasticsearch7Operator) installTemplate(ctx context.Context, esConf *ElasticsearchConf) error {
+	name := esConf.IndexTemplate.Name
+	template, hash := getIndexTemplate(esConf)
+
+	installed, installedHash := false, ""
+	if esConf.IndexTemplate.Legacy {
+		templates, err := e.esClient.IndexGetTemplate(name).Do(ctx)
+		if err != nil && !elasticv7.IsNotFound(err) {
+			return err
+		}
+		if t, found := templates[name]; found {
+			installed, installedHash = true, metaHash(t.Mappings["_meta"])
+		}
+	} else {
+		templates, err := e.esClient.IndexGetIndexTemplate(name).Do(ctx)
+		if err != nil && !elasticv7.IsNotFound(err) {
+			return err
+		}
+		if templates != nil {
+			if t, found := templates.IndexTemplates.ByName(name); found && t.IndexTemplate != nil {
+				installed, installedHash = true, metaHash(t.IndexTemplate.Meta)
+			}
+		}
+	}
+
+	if installedHash == hash {
+		e.log.Debug("Index template ", name, " is up to date")
+		return nil
+	}
+
+	var err error
+	if esConf.IndexTemplate.Legacy {
+		_, err = e.esClient.IndexPutTemplate(name).BodyJson(template).Do(ctx)
+	} else {
+		_, err = e.esClient.IndexPutIndexTemplate(name).BodyJson(template).Do(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if installed {
+		e.log.Warning("Updated index template ", name, " whose mappings or settings changed, the existing indexes keep the previous ones until they roll over")
+	} else {
+		e.log.Info("Installed index template ", name)
+	}
+	return nil
+}
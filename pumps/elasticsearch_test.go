@@ -0,0 +1,510 @@
+package pumps
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	elasticv7 "github.com/olivere/elastic/v7"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// bulkAPIStub is a minimal stand-in for the Elasticsearch/OpenSearch bulk API
+type bulkAPIStub struct {
+	mu            sync.Mutex
+	actions       []map[string]map[string]interface{}
+	documents     []map[string]interface{}
+	authorization string
+	templates     map[string]map[string]interface{}
+	templatePuts  int
+	// itemError returns the status and error type of the item, defaults to 201
+	itemError func(doc map[string]interface{}) (int, string)
+}
+
+func (s *bulkAPIStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authorization = r.Header.Get("Authorization")
+	w.Header().Set("Content-Type", "application/json")
+
+	if strings.HasPrefix(r.URL.Path, "/_index_template/") || strings.HasPrefix(r.URL.Path, "/_template/") {
+		if r.Method != http.MethodPut {
+			template, found := s.templates[r.URL.Path]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"type":"resource_not_found_exception"},"status":404}`))
+				return
+			}
+			name := path.Base(r.URL.Path)
+			if strings.HasPrefix(r.URL.Path, "/_template/") {
+				json.NewEncoder(w).Encode(map[string]interface{}{name: template})
+			} else {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"index_templates": []interface{}{map[string]interface{}{"name": name, "index_template": template}},
+				})
+			}
+			return
+		}
+		if s.templates == nil {
+			s.templates = make(map[string]map[string]interface{})
+		}
+		template := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&template)
+		s.templates[r.URL.Path] = template
+		s.templatePuts++
+		w.Write([]byte(`{"acknowledged":true}`))
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		w.Write([]byte(`{"version":{"number":"8.1.0"}}`))
+		return
+	}
+
+	items := []map[string]interface{}{}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		action := map[string]map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &action)
+		s.actions = append(s.actions, action)
+
+		if !scanner.Scan() {
+			break
+		}
+		doc := map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		s.documents = append(s.documents, doc)
+
+		status, errorType := 201, ""
+		if s.itemError != nil {
+			status, errorType = s.itemError(doc)
+		}
+		for op := range action {
+			item := map[string]interface{}{"status": status}
+			if errorType != "" {
+				item["error"] = map[string]interface{}{"type": errorType, "reason": errorType + " reason"}
+			}
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": s.itemError != nil, "items": items})
+}
+
+func (s *bulkAPIStub) received() ([]map[string]map[string]interface{}, []map[string]interface{}, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.actions, s.documents, s.authorization
+}
+
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	f, err := ioutil.TempFile("", "es-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return f.Name()
+}
+
+func TestElasticsearchPump_TypelessVersions(t *testing.T) {
+	for _, version := range []string{"7", "8", "opensearch"} {
+		t.Run(version, func(t *testing.T) {
+			stub := &bulkAPIStub{}
+			server := httptest.NewTLSServer(stub)
+			defer server.Close()
+
+			caFile := writeCAFile(t, server)
+			defer os.Remove(caFile)
+
+			pmp := &ElasticsearchPump{}
+			err := pmp.Init(map[string]interface{}{
+				"elasticsearch_url": server.URL,
+				"version":           version,
+				"index_name":        "tyk_analytics",
+				"auth_api_key_id":   "id",
+				"auth_api_key":      "key",
+				"ssl_ca_file":       caFile,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []interface{}{
+				analytics.AnalyticsRecord{APIID: "api1", OrgID: "org", ResponseCode: 200, TimeStamp: time.Now()},
+				analytics.AnalyticsRecord{APIID: "api2", OrgID: "org", ResponseCode: 500, TimeStamp: time.Now()},
+			}
+			if err := pmp.WriteData(context.Background(), records); err != nil {
+				t.Fatal(err)
+			}
+			if err := pmp.operator.(*Elasticsearch7Operator).bulkProcessor.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			actions, documents, authorization := stub.received()
+			if len(actions) != 2 || len(documents) != 2 {
+				t.Fatalf("expected 2 bulk actions, got %d", len(actions))
+			}
+			for _, action := range actions {
+				meta := action["index"]
+				if meta == nil || meta["_index"] != "tyk_analytics" {
+					t.Errorf("unexpected bulk action %v", action)
+				}
+				if _, found := meta["_type"]; found {
+					t.Errorf("expected a typeless bulk action, got %v", action)
+				}
+			}
+			if documents[0]["api_id"] != "api1" {
+				t.Errorf("unexpected document %v", documents[0])
+			}
+			if authorization != "ApiKey aWQ6a2V5" {
+				t.Errorf("expected the API key authorization, got %q", authorization)
+			}
+		})
+	}
+}
+
+func TestGetElasticsearchHTTPClient(t *testing.T) {
+	client, err := getElasticsearchHTTPClient(ElasticsearchConf{})
+	if err != nil || client != http.DefaultClient {
+		t.Errorf("expected the default client without TLS nor API key, got %v %v", client, err)
+	}
+
+	if _, err := getElasticsearchHTTPClient(ElasticsearchConf{SSLCAFile: "/does/not/exist.pem"}); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
+
+func TestElasticsearchPump_DataStream(t *testing.T) {
+	stub := &bulkAPIStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	pmp := &ElasticsearchPump{}
+	err := pmp.Init(map[string]interface{}{
+		"elasticsearch_url": server.URL,
+		"version":           "8",
+		"index_name":        "logs-tyk-{org_id}",
+		"data_stream":       true,
+		"ilm_policy":        "tyk-analytics-policy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := stub.templates["/_index_template/tyk_analytics"]
+	if template == nil {
+		t.Fatalf("expected the composable template to be installed, got %v", stub.templates)
+	}
+	if patterns := template["index_patterns"].([]interface{}); len(patterns) != 1 || patterns[0] != "logs-tyk-*" {
+		t.Errorf("unexpected index patterns %v", patterns)
+	}
+	if _, found := template["data_stream"]; !found {
+		t.Errorf("expected a data stream template, got %v", template)
+	}
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	if settings["index.lifecycle.name"] != "tyk-analytics-policy" {
+		t.Errorf("expected the ILM policy in the settings, got %v", settings)
+	}
+
+	records := []interface{}{analytics.AnalyticsRecord{APIID: "api1", OrgID: "Org1", ResponseCode: 200, TimeStamp: time.Now()}}
+	if err := pmp.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.operator.(*Elasticsearch7Operator).bulkProcessor.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, _, _ := stub.received()
+	if len(actions) != 1 || actions[0]["create"] == nil || actions[0]["create"]["_index"] != "logs-tyk-org1" {
+		t.Errorf("expected a create action on the data stream, got %v", actions)
+	}
+}
+
+func TestElasticsearchPump_TemplateUpdate(t *testing.T) {
+	stub := &bulkAPIStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	for _, legacy := range []bool{false, true} {
+		stub.templatePuts = 0
+		for _, policy := range []string{"policy1", "policy1", "policy2"} {
+			pmp := &ElasticsearchPump{}
+			err := pmp.Init(map[string]interface{}{
+				"elasticsearch_url": server.URL,
+				"version":           "7",
+				"ilm_policy":        policy,
+				"index_template":    map[string]interface{}{"enabled": true, "legacy": legacy},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the template is only put again when the configuration changed
+		if stub.templatePuts != 2 {
+			t.Errorf("legacy %v: expected 2 template puts, got %d", legacy, stub.templatePuts)
+		}
+	}
+
+	settings := stub.templates["/_template/tyk_analytics"]["settings"].(map[string]interface{})
+	if settings["index.lifecycle.name"] != "policy2" {
+		t.Errorf("expected the updated ILM policy, got %v", settings)
+	}
+}
+
+func TestGetIndexName(t *testing.T) {
+	// a late record is written in the index of its timestamp
+	now := time.Date(2021, 5, 31, 23, 59, 0, 0, time.UTC)
+	record := analytics.AnalyticsRecord{OrgID: "Org1", APIID: "api1", TimeStamp: now}
+
+	tcs := []struct {
+		testName string
+		conf     ElasticsearchConf
+		expected string
+	}{
+		{"static", ElasticsearchConf{IndexName: "tyk_analytics"}, "tyk_analytics"},
+		{"per org and api", ElasticsearchConf{IndexName: "tyk-{org_id}-{api_id}"}, "tyk-org1-api1"},
+		{"daily", ElasticsearchConf{IndexName: "tyk", RollingIndex: true}, "tyk-" + now.Format("2006.01.02")},
+		{"hourly", ElasticsearchConf{IndexName: "tyk", RollingIndex: true, RollingIndexPeriod: "hour"}, "tyk-" + now.Format("2006.01.02.15")},
+		{"monthly", ElasticsearchConf{IndexName: "tyk", RollingIndex: true, RollingIndexPeriod: "month"}, "tyk-" + now.Format("2006.01")},
+		{"data stream", ElasticsearchConf{IndexName: "logs-tyk", RollingIndex: true, DataStream: true}, "logs-tyk"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			if got := getIndexName(&tc.conf, record); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+
+	if got := getIndexSuffix("week", time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)); got != "2020.w53" {
+		t.Errorf("expected the ISO week, got %s", got)
+	}
+}
+
+func TestElasticsearchPump_BulkFailures(t *testing.T) {
+	busyAttempts := 0
+	stub := &bulkAPIStub{
+		itemError: func(doc map[string]interface{}) (int, string) {
+			switch doc["api_id"] {
+			case "conflict":
+				return 400, "mapper_parsing_exception"
+			case "busy":
+				busyAttempts++
+				if busyAttempts == 1 {
+					return 429, "es_rejected_execution_exception"
+				}
+			}
+			return 201, ""
+		},
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	deadLetter, err := ioutil.TempFile("", "es-dead-letter-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetter.Close()
+	defer os.Remove(deadLetter.Name())
+
+	pmp := &ElasticsearchPump{}
+	err = pmp.Init(map[string]interface{}{
+		"elasticsearch_url": server.URL,
+		"version":           "7",
+		"dead_letter_path":  deadLetter.Name(),
+		"bulk_config": map[string]interface{}{
+			"max_retries":   2,
+			"retry_backoff": 10,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := pmp.operator.(*Elasticsearch7Operator)
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "ok", OrgID: "org", TimeStamp: time.Now()},
+		analytics.AnalyticsRecord{APIID: "conflict", OrgID: "org", TimeStamp: time.Now()},
+		analytics.AnalyticsRecord{APIID: "busy", OrgID: "org", TimeStamp: time.Now()},
+	}
+	if err := pmp.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.bulkProcessor.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the retry of the rejected item
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		time.Sleep(20 * time.Millisecond)
+		op.bulkProcessor.Flush()
+		_, documents, _ := stub.received()
+		if len(documents) == 4 || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	_, documents, _ := stub.received()
+	if len(documents) != 4 {
+		t.Fatalf("expected the rejected item to be retried once, got %d documents", len(documents))
+	}
+	if failed, retried, deadLettered := atomic.LoadUint64(&op.bulkHandler.failed), atomic.LoadUint64(&op.bulkHandler.retried), atomic.LoadUint64(&op.bulkHandler.deadLettered); failed != 2 || retried != 1 || deadLettered != 1 {
+		t.Errorf("expected 2 failed, 1 retried and 1 dead lettered items, got %d, %d and %d", failed, retried, deadLettered)
+	}
+	// the failures of the background bulks aren't errors of the next purges
+	if lost := op.lostItems(); lost != 1 {
+		t.Errorf("expected 1 lost item, got %d", lost)
+	}
+	if err := pmp.WriteData(context.Background(), nil); err != nil {
+		t.Errorf("expected the failures not to be reported to the next purge, got %v", err)
+	}
+
+	content, err := ioutil.ReadFile(deadLetter.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 dead letter, got %q", content)
+	}
+	line := struct {
+		Status   int                    `json:"status"`
+		Type     string                 `json:"type"`
+		Document map[string]interface{} `json:"document"`
+	}{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Status != 400 || line.Type != "mapper_parsing_exception" || line.Document["api_id"] != "conflict" {
+		t.Errorf("unexpected dead letter %+v", line)
+	}
+}
+
+func TestElasticsearchPump_Shutdown(t *testing.T) {
+	stub := &bulkAPIStub{itemError: func(doc map[string]interface{}) (int, string) {
+		if doc["api_id"] == "invalid" {
+			return 400, "mapper_parsing_exception"
+		}
+		return 201, ""
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	pmp := &ElasticsearchPump{}
+	if err := pmp.Init(map[string]interface{}{"elasticsearch_url": server.URL, "version": "7"}); err != nil {
+		t.Fatal(err)
+	}
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "ok", OrgID: "org", TimeStamp: time.Now()},
+		analytics.AnalyticsRecord{APIID: "invalid", OrgID: "org", TimeStamp: time.Now()},
+	}
+	if err := pmp.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	// the items are flushed by the shutdown, which reports their failures
+	if err := pmp.Shutdown(); err == nil || !strings.Contains(err.Error(), "1 bulk items failed") {
+		t.Errorf("expected the failed item to be reported, got %v", err)
+	}
+	if _, documents, _ := stub.received(); len(documents) != 2 {
+		t.Errorf("expected the 2 documents to be flushed, got %d", len(documents))
+	}
+}
+
+func TestElasticsearchBulkHandler_RequestFailure(t *testing.T) {
+	retried := 0
+	handler := newElasticsearchBulkHandler(log.WithField("prefix", elasticsearchPrefix), &ElasticsearchConf{BulkConfig: ElasticsearchBulkConfig{MaxRetries: -1}}, func(bulkableRequest) {
+		retried++
+	})
+
+	request := elasticv7.NewBulkIndexRequest().Index("tyk_analytics").Doc(map[string]interface{}{"api_id": "api"})
+	handler.handle(bulkResults([]elasticv7.BulkableRequest{request}, nil, errors.New("connection refused")))
+
+	if handler.failed != 1 || handler.retried != 0 || retried != 0 {
+		t.Errorf("expected 1 failed item without retries, got %d failed and %d retried", handler.failed, handler.retried)
+	}
+}
+
+func TestElasticsearchBulkHandler_Drain(t *testing.T) {
+	var mu sync.Mutex
+	retried := 0
+	handler := newElasticsearchBulkHandler(log.WithField("prefix", elasticsearchPrefix), &ElasticsearchConf{BulkConfig: ElasticsearchBulkConfig{RetryBackoff: int(time.Hour / time.Millisecond)}}, func(bulkableRequest) {
+		mu.Lock()
+		retried++
+		mu.Unlock()
+	})
+
+	request := elasticv7.NewBulkIndexRequest().Index("tyk_analytics").Doc(map[string]interface{}{"api_id": "api"})
+	handler.handle(bulkResults([]elasticv7.BulkableRequest{request}, nil, errors.New("connection refused")))
+	handler.drain()
+
+	mu.Lock()
+	if retried != 1 {
+		t.Errorf("expected the pending retry to be sent on drain, got %d retries", retried)
+	}
+	mu.Unlock()
+
+	// once drained, the failures are final
+	handler.handle(bulkResults([]elasticv7.BulkableRequest{request}, nil, errors.New("connection refused")))
+	if len(handler.retries) != 0 || handler.lostItems() != 1 {
+		t.Errorf("expected the failure after the drain not to be retried")
+	}
+}
+
+func TestElasticsearchPump_WriteUptimeData(t *testing.T) {
+	stub := &bulkAPIStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	pmp := &ElasticsearchPump{}
+	err := pmp.Init(map[string]interface{}{
+		"elasticsearch_url": server.URL,
+		"version":           "7",
+		"index_name":        "tyk_analytics_{org_id}",
+		"uptime_index_name": "tyk_uptime_{org_id}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []analytics.UptimeReportData{
+		{URL: "http://upstream/health", APIID: "api1", OrgID: "Org1", ResponseCode: 200, RequestTime: 12, TimeStamp: time.Now()},
+		{URL: "http://upstream/health", APIID: "api1", OrgID: "Org1", TCPError: true, TimeStamp: time.Now()},
+	}
+	if err := pmp.WriteUptimeData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if err := pmp.operator.(*Elasticsearch7Operator).bulkProcessor.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, documents, _ := stub.received()
+	if len(actions) != 2 || actions[0]["index"]["_index"] != "tyk_uptime_org1" {
+		t.Fatalf("unexpected bulk actions %v", actions)
+	}
+	if documents[0]["up"] != true || documents[1]["up"] != false || documents[0]["request_time_ms"] != 12.0 {
+		t.Errorf("unexpected documents %v", documents)
+	}
+	if _, found := documents[0]["@timestamp"]; !found {
+		t.Errorf("expected the @timestamp of the check, got %v", documents[0])
+	}
+}
@@ -44,6 +44,8 @@ type HybridPump struct {
 	trackAllPaths          bool
 	storeAnalyticPerMinute bool
 	ignoreTagPrefixList    []string
+	// dimensions whose counters keep a latency sketch besides the total
+	latencySketchDimensions []string
 	CommonPumpConfig
 	rpcConfig rpc.Config
 }
@@ -119,6 +121,17 @@ func (p *HybridPump) Init(config interface{}) error {
 			}
 		}
 
+		if list, ok := meta["latency_sketch_dimensions"]; ok {
+			dimensions, ok := list.([]interface{})
+			if !ok {
+				return fmt.Errorf("latency_sketch_dimensions must be a list of dimensions, got %v", list)
+			}
+			p.latencySketchDimensions = make([]string, len(dimensions))
+			for k, v := range dimensions {
+				p.latencySketchDimensions[k] = fmt.Sprint(v)
+			}
+		}
+
 	}
 
 	return nil
@@ -178,7 +191,7 @@ func (p *HybridPump) WriteData(ctx context.Context, data []interface{}) error {
 		}
 	} else { // send aggregated data
 		// calculate aggregates
-		aggregates := analytics.AggregateData(data, p.trackAllPaths, p.ignoreTagPrefixList, p.storeAnalyticPerMinute)
+		aggregates := analytics.AggregateDataWithLatencySketches(data, p.trackAllPaths, p.ignoreTagPrefixList, p.storeAnalyticPerMinute, p.latencySketchDimensions)
 
 		// turn map with analytics aggregates into JSON payload
 		jsonData, err := json.Marshal(aggregates)
@@ -29,4 +29,10 @@ func init() {
 	AvailablePumps["syslog"] = &SyslogPump{}
 	AvailablePumps["cloudlog"] = &CloudLogPump{}
 	AvailablePumps["cloudloguser"] = &CloudLogUserPump{}
+	AvailablePumps["webhook"] = &WebhookPump{}
+	AvailablePumps["sql"] = &SQLPump{}
+	AvailablePumps["sql-aggregate"] = &SQLAggregatePump{}
+	AvailablePumps["clickhouse"] = &ClickHousePump{}
+	AvailablePumps["loki"] = &LokiPump{}
+	AvailablePumps["s3"] = &S3Pump{}
 }
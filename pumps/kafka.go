@@ -2,25 +2,40 @@ package pumps
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
 	"github.com/mitchellh/mapstructure"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/gzip"
+	"github.com/segmentio/kafka-go/lz4"
 	"github.com/segmentio/kafka-go/sasl"
 	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/segmentio/kafka-go/sasl/scram"
-
 	"github.com/segmentio/kafka-go/snappy"
+	"github.com/segmentio/kafka-go/zstd"
 )
 
 type KafkaPump struct {
 	kafkaConf    *KafkaConf
 	writerConfig kafka.WriterConfig
-	log          *logrus.Entry
+	// writers are long-lived and shared by all the purges, one per topic
+	writers   map[string]*kafka.Writer
+	writersMu sync.Mutex
+	// encoder is nil when the messages are sent in the legacy JSON format
+	encoder *serializer.Encoder
+	log     *logrus.Entry
 	CommonPumpConfig
 }
 
@@ -28,6 +43,15 @@ type Json map[string]interface{}
 
 var kafkaPrefix = "kafka-pump"
 
+// kafkaSchemaVersion is sent in the schema_version header, bump it whenever the message format changes
+const kafkaSchemaVersion = "1"
+
+var (
+	kafkaTopicPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+	// characters not allowed in Kafka topic names
+	kafkaInvalidTopicChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+)
+
 type KafkaConf struct {
 	Broker                []string          `mapstructure:"broker"`
 	ClientId              string            `mapstructure:"client_id"`
@@ -43,6 +67,24 @@ type KafkaConf struct {
 	Username              string            `mapstructure:"sasl_username"`
 	Password              string            `mapstructure:"sasl_password"`
 	Algorithm             string            `mapstructure:"sasl_algorithm"`
+	// Fields of the message used to build the message key, joined with ":". E.g. ["org_id", "api_id"]
+	KeyFields []string `mapstructure:"key_fields"`
+	// Partitioning strategy: least_bytes (default), hash, murmur2, crc32 or round_robin
+	Balancer string `mapstructure:"balancer"`
+	// Compression codec: snappy, lz4, zstd or gzip. compressed is an alias of snappy
+	Compression string `mapstructure:"compression"`
+	// Maximum number of messages buffered before being sent to a partition. Defaults to 100
+	BatchSize int `mapstructure:"batch_size"`
+	// Maximum size in bytes of a request sent to a partition. Defaults to 1048576
+	BatchBytes int `mapstructure:"batch_bytes"`
+	// Time in milliseconds incomplete batches are buffered before being sent. Defaults to 1000
+	BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+	// Acknowledges required from the partition replicas: all (default), one or none
+	RequiredAcks string `mapstructure:"required_acks"`
+	// Maximum number of attempts to deliver a message. Defaults to 10
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Send the messages in one of the canonical formats (json, avro or protobuf) instead of the legacy JSON format
+	Serialization serializer.Config `mapstructure:"serialization"`
 }
 
 func (k *KafkaPump) New() Pump {
@@ -121,16 +163,47 @@ func (k *KafkaPump) Init(config interface{}) error {
 
 	k.writerConfig.Brokers = k.kafkaConf.Broker
 	k.writerConfig.Topic = k.kafkaConf.Topic
-	k.writerConfig.Balancer = &kafka.LeastBytes{}
+	if err = k.writerConfig.Validate(); err != nil {
+		return err
+	}
+	k.writerConfig.Balancer, err = getKafkaBalancer(k.kafkaConf.Balancer)
+	if err != nil {
+		return err
+	}
 	k.writerConfig.Dialer = dialer
 	k.writerConfig.WriteTimeout = k.kafkaConf.Timeout * time.Second
 	k.writerConfig.ReadTimeout = k.kafkaConf.Timeout * time.Second
-	if k.kafkaConf.Compressed {
-		k.writerConfig.CompressionCodec = snappy.NewCompressionCodec()
+	k.writerConfig.BatchSize = k.kafkaConf.BatchSize
+	k.writerConfig.BatchBytes = k.kafkaConf.BatchBytes
+	k.writerConfig.BatchTimeout = k.kafkaConf.BatchTimeout * time.Millisecond
+	k.writerConfig.MaxAttempts = k.kafkaConf.MaxAttempts
+	k.writerConfig.RequiredAcks, err = getKafkaRequiredAcks(k.kafkaConf.RequiredAcks)
+	if err != nil {
+		return err
+	}
+	compression := k.kafkaConf.Compression
+	if compression == "" && k.kafkaConf.Compressed {
+		compression = "snappy"
+	}
+	k.writerConfig.CompressionCodec, err = getKafkaCompressionCodec(compression)
+	if err != nil {
+		return err
+	}
+
+	if k.kafkaConf.Serialization.Format != "" {
+		k.encoder, err = serializer.NewEncoder(k.kafkaConf.Serialization)
+		if err != nil {
+			return err
+		}
 	}
 
 	k.log.Debug("Kafka config: ", k.writerConfig)
 
+	k.writers = make(map[string]*kafka.Writer)
+	if !kafkaTopicPlaceholder.MatchString(k.kafkaConf.Topic) {
+		k.getWriter(k.kafkaConf.Topic)
+	}
+
 	k.log.Info(k.GetName() + " Initialized")
 
 	return nil
@@ -139,8 +212,8 @@ func (k *KafkaPump) Init(config interface{}) error {
 func (k *KafkaPump) WriteData(ctx context.Context, data []interface{}) error {
 	startTime := time.Now()
 	k.log.Debug("Attempting to write ", len(data), " records...")
-	kafkaMessages := make([]kafka.Message, len(data))
-	for i, v := range data {
+	kafkaMessages := make(map[string][]kafka.Message)
+	for _, v := range data {
 		//Build message format
 		decoded := v.(analytics.AnalyticsRecord)
 		message := Json{
@@ -164,35 +237,245 @@ func (k *KafkaPump) WriteData(ctx context.Context, data []interface{}) error {
 			"content_length":  decoded.ContentLength,
 			"user_agent":      decoded.UserAgent,
 		}
+		if decoded.UserAgentInfo.DeviceType != "" {
+			message["user_agent_browser"] = decoded.UserAgentInfo.Browser
+			message["user_agent_browser_version"] = decoded.UserAgentInfo.BrowserVersion
+			message["user_agent_os"] = decoded.UserAgentInfo.OS
+			message["user_agent_os_version"] = decoded.UserAgentInfo.OSVersion
+			message["user_agent_device"] = decoded.UserAgentInfo.DeviceType
+			message["user_agent_bot"] = decoded.UserAgentInfo.Bot
+		}
 		//Add static metadata to json
 		for key, value := range k.kafkaConf.MetaData {
 			message[key] = value
 		}
 
-		//Transform object to json string
-		json, jsonError := json.Marshal(message)
-		if jsonError != nil {
-			k.log.WithError(jsonError).Error("unable to marshal message")
+		topic := getKafkaTopic(k.kafkaConf.Topic, message)
+		if topic == "" {
+			k.log.WithField("topic", k.kafkaConf.Topic).Error("unable to resolve the topic of the message")
+			continue
 		}
 
-		//Kafka message structure
-		kafkaMessages[i] = kafka.Message{
-			Time:  time.Now(),
-			Value: json,
+		headers := []kafka.Header{
+			{Key: "org_id", Value: []byte(decoded.OrgID)},
+			{Key: "api_id", Value: []byte(decoded.APIID)},
+		}
+
+		var value []byte
+		if k.encoder != nil {
+			var encodeError error
+			value, encodeError = k.encoder.Encode(ctx, topic+"-value", decoded)
+			if encodeError != nil {
+				k.log.WithError(encodeError).Error("unable to encode message")
+				continue
+			}
+			headers = append(headers,
+				kafka.Header{Key: "schema_version", Value: []byte(strconv.Itoa(serializer.SchemaVersion))},
+				kafka.Header{Key: "format", Value: []byte(k.encoder.Serializer().Format())},
+			)
+		} else {
+			//Transform object to json string
+			json, jsonError := json.Marshal(message)
+			if jsonError != nil {
+				k.log.WithError(jsonError).Error("unable to marshal message")
+				continue
+			}
+			value = json
+			headers = append(headers, kafka.Header{Key: "schema_version", Value: []byte(kafkaSchemaVersion)})
 		}
+		headers = append(headers, kafka.Header{Key: "message_id", Value: getKafkaMessageID(value)})
+
+		//Kafka message structure
+		kafkaMessages[topic] = append(kafkaMessages[topic], kafka.Message{
+			Key:     getKafkaKey(k.kafkaConf.KeyFields, message),
+			Value:   value,
+			Time:    decoded.TimeStamp,
+			Headers: headers,
+		})
 	}
 	//Send kafka message
-	kafkaError := k.write(ctx, kafkaMessages)
-	if kafkaError != nil {
-		k.log.WithError(kafkaError).Error("unable to write message")
+	var writeErr error
+	for topic, messages := range kafkaMessages {
+		kafkaError := k.getWriter(topic).WriteMessages(ctx, messages...)
+		if kafkaError != nil {
+			k.log.WithError(kafkaError).WithField("topic", topic).Error("unable to write message")
+			writeErr = kafkaError
+		}
+	}
+	if writeErr != nil {
+		return writeErr
 	}
 	k.log.Debug("ElapsedTime in seconds for ", len(data), " records:", time.Now().Sub(startTime))
 	k.log.Info("Purged ", len(data), " records...")
 	return nil
 }
 
-func (k *KafkaPump) write(ctx context.Context, messages []kafka.Message) error {
-	kafkaWriter := kafka.NewWriter(k.writerConfig)
-	defer kafkaWriter.Close()
-	return kafkaWriter.WriteMessages(ctx, messages...)
+// WriteUptimeData sends the uptime checks to the topic in the legacy JSON format, the serialization only applying to the analytics records
+func (k *KafkaPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	k.log.Debug("Attempting to write ", len(data), " uptime records...")
+	kafkaMessages := make(map[string][]kafka.Message)
+	for _, record := range data {
+		message := Json(getUptimeMapping(record))
+		for key, value := range k.kafkaConf.MetaData {
+			message[key] = value
+		}
+
+		topic := getKafkaTopic(k.kafkaConf.Topic, message)
+		if topic == "" {
+			k.log.WithField("topic", k.kafkaConf.Topic).Error("unable to resolve the topic of the message")
+			continue
+		}
+
+		value, err := json.Marshal(message)
+		if err != nil {
+			k.log.WithError(err).Error("unable to marshal message")
+			continue
+		}
+
+		kafkaMessages[topic] = append(kafkaMessages[topic], kafka.Message{
+			Key:   getKafkaKey(k.kafkaConf.KeyFields, message),
+			Value: value,
+			Time:  record.TimeStamp,
+			Headers: []kafka.Header{
+				{Key: "org_id", Value: []byte(record.OrgID)},
+				{Key: "api_id", Value: []byte(record.APIID)},
+				{Key: "schema_version", Value: []byte(kafkaSchemaVersion)},
+				{Key: "message_id", Value: getKafkaMessageID(value)},
+			},
+		})
+	}
+
+	var writeErr error
+	for topic, messages := range kafkaMessages {
+		if err := k.getWriter(topic).WriteMessages(ctx, messages...); err != nil {
+			k.log.WithError(err).WithField("topic", topic).Error("unable to write message")
+			writeErr = err
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	k.log.Info("Purged ", len(data), " uptime records...")
+	return nil
+}
+
+// getWriter returns the writer of the topic, creating it on first use
+func (k *KafkaPump) getWriter(topic string) *kafka.Writer {
+	k.writersMu.Lock()
+	defer k.writersMu.Unlock()
+
+	writer, found := k.writers[topic]
+	if !found {
+		writerConfig := k.writerConfig
+		writerConfig.Topic = topic
+		writer = kafka.NewWriter(writerConfig)
+		k.writers[topic] = writer
+	}
+	return writer
+}
+
+// Shutdown flushes and closes the writers of every topic
+func (k *KafkaPump) Shutdown() error {
+	k.writersMu.Lock()
+	defer k.writersMu.Unlock()
+
+	var closeErr error
+	for topic, writer := range k.writers {
+		if err := writer.Close(); err != nil {
+			k.log.WithError(err).WithField("topic", topic).Error("unable to close the writer")
+			closeErr = err
+		}
+		delete(k.writers, topic)
+	}
+	return closeErr
+}
+
+func getKafkaBalancer(name string) (kafka.Balancer, error) {
+	switch name {
+	case "", "least_bytes":
+		return &kafka.LeastBytes{}, nil
+	case "hash":
+		return &kafka.Hash{}, nil
+	case "murmur2":
+		// compatible with the default partitioner of the Java client
+		return kafka.Murmur2Balancer{}, nil
+	case "crc32":
+		return kafka.CRC32Balancer{}, nil
+	case "round_robin":
+		return &kafka.RoundRobin{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported balancer %q, must be one of least_bytes, hash, murmur2, crc32 or round_robin", name)
+	}
+}
+
+func getKafkaRequiredAcks(acks string) (int, error) {
+	switch acks {
+	case "", "all":
+		return -1, nil
+	case "one":
+		return 1, nil
+	case "none":
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("unsupported required_acks %q, must be one of all, one or none", acks)
+	}
+}
+
+func getKafkaCompressionCodec(name string) (kafka.CompressionCodec, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "snappy":
+		return snappy.NewCompressionCodec(), nil
+	case "lz4":
+		return lz4.NewCompressionCodec(), nil
+	case "zstd":
+		return zstd.NewCompressionCodec(), nil
+	case "gzip":
+		return gzip.NewCompressionCodec(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q, must be one of snappy, lz4, zstd or gzip", name)
+	}
+}
+
+// getKafkaMessageID returns an identifier derived from the message value, so the consumers can
+// discard the duplicates produced when a write is retried
+func getKafkaMessageID(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return []byte(hex.EncodeToString(sum[:16]))
+}
+
+// getKafkaKey builds the message key joining the values of the given fields with ":".
+// It returns a nil key when no fields are configured, so the balancers fall back to their keyless strategy.
+func getKafkaKey(fields []string, message Json) []byte {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		if value, found := message[field]; found && value != nil {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return []byte(strings.Join(values, ":"))
+}
+
+// getKafkaTopic replaces the {field} placeholders of the topic with the values of the message fields,
+// e.g. "tyk-analytics-{org_id}" routes the messages of each organisation to their own topic.
+// It returns an empty topic when a placeholder has no value, rather than a topic shared by those messages
+func getKafkaTopic(topic string, message Json) string {
+	resolved := true
+	topic = kafkaTopicPlaceholder.ReplaceAllStringFunc(topic, func(placeholder string) string {
+		value, found := message[placeholder[1:len(placeholder)-1]]
+		if !found || value == nil || fmt.Sprint(value) == "" {
+			resolved = false
+			return ""
+		}
+		return kafkaInvalidTopicChars.ReplaceAllString(fmt.Sprint(value), "_")
+	})
+	if !resolved {
+		return ""
+	}
+	return topic
 }
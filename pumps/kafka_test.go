@@ -0,0 +1,198 @@
+package pumps
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestGetKafkaBalancer(t *testing.T) {
+	tcs := []struct {
+		testName    string
+		balancer    string
+		expected    kafka.Balancer
+		expectedErr bool
+	}{
+		{"default", "", &kafka.LeastBytes{}, false},
+		{"least bytes", "least_bytes", &kafka.LeastBytes{}, false},
+		{"hash", "hash", &kafka.Hash{}, false},
+		{"murmur2", "murmur2", kafka.Murmur2Balancer{}, false},
+		{"crc32", "crc32", kafka.CRC32Balancer{}, false},
+		{"round robin", "round_robin", &kafka.RoundRobin{}, false},
+		{"unknown", "random", nil, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			balancer, err := getKafkaBalancer(tc.balancer)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err == nil && fmt.Sprintf("%T", balancer) != fmt.Sprintf("%T", tc.expected) {
+				t.Fatalf("expected balancer %T, got %T", tc.expected, balancer)
+			}
+		})
+	}
+}
+
+func TestGetKafkaKey(t *testing.T) {
+	message := Json{
+		"org_id":        "ORG123",
+		"api_id":        "API123",
+		"response_code": 200,
+	}
+
+	tcs := []struct {
+		testName string
+		fields   []string
+		expected []byte
+	}{
+		{"no fields", nil, nil},
+		{"single field", []string{"api_id"}, []byte("API123")},
+		{"combined fields", []string{"org_id", "api_id", "response_code"}, []byte("ORG123:API123:200")},
+		{"missing field", []string{"org_id", "oauth_id"}, []byte("ORG123:")},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			key := getKafkaKey(tc.fields, message)
+			if string(key) != string(tc.expected) || (key == nil) != (tc.expected == nil) {
+				t.Fatalf("expected key %q, got %q", tc.expected, key)
+			}
+		})
+	}
+}
+
+func TestGetKafkaTopic(t *testing.T) {
+	message := Json{
+		"org_id": "ORG123",
+		"api_id": "my api/v1",
+		"alias":  "",
+	}
+
+	tcs := []struct {
+		testName string
+		topic    string
+		expected string
+	}{
+		{"static", "tyk-analytics", "tyk-analytics"},
+		{"per org", "tyk-analytics-{org_id}", "tyk-analytics-ORG123"},
+		{"sanitized", "{org_id}.{api_id}", "ORG123.my_api_v1"},
+		{"unknown field", "tyk-{unknown}", ""},
+		{"empty field", "tyk-{alias}", ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			if topic := getKafkaTopic(tc.topic, message); topic != tc.expected {
+				t.Fatalf("expected topic %q, got %q", tc.expected, topic)
+			}
+		})
+	}
+}
+
+func TestGetKafkaCompressionCodec(t *testing.T) {
+	tcs := []struct {
+		testName    string
+		compression string
+		expected    string
+		expectedErr bool
+	}{
+		{"none", "", "", false},
+		{"snappy", "snappy", "snappy", false},
+		{"lz4", "lz4", "lz4", false},
+		{"zstd", "zstd", "zstd", false},
+		{"gzip", "gzip", "gzip", false},
+		{"unknown", "brotli", "", true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			codec, err := getKafkaCompressionCodec(tc.compression)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err == nil && codec != nil && codec.Name() != tc.expected {
+				t.Fatalf("expected codec %q, got %q", tc.expected, codec.Name())
+			}
+			if err == nil && codec == nil && tc.expected != "" {
+				t.Fatalf("expected codec %q, got none", tc.expected)
+			}
+		})
+	}
+}
+
+func TestGetKafkaRequiredAcks(t *testing.T) {
+	tcs := []struct {
+		acks        string
+		expected    int
+		expectedErr bool
+	}{
+		{"", -1, false},
+		{"all", -1, false},
+		{"one", 1, false},
+		{"none", 0, false},
+		{"2", 0, true},
+	}
+
+	for _, tc := range tcs {
+		acks, err := getKafkaRequiredAcks(tc.acks)
+		if (err != nil) != tc.expectedErr {
+			t.Fatalf("%q: expected error %v, got %v", tc.acks, tc.expectedErr, err)
+		}
+		if acks != tc.expected {
+			t.Fatalf("%q: expected %d acks, got %d", tc.acks, tc.expected, acks)
+		}
+	}
+}
+
+func TestGetKafkaMessageID(t *testing.T) {
+	id := getKafkaMessageID([]byte(`{"api_id":"API123"}`))
+	if string(id) != string(getKafkaMessageID([]byte(`{"api_id":"API123"}`))) {
+		t.Fatal("expected the same id for the same message")
+	}
+	if string(id) == string(getKafkaMessageID([]byte(`{"api_id":"API456"}`))) {
+		t.Fatal("expected different ids for different messages")
+	}
+}
+
+func TestKafkaPump_InitErrors(t *testing.T) {
+	tcs := []struct {
+		testName string
+		config   map[string]interface{}
+	}{
+		{"no brokers", map[string]interface{}{"topic": "tyk"}},
+		{"no topic", map[string]interface{}{"broker": []string{"localhost:9092"}}},
+		{"unknown balancer", map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk", "balancer": "random"}},
+		{"unknown compression", map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk", "compression": "brotli"}},
+		{"unknown acks", map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk", "required_acks": "2"}},
+		{"unknown format", map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk", "serialization": map[string]interface{}{"format": "xml"}}},
+		{"framing without schema", map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk", "serialization": map[string]interface{}{"format": "avro", "confluent_framing": true}}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			pmp := KafkaPump{}
+			if err := pmp.Init(tc.config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestKafkaPump_Shutdown(t *testing.T) {
+	pmp := KafkaPump{}
+	if err := pmp.Init(map[string]interface{}{"broker": []string{"localhost:9092"}, "topic": "tyk-{org_id}"}); err != nil {
+		t.Fatal(err)
+	}
+	pmp.getWriter("tyk-org1")
+	pmp.getWriter("tyk-org2")
+
+	if err := pmp.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pmp.writers) != 0 {
+		t.Errorf("expected every writer to be closed, %d left", len(pmp.writers))
+	}
+}
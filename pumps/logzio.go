@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
 	lg "github.com/logzio/logzio-go"
 	"github.com/mitchellh/mapstructure"
 )
@@ -32,6 +33,8 @@ type LogzioPumpConfig struct {
 	QueueDir       string `mapstructure:"queue_dir"`
 	Token          string `mapstructure:"token"`
 	URL            string `mapstructure:"url"`
+	// Send the records in the canonical json format of the serializer instead of the default fields
+	Serialization serializer.Config `mapstructure:"serialization"`
 }
 
 func NewLogzioPumpConfig() *LogzioPumpConfig {
@@ -46,8 +49,9 @@ func NewLogzioPumpConfig() *LogzioPumpConfig {
 }
 
 type LogzioPump struct {
-	sender *lg.LogzioSender
-	config *LogzioPumpConfig
+	sender     *lg.LogzioSender
+	config     *LogzioPumpConfig
+	serializer serializer.Serializer
 	CommonPumpConfig
 }
 
@@ -102,6 +106,11 @@ func (p *LogzioPump) Init(config interface{}) error {
 
 	p.log.Debugf("Initializing %s with the following configuration: %+v", LogzioPumpName, p.config)
 
+	p.serializer, err = getJSONSerializer(p.config.Serialization)
+	if err != nil {
+		return err
+	}
+
 	p.sender, err = NewLogzioClient(p.config)
 	if err != nil {
 		return err
@@ -116,6 +125,15 @@ func (p *LogzioPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	for _, v := range data {
 		decoded := v.(analytics.AnalyticsRecord)
+		if p.serializer != nil {
+			event, err := p.serializer.Encode(decoded)
+			if err != nil {
+				return fmt.Errorf("failed to serialize decoded data: %s", err)
+			}
+			p.sender.Send(event)
+			continue
+		}
+
 		mapping := map[string]interface{}{
 			"@timestamp":      decoded.TimeStamp,
 			"http_method":     decoded.Method,
@@ -0,0 +1,585 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mitchellh/mapstructure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// LokiPump pushes the analytics records as log lines to Grafana Loki
+type LokiPump struct {
+	conf   *LokiConf
+	client *http.Client
+
+	// entries buffered until batch_wait or batch_size is reached
+	mu           sync.Mutex
+	pending      []lokiEntry
+	pendingSize  int
+	pendingSince time.Time
+	stop         chan struct{}
+	flushing     sync.WaitGroup
+	CommonPumpConfig
+}
+
+type LokiConf struct {
+	// URL of the push API, e.g. http://localhost:3100/loki/api/v1/push
+	URL string `mapstructure:"url"`
+	// Encoding of the push requests: protobuf, compressed with snappy, or json. Defaults to protobuf
+	Format string `mapstructure:"format"`
+	// Fields of the records used as labels of the streams. Defaults to org_id, api_id and status_class
+	Labels []string `mapstructure:"labels"`
+	// Labels added to all the streams. Defaults to {"job": "tyk-pump"}
+	StaticLabels map[string]string `mapstructure:"static_labels"`
+	// Rendering of the log lines: json or logfmt. Defaults to json
+	LineFormat string `mapstructure:"line_format"`
+	// Fields of the records in the log lines, all of them but raw_request and raw_response by default
+	Fields []string `mapstructure:"fields"`
+	// Tenant of the records, sent in the X-Scope-OrgID header
+	TenantID string `mapstructure:"tenant_id"`
+	// Basic auth credentials
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Bearer token sent in the Authorization header
+	BearerToken string            `mapstructure:"bearer_token"`
+	Headers     map[string]string `mapstructure:"headers"`
+	// Maximum size in bytes of the log lines of a push request. Defaults to 1048576
+	BatchSize int `mapstructure:"batch_size"`
+	// Seconds the records are buffered across the purges before being pushed. Defaults to 0, pushing every purge
+	BatchWait int `mapstructure:"batch_wait"`
+	// Timeout of the push requests in seconds. Defaults to 10
+	Timeout               int    `mapstructure:"timeout"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+var lokiPrefix = "loki-pump"
+
+const (
+	lokiProtobufFormat = "protobuf"
+	lokiJSONFormat     = "json"
+	lokiLogfmtFormat   = "logfmt"
+
+	defaultLokiBatchSize = 1024 * 1024
+	defaultLokiTimeout   = 10
+	// the entries of the failed pushes are retried up to this many batches, the oldest ones being dropped
+	lokiMaxPendingBatches = 10
+)
+
+var defaultLokiLabels = []string{"org_id", "api_id", "status_class"}
+
+// lokiLabelFields are the fields of the records which can be labels, their number of values is limited
+var lokiLabelFields = map[string]bool{
+	"org_id":        true,
+	"api_id":        true,
+	"api_name":      true,
+	"api_version":   true,
+	"status_class":  true,
+	"response_code": true,
+	"method":        true,
+	"host":          true,
+}
+
+// lokiFields are the fields of the log lines, in their default order
+var lokiFields = []string{
+	"method", "host", "path", "raw_path", "response_code", "status_class", "api_key", "api_version", "api_name",
+	"api_id", "org_id", "oauth_id", "request_time", "latency_total", "latency_upstream", "content_length",
+	"bytes_in", "bytes_out", "ip_address", "user_agent", "geo_country", "alias", "tags", "raw_request", "raw_response",
+}
+
+type lokiEntry struct {
+	labels    map[string]string
+	timestamp time.Time
+	line      string
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+func (l *LokiPump) New() Pump {
+	newPump := LokiPump{}
+	return &newPump
+}
+
+func (l *LokiPump) GetName() string {
+	return "Loki Pump"
+}
+
+func (l *LokiPump) Init(config interface{}) error {
+	l.conf = &LokiConf{}
+	l.log = log.WithField("prefix", lokiPrefix)
+
+	if err := mapstructure.Decode(config, &l.conf); err != nil {
+		return err
+	}
+	if l.conf.URL == "" {
+		return errors.New("Loki url not set")
+	}
+
+	switch l.conf.Format {
+	case "":
+		l.conf.Format = lokiProtobufFormat
+	case lokiProtobufFormat, lokiJSONFormat:
+	default:
+		return fmt.Errorf("unsupported Loki format %q, must be protobuf or json", l.conf.Format)
+	}
+	switch l.conf.LineFormat {
+	case "":
+		l.conf.LineFormat = lokiJSONFormat
+	case lokiJSONFormat, lokiLogfmtFormat:
+	default:
+		return fmt.Errorf("unsupported Loki line_format %q, must be json or logfmt", l.conf.LineFormat)
+	}
+
+	if len(l.conf.Labels) == 0 {
+		l.conf.Labels = defaultLokiLabels
+	}
+	for _, label := range l.conf.Labels {
+		if !lokiLabelFields[label] {
+			return fmt.Errorf("unsupported Loki label %q", label)
+		}
+	}
+	if len(l.conf.StaticLabels) == 0 {
+		l.conf.StaticLabels = map[string]string{"job": "tyk-pump"}
+	}
+
+	if len(l.conf.Fields) == 0 {
+		l.conf.Fields = lokiFields[:len(lokiFields)-2]
+	}
+	for _, field := range l.conf.Fields {
+		if _, found := lokiFieldValues(&analytics.AnalyticsRecord{})[field]; !found {
+			return fmt.Errorf("unsupported Loki field %q", field)
+		}
+	}
+
+	if l.conf.BatchSize <= 0 {
+		l.conf.BatchSize = defaultLokiBatchSize
+	}
+	if l.conf.Timeout <= 0 {
+		l.conf.Timeout = defaultLokiTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if l.conf.SSLCAFile != "" || l.conf.SSLCertFile != "" || l.conf.SSLKeyFile != "" || l.conf.SSLInsecureSkipVerify {
+		tlsConfig, err := getTLSConfig(l.conf.SSLCAFile, l.conf.SSLCertFile, l.conf.SSLKeyFile, l.conf.SSLInsecureSkipVerify)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	l.client = &http.Client{Timeout: time.Duration(l.conf.Timeout) * time.Second, Transport: transport}
+
+	if l.conf.BatchWait > 0 {
+		l.stop = make(chan struct{})
+		l.flushing.Add(1)
+		go l.flushLoop()
+	}
+
+	l.log.Info(l.GetName() + " Initialized")
+	return nil
+}
+
+func (l *LokiPump) WriteData(ctx context.Context, data []interface{}) error {
+	l.log.Debug("Attempting to write ", len(data), " records...")
+
+	entries := make([]lokiEntry, 0, len(data))
+	size := 0
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		entry := l.entry(&record)
+		size += len(entry.line)
+		entries = append(entries, entry)
+	}
+
+	if l.conf.BatchWait > 0 {
+		l.mu.Lock()
+		if len(l.pending) == 0 {
+			l.pendingSince = time.Now()
+		}
+		l.pending = append(l.pending, entries...)
+		l.pendingSize += size
+		if l.pendingSize < l.conf.BatchSize {
+			l.mu.Unlock()
+			l.log.Debug("Buffered ", len(entries), " records")
+			return nil
+		}
+		entries = l.takePending()
+		l.mu.Unlock()
+	}
+
+	sent, err := l.push(ctx, entries)
+	if err != nil {
+		l.log.Error("Failed to push the records: ", err)
+		if l.conf.BatchWait > 0 {
+			l.retain(entries[sent:])
+		}
+		return err
+	}
+	l.log.Info("Purged ", len(entries), " records...")
+	return nil
+}
+
+// takePending returns the buffered entries and empties the buffer, the lock must be held
+func (l *LokiPump) takePending() []lokiEntry {
+	entries := l.pending
+	l.pending, l.pendingSize = nil, 0
+	return entries
+}
+
+// retain buffers again the entries of a failed push, before the ones buffered since, so they are retried
+// after batch_wait. The oldest entries are dropped past lokiMaxPendingBatches batches.
+func (l *LokiPump) retain(entries []lokiEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := 0
+	for _, entry := range entries {
+		size += len(entry.line)
+	}
+	if len(l.pending) == 0 {
+		l.pendingSince = time.Now()
+	}
+	l.pending = append(entries[:len(entries):len(entries)], l.pending...)
+	l.pendingSize += size
+
+	dropped := 0
+	for l.pendingSize > lokiMaxPendingBatches*l.conf.BatchSize && len(l.pending) > 1 {
+		l.pendingSize -= len(l.pending[0].line)
+		l.pending = l.pending[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		l.log.Error("Dropped ", dropped, " buffered records, the buffer is full")
+	}
+}
+
+// flushLoop pushes the buffered entries once the oldest of them waited batch_wait
+func (l *LokiPump) flushLoop() {
+	defer l.flushing.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.flushExpired(now)
+		}
+	}
+}
+
+func (l *LokiPump) flushExpired(now time.Time) {
+	l.mu.Lock()
+	if len(l.pending) == 0 || now.Sub(l.pendingSince) < time.Duration(l.conf.BatchWait)*time.Second {
+		l.mu.Unlock()
+		return
+	}
+	entries := l.takePending()
+	l.mu.Unlock()
+
+	if err := l.flush(context.Background(), entries); err != nil {
+		l.log.Error("Failed to push the buffered records: ", err)
+	}
+}
+
+// flush pushes the buffered entries, retaining the ones not sent
+func (l *LokiPump) flush(ctx context.Context, entries []lokiEntry) error {
+	sent, err := l.push(ctx, entries)
+	if err != nil {
+		l.retain(entries[sent:])
+		return err
+	}
+	l.log.Info("Purged ", len(entries), " buffered records...")
+	return nil
+}
+
+// Shutdown stops the flushes of batch_wait and pushes the buffered entries
+func (l *LokiPump) Shutdown() error {
+	if l.stop == nil {
+		return nil
+	}
+	close(l.stop)
+	l.flushing.Wait()
+
+	l.mu.Lock()
+	entries := l.takePending()
+	l.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if err := l.flush(context.Background(), entries); err != nil {
+		return fmt.Errorf("%d buffered records couldn't be pushed: %v", len(entries), err)
+	}
+	return nil
+}
+
+func (l *LokiPump) entry(record *analytics.AnalyticsRecord) lokiEntry {
+	values := lokiFieldValues(record)
+
+	labels := make(map[string]string, len(l.conf.StaticLabels)+len(l.conf.Labels))
+	for name, value := range l.conf.StaticLabels {
+		labels[name] = value
+	}
+	for _, name := range l.conf.Labels {
+		// the empty labels don't exist in Loki
+		if value := fmt.Sprint(values[name]); value != "" {
+			labels[name] = value
+		}
+	}
+
+	var line string
+	if l.conf.LineFormat == lokiLogfmtFormat {
+		line = renderLogfmt(l.conf.Fields, values)
+	} else {
+		line = renderJSONLine(l.conf.Fields, values)
+	}
+
+	return lokiEntry{labels: labels, timestamp: record.TimeStamp, line: line}
+}
+
+func lokiFieldValues(record *analytics.AnalyticsRecord) map[string]interface{} {
+	statusClass := ""
+	if record.ResponseCode > 0 {
+		statusClass = strconv.Itoa(record.ResponseCode/100) + "xx"
+	}
+	tags := record.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return map[string]interface{}{
+		"method":           record.Method,
+		"host":             record.Host,
+		"path":             record.Path,
+		"raw_path":         record.RawPath,
+		"response_code":    record.ResponseCode,
+		"status_class":     statusClass,
+		"api_key":          record.APIKey,
+		"api_version":      record.APIVersion,
+		"api_name":         record.APIName,
+		"api_id":           record.APIID,
+		"org_id":           record.OrgID,
+		"oauth_id":         record.OauthID,
+		"request_time":     record.RequestTime,
+		"latency_total":    record.Latency.Total,
+		"latency_upstream": record.Latency.Upstream,
+		"content_length":   record.ContentLength,
+		"bytes_in":         record.Network.BytesIn,
+		"bytes_out":        record.Network.BytesOut,
+		"ip_address":       record.IPAddress,
+		"user_agent":       record.UserAgent,
+		"geo_country":      record.Geo.Country.ISOCode,
+		"alias":            record.Alias,
+		"tags":             tags,
+		"raw_request":      record.RawRequest,
+		"raw_response":     record.RawResponse,
+	}
+}
+
+// renderJSONLine renders the fields as a JSON object, in their configured order
+func renderJSONLine(fields []string, values map[string]interface{}) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(field)
+		value, _ := json.Marshal(values[field])
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// renderLogfmt renders the fields as key=value pairs, quoting the values with spaces, quotes or equal signs
+func renderLogfmt(fields []string, values map[string]interface{}) string {
+	pairs := make([]string, len(fields))
+	for i, field := range fields {
+		var value string
+		switch v := values[field].(type) {
+		case []string:
+			value = strings.Join(v, ",")
+		default:
+			value = fmt.Sprint(v)
+		}
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		pairs[i] = field + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
+
+// push sends the entries in requests of up to batch_size bytes of log lines. It returns the number of
+// entries sent before a failed request.
+func (l *LokiPump) push(ctx context.Context, entries []lokiEntry) (int, error) {
+	for start := 0; start < len(entries); {
+		end, size := start, 0
+		for end < len(entries) && (end == start || size+len(entries[end].line) <= l.conf.BatchSize) {
+			size += len(entries[end].line)
+			end++
+		}
+		if err := l.send(ctx, groupLokiStreams(entries[start:end])); err != nil {
+			return start, err
+		}
+		start = end
+	}
+	return len(entries), nil
+}
+
+// groupLokiStreams groups the entries by labels, the entries of every stream sorted by time
+func groupLokiStreams(entries []lokiEntry) []lokiStream {
+	var streams []lokiStream
+	index := make(map[string]int)
+	for _, entry := range entries {
+		key := formatLokiLabels(entry.labels)
+		i, found := index[key]
+		if !found {
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, lokiStream{labels: entry.labels})
+		}
+		streams[i].entries = append(streams[i].entries, entry)
+	}
+
+	for _, stream := range streams {
+		entries := stream.entries
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].timestamp.Before(entries[j].timestamp) })
+	}
+	return streams
+}
+
+// formatLokiLabels returns the labels as a stream selector, e.g. {api_id="1", org_id="2"}
+func formatLokiLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func (l *LokiPump) send(ctx context.Context, streams []lokiStream) error {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if l.conf.Format == lokiProtobufFormat {
+		body = snappy.Encode(nil, encodeLokiPushRequest(streams))
+		contentType = "application/x-protobuf"
+	} else if body, err = encodeLokiJSONPushRequest(streams); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "tyk-pump")
+	for name, value := range l.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	if l.conf.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.conf.TenantID)
+	}
+	if l.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+l.conf.BearerToken)
+	} else if l.conf.Username != "" {
+		req.SetBasicAuth(l.conf.Username, l.conf.Password)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Loki returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// encodeLokiPushRequest encodes the streams as a logproto.PushRequest
+func encodeLokiPushRequest(streams []lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.BytesType)
+		s = protowire.AppendString(s, formatLokiLabels(stream.labels))
+		for _, entry := range stream.entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.timestamp.Nanosecond()))
+
+			var e []byte
+			e = protowire.AppendTag(e, 1, protowire.BytesType)
+			e = protowire.AppendBytes(e, timestamp)
+			e = protowire.AppendTag(e, 2, protowire.BytesType)
+			e = protowire.AppendString(e, entry.line)
+
+			s = protowire.AppendTag(s, 2, protowire.BytesType)
+			s = protowire.AppendBytes(s, e)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, s)
+	}
+	return request
+}
+
+// encodeLokiJSONPushRequest encodes the streams as the JSON body of the push API
+func encodeLokiJSONPushRequest(streams []lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: make([]jsonStream, len(streams))}
+	for i, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for j, entry := range stream.entries {
+			values[j] = [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), entry.line}
+		}
+		request.Streams[i] = jsonStream{Stream: stream.labels, Values: values}
+	}
+	return json.Marshal(request)
+}
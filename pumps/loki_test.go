@@ -0,0 +1,304 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+type lokiPush struct {
+	header  http.Header
+	streams map[string][]string
+}
+
+// lokiStub decodes the JSON and protobuf push requests in lines per stream
+type lokiStub struct {
+	mu     sync.Mutex
+	pushes []lokiPush
+}
+
+func (s *lokiStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	push := lokiPush{header: r.Header, streams: map[string][]string{}}
+
+	if r.Header.Get("Content-Type") == "application/x-protobuf" {
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, stream := range protoFields(decoded, 1) {
+			labels := string(protoFields(stream, 1)[0])
+			for _, entry := range protoFields(stream, 2) {
+				push.streams[labels] = append(push.streams[labels], string(protoFields(entry, 2)[0]))
+			}
+		}
+	} else {
+		var request struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			} `json:"streams"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, stream := range request.Streams {
+			labels := formatLokiLabels(stream.Stream)
+			for _, value := range stream.Values {
+				push.streams[labels] = append(push.streams[labels], value[1])
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.pushes = append(s.pushes, push)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *lokiStub) get() []lokiPush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]lokiPush{}, s.pushes...)
+}
+
+// protoFields returns the values of the length delimited field of the message
+func protoFields(message []byte, number protowire.Number) [][]byte {
+	var values [][]byte
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		message = message[n:]
+		if typ == protowire.BytesType && num == number {
+			value, m := protowire.ConsumeBytes(message)
+			values = append(values, value)
+			message = message[m:]
+			continue
+		}
+		message = message[protowire.ConsumeFieldValue(num, typ, message):]
+	}
+	return values
+}
+
+func lokiRecords() []interface{} {
+	ts := time.Date(2020, 3, 1, 10, 15, 30, 0, time.UTC)
+	return []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: ts, OrgID: "org1", APIID: "api1", Method: "GET", Path: "/get", ResponseCode: 200},
+		analytics.AnalyticsRecord{TimeStamp: ts.Add(time.Second), OrgID: "org1", APIID: "api1", Method: "POST", Path: "/post path", ResponseCode: 503},
+		analytics.AnalyticsRecord{TimeStamp: ts, OrgID: "org1", APIID: "api1", Method: "GET", Path: "/get", ResponseCode: 201},
+	}
+}
+
+func TestLokiPump_WriteData(t *testing.T) {
+	tcs := []struct {
+		name   string
+		conf   map[string]interface{}
+		header func(http.Header) bool
+		lines  map[string][]string
+	}{
+		{
+			name: "protobuf",
+			conf: map[string]interface{}{
+				"tenant_id":    "tenant1",
+				"bearer_token": "token",
+				"fields":       []string{"method", "path", "response_code"},
+			},
+			header: func(h http.Header) bool {
+				return h.Get("X-Scope-OrgID") == "tenant1" && h.Get("Authorization") == "Bearer token"
+			},
+			lines: map[string][]string{
+				`{api_id="api1", job="tyk-pump", org_id="org1", status_class="2xx"}`: {
+					`{"method":"GET","path":"/get","response_code":200}`,
+					`{"method":"GET","path":"/get","response_code":201}`,
+				},
+				`{api_id="api1", job="tyk-pump", org_id="org1", status_class="5xx"}`: {
+					`{"method":"POST","path":"/post path","response_code":503}`,
+				},
+			},
+		},
+		{
+			name: "json with logfmt lines",
+			conf: map[string]interface{}{
+				"format":        "json",
+				"line_format":   "logfmt",
+				"labels":        []string{"method"},
+				"static_labels": map[string]string{"env": "test"},
+				"fields":        []string{"path", "response_code", "tags"},
+				"username":      "user",
+				"password":      "pass",
+			},
+			header: func(h http.Header) bool {
+				r := &http.Request{Header: h}
+				user, pass, ok := r.BasicAuth()
+				return ok && user == "user" && pass == "pass" && h.Get("X-Scope-OrgID") == ""
+			},
+			lines: map[string][]string{
+				`{env="test", method="GET"}`:  {`path=/get response_code=200 tags=""`, `path=/get response_code=201 tags=""`},
+				`{env="test", method="POST"}`: {`path="/post path" response_code=503 tags=""`},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := &lokiStub{}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			tc.conf["url"] = server.URL
+			l := &LokiPump{}
+			if err := l.Init(tc.conf); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.WriteData(context.Background(), lokiRecords()); err != nil {
+				t.Fatal(err)
+			}
+
+			pushes := stub.get()
+			if len(pushes) != 1 {
+				t.Fatalf("expected 1 push, got %d", len(pushes))
+			}
+			if !tc.header(pushes[0].header) {
+				t.Errorf("unexpected headers %v", pushes[0].header)
+			}
+			if len(pushes[0].streams) != len(tc.lines) {
+				t.Errorf("unexpected streams %v", pushes[0].streams)
+			}
+			for labels, lines := range tc.lines {
+				got := pushes[0].streams[labels]
+				if len(got) != len(lines) {
+					t.Errorf("stream %s: expected %v, got %v", labels, lines, got)
+					continue
+				}
+				for i := range lines {
+					if got[i] != lines[i] {
+						t.Errorf("stream %s: expected %s, got %s", labels, lines[i], got[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLokiPump_Batching(t *testing.T) {
+	stub := &lokiStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	// the lines are 16 or 17 bytes, two of them fill a batch
+	l := &LokiPump{}
+	err := l.Init(map[string]interface{}{"url": server.URL, "fields": []string{"method"}, "batch_size": 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteData(context.Background(), lokiRecords()); err != nil {
+		t.Fatal(err)
+	}
+	if pushes := stub.get(); len(pushes) != 2 {
+		t.Fatalf("expected 2 pushes, got %d", len(pushes))
+	}
+
+	// with batch_wait, the records are buffered until the batch is full or old enough
+	stub.mu.Lock()
+	stub.pushes = nil
+	stub.mu.Unlock()
+	l = &LokiPump{}
+	err = l.Init(map[string]interface{}{"url": server.URL, "fields": []string{"method"}, "batch_size": 100, "batch_wait": 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := lokiRecords()
+	if err := l.WriteData(context.Background(), records[:2]); err != nil {
+		t.Fatal(err)
+	}
+	l.flushExpired(time.Now())
+	if pushes := stub.get(); len(pushes) != 0 {
+		t.Fatalf("expected the records to be buffered, got %d pushes", len(pushes))
+	}
+	l.flushExpired(time.Now().Add(time.Minute))
+	if pushes := stub.get(); len(pushes) != 1 || len(pushes[0].streams) != 2 {
+		t.Fatalf("expected the buffered records to be pushed, got %v", pushes)
+	}
+}
+
+func TestLokiPump_Init(t *testing.T) {
+	for name, conf := range map[string]map[string]interface{}{
+		"no url":        {},
+		"format":        {"url": "http://loki", "format": "xml"},
+		"line format":   {"url": "http://loki", "line_format": "xml"},
+		"label":         {"url": "http://loki", "labels": []string{"path"}},
+		"unknown field": {"url": "http://loki", "fields": []string{"nope"}},
+	} {
+		if err := (&LokiPump{}).Init(conf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLokiPump_WriteDataError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("ingestion rate limit exceeded"))
+	}))
+	defer server.Close()
+
+	l := &LokiPump{}
+	if err := l.Init(map[string]interface{}{"url": server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteData(context.Background(), lokiRecords()); err == nil {
+		t.Error("expected the error of Loki")
+	}
+}
+
+func TestLokiPump_Shutdown(t *testing.T) {
+	stub := &lokiStub{}
+	var failing int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	l := &LokiPump{}
+	err := l.Init(map[string]interface{}{"url": server.URL, "fields": []string{"method"}, "batch_size": 100, "batch_wait": 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteData(context.Background(), lokiRecords()[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries of the failed flush are kept for the next one
+	l.flushExpired(time.Now().Add(time.Minute))
+	l.mu.Lock()
+	pending := len(l.pending)
+	l.mu.Unlock()
+	if pending != 2 {
+		t.Fatalf("expected the 2 records to be retained, got %d", pending)
+	}
+
+	// and pushed on shutdown
+	atomic.StoreInt32(&failing, 0)
+	if err := l.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if pushes := stub.get(); len(pushes) != 1 || len(pushes[0].streams) != 2 {
+		t.Fatalf("expected the buffered records to be pushed on shutdown, got %v", pushes)
+	}
+}
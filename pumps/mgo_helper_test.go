@@ -3,21 +3,31 @@
 package pumps
 
 import (
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const dbAddr = "127.0.0.1:27017"
 const colName = "test_collection"
 
 type Conn struct {
-	Session *mgo.Session
+	Client *mongo.Client
+}
+
+func (c *Conn) db() *mongo.Database {
+	return c.Client.Database(defaultMongoDatabase)
 }
 
 func (c *Conn) ConnectDb() {
-	if c.Session == nil {
+	if c.Client == nil {
 		var err error
-		c.Session, err = mgo.Dial(dbAddr)
+		c.Client, err = mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://"+dbAddr))
+		if err == nil {
+			err = c.Client.Ping(context.Background(), nil)
+		}
 		if err != nil {
 			panic("Unable to connect to mongo")
 		}
@@ -25,30 +35,21 @@ func (c *Conn) ConnectDb() {
 }
 
 func (c *Conn) CleanDb() {
-	sess := c.Session.Copy()
-	defer sess.Close()
-
-	if err := sess.DB("").DropDatabase(); err != nil {
+	if err := c.db().Drop(context.Background()); err != nil {
 		panic(err)
 	}
 }
 
 func (c *Conn) InsertDoc() {
-	sess := c.Session.Copy()
-	defer sess.Close()
-
-	if err := sess.DB("").C(colName).Insert(bson.M{"foo": "bar"}); err != nil {
+	if _, err := c.db().Collection(colName).InsertOne(context.Background(), bson.M{"foo": "bar"}); err != nil {
 		panic(err)
 	}
 }
 
 func (c *Conn) GetCollectionStats() (colStats bson.M) {
-	sess := c.Session.Copy()
-	defer sess.Close()
-
-	data := bson.D{{Name: "collStats", Value: colName}}
+	data := bson.D{{Key: "collStats", Value: colName}}
 
-	if err := sess.DB("").Run(data, &colStats); err != nil {
+	if err := c.db().RunCommand(context.Background(), data).Decode(&colStats); err != nil {
 		panic(err)
 	}
 
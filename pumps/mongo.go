@@ -11,7 +11,6 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,8 +20,6 @@ import (
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/mitchellh/mapstructure"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 const (
@@ -34,8 +31,10 @@ const (
 )
 
 type MongoPump struct {
-	dbSession *mgo.Session
-	dbConf    *MongoConf
+	store  mongoDriver
+	dbConf *MongoConf
+	// uptimeIndexed is set once the index of the uptime aggregates is ensured
+	uptimeIndexed bool
 	CommonPumpConfig
 }
 
@@ -57,6 +56,26 @@ type BaseMongoConf struct {
 	MongoSSLCAFile                string    `json:"mongo_ssl_ca_file" mapstructure:"mongo_ssl_ca_file"`
 	MongoSSLPEMKeyfile            string    `json:"mongo_ssl_pem_keyfile" mapstructure:"mongo_ssl_pem_keyfile"`
 	MongoDBType                   MongoType `json:"mongo_db_type" mapstructure:"mongo_db_type"`
+	// Write concern of the inserts and updates: majority, the number of nodes or a custom write concern name
+	MongoWriteConcern string `json:"mongo_write_concern" mapstructure:"mongo_write_concern"`
+	// Wait for the writes to be in the journal
+	MongoWriteConcernJournal bool `json:"mongo_write_concern_journal" mapstructure:"mongo_write_concern_journal"`
+	// Milliseconds to wait for the write concern
+	MongoWriteConcernTimeout int `json:"mongo_write_concern_timeout" mapstructure:"mongo_write_concern_timeout"`
+	// primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	MongoReadPreference string `json:"mongo_read_preference" mapstructure:"mongo_read_preference"`
+	// Retry the writes once on network errors and failovers. Enabled by default by the driver
+	MongoRetryWrites *bool `json:"mongo_retry_writes" mapstructure:"mongo_retry_writes"`
+	// Compressors of the network traffic, in order of preference: snappy, zlib and zstd
+	MongoCompressors []string `json:"mongo_compressors" mapstructure:"mongo_compressors"`
+	// Limits of the connection pool. The max idle time is in seconds
+	MongoMaxPoolSize     int `json:"mongo_max_pool_size" mapstructure:"mongo_max_pool_size"`
+	MongoMinPoolSize     int `json:"mongo_min_pool_size" mapstructure:"mongo_min_pool_size"`
+	MongoMaxConnIdleTime int `json:"mongo_max_conn_idle_time" mapstructure:"mongo_max_conn_idle_time"`
+	// SCRAM-SHA-1, SCRAM-SHA-256, MONGODB-X509, MONGODB-AWS, PLAIN or GSSAPI
+	MongoAuthMechanism string `json:"mongo_auth_mechanism" mapstructure:"mongo_auth_mechanism"`
+	// Database holding the credentials, defaults to the database of the url
+	MongoAuthSource string `json:"mongo_auth_source" mapstructure:"mongo_auth_source"`
 }
 
 func (b *BaseMongoConf) GetBlurredURL() string {
@@ -77,6 +96,15 @@ type MongoConf struct {
 	MaxDocumentSizeBytes      int    `json:"max_document_size_bytes" mapstructure:"max_document_size_bytes"`
 	CollectionCapMaxSizeBytes int    `json:"collection_cap_max_size_bytes" mapstructure:"collection_cap_max_size_bytes"`
 	CollectionCapEnable       bool   `json:"collection_cap_enable" mapstructure:"collection_cap_enable"`
+	// Remove the records at their expireAt, or collection_ttl_seconds after their timestamp, with a TTL index
+	CollectionTTLEnable  bool `json:"collection_ttl_enable" mapstructure:"collection_ttl_enable"`
+	CollectionTTLSeconds int  `json:"collection_ttl_seconds" mapstructure:"collection_ttl_seconds"`
+	// Store the records in a time-series collection (MongoDB 5.0+), grouped by organisation and API
+	CollectionTimeSeriesEnable bool `json:"collection_timeseries_enable" mapstructure:"collection_timeseries_enable"`
+	// seconds, minutes or hours. Defaults to seconds
+	CollectionTimeSeriesGranularity string `json:"collection_timeseries_granularity" mapstructure:"collection_timeseries_granularity"`
+	// Migrate the existing capped (or not time-series) collection to the configured retention
+	CollectionMigrate bool `json:"collection_migrate" mapstructure:"collection_migrate"`
 }
 
 func loadCertficateAndKeyFromFile(path string) (*tls.Certificate, error) {
@@ -129,93 +157,69 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("Failed to parse private key")
 }
 
-func mongoType(session *mgo.Session) MongoType {
-	// Querying for the features which 100% not supported by AWS DocumentDB
-	var result struct {
-		Code int `bson:"code"`
+func (b *BaseMongoConf) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if b.MongoSSLInsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
 	}
-	session.Run("features", &result)
 
-	if result.Code == 303 {
-		return AWSDocumentDB
-	} else {
-		return StandardMongo
-	}
-}
-
-func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
-	if dialInfo, err = mgo.ParseURL(conf.MongoURL); err != nil {
-		return dialInfo, err
-	}
-
-	if conf.MongoUseSSL {
-		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
-			tlsConfig := &tls.Config{}
-			if conf.MongoSSLInsecureSkipVerify {
-				tlsConfig.InsecureSkipVerify = true
-			}
-
-			if conf.MongoSSLCAFile != "" {
-				caCert, err := ioutil.ReadFile(conf.MongoSSLCAFile)
+	if b.MongoSSLCAFile != "" {
+		caCert, err := ioutil.ReadFile(b.MongoSSLCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load mongo CA certificates: %v", err)
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if b.MongoSSLAllowInvalidHostnames {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			// Code copy/pasted and adapted from
+			// https://github.com/golang/go/blob/81555cb4f3521b53f9de4ce15f64b77cc9df61b9/src/crypto/tls/handshake_client.go#L327-L344, but adapted to skip the hostname verification.
+			// See https://github.com/golang/go/issues/21971#issuecomment-412836078.
+
+			// If this is the first handshake on a connection, process and
+			// (optionally) verify the server's certificates.
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, asn1Data := range rawCerts {
+				cert, err := x509.ParseCertificate(asn1Data)
 				if err != nil {
-					log.Fatal("Can't load mongo CA certificates: ", err)
+					return err
 				}
-				caCertPool := x509.NewCertPool()
-				caCertPool.AppendCertsFromPEM(caCert)
-				tlsConfig.RootCAs = caCertPool
+				certs[i] = cert
 			}
 
-			if conf.MongoSSLAllowInvalidHostnames {
-				tlsConfig.InsecureSkipVerify = true
-				tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-					// Code copy/pasted and adapted from
-					// https://github.com/golang/go/blob/81555cb4f3521b53f9de4ce15f64b77cc9df61b9/src/crypto/tls/handshake_client.go#L327-L344, but adapted to skip the hostname verification.
-					// See https://github.com/golang/go/issues/21971#issuecomment-412836078.
-
-					// If this is the first handshake on a connection, process and
-					// (optionally) verify the server's certificates.
-					certs := make([]*x509.Certificate, len(rawCerts))
-					for i, asn1Data := range rawCerts {
-						cert, err := x509.ParseCertificate(asn1Data)
-						if err != nil {
-							return err
-						}
-						certs[i] = cert
-					}
-
-					opts := x509.VerifyOptions{
-						Roots:         tlsConfig.RootCAs,
-						CurrentTime:   time.Now(),
-						DNSName:       "", // <- skip hostname verification
-						Intermediates: x509.NewCertPool(),
-					}
-
-					for i, cert := range certs {
-						if i == 0 {
-							continue
-						}
-						opts.Intermediates.AddCert(cert)
-					}
-					_, err := certs[0].Verify(opts)
-
-					return err
-				}
+			opts := x509.VerifyOptions{
+				Roots:         tlsConfig.RootCAs,
+				CurrentTime:   time.Now(),
+				DNSName:       "", // <- skip hostname verification
+				Intermediates: x509.NewCertPool(),
 			}
 
-			if conf.MongoSSLPEMKeyfile != "" {
-				cert, err := loadCertficateAndKeyFromFile(conf.MongoSSLPEMKeyfile)
-				if err != nil {
-					log.Fatal("Can't load mongo client certificate: ", err)
+			for i, cert := range certs {
+				if i == 0 {
+					continue
 				}
-
-				tlsConfig.Certificates = []tls.Certificate{*cert}
+				opts.Intermediates.AddCert(cert)
 			}
+			_, err := certs[0].Verify(opts)
 
-			return tls.Dial("tcp", addr.String(), tlsConfig)
+			return err
 		}
 	}
 
-	return dialInfo, err
+	if b.MongoSSLPEMKeyfile != "" {
+		cert, err := loadCertficateAndKeyFromFile(b.MongoSSLPEMKeyfile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load mongo client certificate: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	return tlsConfig, nil
 }
 
 func (m *MongoPump) New() Pump {
@@ -262,10 +266,26 @@ func (m *MongoPump) Init(config interface{}) error {
 		m.dbConf.MaxDocumentSizeBytes = 10 * MiB
 	}
 
+	if _, _, err := m.dbConf.clientOptions(m.timeout); err != nil {
+		return err
+	}
+
+	if err := m.dbConf.validateRetention(); err != nil {
+		return err
+	}
+
 	m.connect()
 
 	m.capCollection()
 
+	migrate, err := m.initCollection()
+	if err != nil {
+		return err
+	}
+	if migrate {
+		go m.migrate()
+	}
+
 	indexCreateErr := m.ensureIndexes()
 	if indexCreateErr != nil {
 		m.log.Error(indexCreateErr)
@@ -315,10 +335,7 @@ func (m *MongoPump) capCollection() (ok bool) {
 		m.log.Infof("-- No max collection size set for %s, defaulting to %d", colName, colCapMaxSizeBytes)
 	}
 
-	sess := m.dbSession.Copy()
-	defer sess.Close()
-
-	err = m.dbSession.DB("").C(colName).Create(&mgo.CollectionInfo{Capped: true, MaxBytes: colCapMaxSizeBytes})
+	err = m.store.CreateCollection(context.Background(), colName, mongoCollectionOptions{Capped: true, MaxBytes: colCapMaxSizeBytes})
 	if err != nil {
 		m.log.Errorf("Unable to create capped collection for (%s). %s", colName, err.Error())
 
@@ -332,10 +349,7 @@ func (m *MongoPump) capCollection() (ok bool) {
 
 // collectionExists checks to see if a collection name exists in the db.
 func (m *MongoPump) collectionExists(name string) (bool, error) {
-	sess := m.dbSession.Copy()
-	defer sess.Close()
-
-	colNames, err := sess.DB("").CollectionNames()
+	colNames, err := m.store.CollectionNames(context.Background())
 	if err != nil {
 		m.log.Error("Unable to get column names: ", err)
 
@@ -354,38 +368,47 @@ func (m *MongoPump) collectionExists(name string) (bool, error) {
 func (m *MongoPump) ensureIndexes() error {
 	var err error
 
-	sess := m.dbSession.Copy()
-	defer sess.Close()
+	ctx := context.Background()
+	c := m.dbConf.CollectionName
+
+	if m.dbConf.CollectionTimeSeriesEnable {
+		return m.ensureTimeSeriesIndexes(ctx)
+	}
 
-	c := sess.DB("").C(m.dbConf.CollectionName)
+	if m.dbConf.CollectionTTLEnable {
+		err = m.ensureTTLIndex(ctx)
+		if err != nil {
+			return err
+		}
+	}
 
-	orgIndex := mgo.Index{
-		Key:        []string{"orgid"},
+	orgIndex := mongoIndex{
+		Keys:       []string{"orgid"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(orgIndex)
+	err = m.store.EnsureIndex(ctx, c, orgIndex)
 	if err != nil {
 		return err
 	}
 
-	apiIndex := mgo.Index{
-		Key:        []string{"apiid"},
+	apiIndex := mongoIndex{
+		Keys:       []string{"apiid"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(apiIndex)
+	err = m.store.EnsureIndex(ctx, c, apiIndex)
 	if err != nil {
 		return err
 	}
 
-	logBrowserIndex := mgo.Index{
+	logBrowserIndex := mongoIndex{
 		Name:       "logBrowserIndex",
-		Key:        []string{"-timestamp", "orgid", "apiid", "apikey", "responsecode"},
+		Keys:       []string{"-timestamp", "orgid", "apiid", "apikey", "responsecode"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(logBrowserIndex)
+	err = m.store.EnsureIndex(ctx, c, logBrowserIndex)
 	if err != nil && !strings.Contains(err.Error(), "already exists with a different name") {
 		return err
 	}
@@ -394,27 +417,15 @@ func (m *MongoPump) ensureIndexes() error {
 }
 
 func (m *MongoPump) connect() {
-	var err error
-	var dialInfo *mgo.DialInfo
-
-	dialInfo, err = mongoDialInfo(m.dbConf.BaseMongoConf)
-	if err != nil {
-		m.log.Panic("Mongo URL is invalid: ", err)
-	}
-
-	if m.timeout > 0 {
-		dialInfo.Timeout = time.Second * time.Duration(m.timeout)
-	}
-	m.dbSession, err = mgo.DialWithInfo(dialInfo)
-
-	for err != nil {
-		m.log.WithError(err).WithField("dialinfo", dialInfo).Error("Mongo connection failed. Retrying.")
-		time.Sleep(5 * time.Second)
-		m.dbSession, err = mgo.DialWithInfo(dialInfo)
+	if m.store != nil {
+		if err := m.store.Close(context.Background()); err != nil {
+			m.log.WithError(err).Debug("Failed to close the previous connection")
+		}
 	}
+	m.store = dialMongo(m.log, m.dbConf.BaseMongoConf, m.timeout)
 
-	if err == nil && m.dbConf.MongoDBType == 0 {
-		m.dbConf.MongoDBType = mongoType(m.dbSession)
+	if m.dbConf.MongoDBType == 0 {
+		m.dbConf.MongoDBType = m.store.DBType(context.Background())
 	}
 }
 
@@ -427,7 +438,7 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	m.log.Debug("Attempting to write ", len(data), " records...")
 
-	for m.dbSession == nil {
+	for m.store == nil {
 		m.log.Debug("Connecting to analytics store")
 		m.connect()
 	}
@@ -436,21 +447,21 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 	errCh := make(chan error, len(accumulateSet))
 	for _, dataSet := range accumulateSet {
 		go func(dataSet []interface{}, errCh chan error) {
-			sess := m.dbSession.Copy()
-			defer sess.Close()
-
-			analyticsCollection := sess.DB("").C(collectionName)
-
 			m.log.WithFields(logrus.Fields{
 				"collection":        collectionName,
 				"number of records": len(dataSet),
 			}).Debug("Attempt to purge records")
 
-			err := analyticsCollection.Insert(dataSet...)
+			docs := dataSet
+			if m.dbConf.CollectionTimeSeriesEnable {
+				docs = timeSeriesRecords(dataSet)
+			}
+
+			err := m.store.Insert(ctx, collectionName, docs)
 			if err != nil {
 				m.log.WithFields(logrus.Fields{"collection": collectionName, "number of records": len(dataSet)}).Error("Problem inserting to mongo collection: ", err)
 
-				if strings.Contains(strings.ToLower(err.Error()), "closed explicitly") {
+				if isMongoDisconnected(err) {
 					m.log.Warning("--> Detected connection failure!")
 				}
 				errCh <- err
@@ -526,52 +537,38 @@ func (m *MongoPump) AccumulateSet(data []interface{}) [][]interface{} {
 	return returnArray
 }
 
-// WriteUptimeData will pull the data from the in-memory store and drop it into the specified MongoDB collection
-func (m *MongoPump) WriteUptimeData(data []interface{}) {
-
-	for m.dbSession == nil {
+// WriteUptimeData drops the uptime checks into the tyk_uptime_analytics collection, read by the Dashboard
+func (m *MongoPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	for m.store == nil {
 		m.log.Debug("Connecting to mongoDB store")
 		m.connect()
 	}
 
 	collectionName := "tyk_uptime_analytics"
-	sess := m.dbSession.Copy()
-	defer sess.Close()
-
-	analyticsCollection := sess.DB("").C(collectionName)
 
 	m.log.Debug("Uptime Data: ", len(data))
 
 	if len(data) == 0 {
-		return
+		return nil
 	}
 
 	keys := make([]interface{}, len(data))
-
-	for i, v := range data {
-		decoded := analytics.UptimeReportData{}
-
-		if err := msgpack.Unmarshal([]byte(v.(string)), &decoded); err != nil {
-			m.log.Error("Couldn't unmarshal analytics data:", err)
-
-			continue
-		}
-
-		keys[i] = interface{}(decoded)
-
-		m.log.Debug("Decoded Record: ", decoded)
+	for i := range data {
+		keys[i] = data[i]
 	}
 
 	m.log.Debug("Writing data to ", collectionName)
 
-	if err := analyticsCollection.Insert(keys...); err != nil {
-
+	if err := m.store.Insert(ctx, collectionName, keys); err != nil {
 		m.log.Error("Problem inserting to mongo collection: ", err)
 
-		if strings.Contains(err.Error(), "Closed explicitly") || strings.Contains(err.Error(), "EOF") {
+		if isMongoDisconnected(err) {
 			m.log.Warning("--> Detected connection failure, reconnecting")
 
 			m.connect()
 		}
+		return err
 	}
+	m.log.Info("Purged ", len(data), " uptime records...")
+	return nil
 }
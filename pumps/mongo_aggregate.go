@@ -4,15 +4,16 @@ import (
 	"context"
 	b64 "encoding/base64"
 	"errors"
+	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
-	"github.com/lonelycode/mgohacks"
 	"github.com/mitchellh/mapstructure"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
@@ -22,20 +23,48 @@ var mongoAggregatePumpPrefix = "PMP_MONGOAGG"
 var THRESHOLD_LEN_TAG_LIST = 1000
 var COMMON_TAGS_COUNT = 5
 
+// Minimum length of the common tag prefixes, so a short prefix doesn't match most of the tags
+var MIN_COMMON_TAG_PREFIX_LEN = 3
+
 type MongoAggregatePump struct {
-	dbSession *mgo.Session
-	dbConf    *MongoAggregateConf
+	store       mongoDriver
+	dbConf      *MongoAggregateConf
+	granularity time.Duration
+	rollups     []aggregateRollup
+	// collections whose indexes were ensured
+	indexed sync.Map
+	// documents of the buckets written by the last purge per collection, so the next purge of these
+	// buckets is written in a single bulk write
+	lastDocs   map[string][]analytics.AnalyticsRecordAggregate
+	lastDocsMu sync.Mutex
+	// updatePipelines is set when the server supports the update pipelines, since MongoDB 4.2
+	updatePipelines bool
+	tags            *tagGuard
+	// stop ends the rollups on shutdown, rollupDone being closed once the current one is finished
+	stop       chan struct{}
+	rollupDone chan struct{}
 	CommonPumpConfig
 }
 
 type MongoAggregateConf struct {
 	BaseMongoConf
-	UseMixedCollection      bool     `mapstructure:"use_mixed_collection"`
-	TrackAllPaths           bool     `mapstructure:"track_all_paths"`
-	IgnoreTagPrefixList     []string `mapstructure:"ignore_tag_prefix_list"`
-	ThresholdLenTagList     int      `mapstructure:"threshold_len_tag_list"`
-	StoreAnalyticsPerMinute bool     `mapstructure:"store_analytics_per_minute"`
-	IgnoreAggregationsList  []string `mapstructure:"ignore_aggregations"`
+	UseMixedCollection  bool     `mapstructure:"use_mixed_collection"`
+	TrackAllPaths       bool     `mapstructure:"track_all_paths"`
+	IgnoreTagPrefixList []string `mapstructure:"ignore_tag_prefix_list"`
+	ThresholdLenTagList int      `mapstructure:"threshold_len_tag_list"`
+	// Stop aggregating the new tags of a bucket once it crossed threshold_len_tag_list, and ignore their
+	// most common prefixes for the organisation
+	EnforceThresholdLenTagList bool     `mapstructure:"enforce_threshold_len_tag_list"`
+	StoreAnalyticsPerMinute    bool     `mapstructure:"store_analytics_per_minute"`
+	IgnoreAggregationsList     []string `mapstructure:"ignore_aggregations"`
+	// Dimensions whose counters keep a latency sketch, e.g. apiid. Only the total has one by default
+	LatencySketchDimensions []string `mapstructure:"latency_sketch_dimensions"`
+	// Size of the aggregation buckets: 1m, 5m, 15m, 1h or 1d. Takes precedence over store_analytics_per_minute
+	AggregationGranularity string `mapstructure:"aggregation_granularity"`
+	// Rollups compacting the aggregates into coarser ones, requires aggregation_granularity
+	Rollups []AggregateRollupConf `mapstructure:"rollups"`
+	// Seconds between two runs of the rollups. Defaults to 300
+	RollupInterval int `mapstructure:"rollup_interval"`
 }
 
 func (m *MongoAggregatePump) New() Pump {
@@ -49,7 +78,12 @@ func getListOfCommonPrefix(list []string) []string {
 	length := len(list)
 
 	if length == 0 || length == 1 {
-		return list
+		for _, tag := range list {
+			if len(tag) >= MIN_COMMON_TAG_PREFIX_LEN {
+				result = append(result, tag)
+			}
+		}
+		return result
 	}
 
 	for i := 0; i < length-1; i++ {
@@ -67,13 +101,13 @@ func getListOfCommonPrefix(list []string) []string {
 			k := 0
 			for k = 0; k < prefLen; k++ {
 				if str1[k] != str2[k] {
-					if k != 0 {
+					if k >= MIN_COMMON_TAG_PREFIX_LEN {
 						count[str1[:k]]++
 					}
 					break
 				}
 			}
-			if k == prefLen {
+			if k == prefLen && prefLen >= MIN_COMMON_TAG_PREFIX_LEN {
 				count[str1[:prefLen]]++
 			}
 		}
@@ -121,7 +155,7 @@ func (m *MongoAggregatePump) GetCollectionName(orgid string) (string, error) {
 		return "", errors.New("OrgID cannot be empty")
 	}
 
-	return "z_tyk_analyticz_aggregate_" + orgid, nil
+	return aggregateCollectionPrefix + orgid, nil
 }
 
 func (m *MongoAggregatePump) Init(config interface{}) error {
@@ -145,157 +179,212 @@ func (m *MongoAggregatePump) Init(config interface{}) error {
 	if m.dbConf.ThresholdLenTagList == 0 {
 		m.dbConf.ThresholdLenTagList = THRESHOLD_LEN_TAG_LIST
 	}
+	m.tags = newTagGuard()
+
+	if m.dbConf.AggregationGranularity != "" {
+		m.granularity, err = analytics.ParseGranularity(m.dbConf.AggregationGranularity)
+		if err != nil {
+			m.log.Fatal("Invalid aggregation_granularity: ", err)
+		}
+	}
+
+	if len(m.dbConf.Rollups) > 0 {
+		if m.granularity == 0 {
+			m.log.Fatal("Rollups require aggregation_granularity to be set")
+		}
+		m.rollups, err = parseRollups(m.granularity, m.dbConf.Rollups)
+		if err != nil {
+			m.log.Fatal("Invalid rollups: ", err)
+		}
+	}
+
+	if _, _, err := m.dbConf.clientOptions(m.timeout); err != nil {
+		return err
+	}
 
 	m.connect()
 
+	if len(m.rollups) > 0 {
+		if m.dbConf.RollupInterval <= 0 {
+			m.dbConf.RollupInterval = defaultRollupInterval
+		}
+		m.stop, m.rollupDone = make(chan struct{}), make(chan struct{})
+		go m.rollupLoop(time.Duration(m.dbConf.RollupInterval) * time.Second)
+	}
+
 	m.log.Debug("MongoDB DB CS: ", m.dbConf.GetBlurredURL())
 	m.log.Info(m.GetName() + " Initialized")
 
 	return nil
 }
 
-func (m *MongoAggregatePump) connect() {
-	var err error
-	var dialInfo *mgo.DialInfo
-
-	dialInfo, err = mongoDialInfo(m.dbConf.BaseMongoConf)
-	if err != nil {
-		m.log.Panic("Mongo URL is invalid: ", err)
+// Shutdown stops the rollups, waiting for the running one
+func (m *MongoAggregatePump) Shutdown() error {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.rollupDone
 	}
+	return nil
+}
 
-	if m.timeout > 0 {
-		dialInfo.Timeout = time.Second * time.Duration(m.timeout)
-	}
-
-	m.dbSession, err = mgo.DialWithInfo(dialInfo)
-
-	for err != nil {
-		m.log.WithError(err).WithField("dialinfo", dialInfo).Error("Mongo connection failed. Retrying.")
-		time.Sleep(5 * time.Second)
-		m.dbSession, err = mgo.DialWithInfo(dialInfo)
+func (m *MongoAggregatePump) connect() {
+	if m.store != nil {
+		if err := m.store.Close(context.Background()); err != nil {
+			m.log.WithError(err).Debug("Failed to close the previous connection")
+		}
 	}
+	m.store = dialMongo(m.log, m.dbConf.BaseMongoConf, m.timeout)
 
-	if err == nil && m.dbConf.MongoDBType == 0 {
-		m.dbConf.MongoDBType = mongoType(m.dbSession)
+	if m.dbConf.MongoDBType == 0 {
+		m.dbConf.MongoDBType = m.store.DBType(context.Background())
 	}
+	m.updatePipelines = m.dbConf.MongoDBType == StandardMongo && mongoSupportsUpdatePipelines(context.Background(), m.store)
 }
 
-func (m *MongoAggregatePump) ensureIndexes(c *mgo.Collection) error {
+func (m *MongoAggregatePump) ensureIndexes(ctx context.Context, c string) error {
 	var err error
-	ttlIndex := mgo.Index{
-		Key:         []string{"expireAt"},
-		ExpireAfter: 0,
-		Background:  m.dbConf.MongoDBType == StandardMongo,
+	ttlIndex := mongoIndex{
+		Keys:       []string{"expireAt"},
+		TTL:        true,
+		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = mgohacks.EnsureTTLIndex(c, ttlIndex)
+	err = m.store.EnsureIndex(ctx, c, ttlIndex)
 	if err != nil {
 		return err
 	}
 
-	apiIndex := mgo.Index{
-		Key:        []string{"timestamp"},
+	apiIndex := mongoIndex{
+		Keys:       []string{"timestamp"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(apiIndex)
+	err = m.store.EnsureIndex(ctx, c, apiIndex)
 	if err != nil {
 		return err
 	}
 
-	orgIndex := mgo.Index{
-		Key:        []string{"orgid"},
+	orgIndex := mongoIndex{
+		Keys:       []string{"orgid"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	return c.EnsureIndex(orgIndex)
+	return m.store.EnsureIndex(ctx, c, orgIndex)
+}
+
+// ensureIndexesOnce ensures the indexes of the collection on its first write only
+func (m *MongoAggregatePump) ensureIndexesOnce(ctx context.Context, c string) {
+	if _, found := m.indexed.Load(c); found {
+		return
+	}
+
+	if err := m.ensureIndexes(ctx, c); err != nil {
+		m.log.Error(err)
+		return
+	}
+	m.indexed.Store(c, true)
 }
 
 func (m *MongoAggregatePump) WriteData(ctx context.Context, data []interface{}) error {
 	m.log.Debug("Attempting to write ", len(data), " records")
 
-	if m.dbSession == nil {
+	if m.store == nil {
 		m.log.Debug("Connecting to analytics store")
 		m.connect()
 		m.WriteData(ctx, data)
 	} else {
-		// calculate aggregates
-		analyticsPerOrg := analytics.AggregateData(data, m.dbConf.TrackAllPaths, m.dbConf.IgnoreTagPrefixList, m.dbConf.StoreAnalyticsPerMinute)
+		// calculate aggregates, per organisation and bucket
+		granularity := m.granularity
+		if granularity == 0 {
+			granularity = time.Hour
+			if m.dbConf.StoreAnalyticsPerMinute {
+				granularity = time.Minute
+			}
+		}
+		aggregates := analytics.AggregateDataWithGranularity(data, m.dbConf.TrackAllPaths, m.dbConf.IgnoreTagPrefixList, m.dbConf.LatencySketchDimensions, granularity)
 
-		// put aggregated data into MongoDB
-		for orgID, filteredData := range analyticsPerOrg {
-			collectionName, collErr := m.GetCollectionName(orgID)
+		// the aggregates are written with a bulk write per organisation collection
+		var collections []string
+		writes := make(map[string][]mongoAggregateWrite)
+
+		for _, filteredData := range aggregates {
+			if m.granularity == 0 {
+				// the documents of the legacy hourly or per minute aggregation have no granularity
+				filteredData.Granularity = 0
+			}
+
+			collectionName, collErr := m.GetCollectionName(filteredData.OrgID)
 			if collErr != nil {
 				m.log.Info("No OrgID for AnalyticsRecord, skipping")
 				continue
 			}
 
-			thisSession := m.dbSession.Copy()
-			defer thisSession.Close()
-
-			analyticsCollection := thisSession.DB("").C(collectionName)
-			indexCreateErr := m.ensureIndexes(analyticsCollection)
-
-			if indexCreateErr != nil {
-				m.log.Error(indexCreateErr)
-			}
+			m.ensureIndexesOnce(ctx, collectionName)
 
 			query := bson.M{
 				"orgid":     filteredData.OrgID,
 				"timestamp": filteredData.TimeStamp,
 			}
+			if filteredData.Granularity > 0 {
+				query["granularity"] = filteredData.Granularity
+			}
 
 			if len(m.dbConf.IgnoreAggregationsList) > 0 {
 				filteredData.DiscardAggregations(m.dbConf.IgnoreAggregationsList)
 			}
+			if m.dbConf.EnforceThresholdLenTagList {
+				m.suppressTags(&filteredData)
+			}
 
-			updateDoc := filteredData.AsChange()
-
-			change := mgo.Change{
-				Update:    updateDoc,
-				ReturnNew: true,
-				Upsert:    true,
+			if _, found := writes[collectionName]; !found {
+				collections = append(collections, collectionName)
 			}
+			writes[collectionName] = append(writes[collectionName], mongoAggregateWrite{query: query, aggregate: filteredData})
+		}
 
-			doc := analytics.AnalyticsRecordAggregate{}
-			_, err := analyticsCollection.Find(query).Apply(change, &doc)
+		mixed := make([]mongoReplacement, 0, len(aggregates))
 
+		// every collection is written, their failures being returned together
+		var errs []string
+		disconnected := false
+		for _, collectionName := range collections {
+			docs, err := m.upsertAggregates(ctx, collectionName, writes[collectionName])
 			if err != nil {
-				m.log.WithField("query", query).Error("UPSERT Failure: ", err)
-				return m.HandleWriteErr(err)
-			}
-
-			// We have the new doc back, lets fix the averages
-			avgUpdateDoc := doc.AsTimeUpdate()
-			avgChange := mgo.Change{
-				Update:    avgUpdateDoc,
-				ReturnNew: true,
+				m.log.WithField("collection", collectionName).Error("Problem inserting or updating to mongo collection: ", err)
+				errs = append(errs, fmt.Sprintf("%s: %s", collectionName, err))
+				disconnected = disconnected || isMongoDisconnected(err)
+				continue
 			}
-			withTimeUpdate := analytics.AnalyticsRecordAggregate{}
-			_, avgErr := analyticsCollection.Find(query).Apply(avgChange, &withTimeUpdate)
 
-			if m.dbConf.ThresholdLenTagList != -1 && (len(withTimeUpdate.Tags) > m.dbConf.ThresholdLenTagList) {
-				m.printAlert(withTimeUpdate, m.dbConf.ThresholdLenTagList)
-			}
+			for i, doc := range docs {
+				if m.dbConf.ThresholdLenTagList != -1 && (len(doc.Tags) > m.dbConf.ThresholdLenTagList) {
+					if m.dbConf.EnforceThresholdLenTagList {
+						m.tripTagThreshold(doc)
+					} else {
+						m.printAlert(doc, m.dbConf.ThresholdLenTagList)
+					}
+				}
 
-			if avgErr != nil {
-				m.log.WithField("query", query).Error("AvgUpdate Failure: ", avgErr)
-				return m.HandleWriteErr(avgErr)
+				if m.dbConf.UseMixedCollection {
+					mixed = append(mixed, mongoReplacement{Query: writes[collectionName][i].query, Doc: doc, Upsert: true})
+				}
 			}
 
 			m.log.WithFields(logrus.Fields{
 				"collection": collectionName,
 			}).Debug("Wrote aggregated data for ", len(data), " records")
+		}
 
-			if m.dbConf.UseMixedCollection {
-				thisData := analytics.AnalyticsRecordAggregate{}
-				err := analyticsCollection.Find(query).One(&thisData)
-				if err != nil {
-					m.log.WithField("query", query).Error("Couldn't find query doc:", err)
-				} else {
-					m.doMixedWrite(thisData, query)
-				}
+		if len(mixed) > 0 {
+			m.doMixedWrite(ctx, mixed)
+		}
+
+		if len(errs) > 0 {
+			if disconnected {
+				m.log.Warning("--> Detected connection failure, reconnecting")
+				m.connect()
 			}
+			return fmt.Errorf("%d of %d collections couldn't be written: %s", len(errs), len(collections), strings.Join(errs, "; "))
 		}
 	}
 	m.log.Info("Purged ", len(data), " records...")
@@ -303,34 +392,283 @@ func (m *MongoAggregatePump) WriteData(ctx context.Context, data []interface{})
 	return nil
 }
 
-func (m *MongoAggregatePump) doMixedWrite(changeDoc analytics.AnalyticsRecordAggregate, query bson.M) {
-	thisSession := m.dbSession.Copy()
-	defer thisSession.Close()
-	analyticsCollection := thisSession.DB("").C(analytics.AgggregateMixedCollectionName)
-	m.ensureIndexes(analyticsCollection)
+// mongoAggregateWrite is the aggregate of a bucket and the query of its document
+type mongoAggregateWrite struct {
+	query     bson.M
+	aggregate analytics.AnalyticsRecordAggregate
+}
 
-	if len(m.dbConf.IgnoreAggregationsList) > 0 {
-		changeDoc.DiscardAggregations(m.dbConf.IgnoreAggregationsList)
+// Number of the last writes whose id is kept in the aggregate documents
+const mongoAggregateWriteIDs = 10
+
+// Number of the attempts to write the aggregates guarded by their stored documents, the last one isn't guarded
+const mongoAggregateAttempts = 3
+
+// upsertAggregates adds the aggregates to the documents of their buckets and returns the updated documents.
+// The documents are computed from the stored ones, those of the buckets not written by the previous purge
+// being read at once, and written with their lists and percentiles in a single unordered bulk write. Each
+// update is guarded by the total hits and last time of the stored document so a write of another pump is
+// detected, the buckets whose guard missed being read and written again. The buckets without a document
+// and the last attempt are upserted without a guard.
+func (m *MongoAggregatePump) upsertAggregates(ctx context.Context, c string, writes []mongoAggregateWrite) ([]analytics.AnalyticsRecordAggregate, error) {
+	docs := make([]analytics.AnalyticsRecordAggregate, len(writes))
+	lastDocs := m.takeLastDocs(c)
+	writeID := primitive.NewObjectID().Hex()
+
+	// stored documents of the buckets, by write
+	stored := make(map[int]analytics.AnalyticsRecordAggregate)
+	pending := make([]int, len(writes))
+	for i, w := range writes {
+		if doc, found := findBucketDoc(lastDocs, w.aggregate); found {
+			stored[i] = doc
+		}
+		pending[i] = i
 	}
 
-	avgChange := mgo.Change{
-		Update:    changeDoc,
-		ReturnNew: true,
-		Upsert:    true,
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var unknown []int
+		for _, i := range pending {
+			if _, found := stored[i]; !found {
+				unknown = append(unknown, i)
+			}
+		}
+		if len(unknown) > 0 {
+			if err := m.readBucketDocs(ctx, c, writes, unknown, stored); err != nil {
+				m.log.WithField("collection", c).Error("Failed to read the aggregates: ", err)
+				return docs, err
+			}
+		}
+
+		var guarded []int
+		updates := make([]mongoUpdate, len(pending))
+		for n, i := range pending {
+			w := writes[i]
+			query := bson.M{}
+			for k, v := range w.query {
+				query[k] = v
+			}
+
+			doc, found := stored[i]
+			if !found {
+				doc = analytics.AnalyticsRecordAggregate{OrgID: w.aggregate.OrgID, TimeStamp: w.aggregate.TimeStamp, TimeID: w.aggregate.TimeID}
+			}
+			guard := found && attempt < mongoAggregateAttempts
+			if guard {
+				query["total.hits"] = doc.Total.Hits
+				query["lasttime"] = doc.LastTime
+				guarded = append(guarded, i)
+			}
+
+			doc.Apply(w.aggregate)
+			docs[i] = doc
+			updates[n] = mongoUpdate{Query: query, Update: m.aggregateUpdate(w.aggregate.AsChange(), &docs[i], writeID), Upsert: !guard}
+		}
+
+		written, err := m.store.BulkUpdate(ctx, c, updates)
+		if err != nil {
+			m.log.WithField("collection", c).Error("UPSERT Failure: ", err)
+			return docs, err
+		}
+
+		pending = nil
+		if int(written) < len(updates) {
+			m.log.WithField("collection", c).Debug("Aggregates written by another pump, reading them back")
+			applied, err := m.appliedWrites(ctx, c, writes, guarded, writeID)
+			if err != nil {
+				return docs, err
+			}
+			for _, i := range guarded {
+				if !applied[i] {
+					delete(stored, i)
+					pending = append(pending, i)
+				}
+			}
+		}
+	}
+
+	m.putLastDocs(c, docs)
+	return docs, nil
+}
+
+// readBucketDocs reads the stored documents of the buckets of the writes
+func (m *MongoAggregatePump) readBucketDocs(ctx context.Context, c string, writes []mongoAggregateWrite, indexes []int, stored map[int]analytics.AnalyticsRecordAggregate) error {
+	timestamps := make([]interface{}, len(indexes))
+	for n, i := range indexes {
+		timestamps[n] = writes[i].aggregate.TimeStamp
 	}
 
+	cursor, err := m.store.Find(ctx, c, bson.M{"timestamp": bson.M{"$in": timestamps}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		doc := analytics.AnalyticsRecordAggregate{}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		for _, i := range indexes {
+			if writes[i].aggregate.TimeStamp.Equal(doc.TimeStamp) && writes[i].aggregate.Granularity == doc.Granularity {
+				stored[i] = doc
+			}
+		}
+	}
+	return cursor.Err()
+}
+
+// appliedWrites returns the guarded writes applied by the bulk write, from the ids of the last writes of the documents
+func (m *MongoAggregatePump) appliedWrites(ctx context.Context, c string, writes []mongoAggregateWrite, guarded []int, writeID string) (map[int]bool, error) {
+	timestamps := make([]interface{}, len(guarded))
+	for i, w := range guarded {
+		timestamps[i] = writes[w].aggregate.TimeStamp
+	}
+
+	cursor, err := m.store.Find(ctx, c, bson.M{"timestamp": bson.M{"$in": timestamps}, "writeids": writeID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	applied := make(map[int]bool)
+	for cursor.Next(ctx) {
+		var doc struct {
+			TimeStamp   time.Time `bson:"timestamp"`
+			Granularity int       `bson:"granularity"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		for _, i := range guarded {
+			if writes[i].aggregate.TimeStamp.Equal(doc.TimeStamp) && writes[i].aggregate.Granularity == doc.Granularity {
+				applied[i] = true
+			}
+		}
+	}
+	return applied, cursor.Err()
+}
+
+// aggregateUpdate converts the change of an aggregate to the update of its document, with the lists and
+// percentiles of the updated document. The update pipelines need a MongoDB 4.2, the update operators are
+// used with older servers and DocumentDB.
+func (m *MongoAggregatePump) aggregateUpdate(change bson.M, doc *analytics.AnalyticsRecordAggregate, writeID string) interface{} {
+	if m.updatePipelines {
+		return aggregatePipeline(change, doc, writeID)
+	}
+	return aggregateOperators(change, doc, writeID)
+}
+
+// aggregateOperators adds the lists and averages of the updated document to the change, and writeID to the
+// ids of the last writes of the document
+func aggregateOperators(change bson.M, doc *analytics.AnalyticsRecordAggregate, writeID string) bson.M {
+	set := change["$set"].(bson.M)
+	for k, v := range doc.AsTimeUpdate()["$set"].(bson.M) {
+		set[k] = v
+	}
+	change["$push"] = bson.M{"writeids": bson.M{"$each": bson.A{writeID}, "$slice": -mongoAggregateWriteIDs}}
+	return change
+}
+
+// aggregatePipeline converts the change of an aggregate to an update pipeline: the counters are updated,
+// then their averages computed from the updated counters. When the updated document is known, its lists
+// and percentiles are set too, and writeID is kept in the ids of the last writes of the document.
+func aggregatePipeline(change bson.M, doc *analytics.AnalyticsRecordAggregate, writeID string) bson.A {
+	counters := bson.M{}
+	averages := bson.M{}
+	for k, v := range change["$inc"].(bson.M) {
+		counters[k] = bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + k, 0}}, v}}
+		if strings.HasSuffix(k, ".hits") {
+			prefix := strings.TrimSuffix(k, "hits")
+			averages[prefix+"requesttime"] = mongoAverage(prefix+"totalrequesttime", prefix+"hits")
+			averages[prefix+"latency"] = mongoAverage(prefix+"totallatency", prefix+"hits")
+			averages[prefix+"upstreamlatency"] = mongoAverage(prefix+"totalupstreamlatency", prefix+"hits")
+		}
+	}
+	for k, v := range change["$max"].(bson.M) {
+		counters[k] = bson.M{"$max": bson.A{"$" + k, v}}
+	}
+	if min, ok := change["$min"].(bson.M); ok {
+		for k, v := range min {
+			counters[k] = bson.M{"$min": bson.A{"$" + k, v}}
+		}
+	}
+	for k, v := range change["$set"].(bson.M) {
+		counters[k] = bson.M{"$literal": v}
+	}
+
+	pipeline := bson.A{bson.M{"$set": counters}, bson.M{"$set": averages}}
+	if doc != nil {
+		lists := bson.M{}
+		for k, v := range doc.AsTimeUpdate()["$set"].(bson.M) {
+			if _, found := averages[k]; !found {
+				lists[k] = bson.M{"$literal": v}
+			}
+		}
+		pipeline = append(pipeline, bson.M{"$set": lists})
+	}
+	if writeID != "" {
+		writeIDs := bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$writeids", bson.A{}}}, bson.A{writeID}}}
+		pipeline = append(pipeline, bson.M{"$set": bson.M{"writeids": bson.M{"$slice": bson.A{writeIDs, -mongoAggregateWriteIDs}}}})
+	}
+	return pipeline
+}
+
+// mongoAverage is the expression of the average of the total field per hit, 0 without hits
+func mongoAverage(total, hits string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{"$" + hits, 0}},
+		bson.M{"$divide": bson.A{"$" + total, "$" + hits}},
+		0,
+	}}
+}
+
+// findBucketDoc returns the document of the bucket of the aggregate
+func findBucketDoc(docs []analytics.AnalyticsRecordAggregate, aggregate analytics.AnalyticsRecordAggregate) (analytics.AnalyticsRecordAggregate, bool) {
+	for _, doc := range docs {
+		// the timestamps of the documents read back are in UTC
+		if doc.TimeStamp.Equal(aggregate.TimeStamp) && doc.Granularity == aggregate.Granularity {
+			return doc, true
+		}
+	}
+	return analytics.AnalyticsRecordAggregate{}, false
+}
+
+// takeLastDocs removes and returns the documents of the buckets written by the last purge in the collection
+func (m *MongoAggregatePump) takeLastDocs(c string) []analytics.AnalyticsRecordAggregate {
+	m.lastDocsMu.Lock()
+	defer m.lastDocsMu.Unlock()
+
+	docs := m.lastDocs[c]
+	delete(m.lastDocs, c)
+	return docs
+}
+
+func (m *MongoAggregatePump) putLastDocs(c string, docs []analytics.AnalyticsRecordAggregate) {
+	m.lastDocsMu.Lock()
+	defer m.lastDocsMu.Unlock()
+
+	if m.lastDocs == nil {
+		m.lastDocs = make(map[string][]analytics.AnalyticsRecordAggregate)
+	}
+	m.lastDocs[c] = docs
+}
+
+// doMixedWrite copies the documents of the organisations to the mixed collection in a single bulk write
+func (m *MongoAggregatePump) doMixedWrite(ctx context.Context, replacements []mongoReplacement) {
+	m.ensureIndexesOnce(ctx, analytics.AgggregateMixedCollectionName)
+
 	m.log.WithFields(logrus.Fields{
 		"collection": analytics.AgggregateMixedCollectionName,
-	}).Debug("Attempt to upsert aggregated doc")
+	}).Debug("Attempt to upsert aggregated docs")
 
-	final := analytics.AnalyticsRecordAggregate{}
-	_, avgErr := analyticsCollection.Find(query).Apply(avgChange, &final)
+	err := m.store.ReplaceMany(ctx, analytics.AgggregateMixedCollectionName, replacements)
 
-	if avgErr != nil {
+	if err != nil {
 		m.log.WithFields(logrus.Fields{
 			"collection": analytics.AgggregateMixedCollectionName,
-		}).Error("Mixed coll upsert failure: ", avgErr)
-		m.HandleWriteErr(avgErr)
+		}).Error("Mixed coll upsert failure: ", err)
+		m.HandleWriteErr(err)
+		return
 	}
 	m.log.WithFields(logrus.Fields{
 		"collection": analytics.AgggregateMixedCollectionName,
@@ -340,15 +678,10 @@ func (m *MongoAggregatePump) doMixedWrite(changeDoc analytics.AnalyticsRecordAgg
 func (m *MongoAggregatePump) HandleWriteErr(err error) error {
 	if err != nil {
 		m.log.Error("Problem inserting or updating to mongo collection: ", err)
-		if strings.Contains(err.Error(), "Closed explicitly") || strings.Contains(err.Error(), "EOF") {
+		if isMongoDisconnected(err) {
 			m.log.Warning("--> Detected connection failure, reconnecting")
 			m.connect()
 		}
 	}
 	return err
 }
-
-// WriteUptimeData will pull the data from the in-memory store and drop it into the specified MongoDB collection
-func (m *MongoAggregatePump) WriteUptimeData(data []interface{}) {
-	m.log.Warning("Mongo Aggregate should not be writing uptime data!")
-}
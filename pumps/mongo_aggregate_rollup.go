@@ -0,0 +1,274 @@
+package pumps
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	defaultRollupInterval     = 300
+	aggregateCollectionPrefix = "z_tyk_analyticz_aggregate_"
+)
+
+// AggregateRollupConf configures the compaction of the aggregates into coarser ones
+type AggregateRollupConf struct {
+	// Granularity of the rolled up documents: 5m, 15m, 1h or 1d
+	Granularity string `mapstructure:"granularity"`
+	// Age in seconds after which the finer documents are rolled up
+	After int `mapstructure:"after"`
+	// Seconds the rolled up documents are kept. 0 keeps the expiry of the finer documents
+	TTL int `mapstructure:"ttl"`
+}
+
+type aggregateRollup struct {
+	granularity time.Duration
+	after       time.Duration
+	ttl         time.Duration
+}
+
+// parseRollups validates the rollups, which must be ordered from the finest to the coarsest
+// granularity, each one being a multiple of the previous one
+func parseRollups(granularity time.Duration, confs []AggregateRollupConf) ([]aggregateRollup, error) {
+	rollups := make([]aggregateRollup, 0, len(confs))
+	previous := granularity
+
+	for _, conf := range confs {
+		d, err := analytics.ParseGranularity(conf.Granularity)
+		if err != nil {
+			return nil, err
+		}
+		if d <= previous || d%previous != 0 {
+			return nil, fmt.Errorf("rollup granularity %s must be a multiple of the previous granularity %s", d, previous)
+		}
+		if conf.After <= 0 {
+			return nil, fmt.Errorf("rollup %s must have a positive after", conf.Granularity)
+		}
+
+		rollups = append(rollups, aggregateRollup{
+			granularity: d,
+			after:       time.Duration(conf.After) * time.Second,
+			ttl:         time.Duration(conf.TTL) * time.Second,
+		})
+		previous = d
+	}
+
+	return rollups, nil
+}
+
+func (m *MongoAggregatePump) rollupLoop(interval time.Duration) {
+	defer close(m.rollupDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.rollup(time.Now())
+		}
+	}
+}
+
+// rollup compacts the aggregates of all the organisations which are older than the configured ages
+func (m *MongoAggregatePump) rollup(now time.Time) {
+	if m.store == nil {
+		return
+	}
+	ctx := context.Background()
+
+	collectionNames, err := m.store.CollectionNames(ctx)
+	if err != nil {
+		m.HandleWriteErr(err)
+		return
+	}
+
+	for _, collectionName := range collectionNames {
+		if !strings.HasPrefix(collectionName, aggregateCollectionPrefix) &&
+			!(m.dbConf.UseMixedCollection && collectionName == analytics.AgggregateMixedCollectionName) {
+			continue
+		}
+
+		for _, r := range m.rollups {
+			if err := m.rollupCollection(ctx, collectionName, r, now); err != nil {
+				m.log.WithField("collection", collectionName).Error("Rollup failure: ", err)
+				break
+			}
+		}
+	}
+}
+
+// rollupSource is the merge of the documents of an organisation bucket tagged with the same rollup id
+type rollupSource struct {
+	rolled analytics.AnalyticsRecordAggregate
+	ids    []interface{}
+}
+
+// rollupCollection merges the documents finer than the rollup granularity into one document per
+// organisation and bucket, then removes them. Only complete buckets older than the rollup age are processed.
+func (m *MongoAggregatePump) rollupCollection(ctx context.Context, c string, r aggregateRollup, now time.Time) error {
+	seconds := int(r.granularity / time.Second)
+	cutoff := analytics.TruncateTimestamp(now.Add(-r.after), r.granularity)
+
+	query := bson.M{
+		"granularity": bson.M{"$lt": seconds},
+		"timestamp":   bson.M{"$lt": cutoff},
+	}
+	iter, err := m.store.Find(ctx, c, query, "orgid", "timestamp")
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		ID                                 interface{} `bson:"_id"`
+		RollupID                           string      `bson:"rollupid,omitempty"`
+		analytics.AnalyticsRecordAggregate `bson:",inline"`
+	}
+	// the documents of the current bucket per rollup id, the ones not tagged yet having an empty id
+	var bucket map[string]*rollupSource
+	var orgID string
+	var start time.Time
+	rolledUp := 0
+
+	for iter.Next(ctx) {
+		if err := iter.Decode(&doc); err != nil {
+			iter.Close(ctx)
+			return err
+		}
+
+		docStart := analytics.TruncateTimestamp(doc.TimeStamp, r.granularity)
+		if bucket != nil && (orgID != doc.OrgID || !start.Equal(docStart)) {
+			if err := m.writeRollups(ctx, c, bucket, r); err != nil {
+				iter.Close(ctx)
+				return err
+			}
+			bucket = nil
+		}
+
+		if bucket == nil {
+			bucket = make(map[string]*rollupSource)
+			orgID, start = doc.OrgID, docStart
+		}
+		source := bucket[doc.RollupID]
+		if source == nil {
+			source = &rollupSource{rolled: analytics.AnalyticsRecordAggregate{}.New()}
+			source.rolled.OrgID = doc.OrgID
+			source.rolled.TimeStamp = docStart
+			source.rolled.Granularity = seconds
+			bucket[doc.RollupID] = source
+		}
+		source.rolled.Merge(doc.AnalyticsRecordAggregate)
+		source.ids = append(source.ids, doc.ID)
+		rolledUp++
+
+		doc.ID, doc.RollupID = nil, ""
+		doc.AnalyticsRecordAggregate = analytics.AnalyticsRecordAggregate{}
+	}
+	err = iter.Err()
+	iter.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	if bucket != nil {
+		if err := m.writeRollups(ctx, c, bucket, r); err != nil {
+			return err
+		}
+	}
+
+	if rolledUp > 0 {
+		m.log.WithField("collection", c).Info("Rolled up ", rolledUp, " aggregates to ", r.granularity)
+	}
+
+	return nil
+}
+
+// writeRollups writes the documents of a bucket: the ones tagged by an interrupted rollup are
+// finished first, then the others are tagged with a new rollup id and written
+func (m *MongoAggregatePump) writeRollups(ctx context.Context, c string, bucket map[string]*rollupSource, r aggregateRollup) error {
+	rollupIDs := make([]string, 0, len(bucket))
+	for rollupID := range bucket {
+		if rollupID != "" {
+			rollupIDs = append(rollupIDs, rollupID)
+		}
+	}
+	sort.Strings(rollupIDs)
+
+	for _, rollupID := range rollupIDs {
+		if err := m.writeRollup(ctx, c, bucket[rollupID].rolled, rollupID, r); err != nil {
+			return err
+		}
+	}
+
+	source := bucket[""]
+	if source == nil {
+		return nil
+	}
+	rollupID := primitive.NewObjectID().Hex()
+	tagged, err := m.store.UpdateMany(ctx, c, bson.M{
+		"_id":      bson.M{"$in": source.ids},
+		"rollupid": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"rollupid": rollupID}})
+	if err != nil {
+		return m.HandleWriteErr(err)
+	}
+	if tagged != int64(len(source.ids)) {
+		// another pump tagged some of them, the documents tagged here are written by the next run
+		return fmt.Errorf("%d of the %d aggregates to roll up were tagged concurrently", int64(len(source.ids))-tagged, len(source.ids))
+	}
+
+	return m.writeRollup(ctx, c, source.rolled, rollupID, r)
+}
+
+// writeRollup adds the rolled up aggregate to its document, fixes its averages and removes the documents
+// it was made of. The document keeps the ids of the rollups it contains until their documents are removed,
+// so every step can be replayed after an interruption without counting the documents twice.
+func (m *MongoAggregatePump) writeRollup(ctx context.Context, c string, rolled analytics.AnalyticsRecordAggregate, rollupID string, r aggregateRollup) error {
+	query := bson.M{
+		"orgid":       rolled.OrgID,
+		"timestamp":   rolled.TimeStamp,
+		"granularity": rolled.Granularity,
+	}
+
+	if r.ttl > 0 {
+		rolled.ExpireAt = rolled.TimeStamp.Add(r.granularity).Add(r.ttl)
+	}
+
+	// the document is created first, as the update guarded by the rollup ids can't be an upsert
+	if err := m.store.FindAndModify(ctx, c, query, bson.M{"$setOnInsert": bson.M{"rollupids": bson.A{}}}, true, nil); err != nil {
+		return m.HandleWriteErr(err)
+	}
+
+	guarded := bson.M{"rollupids": bson.M{"$ne": rollupID}}
+	for k, v := range query {
+		guarded[k] = v
+	}
+	change := rolled.AsChange()
+	change["$push"] = bson.M{"rollupids": rollupID}
+	if _, err := m.store.Update(ctx, c, guarded, change); err != nil {
+		return m.HandleWriteErr(err)
+	}
+
+	doc := analytics.AnalyticsRecordAggregate{}
+	if err := m.store.FindOne(ctx, c, query, &doc); err != nil {
+		return m.HandleWriteErr(err)
+	}
+	if err := m.store.FindAndModify(ctx, c, query, doc.AsTimeUpdate(), false, nil); err != nil {
+		return m.HandleWriteErr(err)
+	}
+
+	if _, err := m.store.Remove(ctx, c, bson.M{"orgid": rolled.OrgID, "rollupid": rollupID}); err != nil {
+		return m.HandleWriteErr(err)
+	}
+
+	_, err := m.store.Update(ctx, c, query, bson.M{"$pull": bson.M{"rollupids": rollupID}})
+	return m.HandleWriteErr(err)
+}
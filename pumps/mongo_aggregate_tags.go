@@ -0,0 +1,199 @@
+package pumps
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// TagExplosion is reported when the aggregate of an organisation has more tags than threshold_len_tag_list.
+// With enforce_threshold_len_tag_list, the new tags of its bucket are suppressed and the most common
+// tag prefixes are ignored for the organisation from then on.
+type TagExplosion struct {
+	OrgID string `json:"org_id"`
+	// Bucket of the aggregate which crossed the threshold
+	TimeStamp time.Time `json:"timestamp"`
+	Tags      int       `json:"tags"`
+	// Tags suppressed since the threshold was crossed
+	Suppressed      int       `json:"suppressed"`
+	IgnoredPrefixes []string  `json:"ignored_prefixes"`
+	DetectedAt      time.Time `json:"detected_at"`
+}
+
+type tagExplosionState struct {
+	TagExplosion
+	// tags of the bucket when the threshold was crossed, the only ones still aggregated. Nil once the bucket is over.
+	known map[string]bool
+}
+
+// tagGuard suppresses the tags of the organisations whose aggregates crossed the threshold
+type tagGuard struct {
+	mu         sync.Mutex
+	explosions map[string]*tagExplosionState
+}
+
+// tagGuards are the guards of the pumps, listed by the admin API
+var tagGuards struct {
+	sync.Mutex
+	guards []*tagGuard
+}
+
+func newTagGuard() *tagGuard {
+	g := &tagGuard{explosions: make(map[string]*tagExplosionState)}
+
+	tagGuards.Lock()
+	tagGuards.guards = append(tagGuards.guards, g)
+	tagGuards.Unlock()
+
+	return g
+}
+
+// TagExplosions returns the tag explosions detected by the Mongo aggregate pumps
+func TagExplosions() []TagExplosion {
+	tagGuards.Lock()
+	defer tagGuards.Unlock()
+
+	explosions := make([]TagExplosion, 0)
+	for _, g := range tagGuards.guards {
+		g.mu.Lock()
+		for _, st := range g.explosions {
+			explosion := st.TagExplosion
+			explosion.IgnoredPrefixes = append([]string{}, st.IgnoredPrefixes...)
+			explosions = append(explosions, explosion)
+		}
+		g.mu.Unlock()
+	}
+
+	sort.Slice(explosions, func(i, j int) bool { return explosions[i].DetectedAt.Before(explosions[j].DetectedAt) })
+	return explosions
+}
+
+// ResetTagExplosion aggregates all the tags of the organisation again. It returns false if no explosion was detected.
+func ResetTagExplosion(orgID string) bool {
+	tagGuards.Lock()
+	defer tagGuards.Unlock()
+
+	found := false
+	for _, g := range tagGuards.guards {
+		g.mu.Lock()
+		if _, exists := g.explosions[orgID]; exists {
+			delete(g.explosions, orgID)
+			found = true
+		}
+		g.mu.Unlock()
+	}
+	return found
+}
+
+// filter removes the suppressed tags from the aggregate and returns their number
+func (g *tagGuard) filter(aggregate *analytics.AnalyticsRecordAggregate) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st, found := g.explosions[aggregate.OrgID]
+	if !found {
+		return 0
+	}
+	// the next buckets get new tags again, except the ignored prefixes
+	if !st.TimeStamp.Equal(aggregate.TimeStamp) {
+		st.known = nil
+	}
+
+	suppressed := 0
+	for tag := range aggregate.Tags {
+		// the tags of the bucket are still aggregated until its end
+		suppress := hasTagPrefix(tag, st.IgnoredPrefixes)
+		if st.known != nil {
+			suppress = !st.known[tag]
+		}
+		if suppress {
+			delete(aggregate.Tags, tag)
+			suppressed++
+		}
+	}
+	st.Suppressed += suppressed
+
+	return suppressed
+}
+
+// trip suppresses the new tags of the bucket of the document and ignores their most common prefixes.
+// It returns the explosion, or false if the bucket already crossed the threshold.
+func (g *tagGuard) trip(doc analytics.AnalyticsRecordAggregate) (TagExplosion, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st, found := g.explosions[doc.OrgID]
+	if found && st.known != nil && st.TimeStamp.Equal(doc.TimeStamp) {
+		return st.TagExplosion, false
+	}
+	if !found {
+		st = &tagExplosionState{}
+		g.explosions[doc.OrgID] = st
+	}
+
+	tags := make([]string, 0, len(doc.Tags))
+	st.known = make(map[string]bool, len(doc.Tags))
+	for tag := range doc.Tags {
+		tags = append(tags, tag)
+		st.known[tag] = true
+	}
+
+	prefixes := getListOfCommonPrefix(tags)
+	if len(prefixes) > COMMON_TAGS_COUNT {
+		prefixes = prefixes[:COMMON_TAGS_COUNT]
+	}
+	for _, prefix := range prefixes {
+		if !contains(st.IgnoredPrefixes, prefix) {
+			st.IgnoredPrefixes = append(st.IgnoredPrefixes, prefix)
+		}
+	}
+
+	st.OrgID = doc.OrgID
+	st.TimeStamp = doc.TimeStamp
+	st.Tags = len(doc.Tags)
+	st.Suppressed = 0
+	st.DetectedAt = time.Now()
+
+	return st.TagExplosion, true
+}
+
+func hasTagPrefix(tag string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressTags removes the tags suppressed for the organisation from its aggregate
+func (m *MongoAggregatePump) suppressTags(aggregate *analytics.AnalyticsRecordAggregate) {
+	suppressed := m.tags.filter(aggregate)
+	if suppressed == 0 {
+		return
+	}
+
+	m.log.WithField("org_id", aggregate.OrgID).Debug("Suppressed ", suppressed, " tags")
+	if Instrument != nil {
+		Instrument.NewJob("MongoAggregate").GaugeKv("tags_suppressed", float64(suppressed), health.Kvs{"org_id": aggregate.OrgID})
+	}
+}
+
+// tripTagThreshold reports the document crossing the threshold, and stops aggregating its new tags
+func (m *MongoAggregatePump) tripTagThreshold(doc analytics.AnalyticsRecordAggregate) {
+	explosion, tripped := m.tags.trip(doc)
+	if !tripped {
+		return
+	}
+
+	m.log.WithField("org_id", doc.OrgID).Warnf("Found %d tag entries in the aggregate, more than %d: the new tags of this bucket are suppressed and the tags prefixed by [%s] ignored",
+		explosion.Tags, m.dbConf.ThresholdLenTagList, strings.Join(explosion.IgnoredPrefixes, ", "))
+	if Instrument != nil {
+		Instrument.NewJob("MongoAggregate").EventKv("tag_explosion", health.Kvs{"org_id": doc.OrgID})
+	}
+}
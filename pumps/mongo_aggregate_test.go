@@ -0,0 +1,550 @@
+package pumps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestParseRollups(t *testing.T) {
+	tcs := []struct {
+		testName    string
+		granularity time.Duration
+		rollups     []AggregateRollupConf
+		expectedErr bool
+	}{
+		{"valid", time.Minute, []AggregateRollupConf{{Granularity: "1h", After: 86400}, {Granularity: "1d", After: 604800, TTL: 31536000}}, false},
+		{"unknown granularity", time.Minute, []AggregateRollupConf{{Granularity: "2h", After: 86400}}, true},
+		{"not coarser", time.Hour, []AggregateRollupConf{{Granularity: "15m", After: 86400}}, true},
+		{"unordered", time.Minute, []AggregateRollupConf{{Granularity: "1d", After: 86400}, {Granularity: "1h", After: 86400}}, true},
+		{"missing after", time.Minute, []AggregateRollupConf{{Granularity: "1h"}}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			rollups, err := parseRollups(tc.granularity, tc.rollups)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err == nil && len(rollups) != len(tc.rollups) {
+				t.Fatalf("expected %d rollups, got %d", len(tc.rollups), len(rollups))
+			}
+		})
+	}
+}
+
+// fakeAggregateDriver records the writes of the aggregate pump, the reads returning the stored documents
+type fakeAggregateDriver struct {
+	mongoDriver
+	stored       []bson.Raw
+	reads        int
+	indexes      int
+	updates      []mongoUpdate
+	bulkWrites   int
+	replacements map[string][]mongoReplacement
+	// guardMisses is the number of the next guarded updates which miss, as if another pump wrote the documents
+	guardMisses int
+	// timestamps of the documents whose last write was applied
+	applied []time.Time
+}
+
+func (d *fakeAggregateDriver) EnsureIndex(ctx context.Context, collection string, index mongoIndex) error {
+	d.indexes++
+	return nil
+}
+
+func (d *fakeAggregateDriver) BulkUpdate(ctx context.Context, collection string, updates []mongoUpdate) (int64, error) {
+	d.bulkWrites++
+	d.applied = nil
+	written := 0
+	for _, u := range updates {
+		d.updates = append(d.updates, u)
+		query := u.Query.(bson.M)
+		if _, guarded := query["total.hits"]; guarded && d.guardMisses > 0 {
+			d.guardMisses--
+			continue
+		}
+		d.applied = append(d.applied, query["timestamp"].(time.Time))
+		written++
+	}
+	return int64(written), nil
+}
+
+func (d *fakeAggregateDriver) Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error) {
+	if _, found := query.(bson.M)["writeids"]; !found {
+		d.reads++
+		return &fakeRawCursor{docs: d.stored, i: -1}, nil
+	}
+
+	var docs []bson.Raw
+	for _, ts := range d.applied {
+		doc, err := bson.Marshal(bson.M{"timestamp": ts, "writeids": bson.A{"id"}})
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return &fakeRawCursor{docs: docs, i: -1}, nil
+}
+
+func (d *fakeAggregateDriver) ReplaceMany(ctx context.Context, collection string, replacements []mongoReplacement) error {
+	d.replacements[collection] = append(d.replacements[collection], replacements...)
+	return nil
+}
+
+func (d *fakeAggregateDriver) store(t *testing.T, docs ...analytics.AnalyticsRecordAggregate) {
+	d.stored = nil
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.stored = append(d.stored, raw)
+	}
+}
+
+func TestMongoAggregatePump_WriteData(t *testing.T) {
+	ts := time.Now().Truncate(time.Hour)
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org1", APIID: "api1", ResponseCode: 200, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org2", APIID: "api1", ResponseCode: 200, TimeStamp: ts},
+	}
+
+	store := &fakeAggregateDriver{replacements: make(map[string][]mongoReplacement)}
+
+	m := &MongoAggregatePump{
+		store:            store,
+		dbConf:           &MongoAggregateConf{UseMixedCollection: true, ThresholdLenTagList: -1},
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", analytics.MongoAggregatePrefix)},
+	}
+
+	// the documents aren't stored yet, they are upserted in a single write
+	if err := m.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if store.reads != 2 || store.bulkWrites != 2 {
+		t.Fatalf("expected a read and a write per collection, got %d reads and %d writes", store.reads, store.bulkWrites)
+	}
+	if u := store.updates[0]; !u.Upsert || u.Query.(bson.M)["total.hits"] != nil {
+		t.Errorf("expected an unguarded upsert, got %+v", u)
+	}
+	if mixed := store.replacements[analytics.AgggregateMixedCollectionName]; len(mixed) != 2 {
+		t.Fatalf("expected the documents of the 2 organisations in a single bulk write, got %d", len(mixed))
+	}
+
+	// the next purge of the bucket is a single update, guarded by the written hits
+	store.updates = nil
+	if err := m.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if store.reads != 2 || len(store.updates) != 2 {
+		t.Fatalf("expected 2 updates without reads, got %d reads and %d updates", store.reads, len(store.updates))
+	}
+	if u := store.updates[0]; u.Upsert || u.Query.(bson.M)["total.hits"] != 1 {
+		t.Errorf("expected the update to be guarded by the written hits, got %+v", u)
+	}
+
+	// another pump keeps writing the documents, the last attempt isn't guarded
+	stored := analytics.AggregateData(data[:1], false, nil, false)["org1"]
+	stored.Total.Hits = 100
+	store.store(t, stored)
+	store.guardMisses = 2 * (mongoAggregateAttempts - 1)
+	store.updates = nil
+	if err := m.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if store.reads != 2+2*(mongoAggregateAttempts-1) || len(store.updates) != 2*mongoAggregateAttempts {
+		t.Fatalf("expected the documents to be read and written again, got %d reads and %d updates", store.reads, len(store.updates))
+	}
+	if u := store.updates[len(store.updates)-1]; !u.Upsert || u.Query.(bson.M)["total.hits"] != nil {
+		t.Errorf("expected an unguarded upsert, got %+v", u)
+	}
+
+	// org1, org2 and the mixed collection have 3 indexes each
+	if store.indexes != 9 {
+		t.Errorf("expected the indexes to be ensured once per collection, got %d", store.indexes)
+	}
+}
+
+func TestMongoAggregatePump_WriteDataErrors(t *testing.T) {
+	ts := time.Now().Truncate(time.Hour)
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org1", APIID: "api1", ResponseCode: 200, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org2", APIID: "api1", ResponseCode: 200, TimeStamp: ts},
+	}
+
+	store := &failingAggregateDriver{fakeAggregateDriver: fakeAggregateDriver{replacements: make(map[string][]mongoReplacement)}, failing: "z_tyk_analyticz_aggregate_org1"}
+	m := &MongoAggregatePump{
+		store:            store,
+		dbConf:           &MongoAggregateConf{ThresholdLenTagList: -1},
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", analytics.MongoAggregatePrefix)},
+	}
+
+	err := m.WriteData(context.Background(), data)
+	if err == nil || !strings.Contains(err.Error(), "org1") {
+		t.Fatalf("expected the failure of org1, got %v", err)
+	}
+	if store.bulkWrites != 1 {
+		t.Errorf("expected the collection of org2 to be written, got %d writes", store.bulkWrites)
+	}
+}
+
+// failingAggregateDriver fails the writes of a collection
+type failingAggregateDriver struct {
+	fakeAggregateDriver
+	failing string
+}
+
+func (d *failingAggregateDriver) BulkUpdate(ctx context.Context, collection string, updates []mongoUpdate) (int64, error) {
+	if collection == d.failing {
+		return 0, errors.New("write failed")
+	}
+	return d.fakeAggregateDriver.BulkUpdate(ctx, collection, updates)
+}
+
+func TestMongoAggregatePump_upsertAggregates(t *testing.T) {
+	bucket := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	newAggregate := func(ts time.Time, hits int) analytics.AnalyticsRecordAggregate {
+		aggregate := analytics.AnalyticsRecordAggregate{}.New()
+		aggregate.OrgID = "org1"
+		aggregate.TimeStamp = ts
+		aggregate.LastTime = ts
+		aggregate.Total = analytics.Counter{Hits: hits, Success: hits}
+		return aggregate
+	}
+
+	// the guard of the first bucket misses, another pump wrote it
+	store := &fakeAggregateDriver{guardMisses: 1}
+	store.store(t, newAggregate(bucket, 50))
+
+	m := &MongoAggregatePump{
+		store:            store,
+		dbConf:           &MongoAggregateConf{ThresholdLenTagList: -1},
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", analytics.MongoAggregatePrefix)},
+	}
+	m.putLastDocs("c", []analytics.AnalyticsRecordAggregate{newAggregate(bucket, 10), newAggregate(bucket.Add(time.Hour), 20)})
+
+	writes := []mongoAggregateWrite{
+		{query: bson.M{"orgid": "org1", "timestamp": bucket}, aggregate: newAggregate(bucket, 1)},
+		{query: bson.M{"orgid": "org1", "timestamp": bucket.Add(time.Hour)}, aggregate: newAggregate(bucket.Add(time.Hour), 1)},
+	}
+	docs, err := m.upsertAggregates(context.Background(), "c", writes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.bulkWrites != 2 || len(store.updates) != 3 || store.reads != 1 {
+		t.Fatalf("expected the bucket whose guard missed to be read and written again, got %d reads and %d bulk writes of %d updates",
+			store.reads, store.bulkWrites, len(store.updates))
+	}
+	if hits := store.updates[2].Query.(bson.M)["total.hits"]; hits != 50 {
+		t.Errorf("expected the update to be guarded by the read hits, got %v", hits)
+	}
+	if docs[0].Total.Hits != 51 || docs[1].Total.Hits != 21 {
+		t.Errorf("expected 51 and 21 hits, got %d and %d", docs[0].Total.Hits, docs[1].Total.Hits)
+	}
+	if len(m.takeLastDocs("c")) != 2 {
+		t.Error("expected the documents of the 2 buckets to be kept for the next purge")
+	}
+}
+
+func TestAggregateOperators(t *testing.T) {
+	aggregate := analytics.AnalyticsRecordAggregate{}.New()
+	aggregate.Total = analytics.Counter{Hits: 2, TotalRequestTime: 30}
+	doc := aggregate
+
+	update := aggregateOperators(aggregate.AsChange(), &doc, "id")
+	if hits := update["$inc"].(bson.M)["total.hits"]; hits != 2 {
+		t.Errorf("unexpected hits increment %v", hits)
+	}
+	if requestTime := update["$set"].(bson.M)["total.requesttime"]; requestTime != 15.0 {
+		t.Errorf("expected the request time average of the document, got %v", requestTime)
+	}
+	if _, found := update["$set"].(bson.M)["lists.apiid"]; !found {
+		t.Error("expected the lists of the document")
+	}
+	if _, found := update["$push"].(bson.M)["writeids"]; !found {
+		t.Error("expected the write id")
+	}
+}
+
+func TestMongoSupportsUpdatePipelines(t *testing.T) {
+	tcs := []struct {
+		version  []int
+		expected bool
+	}{
+		{[]int{3, 6, 23, 0}, false},
+		{[]int{4, 0, 0, 0}, false},
+		{[]int{4, 2, 1, 0}, true},
+		{[]int{5, 0, 0, 0}, true},
+		{nil, false},
+	}
+
+	for _, tc := range tcs {
+		if supported := mongoSupportsUpdatePipelines(context.Background(), &fakeBuildInfoDriver{version: tc.version}); supported != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.version, tc.expected, supported)
+		}
+	}
+}
+
+// fakeBuildInfoDriver answers the buildInfo command with the version
+type fakeBuildInfoDriver struct {
+	mongoDriver
+	version []int
+}
+
+func (d *fakeBuildInfoDriver) RunCommand(ctx context.Context, command, result interface{}) error {
+	if d.version == nil {
+		return errors.New("command buildInfo failed")
+	}
+	raw, err := bson.Marshal(bson.M{"versionArray": d.version})
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+func TestAggregatePipeline(t *testing.T) {
+	aggregate := analytics.AnalyticsRecordAggregate{}.New()
+	aggregate.Total = analytics.Counter{Hits: 2, TotalRequestTime: 30}
+
+	pipeline := aggregatePipeline(aggregate.AsChange(), nil, "id")
+	if len(pipeline) != 3 {
+		t.Fatalf("expected the counters, averages and write id stages, got %d stages", len(pipeline))
+	}
+	counters := pipeline[0].(bson.M)["$set"].(bson.M)
+	if hits := counters["total.hits"]; !reflect.DeepEqual(hits, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$total.hits", 0}}, 2}}) {
+		t.Errorf("unexpected hits increment %v", hits)
+	}
+	averages := pipeline[1].(bson.M)["$set"].(bson.M)
+	if _, found := averages["total.requesttime"]; !found {
+		t.Errorf("expected the request time average, got %v", averages)
+	}
+}
+
+func TestGetListOfCommonPrefix(t *testing.T) {
+	tcs := []struct {
+		testName string
+		tags     []string
+		expected []string
+	}{
+		{"single tag", []string{"key-1"}, []string{"key-1"}},
+		{"short single tag", []string{"k"}, []string{}},
+		{"common prefix", []string{"key-1", "key-2", "path-1"}, []string{"key-"}},
+		{"short prefixes ignored", []string{"ab1", "ab2", "a3"}, []string{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			if prefixes := getListOfCommonPrefix(tc.tags); !reflect.DeepEqual(prefixes, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, prefixes)
+			}
+		})
+	}
+}
+
+func TestTagGuard(t *testing.T) {
+	bucket := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	newAggregate := func(ts time.Time, tags ...string) analytics.AnalyticsRecordAggregate {
+		aggregate := analytics.AnalyticsRecordAggregate{}.New()
+		aggregate.OrgID = "org1"
+		aggregate.TimeStamp = ts
+		for _, tag := range tags {
+			aggregate.Tags[tag] = &analytics.Counter{Hits: 1}
+		}
+		return aggregate
+	}
+
+	g := newTagGuard()
+	defer ResetTagExplosion("org1")
+
+	doc := newAggregate(bucket, "key-1", "key-2", "key-3", "path-1")
+	if _, tripped := g.trip(doc); !tripped {
+		t.Fatal("expected the threshold to be tripped")
+	}
+	if _, tripped := g.trip(doc); tripped {
+		t.Error("expected the bucket to be tripped once")
+	}
+
+	// the tags of the bucket are still aggregated, the new ones are suppressed
+	aggregate := newAggregate(bucket, "key-1", "key-4", "other")
+	if suppressed := g.filter(&aggregate); suppressed != 2 || aggregate.Tags["key-1"] == nil {
+		t.Errorf("expected the 2 new tags to be suppressed, got %d and %v", suppressed, aggregate.Tags)
+	}
+
+	// the next bucket only ignores the common prefixes
+	aggregate = newAggregate(bucket.Add(time.Hour), "key-1", "key-4", "other")
+	if suppressed := g.filter(&aggregate); suppressed != 2 || aggregate.Tags["other"] == nil {
+		t.Errorf("expected the tags prefixed by key- to be suppressed, got %d and %v", suppressed, aggregate.Tags)
+	}
+
+	explosions := TagExplosions()
+	if len(explosions) != 1 || explosions[0].Suppressed != 4 || explosions[0].Tags != 4 || !contains(explosions[0].IgnoredPrefixes, "key-") {
+		t.Errorf("unexpected explosions %+v", explosions)
+	}
+
+	if !ResetTagExplosion("org1") {
+		t.Fatal("expected the explosion to be reset")
+	}
+	aggregate = newAggregate(bucket.Add(time.Hour), "key-1")
+	if suppressed := g.filter(&aggregate); suppressed != 0 {
+		t.Errorf("expected the tags to be aggregated after the reset, got %d suppressed", suppressed)
+	}
+}
+
+// fakeRollupDriver keeps the finer documents to roll up and the hits added to the rolled up document,
+// implementing the operations of the rollups
+type fakeRollupDriver struct {
+	mongoDriver
+	sources   []bson.Raw
+	hits      int
+	rollupIDs []string
+	// failRemove fails the removal of the rolled up documents, as if the pump stopped before it
+	failRemove bool
+}
+
+type fakeRollupSource struct {
+	ID                                 int    `bson:"_id"`
+	RollupID                           string `bson:"rollupid,omitempty"`
+	analytics.AnalyticsRecordAggregate `bson:",inline"`
+}
+
+func (d *fakeRollupDriver) add(id int, ts time.Time) {
+	source := fakeRollupSource{ID: id, AnalyticsRecordAggregate: analytics.AnalyticsRecordAggregate{}.New()}
+	source.OrgID, source.TimeStamp, source.Granularity = "org1", ts, 300
+	source.Total.Hits = 1
+	raw, _ := bson.Marshal(source)
+	d.sources = append(d.sources, raw)
+}
+
+func (d *fakeRollupDriver) source(i int) fakeRollupSource {
+	var source fakeRollupSource
+	bson.Unmarshal(d.sources[i], &source)
+	return source
+}
+
+func (d *fakeRollupDriver) Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error) {
+	return &fakeRawCursor{docs: d.sources, i: -1}, nil
+}
+
+func (d *fakeRollupDriver) UpdateMany(ctx context.Context, collection string, query, update interface{}) (int64, error) {
+	ids := query.(bson.M)["_id"].(bson.M)["$in"].([]interface{})
+	tagged := int64(0)
+	for i := range d.sources {
+		source := d.source(i)
+		for _, id := range ids {
+			if fmt.Sprint(source.ID) == fmt.Sprint(id) && source.RollupID == "" {
+				source.RollupID = update.(bson.M)["$set"].(bson.M)["rollupid"].(string)
+				d.sources[i], _ = bson.Marshal(source)
+				tagged++
+			}
+		}
+	}
+	return tagged, nil
+}
+
+func (d *fakeRollupDriver) FindAndModify(ctx context.Context, collection string, query, update interface{}, upsert bool, result interface{}) error {
+	return nil
+}
+
+func (d *fakeRollupDriver) Update(ctx context.Context, collection string, query, update interface{}) (bool, error) {
+	if pull, found := update.(bson.M)["$pull"]; found {
+		rollupID := pull.(bson.M)["rollupids"]
+		for i, id := range d.rollupIDs {
+			if id == rollupID {
+				d.rollupIDs = append(d.rollupIDs[:i], d.rollupIDs[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	rollupID := query.(bson.M)["rollupids"].(bson.M)["$ne"].(string)
+	for _, id := range d.rollupIDs {
+		if id == rollupID {
+			return false, nil
+		}
+	}
+	d.rollupIDs = append(d.rollupIDs, rollupID)
+	d.hits += update.(bson.M)["$inc"].(bson.M)["total.hits"].(int)
+	return true, nil
+}
+
+func (d *fakeRollupDriver) FindOne(ctx context.Context, collection string, query, result interface{}) error {
+	result.(*analytics.AnalyticsRecordAggregate).Total.Hits = d.hits
+	return nil
+}
+
+func (d *fakeRollupDriver) Remove(ctx context.Context, collection string, query interface{}) (int64, error) {
+	if d.failRemove {
+		return 0, errors.New("stopped")
+	}
+	var kept []bson.Raw
+	for i := range d.sources {
+		if d.source(i).RollupID != query.(bson.M)["rollupid"] {
+			kept = append(kept, d.sources[i])
+		}
+	}
+	removed := int64(len(d.sources) - len(kept))
+	d.sources = kept
+	return removed, nil
+}
+
+type fakeRawCursor struct {
+	docs []bson.Raw
+	i    int
+}
+
+func (c *fakeRawCursor) Next(ctx context.Context) bool {
+	c.i++
+	return c.i < len(c.docs)
+}
+
+func (c *fakeRawCursor) Decode(v interface{}) error      { return bson.Unmarshal(c.docs[c.i], v) }
+func (c *fakeRawCursor) Err() error                      { return nil }
+func (c *fakeRawCursor) Close(ctx context.Context) error { return nil }
+
+func TestMongoAggregatePump_rollupResume(t *testing.T) {
+	bucket := time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC)
+	store := &fakeRollupDriver{failRemove: true}
+	for i := 0; i < 3; i++ {
+		store.add(i, bucket.Add(time.Duration(i)*5*time.Minute))
+	}
+
+	m := &MongoAggregatePump{
+		store:            store,
+		dbConf:           &MongoAggregateConf{},
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", analytics.MongoAggregatePrefix)},
+	}
+	r := aggregateRollup{granularity: time.Hour, after: time.Hour}
+	now := bucket.Add(3 * time.Hour)
+
+	// the pump stops after adding the documents to the rollup, before removing them
+	if err := m.rollupCollection(context.Background(), "c", r, now); err == nil {
+		t.Fatal("expected the removal to fail")
+	}
+	if store.hits != 3 || len(store.sources) != 3 || store.source(0).RollupID == "" {
+		t.Fatalf("expected the 3 documents to be tagged and rolled up, got %d hits", store.hits)
+	}
+
+	// the next run removes them without adding them again, and rolls up the new document
+	store.failRemove = false
+	store.add(3, bucket.Add(20*time.Minute))
+	if err := m.rollupCollection(context.Background(), "c", r, now); err != nil {
+		t.Fatal(err)
+	}
+	if store.hits != 4 {
+		t.Errorf("expected the 4 documents to be counted once, got %d hits", store.hits)
+	}
+	if len(store.sources) != 0 || len(store.rollupIDs) != 0 {
+		t.Errorf("expected the documents and the rollup ids to be removed, got %d and %v", len(store.sources), store.rollupIDs)
+	}
+}
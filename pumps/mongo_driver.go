@@ -0,0 +1,530 @@
+package pumps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// mgo used the test database when the url didn't have one
+const defaultMongoDatabase = "test"
+
+var (
+	mongoCompressors    = []string{"snappy", "zlib", "zstd"}
+	mongoAuthMechanisms = []string{"SCRAM-SHA-1", "SCRAM-SHA-256", "MONGODB-X509", "MONGODB-AWS", "PLAIN", "GSSAPI"}
+)
+
+// mongoDriver is the database layer of the Mongo pumps
+type mongoDriver interface {
+	// DBType detects if the database is a MongoDB or an AWS DocumentDB
+	DBType(ctx context.Context) MongoType
+	CollectionNames(ctx context.Context) ([]string, error)
+	// CollectionOptions returns the options of the collection and if it exists
+	CollectionOptions(ctx context.Context, name string) (mongoCollectionOptions, bool, error)
+	CreateCollection(ctx context.Context, name string, opts mongoCollectionOptions) error
+	RenameCollection(ctx context.Context, from, to string) error
+	DropCollection(ctx context.Context, name string) error
+	// EnsureIndex creates the index if it doesn't exist
+	EnsureIndex(ctx context.Context, collection string, index mongoIndex) error
+	// Indexes returns the indexes of the collection
+	Indexes(ctx context.Context, collection string) ([]mongoIndex, error)
+	DropIndex(ctx context.Context, collection, name string) error
+	Insert(ctx context.Context, collection string, docs []interface{}) error
+	FindOne(ctx context.Context, collection string, query, result interface{}) error
+	// Find returns the documents matching the query sorted by the keys, prefixed with - for a descending order
+	Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error)
+	// FindAndModify applies the update to the document matching the query and decodes the updated document
+	// in result, unless it's nil
+	FindAndModify(ctx context.Context, collection string, query, update interface{}, upsert bool, result interface{}) error
+	// Update applies the update to the document matching the query and returns if one matched
+	Update(ctx context.Context, collection string, query, update interface{}) (bool, error)
+	// UpdateMany applies the update to all the documents matching the query and returns how many matched
+	UpdateMany(ctx context.Context, collection string, query, update interface{}) (int64, error)
+	// ReplaceMany sends the replacements in a single unordered bulk write
+	ReplaceMany(ctx context.Context, collection string, replacements []mongoReplacement) error
+	// BulkUpdate sends the updates in a single unordered bulk write and returns the number of documents matched
+	// or upserted
+	BulkUpdate(ctx context.Context, collection string, updates []mongoUpdate) (int64, error)
+	Remove(ctx context.Context, collection string, query interface{}) (int64, error)
+	RunCommand(ctx context.Context, command, result interface{}) error
+	// Database returns a driver for another database sharing the connections, it must not be closed
+	Database(name string) mongoDriver
+	Close(ctx context.Context) error
+}
+
+type mongoCursor interface {
+	Next(ctx context.Context) bool
+	Decode(v interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+type mongoCollectionOptions struct {
+	Capped   bool
+	MaxBytes int
+	// TimeSeries stores the documents timed by TimeField and grouped by MetaField in buckets,
+	// the granularity being seconds, minutes or hours
+	TimeSeries  bool
+	TimeField   string
+	MetaField   string
+	Granularity string
+	// ExpireAfter removes the documents of a time-series collection after their time
+	ExpireAfter time.Duration
+}
+
+type mongoIndex struct {
+	Name string
+	// Keys of the index, prefixed with - for a descending order
+	Keys       []string
+	Background bool
+	// TTL makes the documents expire ExpireAfter after the date of the first key
+	TTL         bool
+	ExpireAfter time.Duration
+}
+
+type mongoReplacement struct {
+	Query  interface{}
+	Doc    interface{}
+	Upsert bool
+}
+
+type mongoUpdate struct {
+	Query  interface{}
+	Update interface{}
+	Upsert bool
+}
+
+// mongoKeys converts the keys to an ordered document, e.g. -timestamp to {timestamp: -1}
+func mongoKeys(keys []string) bson.D {
+	doc := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, "-") {
+			doc = append(doc, bson.E{Key: key[1:], Value: -1})
+		} else {
+			doc = append(doc, bson.E{Key: key, Value: 1})
+		}
+	}
+	return doc
+}
+
+// isMongoDisconnected tells if the error was caused by a closed connection, which requires to connect again
+func isMongoDisconnected(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, mongo.ErrClientDisconnected) || mongo.IsNetworkError(err) {
+		return true
+	}
+	return strings.Contains(err.Error(), "Closed explicitly") || strings.Contains(err.Error(), "EOF")
+}
+
+// mongoSupportsUpdatePipelines tells if the server is a MongoDB 4.2 or later, which accepts the update pipelines
+func mongoSupportsUpdatePipelines(ctx context.Context, store mongoDriver) bool {
+	var info struct {
+		VersionArray []int `bson:"versionArray"`
+	}
+	if err := store.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}, &info); err != nil || len(info.VersionArray) < 2 {
+		return false
+	}
+	return info.VersionArray[0] > 4 || info.VersionArray[0] == 4 && info.VersionArray[1] >= 2
+}
+
+// isMongoNotFound tells if the error was caused by a query which didn't match any document
+func isMongoNotFound(err error) bool {
+	return errors.Is(err, mongo.ErrNoDocuments)
+}
+
+// isMongoIndexConflict tells if the error was caused by an index which exists with other options
+func isMongoIndexConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	// IndexOptionsConflict and IndexKeySpecsConflict
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86)
+}
+
+// mongoClient implements mongoDriver with the official MongoDB driver
+type mongoClient struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+func newMongoClient(opts *options.ClientOptions, dbName string) (*mongoClient, error) {
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect doesn't wait for the servers
+	if err := client.Ping(context.Background(), nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return &mongoClient{client: client, db: client.Database(dbName)}, nil
+}
+
+// dialMongo connects to the database, retrying every 5 seconds until it succeeds
+func dialMongo(logger *logrus.Entry, conf BaseMongoConf, timeout int) mongoDriver {
+	opts, dbName, err := conf.clientOptions(timeout)
+	if err != nil {
+		logger.Panic("Mongo URL is invalid: ", err)
+	}
+
+	client, err := newMongoClient(opts, dbName)
+	for err != nil {
+		logger.WithError(err).WithField("url", conf.GetBlurredURL()).Error("Mongo connection failed. Retrying.")
+		time.Sleep(5 * time.Second)
+		client, err = newMongoClient(opts, dbName)
+	}
+
+	return client
+}
+
+func (c *mongoClient) DBType(ctx context.Context) MongoType {
+	// Querying for the features which 100% not supported by AWS DocumentDB
+	err := c.db.RunCommand(ctx, bson.D{{Key: "features", Value: 1}}).Err()
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 303 {
+		return AWSDocumentDB
+	}
+	return StandardMongo
+}
+
+func (c *mongoClient) CollectionNames(ctx context.Context) ([]string, error) {
+	return c.db.ListCollectionNames(ctx, bson.D{})
+}
+
+func (c *mongoClient) CollectionOptions(ctx context.Context, name string) (mongoCollectionOptions, bool, error) {
+	specs, err := c.db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: name}})
+	if err != nil || len(specs) == 0 {
+		return mongoCollectionOptions{}, false, err
+	}
+
+	var opts struct {
+		Capped     bool  `bson:"capped"`
+		Size       int64 `bson:"size"`
+		TimeSeries *struct {
+			TimeField   string `bson:"timeField"`
+			MetaField   string `bson:"metaField"`
+			Granularity string `bson:"granularity"`
+		} `bson:"timeseries"`
+		ExpireAfterSeconds int64 `bson:"expireAfterSeconds"`
+	}
+	if specs[0].Options != nil {
+		if err := bson.Unmarshal(specs[0].Options, &opts); err != nil {
+			return mongoCollectionOptions{}, true, err
+		}
+	}
+
+	collectionOpts := mongoCollectionOptions{
+		Capped:      opts.Capped,
+		MaxBytes:    int(opts.Size),
+		ExpireAfter: time.Duration(opts.ExpireAfterSeconds) * time.Second,
+	}
+	if opts.TimeSeries != nil {
+		collectionOpts.TimeSeries = true
+		collectionOpts.TimeField = opts.TimeSeries.TimeField
+		collectionOpts.MetaField = opts.TimeSeries.MetaField
+		collectionOpts.Granularity = opts.TimeSeries.Granularity
+	}
+	return collectionOpts, true, nil
+}
+
+func (c *mongoClient) CreateCollection(ctx context.Context, name string, opts mongoCollectionOptions) error {
+	createOpts := options.CreateCollection()
+	if opts.Capped {
+		createOpts.SetCapped(true).SetSizeInBytes(int64(opts.MaxBytes))
+	}
+	if opts.TimeSeries {
+		timeSeriesOpts := options.TimeSeries().SetTimeField(opts.TimeField)
+		if opts.MetaField != "" {
+			timeSeriesOpts.SetMetaField(opts.MetaField)
+		}
+		if opts.Granularity != "" {
+			timeSeriesOpts.SetGranularity(opts.Granularity)
+		}
+		createOpts.SetTimeSeriesOptions(timeSeriesOpts)
+		if opts.ExpireAfter > 0 {
+			createOpts.SetExpireAfterSeconds(int64(opts.ExpireAfter / time.Second))
+		}
+	}
+	return c.db.CreateCollection(ctx, name, createOpts)
+}
+
+func (c *mongoClient) RenameCollection(ctx context.Context, from, to string) error {
+	// renameCollection is an admin command which takes the full names of the collections
+	command := bson.D{
+		{Key: "renameCollection", Value: c.db.Name() + "." + from},
+		{Key: "to", Value: c.db.Name() + "." + to},
+	}
+	return c.client.Database("admin").RunCommand(ctx, command).Err()
+}
+
+func (c *mongoClient) DropCollection(ctx context.Context, name string) error {
+	return c.db.Collection(name).Drop(ctx)
+}
+
+func (c *mongoClient) EnsureIndex(ctx context.Context, collection string, index mongoIndex) error {
+	indexOpts := options.Index()
+	if index.Name != "" {
+		indexOpts.SetName(index.Name)
+	}
+	if index.Background {
+		indexOpts.SetBackground(true)
+	}
+	if index.TTL {
+		indexOpts.SetExpireAfterSeconds(int32(index.ExpireAfter / time.Second))
+	}
+
+	_, err := c.db.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    mongoKeys(index.Keys),
+		Options: indexOpts,
+	})
+	return err
+}
+
+func (c *mongoClient) Indexes(ctx context.Context, collection string) ([]mongoIndex, error) {
+	specs, err := c.db.Collection(collection).Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]mongoIndex, len(specs))
+	for i, spec := range specs {
+		indexes[i].Name = spec.Name
+		elements, err := spec.KeysDocument.Elements()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range elements {
+			key := e.Key()
+			if order, ok := e.Value().AsInt64OK(); ok && order < 0 {
+				key = "-" + key
+			}
+			indexes[i].Keys = append(indexes[i].Keys, key)
+		}
+		if spec.ExpireAfterSeconds != nil {
+			indexes[i].TTL = true
+			indexes[i].ExpireAfter = time.Duration(*spec.ExpireAfterSeconds) * time.Second
+		}
+	}
+	return indexes, nil
+}
+
+func (c *mongoClient) DropIndex(ctx context.Context, collection, name string) error {
+	_, err := c.db.Collection(collection).Indexes().DropOne(ctx, name)
+	return err
+}
+
+func (c *mongoClient) Insert(ctx context.Context, collection string, docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err := c.db.Collection(collection).InsertMany(ctx, docs)
+	return err
+}
+
+func (c *mongoClient) FindOne(ctx context.Context, collection string, query, result interface{}) error {
+	return c.db.Collection(collection).FindOne(ctx, query).Decode(result)
+}
+
+func (c *mongoClient) Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error) {
+	findOpts := options.Find()
+	if len(sort) > 0 {
+		findOpts.SetSort(mongoKeys(sort))
+	}
+	return c.db.Collection(collection).Find(ctx, query, findOpts)
+}
+
+func (c *mongoClient) FindAndModify(ctx context.Context, collection string, query, update interface{}, upsert bool, result interface{}) error {
+	updateOpts := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	res := c.db.Collection(collection).FindOneAndUpdate(ctx, query, update, updateOpts)
+	if result == nil {
+		return res.Err()
+	}
+	return res.Decode(result)
+}
+
+func (c *mongoClient) Update(ctx context.Context, collection string, query, update interface{}) (bool, error) {
+	res, err := c.db.Collection(collection).UpdateOne(ctx, query, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (c *mongoClient) UpdateMany(ctx context.Context, collection string, query, update interface{}) (int64, error) {
+	res, err := c.db.Collection(collection).UpdateMany(ctx, query, update)
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+func (c *mongoClient) ReplaceMany(ctx context.Context, collection string, replacements []mongoReplacement) error {
+	if len(replacements) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(replacements))
+	for i, r := range replacements {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(r.Query).SetReplacement(r.Doc).SetUpsert(r.Upsert)
+	}
+	_, err := c.db.Collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (c *mongoClient) BulkUpdate(ctx context.Context, collection string, updates []mongoUpdate) (int64, error) {
+	if len(updates) == 0 {
+		return 0, nil
+	}
+
+	models := make([]mongo.WriteModel, len(updates))
+	for i, u := range updates {
+		models[i] = mongo.NewUpdateOneModel().SetFilter(u.Query).SetUpdate(u.Update).SetUpsert(u.Upsert)
+	}
+	res, err := c.db.Collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount + res.UpsertedCount, nil
+}
+
+func (c *mongoClient) Remove(ctx context.Context, collection string, query interface{}) (int64, error) {
+	res, err := c.db.Collection(collection).DeleteMany(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (c *mongoClient) RunCommand(ctx context.Context, command, result interface{}) error {
+	return c.db.RunCommand(ctx, command).Decode(result)
+}
+
+func (c *mongoClient) Database(name string) mongoDriver {
+	return &mongoClient{client: c.client, db: c.client.Database(name)}
+}
+
+func (c *mongoClient) Close(ctx context.Context) error {
+	return c.client.Disconnect(ctx)
+}
+
+// clientOptions converts the configuration to the options of the driver, the settings of the url being
+// overridden by the ones of the configuration. It also returns the database of the url.
+func (b *BaseMongoConf) clientOptions(timeout int) (*options.ClientOptions, string, error) {
+	uri := b.MongoURL
+	// mgo accepted urls without scheme, e.g. localhost:27017/tyk_analytics
+	if !strings.Contains(uri, "://") {
+		uri = "mongodb://" + uri
+	}
+
+	cs, err := connstring.ParseAndValidate(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	dbName := cs.Database
+	if dbName == "" {
+		dbName = defaultMongoDatabase
+	}
+
+	opts := options.Client().ApplyURI(uri)
+
+	if timeout > 0 {
+		opts.SetConnectTimeout(time.Duration(timeout) * time.Second)
+		opts.SetServerSelectionTimeout(time.Duration(timeout) * time.Second)
+	}
+
+	if b.MongoUseSSL {
+		tlsConfig, err := b.tlsConfig()
+		if err != nil {
+			return nil, "", err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if b.MongoWriteConcern != "" || b.MongoWriteConcernJournal || b.MongoWriteConcernTimeout > 0 {
+		var wcOpts []writeconcern.Option
+		if b.MongoWriteConcern == "majority" {
+			wcOpts = append(wcOpts, writeconcern.WMajority())
+		} else if w, err := strconv.Atoi(b.MongoWriteConcern); err == nil {
+			wcOpts = append(wcOpts, writeconcern.W(w))
+		} else if b.MongoWriteConcern != "" {
+			// name of a custom write concern defined with the tags of the replica set
+			wcOpts = append(wcOpts, writeconcern.WTagSet(b.MongoWriteConcern))
+		}
+		if b.MongoWriteConcernJournal {
+			wcOpts = append(wcOpts, writeconcern.J(true))
+		}
+		if b.MongoWriteConcernTimeout > 0 {
+			wcOpts = append(wcOpts, writeconcern.WTimeout(time.Duration(b.MongoWriteConcernTimeout)*time.Millisecond))
+		}
+		opts.SetWriteConcern(writeconcern.New(wcOpts...))
+	}
+
+	if b.MongoReadPreference != "" {
+		mode, err := readpref.ModeFromString(b.MongoReadPreference)
+		if err != nil {
+			return nil, "", err
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.SetReadPreference(rp)
+	}
+
+	if b.MongoRetryWrites != nil {
+		opts.SetRetryWrites(*b.MongoRetryWrites)
+	}
+
+	if len(b.MongoCompressors) > 0 {
+		for _, compressor := range b.MongoCompressors {
+			if !contains(mongoCompressors, compressor) {
+				return nil, "", fmt.Errorf("unsupported mongo compressor %q, must be one of %s", compressor, strings.Join(mongoCompressors, ", "))
+			}
+		}
+		opts.SetCompressors(b.MongoCompressors)
+	}
+
+	if b.MongoMaxPoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(b.MongoMaxPoolSize))
+	}
+	if b.MongoMinPoolSize > 0 {
+		opts.SetMinPoolSize(uint64(b.MongoMinPoolSize))
+	}
+	if b.MongoMaxConnIdleTime > 0 {
+		opts.SetMaxConnIdleTime(time.Duration(b.MongoMaxConnIdleTime) * time.Second)
+	}
+
+	if b.MongoAuthMechanism != "" || b.MongoAuthSource != "" {
+		var credential options.Credential
+		if opts.Auth != nil {
+			credential = *opts.Auth
+		}
+		if b.MongoAuthMechanism != "" {
+			mechanism := strings.ToUpper(b.MongoAuthMechanism)
+			if !contains(mongoAuthMechanisms, mechanism) {
+				return nil, "", fmt.Errorf("unsupported mongo auth mechanism %q, must be one of %s", b.MongoAuthMechanism, strings.Join(mongoAuthMechanisms, ", "))
+			}
+			credential.AuthMechanism = mechanism
+		}
+		if b.MongoAuthSource != "" {
+			credential.AuthSource = b.MongoAuthSource
+		}
+		opts.SetAuth(credential)
+	}
+
+	return opts, dbName, opts.Validate()
+}
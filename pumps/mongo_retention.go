@@ -0,0 +1,393 @@
+package pumps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	mongoTimeSeriesTimeField          = "timestamp"
+	mongoTimeSeriesMetaField          = "meta"
+	defaultMongoTimeSeriesGranularity = "seconds"
+
+	// suffix of the collection being migrated, renamed while its records are copied
+	mongoMigrationSuffix = "_migrating"
+	// collection holding the last record copied by the migrations, so they resume where they stopped
+	mongoMigrationsCollection = "tyk_pump_migrations"
+	mongoMigrationBatchSize   = 1000
+)
+
+var mongoTimeSeriesGranularities = []string{"seconds", "minutes", "hours"}
+
+// mongoTimeSeriesRecord adds the metadata of the time-series collections to the record,
+// so the records of an organisation and API are stored together
+type mongoTimeSeriesRecord struct {
+	analytics.AnalyticsRecord `bson:",inline"`
+	Meta                      mongoTimeSeriesMeta `bson:"meta"`
+}
+
+type mongoTimeSeriesMeta struct {
+	OrgID string `bson:"orgid"`
+	APIID string `bson:"apiid"`
+}
+
+// validateRetention checks the retention settings and sets their defaults
+func (c *MongoConf) validateRetention() error {
+	if c.CollectionTTLSeconds < 0 {
+		return errors.New("collection_ttl_seconds can't be negative")
+	}
+	if c.CollectionCapEnable && (c.CollectionTTLEnable || c.CollectionTimeSeriesEnable) {
+		return errors.New("collection_cap_enable can't be used with collection_ttl_enable or collection_timeseries_enable")
+	}
+	if c.CollectionMigrate && !c.CollectionTTLEnable && !c.CollectionTimeSeriesEnable {
+		return errors.New("collection_migrate requires collection_ttl_enable or collection_timeseries_enable")
+	}
+
+	if c.CollectionTimeSeriesEnable {
+		if c.CollectionTimeSeriesGranularity == "" {
+			c.CollectionTimeSeriesGranularity = defaultMongoTimeSeriesGranularity
+		}
+		if !contains(mongoTimeSeriesGranularities, c.CollectionTimeSeriesGranularity) {
+			return fmt.Errorf("unsupported collection_timeseries_granularity %q, must be one of %s", c.CollectionTimeSeriesGranularity, strings.Join(mongoTimeSeriesGranularities, ", "))
+		}
+		// time-series collections only expire the documents after their time field
+		if c.CollectionTTLEnable && c.CollectionTTLSeconds == 0 {
+			return errors.New("time-series collections require collection_ttl_seconds to expire the records")
+		}
+	}
+
+	return nil
+}
+
+func (m *MongoPump) ttl() time.Duration {
+	return time.Duration(m.dbConf.CollectionTTLSeconds) * time.Second
+}
+
+// initCollection creates the time-series collection, and renames the existing collection which
+// doesn't match the configured retention so its records are migrated. It returns if there are
+// records to migrate.
+func (m *MongoPump) initCollection() (bool, error) {
+	conf := m.dbConf
+	if !conf.CollectionTTLEnable && !conf.CollectionTimeSeriesEnable {
+		return false, nil
+	}
+	if conf.CollectionTimeSeriesEnable && conf.MongoDBType == AWSDocumentDB {
+		return false, errors.New("AWS DocumentDB doesn't support time-series collections")
+	}
+
+	ctx := context.Background()
+	name := conf.CollectionName
+	migrating := name + mongoMigrationSuffix
+
+	current, exists, err := m.store.CollectionOptions(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	// capped collections don't support TTL indexes and existing collections can't become time-series ones
+	if exists && (current.Capped || (conf.CollectionTimeSeriesEnable && !current.TimeSeries)) {
+		if !conf.CollectionMigrate {
+			return false, fmt.Errorf("collection %s doesn't support the configured retention, set collection_migrate to migrate it", name)
+		}
+
+		_, alreadyMigrating, err := m.store.CollectionOptions(ctx, migrating)
+		if err != nil {
+			return false, err
+		}
+		if alreadyMigrating {
+			return false, fmt.Errorf("collection %s is still being migrated from %s", name, migrating)
+		}
+
+		if err := m.store.RenameCollection(ctx, name, migrating); err != nil {
+			return false, err
+		}
+		m.log.Infof("Collection (%s) renamed to %s, migrating its records", name, migrating)
+		exists = false
+	}
+
+	if conf.CollectionTimeSeriesEnable {
+		if !exists {
+			err = m.store.CreateCollection(ctx, name, mongoCollectionOptions{
+				TimeSeries:  true,
+				TimeField:   mongoTimeSeriesTimeField,
+				MetaField:   mongoTimeSeriesMetaField,
+				Granularity: conf.CollectionTimeSeriesGranularity,
+				ExpireAfter: m.ttl(),
+			})
+			if err != nil {
+				return false, err
+			}
+			m.log.Infof("Time-series collection (%s) created", name)
+		} else if conf.CollectionTTLEnable && current.ExpireAfter != m.ttl() {
+			command := bson.D{
+				{Key: "collMod", Value: name},
+				{Key: "expireAfterSeconds", Value: int64(conf.CollectionTTLSeconds)},
+			}
+			if err := m.store.RunCommand(ctx, command, &bson.M{}); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// also true when a previous migration was interrupted
+	_, migrate, err := m.store.CollectionOptions(ctx, migrating)
+	return migrate, err
+}
+
+// migrate copies the records of the renamed collection in the background
+func (m *MongoPump) migrate() {
+	from := m.dbConf.CollectionName + mongoMigrationSuffix
+	if err := m.migrateCollection(context.Background(), from, m.dbConf.CollectionName); err != nil {
+		m.log.WithField("collection", from).Error("Migration failure, it will resume at the next start: ", err)
+	}
+}
+
+// ensureTTLIndex expires the records at their expireAt, or collection_ttl_seconds after their timestamp
+func (m *MongoPump) ensureTTLIndex(ctx context.Context) error {
+	return ensureMongoTTLIndex(ctx, m.store, m.dbConf.CollectionName, m.dbConf.CollectionTTLSeconds, m.dbConf.MongoDBType == StandardMongo)
+}
+
+// ensureMongoTTLIndex expires the records of the collection at their expireAt, or ttl seconds after their
+// timestamp. The expiry of an existing index is updated, and the TTL index of the other field dropped.
+func ensureMongoTTLIndex(ctx context.Context, store mongoDriver, c string, ttl int, background bool) error {
+	index := mongoIndex{
+		Keys:       []string{"expireAt"},
+		TTL:        true,
+		Background: background,
+	}
+	stale := "timestamp"
+	if ttl > 0 {
+		index.Keys = []string{"timestamp"}
+		index.ExpireAfter = time.Duration(ttl) * time.Second
+		stale = "expireAt"
+	}
+
+	err := store.EnsureIndex(ctx, c, index)
+	if isMongoIndexConflict(err) {
+		// the index exists with another expiry
+		command := bson.D{
+			{Key: "collMod", Value: c},
+			{Key: "index", Value: bson.D{
+				{Key: "keyPattern", Value: mongoKeys(index.Keys)},
+				{Key: "expireAfterSeconds", Value: int64(ttl)},
+			}},
+		}
+		err = store.RunCommand(ctx, command, &bson.M{})
+	}
+	if err != nil {
+		return err
+	}
+
+	// the records would still expire on the field of the previous setting
+	indexes, err := store.Indexes(ctx, c)
+	if err != nil {
+		return err
+	}
+	for _, existing := range indexes {
+		if existing.TTL && len(existing.Keys) == 1 && existing.Keys[0] == stale {
+			if err := store.DropIndex(ctx, c, existing.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateCollection copies the records of the collection in batches, then drops it. The id of the last
+// record copied is saved after every batch, so an interrupted migration resumes where it stopped.
+func (m *MongoPump) migrateCollection(ctx context.Context, from, to string) error {
+	checkpointQuery := bson.M{"_id": from}
+	var checkpoint struct {
+		LastID interface{} `bson:"last_id"`
+	}
+
+	query := bson.M{}
+	err := m.store.FindOne(ctx, mongoMigrationsCollection, checkpointQuery, &checkpoint)
+	if err != nil && !isMongoNotFound(err) {
+		return err
+	}
+	if err == nil && checkpoint.LastID != nil {
+		query["_id"] = bson.M{"$gt": checkpoint.LastID}
+	}
+
+	cursor, err := m.store.Find(ctx, from, query, "_id")
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	copied := 0
+	batch := make([]bson.D, 0, mongoMigrationBatchSize)
+	var lastID interface{}
+	// the first batch may have been copied by an interrupted run before its checkpoint was saved
+	resumed := true
+
+	flush := func() error {
+		if err := m.copyBatch(ctx, to, batch, resumed); err != nil {
+			return err
+		}
+		copied += len(batch)
+		resumed = false
+		batch = make([]bson.D, 0, mongoMigrationBatchSize)
+
+		update := bson.M{"$set": bson.M{"last_id": lastID}}
+		return m.store.FindAndModify(ctx, mongoMigrationsCollection, checkpointQuery, update, true, nil)
+	}
+
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		for _, e := range doc {
+			if e.Key == "_id" {
+				lastID = e.Value
+			}
+		}
+
+		if m.dbConf.CollectionTimeSeriesEnable {
+			var ok bool
+			if doc, ok = timeSeriesDoc(doc); !ok {
+				m.log.WithField("_id", lastID).Warning("Record without timestamp, not migrated")
+				continue
+			}
+		}
+
+		batch = append(batch, doc)
+		if len(batch) == mongoMigrationBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := m.store.DropCollection(ctx, from); err != nil {
+		return err
+	}
+	if _, err := m.store.Remove(ctx, mongoMigrationsCollection, checkpointQuery); err != nil {
+		return err
+	}
+
+	m.log.Infof("Migrated %d records from %s to %s", copied, from, to)
+	return nil
+}
+
+// copyBatch writes the records to the collection, so that copying them again is a no-op: the records are
+// upserted by _id, and the time-series collections, which don't support upserts, skip the records of a
+// resumed batch already copied
+func (m *MongoPump) copyBatch(ctx context.Context, to string, batch []bson.D, resumed bool) error {
+	ids := make([]interface{}, len(batch))
+	for i, doc := range batch {
+		for _, e := range doc {
+			if e.Key == "_id" {
+				ids[i] = e.Value
+			}
+		}
+	}
+
+	if !m.dbConf.CollectionTimeSeriesEnable {
+		replacements := make([]mongoReplacement, len(batch))
+		for i, doc := range batch {
+			replacements[i] = mongoReplacement{Query: bson.M{"_id": ids[i]}, Doc: doc, Upsert: true}
+		}
+		return m.store.ReplaceMany(ctx, to, replacements)
+	}
+
+	copied := map[interface{}]bool{}
+	if resumed {
+		cursor, err := m.store.Find(ctx, to, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var doc bson.D
+			if err := cursor.Decode(&doc); err != nil {
+				return err
+			}
+			for _, e := range doc {
+				if e.Key == "_id" {
+					copied[e.Value] = true
+				}
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+	}
+
+	docs := make([]interface{}, 0, len(batch))
+	for i, doc := range batch {
+		if !copied[ids[i]] {
+			docs = append(docs, doc)
+		}
+	}
+	return m.store.Insert(ctx, to, docs)
+}
+
+// timeSeriesDoc adds the metadata of the time-series collections to a stored record
+func timeSeriesDoc(doc bson.D) (bson.D, bool) {
+	var meta mongoTimeSeriesMeta
+	hasTime := false
+
+	for _, e := range doc {
+		switch e.Key {
+		case mongoTimeSeriesTimeField:
+			_, hasTime = e.Value.(primitive.DateTime)
+		case "orgid":
+			meta.OrgID, _ = e.Value.(string)
+		case "apiid":
+			meta.APIID, _ = e.Value.(string)
+		}
+	}
+	if !hasTime {
+		return nil, false
+	}
+
+	return append(doc, bson.E{Key: mongoTimeSeriesMetaField, Value: meta}), true
+}
+
+// timeSeriesRecords adds the metadata of the time-series collections to the records
+func timeSeriesRecords(records []interface{}) []interface{} {
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		r := record.(analytics.AnalyticsRecord)
+		docs[i] = mongoTimeSeriesRecord{
+			AnalyticsRecord: r,
+			Meta:            mongoTimeSeriesMeta{OrgID: r.OrgID, APIID: r.APIID},
+		}
+	}
+	return docs
+}
+
+// ensureTimeSeriesIndexes creates the indexes of the time-series collections, which only support
+// the metadata and time fields on MongoDB 5.0
+func (m *MongoPump) ensureTimeSeriesIndexes(ctx context.Context) error {
+	c := m.dbConf.CollectionName
+	for _, keys := range [][]string{
+		{mongoTimeSeriesMetaField + ".orgid", "-" + mongoTimeSeriesTimeField},
+		{mongoTimeSeriesMetaField + ".apiid", "-" + mongoTimeSeriesTimeField},
+	} {
+		if err := m.store.EnsureIndex(ctx, c, mongoIndex{Keys: keys}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package pumps
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// fakeMongoDriver keeps the collections in memory, implementing the operations used by the retention
+type fakeMongoDriver struct {
+	mongoDriver
+	collections map[string]mongoCollectionOptions
+	docs        map[string][]bson.D
+	checkpoints map[string]interface{}
+	commands    []bson.D
+}
+
+func newFakeMongoDriver() *fakeMongoDriver {
+	return &fakeMongoDriver{
+		collections: make(map[string]mongoCollectionOptions),
+		docs:        make(map[string][]bson.D),
+		checkpoints: make(map[string]interface{}),
+	}
+}
+
+func (d *fakeMongoDriver) CollectionOptions(ctx context.Context, name string) (mongoCollectionOptions, bool, error) {
+	opts, exists := d.collections[name]
+	return opts, exists, nil
+}
+
+func (d *fakeMongoDriver) CreateCollection(ctx context.Context, name string, opts mongoCollectionOptions) error {
+	d.collections[name] = opts
+	return nil
+}
+
+func (d *fakeMongoDriver) RenameCollection(ctx context.Context, from, to string) error {
+	d.collections[to], d.docs[to] = d.collections[from], d.docs[from]
+	delete(d.collections, from)
+	delete(d.docs, from)
+	return nil
+}
+
+func (d *fakeMongoDriver) DropCollection(ctx context.Context, name string) error {
+	delete(d.collections, name)
+	delete(d.docs, name)
+	return nil
+}
+
+func (d *fakeMongoDriver) RunCommand(ctx context.Context, command, result interface{}) error {
+	d.commands = append(d.commands, command.(bson.D))
+	return nil
+}
+
+func (d *fakeMongoDriver) Insert(ctx context.Context, collection string, docs []interface{}) error {
+	for _, doc := range docs {
+		d.docs[collection] = append(d.docs[collection], doc.(bson.D))
+	}
+	return nil
+}
+
+func (d *fakeMongoDriver) FindOne(ctx context.Context, collection string, query, result interface{}) error {
+	lastID, found := d.checkpoints[query.(bson.M)["_id"].(string)]
+	if !found {
+		return mongo.ErrNoDocuments
+	}
+	result.(*struct {
+		LastID interface{} `bson:"last_id"`
+	}).LastID = lastID
+	return nil
+}
+
+func (d *fakeMongoDriver) FindAndModify(ctx context.Context, collection string, query, update interface{}, upsert bool, result interface{}) error {
+	d.checkpoints[query.(bson.M)["_id"].(string)] = update.(bson.M)["$set"].(bson.M)["last_id"]
+	return nil
+}
+
+func (d *fakeMongoDriver) Remove(ctx context.Context, collection string, query interface{}) (int64, error) {
+	delete(d.checkpoints, query.(bson.M)["_id"].(string))
+	return 1, nil
+}
+
+func (d *fakeMongoDriver) ReplaceMany(ctx context.Context, collection string, replacements []mongoReplacement) error {
+	for _, r := range replacements {
+		id := r.Query.(bson.M)["_id"]
+		replaced := false
+		for i, doc := range d.docs[collection] {
+			if doc[0].Value == id {
+				d.docs[collection][i] = r.Doc.(bson.D)
+				replaced = true
+			}
+		}
+		if !replaced {
+			d.docs[collection] = append(d.docs[collection], r.Doc.(bson.D))
+		}
+	}
+	return nil
+}
+
+// Find only supports the {_id: {$gt: id}} and {_id: {$in: ids}} queries of the migrations, the ids being ints
+func (d *fakeMongoDriver) Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error) {
+	var docs []bson.D
+	for _, doc := range d.docs[collection] {
+		idQuery, ok := query.(bson.M)["_id"].(bson.M)
+		if ok && idQuery["$gt"] != nil && doc[0].Value.(int) <= idQuery["$gt"].(int) {
+			continue
+		}
+		if ok && idQuery["$in"] != nil {
+			found := false
+			for _, id := range idQuery["$in"].([]interface{}) {
+				found = found || id == doc[0].Value
+			}
+			if !found {
+				continue
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return &fakeMongoCursor{docs: docs, i: -1}, nil
+}
+
+type fakeMongoCursor struct {
+	docs []bson.D
+	i    int
+}
+
+func (c *fakeMongoCursor) Next(ctx context.Context) bool {
+	c.i++
+	return c.i < len(c.docs)
+}
+
+func (c *fakeMongoCursor) Decode(v interface{}) error {
+	*v.(*bson.D) = append(bson.D{}, c.docs[c.i]...)
+	return nil
+}
+
+func (c *fakeMongoCursor) Err() error                      { return nil }
+func (c *fakeMongoCursor) Close(ctx context.Context) error { return nil }
+
+func newRetentionPump(store mongoDriver, conf MongoConf) *MongoPump {
+	if conf.CollectionName == "" {
+		conf.CollectionName = "tyk_analytics"
+	}
+	return &MongoPump{
+		store:            store,
+		dbConf:           &conf,
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", mongoPrefix)},
+	}
+}
+
+func TestMongoConf_validateRetention(t *testing.T) {
+	tcs := []struct {
+		testName string
+		conf     MongoConf
+		valid    bool
+	}{
+		{"no retention", MongoConf{}, true},
+		{"ttl at expireAt", MongoConf{CollectionTTLEnable: true}, true},
+		{"ttl after timestamp", MongoConf{CollectionTTLEnable: true, CollectionTTLSeconds: 3600}, true},
+		{"time-series", MongoConf{CollectionTimeSeriesEnable: true, CollectionMigrate: true}, true},
+		{"time-series with ttl", MongoConf{CollectionTimeSeriesEnable: true, CollectionTTLEnable: true, CollectionTTLSeconds: 60}, true},
+		{"negative ttl", MongoConf{CollectionTTLEnable: true, CollectionTTLSeconds: -1}, false},
+		{"capped with ttl", MongoConf{CollectionCapEnable: true, CollectionTTLEnable: true}, false},
+		{"migrate without retention", MongoConf{CollectionMigrate: true}, false},
+		{"unknown granularity", MongoConf{CollectionTimeSeriesEnable: true, CollectionTimeSeriesGranularity: "days"}, false},
+		{"time-series expiring at expireAt", MongoConf{CollectionTimeSeriesEnable: true, CollectionTTLEnable: true}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			err := tc.conf.validateRetention()
+			if tc.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", tc.valid, err)
+			}
+		})
+	}
+
+	conf := MongoConf{CollectionTimeSeriesEnable: true}
+	conf.validateRetention()
+	if conf.CollectionTimeSeriesGranularity != defaultMongoTimeSeriesGranularity {
+		t.Errorf("expected the default granularity, got %s", conf.CollectionTimeSeriesGranularity)
+	}
+}
+
+func TestMongoPump_initCollection(t *testing.T) {
+	t.Run("capped collection without migration", func(t *testing.T) {
+		store := newFakeMongoDriver()
+		store.collections["tyk_analytics"] = mongoCollectionOptions{Capped: true}
+
+		m := newRetentionPump(store, MongoConf{CollectionTTLEnable: true})
+		if _, err := m.initCollection(); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("capped collection to time-series", func(t *testing.T) {
+		store := newFakeMongoDriver()
+		store.collections["tyk_analytics"] = mongoCollectionOptions{Capped: true}
+
+		m := newRetentionPump(store, MongoConf{
+			CollectionTimeSeriesEnable:      true,
+			CollectionTimeSeriesGranularity: "minutes",
+			CollectionTTLEnable:             true,
+			CollectionTTLSeconds:            60,
+			CollectionMigrate:               true,
+		})
+		migrate, err := m.initCollection()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !migrate {
+			t.Error("expected the records to be migrated")
+		}
+
+		created := store.collections["tyk_analytics"]
+		if !created.TimeSeries || created.TimeField != "timestamp" || created.MetaField != "meta" ||
+			created.Granularity != "minutes" || created.ExpireAfter != time.Minute {
+			t.Errorf("unexpected collection %+v", created)
+		}
+		if _, found := store.collections["tyk_analytics"+mongoMigrationSuffix]; !found {
+			t.Error("expected the capped collection to be renamed")
+		}
+	})
+
+	t.Run("time-series collection with new ttl", func(t *testing.T) {
+		store := newFakeMongoDriver()
+		store.collections["tyk_analytics"] = mongoCollectionOptions{TimeSeries: true, ExpireAfter: time.Hour}
+
+		m := newRetentionPump(store, MongoConf{CollectionTimeSeriesEnable: true, CollectionTTLEnable: true, CollectionTTLSeconds: 60})
+		if _, err := m.initCollection(); err != nil {
+			t.Fatal(err)
+		}
+		if len(store.commands) != 1 || store.commands[0][0].Key != "collMod" {
+			t.Errorf("expected the expiry to be updated, got %v", store.commands)
+		}
+	})
+}
+
+func TestMongoPump_migrateCollection(t *testing.T) {
+	store := newFakeMongoDriver()
+	from := "tyk_analytics" + mongoMigrationSuffix
+	now := primitive.NewDateTimeFromTime(time.Now())
+	for i := 1; i <= 2500; i++ {
+		store.docs[from] = append(store.docs[from], bson.D{
+			{Key: "_id", Value: i},
+			{Key: "timestamp", Value: now},
+			{Key: "orgid", Value: "org1"},
+			{Key: "apiid", Value: "api1"},
+		})
+	}
+	// a record without timestamp can't be stored in a time-series collection
+	store.docs[from] = append(store.docs[from], bson.D{{Key: "_id", Value: 2501}})
+	store.collections[from] = mongoCollectionOptions{Capped: true}
+	// the first 1000 records were copied before an interruption
+	store.checkpoints[from] = 1000
+
+	m := newRetentionPump(store, MongoConf{CollectionTimeSeriesEnable: true})
+	if err := m.migrateCollection(context.Background(), from, "tyk_analytics"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated := store.docs["tyk_analytics"]
+	if len(migrated) != 1500 {
+		t.Fatalf("expected 1500 records to be copied, got %d", len(migrated))
+	}
+	first := migrated[0]
+	if first[0].Value != 1001 {
+		t.Errorf("expected the migration to resume after the checkpoint, got %v", first[0].Value)
+	}
+	if meta := first[len(first)-1]; meta.Key != "meta" || meta.Value != (mongoTimeSeriesMeta{OrgID: "org1", APIID: "api1"}) {
+		t.Errorf("expected the time-series metadata, got %v", meta)
+	}
+	if _, found := store.collections[from]; found {
+		t.Error("expected the migrated collection to be dropped")
+	}
+	if len(store.checkpoints) != 0 {
+		t.Error("expected the checkpoint to be removed")
+	}
+}
+
+func TestMongoPump_migrateCollectionResume(t *testing.T) {
+	for _, timeSeries := range []bool{false, true} {
+		t.Run(fmt.Sprintf("time-series %v", timeSeries), func(t *testing.T) {
+			store := newFakeMongoDriver()
+			from := "tyk_analytics" + mongoMigrationSuffix
+			now := primitive.NewDateTimeFromTime(time.Now())
+			for i := 1; i <= 1500; i++ {
+				store.docs[from] = append(store.docs[from], bson.D{
+					{Key: "_id", Value: i},
+					{Key: "timestamp", Value: now},
+				})
+			}
+			// the first batch was copied, but the run was interrupted before saving its checkpoint
+			for _, doc := range store.docs[from][:mongoMigrationBatchSize] {
+				store.docs["tyk_analytics"] = append(store.docs["tyk_analytics"], doc)
+			}
+
+			m := newRetentionPump(store, MongoConf{CollectionTimeSeriesEnable: timeSeries})
+			if err := m.migrateCollection(context.Background(), from, "tyk_analytics"); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := map[interface{}]int{}
+			for _, doc := range store.docs["tyk_analytics"] {
+				ids[doc[0].Value]++
+			}
+			if len(store.docs["tyk_analytics"]) != 1500 || len(ids) != 1500 {
+				t.Errorf("expected the 1500 records to be copied once, got %d records and %d ids", len(store.docs["tyk_analytics"]), len(ids))
+			}
+		})
+	}
+}
+
+func TestTimeSeriesRecords(t *testing.T) {
+	records := []interface{}{analytics.AnalyticsRecord{OrgID: "org1", APIID: "api1", Path: "/"}}
+	docs := timeSeriesRecords(records)
+
+	data, err := bson.Marshal(docs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	// the record fields stay at the root, so the existing queries still work
+	if doc["orgid"] != "org1" || doc["path"] != "/" {
+		t.Errorf("expected the record fields, got %v", doc)
+	}
+	if meta := doc["meta"].(bson.M); meta["orgid"] != "org1" || meta["apiid"] != "api1" {
+		t.Errorf("unexpected metadata %v", meta)
+	}
+}
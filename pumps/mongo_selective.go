@@ -3,31 +3,141 @@ package pumps
 import (
 	"context"
 	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/kelseyhightower/envconfig"
-	"github.com/lonelycode/mgohacks"
 	"github.com/mitchellh/mapstructure"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/vmihailenco/msgpack.v2"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 type MongoSelectivePump struct {
-	dbSession *mgo.Session
-	dbConf    *MongoSelectiveConf
+	store  mongoDriver
+	dbConf *MongoSelectiveConf
+	// collections initialised, by database and name
+	initialised sync.Map
 	CommonPumpConfig
 }
 
 var mongoSelectivePrefix = "mongo-pump-selective"
 var mongoSelectivePumpPrefix = "PMP_MONGOSEL"
 
+const defaultMongoSelectiveCollectionName = "z_tyk_analyticz_{org_id}"
+
+var (
+	// characters replaced in the values of the placeholders of the database names
+	mongoInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+	// characters replaced in the values of the placeholders of the collection names, the others being
+	// kept so the default template matches the names of GetCollectionName
+	mongoInvalidCollectionChars = regexp.MustCompile("[$\x00]")
+)
+
 type MongoSelectiveConf struct {
 	BaseMongoConf
 	MaxInsertBatchSizeBytes int `mapstructure:"max_insert_batch_size_bytes"`
 	MaxDocumentSizeBytes    int `mapstructure:"max_document_size_bytes"`
+	// Name of the collections, the {org_id}, {api_id}, {date} (YYYY_MM_DD) and {month} (YYYY_MM) placeholders
+	// being replaced by the values of the records. Defaults to z_tyk_analyticz_{org_id}
+	CollectionNameTemplate string `mapstructure:"collection_name_template"`
+	// Name of the database of each organisation, with the {org_id} placeholder, e.g. tyk_analytics_{org_id}.
+	// Defaults to the database of mongo_url
+	DatabaseNameTemplate string `mapstructure:"database_name_template"`
+	// Expire the records collection_ttl_seconds after their timestamp rather than at their expireAt
+	CollectionTTLSeconds      int  `mapstructure:"collection_ttl_seconds"`
+	CollectionCapEnable       bool `mapstructure:"collection_cap_enable"`
+	CollectionCapMaxSizeBytes int  `mapstructure:"collection_cap_max_size_bytes"`
+	// Don't store the raw requests and responses
+	OmitRawBodies bool `mapstructure:"omit_raw_bodies"`
+	// Settings of some organisations overriding the ones above, by org ID
+	OrgOverrides map[string]MongoSelectiveOrgConf `mapstructure:"org_overrides"`
+}
+
+// MongoSelectiveOrgConf overrides the settings of an organisation, the unset ones keeping their default
+type MongoSelectiveOrgConf struct {
+	// Database of the organisation, overriding database_name_template
+	Database                  string `mapstructure:"database"`
+	CollectionTTLSeconds      *int   `mapstructure:"collection_ttl_seconds"`
+	CollectionCapEnable       *bool  `mapstructure:"collection_cap_enable"`
+	CollectionCapMaxSizeBytes *int   `mapstructure:"collection_cap_max_size_bytes"`
+	OmitRawBodies             *bool  `mapstructure:"omit_raw_bodies"`
+}
+
+// mongoSelectiveOrgSettings are the settings of an organisation, with its overrides applied
+type mongoSelectiveOrgSettings struct {
+	database    string
+	ttl         int
+	capEnable   bool
+	capMaxBytes int
+	omitBodies  bool
+}
+
+// orgSettings returns the settings of the organisation
+func (c *MongoSelectiveConf) orgSettings(orgID string) mongoSelectiveOrgSettings {
+	settings := mongoSelectiveOrgSettings{
+		ttl:         c.CollectionTTLSeconds,
+		capEnable:   c.CollectionCapEnable,
+		capMaxBytes: c.CollectionCapMaxSizeBytes,
+		omitBodies:  c.OmitRawBodies,
+	}
+	if c.DatabaseNameTemplate != "" {
+		settings.database = strings.Replace(c.DatabaseNameTemplate, "{org_id}", mongoInvalidNameChars.ReplaceAllString(orgID, "_"), -1)
+	}
+
+	override, found := c.OrgOverrides[orgID]
+	if !found {
+		return settings
+	}
+	if override.Database != "" {
+		settings.database = override.Database
+	}
+	if override.CollectionTTLSeconds != nil {
+		settings.ttl = *override.CollectionTTLSeconds
+	}
+	if override.CollectionCapEnable != nil {
+		settings.capEnable = *override.CollectionCapEnable
+	}
+	if override.CollectionCapMaxSizeBytes != nil {
+		settings.capMaxBytes = *override.CollectionCapMaxSizeBytes
+	}
+	if override.OmitRawBodies != nil {
+		settings.omitBodies = *override.OmitRawBodies
+	}
+	return settings
+}
+
+func (s mongoSelectiveOrgSettings) validate() error {
+	if s.ttl < 0 {
+		return errors.New("collection_ttl_seconds can't be negative")
+	}
+	if s.capEnable && s.ttl > 0 {
+		return errors.New("capped collections don't support collection_ttl_seconds")
+	}
+	return nil
+}
+
+// validate checks the naming and the settings of every organisation
+func (c *MongoSelectiveConf) validate() error {
+	if c.CollectionNameTemplate == "" {
+		c.CollectionNameTemplate = defaultMongoSelectiveCollectionName
+	}
+	// the records of the organisations must not be mixed
+	if !strings.Contains(c.CollectionNameTemplate, "{org_id}") && !strings.Contains(c.DatabaseNameTemplate, "{org_id}") {
+		return errors.New("collection_name_template or database_name_template must contain {org_id}")
+	}
+
+	if err := c.orgSettings("").validate(); err != nil {
+		return err
+	}
+	for orgID := range c.OrgOverrides {
+		if err := c.orgSettings(orgID).validate(); err != nil {
+			return fmt.Errorf("org_overrides of %s: %v", orgID, err)
+		}
+	}
+	return nil
 }
 
 func (m *MongoSelectivePump) New() Pump {
@@ -39,6 +149,7 @@ func (m *MongoSelectivePump) GetName() string {
 	return "MongoDB Selective Pump"
 }
 
+// GetCollectionName returns the default collection of the organisation, collection_name_template not applying
 func (m *MongoSelectivePump) GetCollectionName(orgid string) (string, error) {
 	if orgid == "" {
 		return "", errors.New("OrgID cannot be empty")
@@ -46,6 +157,22 @@ func (m *MongoSelectivePump) GetCollectionName(orgid string) (string, error) {
 	return "z_tyk_analyticz_" + orgid, nil
 }
 
+// collectionName returns the collection of the record, from collection_name_template
+func (m *MongoSelectivePump) collectionName(record analytics.AnalyticsRecord) (string, error) {
+	if record.OrgID == "" {
+		return "", errors.New("OrgID cannot be empty")
+	}
+
+	ts := record.TimeStamp.UTC()
+	name := strings.NewReplacer(
+		"{org_id}", mongoInvalidCollectionChars.ReplaceAllString(record.OrgID, "_"),
+		"{api_id}", mongoInvalidCollectionChars.ReplaceAllString(record.APIID, "_"),
+		"{date}", ts.Format("2006_01_02"),
+		"{month}", ts.Format("2006_01"),
+	).Replace(m.dbConf.CollectionNameTemplate)
+	return name, nil
+}
+
 func (m *MongoSelectivePump) Init(config interface{}) error {
 	m.dbConf = &MongoSelectiveConf{}
 	m.log = log.WithField("prefix", mongoSelectivePrefix)
@@ -74,6 +201,14 @@ func (m *MongoSelectivePump) Init(config interface{}) error {
 		m.dbConf.MaxDocumentSizeBytes = 10 * MiB
 	}
 
+	if err := m.dbConf.validate(); err != nil {
+		return err
+	}
+
+	if _, _, err := m.dbConf.clientOptions(m.timeout); err != nil {
+		return err
+	}
+
 	m.connect()
 
 	m.log.Debug("MongoDB DB CS: ", m.dbConf.GetBlurredURL())
@@ -83,61 +218,99 @@ func (m *MongoSelectivePump) Init(config interface{}) error {
 }
 
 func (m *MongoSelectivePump) connect() {
-	var err error
-	var dialInfo *mgo.DialInfo
+	if m.store != nil {
+		if err := m.store.Close(context.Background()); err != nil {
+			m.log.WithError(err).Debug("Failed to close the previous connection")
+		}
+	}
+	m.store = dialMongo(m.log, m.dbConf.BaseMongoConf, m.timeout)
 
-	dialInfo, err = mongoDialInfo(m.dbConf.BaseMongoConf)
-	if err != nil {
-		m.log.Panic("Mongo URL is invalid: ", err)
+	if m.dbConf.MongoDBType == 0 {
+		m.dbConf.MongoDBType = m.store.DBType(context.Background())
+	}
+}
+
+// initCollection creates the capped collection of the organisation and its indexes, once per collection
+func (m *MongoSelectivePump) initCollection(ctx context.Context, store mongoDriver, c string, settings mongoSelectiveOrgSettings) {
+	key := settings.database + "." + c
+	if _, found := m.initialised.Load(key); found {
+		return
+	}
+
+	if settings.capEnable {
+		capped, err := m.capCollection(ctx, store, c, settings.capMaxBytes)
+		if err != nil {
+			m.log.WithField("collection", c).Error("Unable to create capped collection: ", err)
+			return
+		}
+		// the records of a collection which couldn't be capped expire instead
+		settings.capEnable = capped
+	}
+
+	if err := m.ensureIndexes(ctx, store, c, settings); err != nil {
+		m.log.WithField("collection", c).Error(err)
+		return
 	}
+	m.initialised.Store(key, true)
+}
 
-	if m.timeout > 0 {
-		dialInfo.Timeout = time.Second * time.Duration(m.timeout)
+// capCollection creates the capped collection unless it already exists, and returns if the collection is capped
+func (m *MongoSelectivePump) capCollection(ctx context.Context, store mongoDriver, c string, maxBytes int) (bool, error) {
+	opts, exists, err := store.CollectionOptions(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		if !opts.Capped {
+			m.log.Warnf("Collection (%s) already exists. Capping could result in data loss. Ignoring", c)
+		}
+		return opts.Capped, nil
 	}
 
-	m.dbSession, err = mgo.DialWithInfo(dialInfo)
+	if strconv.IntSize < 64 {
+		m.log.Warn("Pump running < 64bit architecture. Not capping collection as max size would be 2gb")
+		return false, nil
+	}
 
-	for err != nil {
-		m.log.WithError(err).WithField("dialinfo", dialInfo).Error("Mongo connection failed. Retrying.")
-		time.Sleep(5 * time.Second)
-		m.dbSession, err = mgo.DialWithInfo(dialInfo)
+	if maxBytes == 0 {
+		maxBytes = 5 * GiB
 	}
 
-	if err == nil && m.dbConf.MongoDBType == 0 {
-		m.dbConf.MongoDBType = mongoType(m.dbSession)
+	if err := store.CreateCollection(ctx, c, mongoCollectionOptions{Capped: true, MaxBytes: maxBytes}); err != nil {
+		return false, err
 	}
+	m.log.Infof("Capped collection (%s) created. %d bytes", c, maxBytes)
+	return true, nil
 }
 
-func (m *MongoSelectivePump) ensureIndexes(c *mgo.Collection) error {
+func (m *MongoSelectivePump) ensureIndexes(ctx context.Context, store mongoDriver, c string, settings mongoSelectiveOrgSettings) error {
 	var err error
-	ttlIndex := mgo.Index{
-		Key:         []string{"expireAt"},
-		ExpireAfter: 0,
-		Background:  m.dbConf.MongoDBType == StandardMongo,
-	}
 
-	err = mgohacks.EnsureTTLIndex(c, ttlIndex)
-	if err != nil {
-		return err
+	// capped collections don't support TTL indexes
+	if !settings.capEnable {
+		err = ensureMongoTTLIndex(ctx, store, c, settings.ttl, m.dbConf.MongoDBType == StandardMongo)
+		if err != nil {
+			return err
+		}
 	}
 
-	apiIndex := mgo.Index{
-		Key:        []string{"apiid"},
+	apiIndex := mongoIndex{
+		Keys:       []string{"apiid"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(apiIndex)
+	err = store.EnsureIndex(ctx, c, apiIndex)
 	if err != nil {
 		return err
 	}
 
-	logBrowserIndex := mgo.Index{
+	logBrowserIndex := mongoIndex{
 		Name:       "logBrowserIndex",
-		Key:        []string{"-timestamp", "apiid", "apikey", "responsecode"},
+		Keys:       []string{"-timestamp", "apiid", "apikey", "responsecode"},
 		Background: m.dbConf.MongoDBType == StandardMongo,
 	}
 
-	err = c.EnsureIndex(logBrowserIndex)
+	err = store.EnsureIndex(ctx, c, logBrowserIndex)
 	if err != nil && !strings.Contains(err.Error(), "already exists with a different name") {
 		return err
 	}
@@ -148,56 +321,64 @@ func (m *MongoSelectivePump) ensureIndexes(c *mgo.Collection) error {
 func (m *MongoSelectivePump) WriteData(ctx context.Context, data []interface{}) error {
 	m.log.Debug("Attempting to write ", len(data), " records...")
 
-	if m.dbSession == nil {
+	if m.store == nil {
 		m.log.Debug("Connecting to analytics store")
 		m.connect()
 		m.WriteData(ctx, data)
 	} else {
-		analyticsPerOrg := make(map[string][]interface{})
+		type destination struct {
+			database   string
+			collection string
+		}
+		analyticsPerCollection := make(map[destination][]interface{})
+		settingsPerOrg := make(map[string]mongoSelectiveOrgSettings)
 
 		for _, v := range data {
-			orgID := v.(analytics.AnalyticsRecord).OrgID
-			collectionName, collErr := m.GetCollectionName(orgID)
-			skip := false
+			record := v.(analytics.AnalyticsRecord)
+			collectionName, collErr := m.collectionName(record)
 			if collErr != nil {
 				m.log.Warning("No OrgID for AnalyticsRecord, skipping")
-				skip = true
+				continue
 			}
 
-			if !skip {
-				_, found := analyticsPerOrg[collectionName]
-				if !found {
-					analyticsPerOrg[collectionName] = []interface{}{v}
-				} else {
-					analyticsPerOrg[collectionName] = append(analyticsPerOrg[collectionName], v)
-				}
+			settings, found := settingsPerOrg[record.OrgID]
+			if !found {
+				settings = m.dbConf.orgSettings(record.OrgID)
+				settingsPerOrg[record.OrgID] = settings
+			}
+			if settings.omitBodies {
+				record.RawRequest = ""
+				record.RawResponse = ""
 			}
-		}
-
-		for col_name, filtered_data := range analyticsPerOrg {
 
-			for _, dataSet := range m.AccumulateSet(filtered_data) {
-				thisSession := m.dbSession.Copy()
-				defer thisSession.Close()
-				analyticsCollection := thisSession.DB("").C(col_name)
+			dest := destination{database: settings.database, collection: collectionName}
+			analyticsPerCollection[dest] = append(analyticsPerCollection[dest], record)
+		}
 
-				indexCreateErr := m.ensureIndexes(analyticsCollection)
-				if indexCreateErr != nil {
-					m.log.WithField("collection", col_name).Error(indexCreateErr)
-				}
+		for dest, filteredData := range analyticsPerCollection {
+			store := m.store
+			if dest.database != "" {
+				store = m.store.Database(dest.database)
+			}
+			orgID := filteredData[0].(analytics.AnalyticsRecord).OrgID
+			m.initCollection(ctx, store, dest.collection, settingsPerOrg[orgID])
 
-				err := analyticsCollection.Insert(dataSet...)
+			for _, dataSet := range m.AccumulateSet(filteredData) {
+				err := store.Insert(ctx, dest.collection, dataSet)
 				if err != nil {
-					m.log.WithField("collection", col_name).Error("Problem inserting to mongo collection: ", err)
-					if strings.Contains(strings.ToLower(err.Error()), "closed explicitly") {
+					m.log.WithField("collection", dest.collection).Error("Problem inserting to mongo collection: ", err)
+					if isMongoDisconnected(err) {
 						m.log.Warning("--> Detected connection failure, reconnecting")
 						m.connect()
+						// the previous store was closed with its connection
+						store = m.store
+						if dest.database != "" {
+							store = m.store.Database(dest.database)
+						}
 					}
 				}
 			}
-
 		}
-
 	}
 	m.log.Info("Purged ", len(data), " records...")
 
@@ -251,47 +432,34 @@ func (m *MongoSelectivePump) AccumulateSet(data []interface{}) [][]interface{} {
 	return returnArray
 }
 
-// WriteUptimeData will pull the data from the in-memory store and drop it into the specified MongoDB collection
-func (m *MongoSelectivePump) WriteUptimeData(data []interface{}) {
-	if m.dbSession == nil {
+// WriteUptimeData drops the uptime checks into the tyk_uptime_analytics collection, read by the Dashboard
+func (m *MongoSelectivePump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	for m.store == nil {
 		m.log.Debug("Connecting to mongoDB store")
 		m.connect()
-		m.WriteUptimeData(data)
-	} else {
-		m.log.Info("MONGO Selective Should not be writing uptime data!")
-		collectionName := "tyk_uptime_analytics"
-		thisSession := m.dbSession.Copy()
-		defer thisSession.Close()
-		analyticsCollection := thisSession.DB("").C(collectionName)
-
-		m.log.Debug("Uptime Data: ", len(data))
+	}
 
-		if len(data) > 0 {
-			keys := make([]interface{}, len(data))
+	collectionName := "tyk_uptime_analytics"
 
-			for i, v := range data {
-				decoded := analytics.UptimeReportData{}
-				err := msgpack.Unmarshal(v.([]byte), &decoded)
-				m.log.Debug("Decoded Record: ", decoded)
-				if err != nil {
-					m.log.Error("Couldn't unmarshal analytics data:", err)
+	m.log.Debug("Uptime Data: ", len(data))
 
-				} else {
-					keys[i] = interface{}(decoded)
-				}
-			}
+	if len(data) == 0 {
+		return nil
+	}
 
-			err := analyticsCollection.Insert(keys...)
-			m.log.Debug("Wrote data to ", collectionName)
+	keys := make([]interface{}, len(data))
+	for i := range data {
+		keys[i] = data[i]
+	}
 
-			if err != nil {
-				m.log.WithField("collection", collectionName).Error("Problem inserting to mongo collection: ", err)
-				if strings.Contains(err.Error(), "Closed explicitly") || strings.Contains(err.Error(), "EOF") {
-					m.log.Warning("--> Detected connection failure, reconnecting")
-					m.connect()
-				}
-			}
+	if err := m.store.Insert(ctx, collectionName, keys); err != nil {
+		m.log.WithField("collection", collectionName).Error("Problem inserting to mongo collection: ", err)
+		if isMongoDisconnected(err) {
+			m.log.Warning("--> Detected connection failure, reconnecting")
+			m.connect()
 		}
+		return err
 	}
-
+	m.log.Debug("Wrote data to ", collectionName)
+	return nil
 }
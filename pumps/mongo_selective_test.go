@@ -0,0 +1,225 @@
+package pumps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// fakeSelectiveDriver records the collections created, the indexes and the inserts per database
+type fakeSelectiveDriver struct {
+	mongoDriver
+	database string
+	created  map[string]mongoCollectionOptions
+	indexes  map[string][]mongoIndex
+	dropped  map[string][]string
+	inserted map[string][]interface{}
+}
+
+func newFakeSelectiveDriver() *fakeSelectiveDriver {
+	return &fakeSelectiveDriver{
+		created:  make(map[string]mongoCollectionOptions),
+		indexes:  make(map[string][]mongoIndex),
+		dropped:  make(map[string][]string),
+		inserted: make(map[string][]interface{}),
+	}
+}
+
+func (d *fakeSelectiveDriver) Database(name string) mongoDriver {
+	db := *d
+	db.database = name
+	return &db
+}
+
+func (d *fakeSelectiveDriver) CollectionOptions(ctx context.Context, name string) (mongoCollectionOptions, bool, error) {
+	opts, exists := d.created[d.database+"."+name]
+	return opts, exists, nil
+}
+
+func (d *fakeSelectiveDriver) CreateCollection(ctx context.Context, name string, opts mongoCollectionOptions) error {
+	d.created[d.database+"."+name] = opts
+	return nil
+}
+
+func (d *fakeSelectiveDriver) EnsureIndex(ctx context.Context, collection string, index mongoIndex) error {
+	d.indexes[d.database+"."+collection] = append(d.indexes[d.database+"."+collection], index)
+	return nil
+}
+
+func (d *fakeSelectiveDriver) Indexes(ctx context.Context, collection string) ([]mongoIndex, error) {
+	return d.indexes[d.database+"."+collection], nil
+}
+
+func (d *fakeSelectiveDriver) DropIndex(ctx context.Context, collection, name string) error {
+	d.dropped[d.database+"."+collection] = append(d.dropped[d.database+"."+collection], name)
+	return nil
+}
+
+func (d *fakeSelectiveDriver) Insert(ctx context.Context, collection string, docs []interface{}) error {
+	d.inserted[d.database+"."+collection] = append(d.inserted[d.database+"."+collection], docs...)
+	return nil
+}
+
+func newSelectivePump(store mongoDriver, conf MongoSelectiveConf) (*MongoSelectivePump, error) {
+	conf.MaxInsertBatchSizeBytes = 10 * MiB
+	conf.MaxDocumentSizeBytes = 10 * MiB
+	m := &MongoSelectivePump{
+		store:            store,
+		dbConf:           &conf,
+		CommonPumpConfig: CommonPumpConfig{log: log.WithField("prefix", mongoSelectivePrefix)},
+	}
+	return m, conf.validate()
+}
+
+func TestMongoSelectivePump_GetCollectionName(t *testing.T) {
+	record := analytics.AnalyticsRecord{
+		OrgID:     "org1",
+		APIID:     "api.1",
+		TimeStamp: time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC),
+	}
+
+	tcs := []struct {
+		template string
+		expected string
+	}{
+		{"", "z_tyk_analyticz_org1"},
+		{"analytics_{org_id}_{api_id}", "analytics_org1_api.1"},
+		{"analytics_{org_id}_{date}", "analytics_org1_2021_06_15"},
+		{"analytics_{org_id}_{month}", "analytics_org1_2021_06"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.expected, func(t *testing.T) {
+			m, err := newSelectivePump(nil, MongoSelectiveConf{CollectionNameTemplate: tc.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name, _ := m.collectionName(record); name != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, name)
+			}
+		})
+	}
+
+	m, _ := newSelectivePump(nil, MongoSelectiveConf{})
+	if _, err := m.collectionName(analytics.AnalyticsRecord{}); err == nil {
+		t.Error("expected an error without OrgID")
+	}
+
+	// the default template keeps the names of the previous versions
+	record.OrgID = "org.1"
+	name, _ := m.collectionName(record)
+	if legacy, _ := m.GetCollectionName("org.1"); name != legacy || legacy != "z_tyk_analyticz_org.1" {
+		t.Errorf("expected the default collection z_tyk_analyticz_org.1, got %s and %s", name, legacy)
+	}
+}
+
+func TestMongoSelectiveConf_validate(t *testing.T) {
+	ttl, capEnable := 3600, true
+
+	tcs := []struct {
+		testName string
+		conf     MongoSelectiveConf
+		valid    bool
+	}{
+		{"defaults", MongoSelectiveConf{}, true},
+		{"collection per api", MongoSelectiveConf{CollectionNameTemplate: "tyk_{api_id}", DatabaseNameTemplate: "tyk_{org_id}"}, true},
+		{"organisations mixed", MongoSelectiveConf{CollectionNameTemplate: "tyk_{api_id}"}, false},
+		{"negative ttl", MongoSelectiveConf{CollectionTTLSeconds: -1}, false},
+		{"capped with ttl", MongoSelectiveConf{CollectionCapEnable: true, CollectionTTLSeconds: 60}, false},
+		{"override capped with ttl", MongoSelectiveConf{CollectionCapEnable: true, OrgOverrides: map[string]MongoSelectiveOrgConf{
+			"org1": {CollectionTTLSeconds: &ttl},
+		}}, false},
+		{"override uncapped with ttl", MongoSelectiveConf{OrgOverrides: map[string]MongoSelectiveOrgConf{
+			"org1": {CollectionTTLSeconds: &ttl},
+			"org2": {CollectionCapEnable: &capEnable},
+		}}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			err := tc.conf.validate()
+			if tc.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestMongoSelectivePump_WriteData(t *testing.T) {
+	ttl, capEnable, omitBodies := 3600, true, false
+	store := newFakeSelectiveDriver()
+	m, err := newSelectivePump(store, MongoSelectiveConf{
+		OmitRawBodies: true,
+		OrgOverrides: map[string]MongoSelectiveOrgConf{
+			"org1": {CollectionTTLSeconds: &ttl, OmitRawBodies: &omitBodies},
+			"org2": {Database: "tyk_org2", CollectionCapEnable: &capEnable},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org1", APIID: "api1", RawRequest: "request", RawResponse: "response"},
+		analytics.AnalyticsRecord{OrgID: "org2", APIID: "api1", RawRequest: "request", RawResponse: "response"},
+		analytics.AnalyticsRecord{OrgID: "org3", APIID: "api1", RawRequest: "request", RawResponse: "response"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.WriteData(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	org1 := store.inserted[".z_tyk_analyticz_org1"]
+	if len(org1) != 2 || org1[0].(analytics.AnalyticsRecord).RawRequest != "request" {
+		t.Errorf("expected the raw bodies of org1 to be stored, got %v", org1)
+	}
+	if index := store.indexes[".z_tyk_analyticz_org1"][0]; index.Keys[0] != "timestamp" || index.ExpireAfter != time.Hour {
+		t.Errorf("expected org1 to expire after an hour, got %+v", index)
+	}
+
+	org2 := store.inserted["tyk_org2.z_tyk_analyticz_org2"]
+	if len(org2) != 2 {
+		t.Fatalf("expected the records of org2 in its own database, got %v", store.inserted)
+	}
+	if !store.created["tyk_org2.z_tyk_analyticz_org2"].Capped {
+		t.Error("expected the collection of org2 to be capped")
+	}
+	// no TTL index on capped collections, the indexes are only ensured once
+	if indexes := store.indexes["tyk_org2.z_tyk_analyticz_org2"]; len(indexes) != 2 {
+		t.Errorf("expected 2 indexes, got %+v", indexes)
+	}
+
+	org3 := store.inserted[".z_tyk_analyticz_org3"]
+	if len(org3) != 2 || org3[0].(analytics.AnalyticsRecord).RawRequest != "" || org3[0].(analytics.AnalyticsRecord).RawResponse != "" {
+		t.Errorf("expected the raw bodies of org3 to be omitted, got %v", org3)
+	}
+}
+
+func TestMongoSelectivePump_initCollection(t *testing.T) {
+	store := newFakeSelectiveDriver()
+	// the collection of org1 expired at the expireAt of the records before collection_ttl_seconds was set
+	store.indexes[".z_tyk_analyticz_org1"] = []mongoIndex{{Name: "expireAt_1", Keys: []string{"expireAt"}, TTL: true}}
+	// the collection of org2 existed before collection_cap_enable was set
+	store.created[".z_tyk_analyticz_org2"] = mongoCollectionOptions{}
+
+	m, err := newSelectivePump(store, MongoSelectiveConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.initCollection(context.Background(), store, "z_tyk_analyticz_org1", mongoSelectiveOrgSettings{ttl: 3600})
+	if dropped := store.dropped[".z_tyk_analyticz_org1"]; len(dropped) != 1 || dropped[0] != "expireAt_1" {
+		t.Errorf("expected the expireAt TTL index to be dropped, got %v", dropped)
+	}
+
+	m.initCollection(context.Background(), store, "z_tyk_analyticz_org2", mongoSelectiveOrgSettings{capEnable: true})
+	if store.created[".z_tyk_analyticz_org2"].Capped {
+		t.Error("expected the existing collection not to be capped")
+	}
+	if index := store.indexes[".z_tyk_analyticz_org2"][0]; !index.TTL || index.Keys[0] != "expireAt" {
+		t.Errorf("expected the records of the uncapped collection to expire, got %+v", index)
+	}
+}
@@ -0,0 +1,89 @@
+package pumps
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const mongoUptimeAggregateCollection = "tyk_uptime_analytics_aggregate"
+
+// WriteUptimeAggregates merges the rollups of the checks in the tyk_uptime_analytics_aggregate collection
+// in a single bulk write, reads the merged documents back at once, then updates their availability and
+// latencies from the merged counters in a second bulk write
+func (m *MongoPump) WriteUptimeAggregates(ctx context.Context, aggregates []analytics.UptimeAggregate) error {
+	for m.store == nil {
+		m.log.Debug("Connecting to mongoDB store")
+		m.connect()
+	}
+
+	if !m.uptimeIndexed {
+		index := mongoIndex{
+			Name:       "uptime_aggregate",
+			Keys:       []string{"orgid", "apiid", "url", "granularity", "-timestamp"},
+			Background: m.dbConf.MongoDBType == StandardMongo,
+		}
+		if err := m.store.EnsureIndex(ctx, mongoUptimeAggregateCollection, index); err != nil {
+			m.log.Error("Couldn't ensure the uptime aggregate index: ", err)
+		} else {
+			m.uptimeIndexed = true
+		}
+	}
+
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	changes := make([]mongoUpdate, len(aggregates))
+	queries := make(bson.A, len(aggregates))
+	for i := range aggregates {
+		queries[i] = aggregates[i].Query()
+		changes[i] = mongoUpdate{Query: queries[i], Update: aggregates[i].AsChange(), Upsert: true}
+	}
+	if _, err := m.store.BulkUpdate(ctx, mongoUptimeAggregateCollection, changes); err != nil {
+		m.log.Error("UPSERT Failure: ", err)
+		if isMongoDisconnected(err) {
+			m.log.Warning("--> Detected connection failure, reconnecting")
+			m.connect()
+		}
+		return err
+	}
+
+	docs, err := m.readUptimeAggregates(ctx, queries)
+	if err != nil {
+		m.log.Error("Failed to read the uptime aggregates: ", err)
+		return err
+	}
+
+	updates := make([]mongoUpdate, len(docs))
+	for i := range docs {
+		updates[i] = mongoUpdate{Query: docs[i].Query(), Update: docs[i].AsTimeUpdate()}
+	}
+	if _, err := m.store.BulkUpdate(ctx, mongoUptimeAggregateCollection, updates); err != nil {
+		m.log.Error("AvgUpdate Failure: ", err)
+		return err
+	}
+	m.log.Info("Purged ", len(aggregates), " uptime aggregates...")
+	return nil
+}
+
+// readUptimeAggregates returns the stored aggregates matching the queries
+func (m *MongoPump) readUptimeAggregates(ctx context.Context, queries bson.A) ([]analytics.UptimeAggregate, error) {
+	cursor, err := m.store.Find(ctx, mongoUptimeAggregateCollection, bson.M{"$or": queries})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []analytics.UptimeAggregate
+	for cursor.Next(ctx) {
+		doc := analytics.UptimeAggregate{}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, cursor.Err()
+}
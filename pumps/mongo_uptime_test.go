@@ -0,0 +1,73 @@
+package pumps
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// fakeUptimeDriver returns the merged aggregates with the counters already stored
+type fakeUptimeDriver struct {
+	mongoDriver
+	stored     analytics.UptimeAggregate
+	indexes    []mongoIndex
+	updates    []bson.M
+	bulkWrites int
+	reads      int
+}
+
+func (d *fakeUptimeDriver) EnsureIndex(ctx context.Context, collection string, index mongoIndex) error {
+	d.indexes = append(d.indexes, index)
+	return nil
+}
+
+func (d *fakeUptimeDriver) BulkUpdate(ctx context.Context, collection string, updates []mongoUpdate) (int64, error) {
+	d.bulkWrites++
+	for _, u := range updates {
+		d.updates = append(d.updates, u.Update.(bson.M))
+	}
+	return int64(len(updates)), nil
+}
+
+func (d *fakeUptimeDriver) Find(ctx context.Context, collection string, query interface{}, sort ...string) (mongoCursor, error) {
+	d.reads++
+	doc, err := bson.Marshal(d.stored)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRawCursor{docs: []bson.Raw{doc}, i: -1}, nil
+}
+
+func TestMongoPump_WriteUptimeAggregates(t *testing.T) {
+	store := &fakeUptimeDriver{stored: analytics.UptimeAggregate{APIID: "api1", Granularity: "1h", Checks: 10, Failures: 1, TotalLatency: 90, LatencySketch: analytics.NewLatencySketch()}}
+	for i := 0; i < 9; i++ {
+		store.stored.LatencySketch.Add(10)
+	}
+	m := newRetentionPump(store, MongoConf{})
+
+	aggregate := analytics.UptimeAggregate{APIID: "api1", Granularity: "1h"}
+	aggregate.Add(analytics.UptimeReportData{RequestTime: 10})
+	for i := 0; i < 2; i++ {
+		if err := m.WriteUptimeAggregates(context.Background(), []analytics.UptimeAggregate{aggregate, aggregate}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(store.indexes) != 1 {
+		t.Errorf("expected the index to be ensured once, got %v", store.indexes)
+	}
+	// the aggregates of a purge are merged and read back at once
+	if store.bulkWrites != 4 || store.reads != 2 {
+		t.Fatalf("expected 2 bulk writes and a read per purge, got %d writes and %d reads", store.bulkWrites, store.reads)
+	}
+	if len(store.updates) != 6 || store.updates[0]["$inc"].(bson.M)["checks"] != int64(1) {
+		t.Fatalf("unexpected updates %v", store.updates)
+	}
+	// the computed fields come from the stored counters
+	if set := store.updates[2]["$set"].(bson.M); set["availability"] != 90.0 || set["latency"] != 10.0 {
+		t.Errorf("unexpected computed fields %v", set)
+	}
+}
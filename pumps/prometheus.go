@@ -3,8 +3,10 @@ package pumps
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 
@@ -21,19 +23,97 @@ type PrometheusPump struct {
 	KeyStatusMetrics    *prometheus.CounterVec
 	OauthStatusMetrics  *prometheus.CounterVec
 	TotalLatencyMetrics *prometheus.HistogramVec
+	RequestSizeMetrics  *prometheus.HistogramVec
+	ResponseSizeMetrics *prometheus.HistogramVec
+	// Per host checked by the uptime tests
+	UptimeMetrics        *prometheus.GaugeVec
+	UptimeLatencyMetrics *prometheus.HistogramVec
+
+	// limiter is nil when the label values aren't limited
+	limiter *cardinalityLimiter
+	// pathNormalizer is nil when the paths aren't normalized
+	pathNormalizer *pathNormalizer
+
+	// every pump has its own registry, so several prometheus pumps can run in the same process
+	registry *prometheus.Registry
+	// push sends the metrics in the remote_write and pushgateway modes
+	push func() error
+	// stopPush stops the push loop, pushing waits for it to return
+	stopPush chan struct{}
+	pushing  sync.WaitGroup
 
 	CommonPumpConfig
 }
 
 type PrometheusConf struct {
+	// scrape (default) exposes the metrics on listen_address, remote_write and pushgateway push them to push.url
+	Mode string `mapstructure:"mode"`
 	Addr string `mapstructure:"listen_address"`
 	Path string `mapstructure:"path"`
+	// Configuration of the remote_write and pushgateway modes
+	Push PrometheusPushConf `mapstructure:"push"`
+	// Names of the default metrics which aren't exposed, e.g. ["tyk_http_status_per_key"]
+	DisabledMetrics []string `mapstructure:"disabled_metrics"`
+	// User defined metrics
+	CustomMetrics []PrometheusMetric `mapstructure:"custom_metrics"`
+	// Maximum number of distinct values of every label of every metric, the new values over
+	// the limit are replaced with "other". 0 means unlimited
+	MaxLabelValues int `mapstructure:"max_label_values"`
+	// Replace the path segments which look like identifiers (numbers, UUIDs, long hex strings) with {id}
+	NormalizePaths bool `mapstructure:"normalize_paths"`
+	// Additional regular expressions of the path segments replaced with {id} when normalize_paths is enabled
+	PathIDPatterns []string `mapstructure:"path_id_patterns"`
+}
+
+const (
+	prometheusCounterType   = "counter"
+	prometheusHistogramType = "histogram"
+)
+
+// PrometheusMetric is a user defined metric, labelled with the values of record fields
+type PrometheusMetric struct {
+	Name string `mapstructure:"name"`
+	Help string `mapstructure:"help"`
+	// counter or histogram. The histograms observe the request time in milliseconds
+	MetricType string `mapstructure:"metric_type"`
+	// Record fields used as labels, e.g. ["api_id", "method", "response_code"]
+	Labels []string `mapstructure:"labels"`
+	// Buckets of the histograms. Defaults to the buckets of tyk_latency
+	Buckets []float64 `mapstructure:"buckets"`
+
+	counterVec   *prometheus.CounterVec
+	histogramVec *prometheus.HistogramVec
 }
 
 var prometheusPrefix = "prometheus-pump"
 
 var buckets = []float64{1, 2, 5, 7, 10, 15, 20, 25, 30, 40, 50, 60, 70, 80, 90, 100, 200, 300, 400, 500, 1000, 2000, 5000, 10000, 30000, 60000}
 
+// sizeBuckets are the buckets of the request and response sizes, from 64 bytes to 16MB
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+// prometheusLabelFields are the record fields which can be used as labels of the custom metrics
+var prometheusLabelFields = map[string]func(record *analytics.AnalyticsRecord) string{
+	"host":               func(r *analytics.AnalyticsRecord) string { return r.Host },
+	"method":             func(r *analytics.AnalyticsRecord) string { return r.Method },
+	"path":               func(r *analytics.AnalyticsRecord) string { return r.Path },
+	"raw_path":           func(r *analytics.AnalyticsRecord) string { return r.RawPath },
+	"response_code":      func(r *analytics.AnalyticsRecord) string { return strconv.Itoa(r.ResponseCode) },
+	"api_key":            func(r *analytics.AnalyticsRecord) string { return r.APIKey },
+	"api_version":        func(r *analytics.AnalyticsRecord) string { return r.APIVersion },
+	"api_name":           func(r *analytics.AnalyticsRecord) string { return r.APIName },
+	"api_id":             func(r *analytics.AnalyticsRecord) string { return r.APIID },
+	"org_id":             func(r *analytics.AnalyticsRecord) string { return r.OrgID },
+	"oauth_id":           func(r *analytics.AnalyticsRecord) string { return r.OauthID },
+	"alias":              func(r *analytics.AnalyticsRecord) string { return r.Alias },
+	"ip_address":         func(r *analytics.AnalyticsRecord) string { return r.IPAddress },
+	"geo_country":        func(r *analytics.AnalyticsRecord) string { return r.Geo.Country.ISOCode },
+	"geo_region":         func(r *analytics.AnalyticsRecord) string { return r.Geo.Region() },
+	"user_agent_browser": func(r *analytics.AnalyticsRecord) string { return r.UserAgentInfo.Browser },
+	"user_agent_os":      func(r *analytics.AnalyticsRecord) string { return r.UserAgentInfo.OS },
+	"user_agent_device":  func(r *analytics.AnalyticsRecord) string { return r.UserAgentInfo.DeviceType },
+}
+
 func (p *PrometheusPump) New() Pump {
 	newPump := PrometheusPump{}
 	newPump.TotalStatusMetrics = prometheus.NewCounterVec(
@@ -72,12 +152,38 @@ func (p *PrometheusPump) New() Pump {
 		},
 		[]string{"type", "api"},
 	)
+	newPump.RequestSizeMetrics = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tyk_request_size",
+			Help:    "Size of the requests in bytes per API",
+			Buckets: sizeBuckets,
+		},
+		[]string{"api"},
+	)
+	newPump.ResponseSizeMetrics = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tyk_response_size",
+			Help:    "Size of the responses in bytes per API",
+			Buckets: sizeBuckets,
+		},
+		[]string{"api"},
+	)
+	newPump.UptimeMetrics = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tyk_uptime_up",
+			Help: "Whether the last uptime check of the host succeeded (1) or failed (0)",
+		},
+		[]string{"api", "org", "url"},
+	)
+	newPump.UptimeLatencyMetrics = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tyk_uptime_latency",
+			Help:    "Latency of the uptime checks per API and host",
+			Buckets: buckets,
+		},
+		[]string{"api", "url"},
+	)
 
-	prometheus.MustRegister(newPump.TotalStatusMetrics)
-	prometheus.MustRegister(newPump.PathStatusMetrics)
-	prometheus.MustRegister(newPump.KeyStatusMetrics)
-	prometheus.MustRegister(newPump.OauthStatusMetrics)
-	prometheus.MustRegister(newPump.TotalLatencyMetrics)
 	return &newPump
 }
 
@@ -98,22 +204,118 @@ func (p *PrometheusPump) Init(conf interface{}) error {
 		p.conf.Path = "/metrics"
 	}
 
-	if p.conf.Addr == "" {
-		return errors.New("Prometheus listen_addr not set")
+	switch p.conf.Mode {
+	case "", prometheusScrapeMode:
+		if p.conf.Addr == "" {
+			return errors.New("Prometheus listen_addr not set")
+		}
+	case prometheusRemoteWriteMode, prometheusPushgatewayMode:
+	default:
+		return fmt.Errorf("unsupported Prometheus mode %q, must be one of scrape, remote_write or pushgateway", p.conf.Mode)
+	}
+
+	if err := p.initMetrics(); err != nil {
+		return err
+	}
+
+	if p.conf.Mode == prometheusRemoteWriteMode || p.conf.Mode == prometheusPushgatewayMode {
+		if err := p.initPush(); err != nil {
+			return err
+		}
+		p.log.Info(p.GetName() + " Initialized")
+		return nil
 	}
 
 	p.log.Info("Starting prometheus listener on:", p.conf.Addr)
 
-	http.Handle(p.conf.Path, promhttp.Handler())
+	mux := http.NewServeMux()
+	mux.Handle(p.conf.Path, promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}))
 
 	go func() {
-		log.Fatal(http.ListenAndServe(p.conf.Addr, nil))
+		if err := http.ListenAndServe(p.conf.Addr, mux); err != nil {
+			p.log.Error("Prometheus listener stopped: ", err)
+		}
 	}()
 	p.log.Info(p.GetName() + " Initialized")
 
 	return nil
 }
 
+// initMetrics registers the enabled default metrics and the custom metrics in the registry of the pump
+func (p *PrometheusPump) initMetrics() error {
+	p.registry = prometheus.NewRegistry()
+
+	disabled := make(map[string]bool, len(p.conf.DisabledMetrics))
+	for _, name := range p.conf.DisabledMetrics {
+		disabled[name] = true
+	}
+
+	defaultCounters := map[string]**prometheus.CounterVec{
+		"tyk_http_status":                  &p.TotalStatusMetrics,
+		"tyk_http_status_per_path":         &p.PathStatusMetrics,
+		"tyk_http_status_per_key":          &p.KeyStatusMetrics,
+		"tyk_http_status_per_oauth_client": &p.OauthStatusMetrics,
+	}
+	for name, metric := range defaultCounters {
+		if disabled[name] {
+			*metric = nil
+			continue
+		}
+		if err := p.registry.Register(*metric); err != nil {
+			return err
+		}
+	}
+	defaultHistograms := map[string]**prometheus.HistogramVec{
+		"tyk_latency":        &p.TotalLatencyMetrics,
+		"tyk_request_size":   &p.RequestSizeMetrics,
+		"tyk_response_size":  &p.ResponseSizeMetrics,
+		"tyk_uptime_latency": &p.UptimeLatencyMetrics,
+	}
+	for name, metric := range defaultHistograms {
+		if disabled[name] {
+			*metric = nil
+			continue
+		}
+		if err := p.registry.Register(*metric); err != nil {
+			return err
+		}
+	}
+	if disabled["tyk_uptime_up"] {
+		p.UptimeMetrics = nil
+	} else if err := p.registry.Register(p.UptimeMetrics); err != nil {
+		return err
+	}
+
+	if p.conf.MaxLabelValues > 0 {
+		p.limiter = newCardinalityLimiter(p.conf.MaxLabelValues)
+		if err := p.registry.Register(p.limiter.overflows); err != nil {
+			return err
+		}
+	}
+	if p.conf.NormalizePaths {
+		var err error
+		p.pathNormalizer, err = newPathNormalizer(p.conf.PathIDPatterns)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range p.conf.CustomMetrics {
+		metric := &p.conf.CustomMetrics[i]
+		if err := metric.init(); err != nil {
+			return err
+		}
+		collector := prometheus.Collector(metric.counterVec)
+		if metric.histogramVec != nil {
+			collector = metric.histogramVec
+		}
+		if err := p.registry.Register(collector); err != nil {
+			return fmt.Errorf("couldn't register metric %s: %v", metric.Name, err)
+		}
+	}
+	return nil
+}
+
 func (p *PrometheusPump) WriteData(ctx context.Context, data []interface{}) error {
 	p.log.Debug("Attempting to write ", len(data), " records...")
 
@@ -121,15 +323,124 @@ func (p *PrometheusPump) WriteData(ctx context.Context, data []interface{}) erro
 		record := item.(analytics.AnalyticsRecord)
 		code := strconv.Itoa(record.ResponseCode)
 
-		p.TotalStatusMetrics.WithLabelValues(code, record.APIID).Inc()
-		p.PathStatusMetrics.WithLabelValues(code, record.APIID, record.Path, record.Method).Inc()
-		p.KeyStatusMetrics.WithLabelValues(code, record.APIKey).Inc()
-		if record.OauthID != "" {
-			p.OauthStatusMetrics.WithLabelValues(code, record.OauthID).Inc()
+		if p.TotalStatusMetrics != nil {
+			p.TotalStatusMetrics.WithLabelValues(p.labelValues("tyk_http_status", []string{"code", "api"}, code, record.APIID)...).Inc()
+		}
+		if p.PathStatusMetrics != nil {
+			p.PathStatusMetrics.WithLabelValues(p.labelValues("tyk_http_status_per_path", []string{"code", "api", "path", "method"}, code, record.APIID, record.Path, record.Method)...).Inc()
+		}
+		if p.KeyStatusMetrics != nil {
+			p.KeyStatusMetrics.WithLabelValues(p.labelValues("tyk_http_status_per_key", []string{"code", "key"}, code, record.APIKey)...).Inc()
+		}
+		if p.OauthStatusMetrics != nil && record.OauthID != "" {
+			p.OauthStatusMetrics.WithLabelValues(p.labelValues("tyk_http_status_per_oauth_client", []string{"code", "client_id"}, code, record.OauthID)...).Inc()
+		}
+		if p.TotalLatencyMetrics != nil {
+			api := p.labelValues("tyk_latency", []string{"api"}, record.APIID)[0]
+			p.TotalLatencyMetrics.WithLabelValues("total", api).Observe(float64(record.RequestTime))
+			// the latencies are only sent by the gateways recording them
+			if record.Latency.Total > 0 {
+				p.TotalLatencyMetrics.WithLabelValues("upstream", api).Observe(float64(record.Latency.Upstream))
+				p.TotalLatencyMetrics.WithLabelValues("gateway", api).Observe(float64(record.Latency.Total - record.Latency.Upstream))
+			}
+		}
+		if p.RequestSizeMetrics != nil {
+			requestSize := record.Network.BytesIn
+			if requestSize == 0 {
+				requestSize = record.ContentLength
+			}
+			p.RequestSizeMetrics.WithLabelValues(p.labelValues("tyk_request_size", []string{"api"}, record.APIID)...).Observe(float64(requestSize))
+		}
+		if p.ResponseSizeMetrics != nil && record.Network.BytesOut > 0 {
+			p.ResponseSizeMetrics.WithLabelValues(p.labelValues("tyk_response_size", []string{"api"}, record.APIID)...).Observe(float64(record.Network.BytesOut))
+		}
+
+		for i := range p.conf.CustomMetrics {
+			metric := &p.conf.CustomMetrics[i]
+			values := make([]string, len(metric.Labels))
+			for j, label := range metric.Labels {
+				values[j] = prometheusLabelFields[label](&record)
+			}
+			metric.observe(p.labelValues(metric.Name, metric.Labels, values...), &record)
 		}
-		p.TotalLatencyMetrics.WithLabelValues("total", record.APIID).Observe(float64(record.RequestTime))
 	}
 	p.log.Info("Purged ", len(data), " records...")
 
 	return nil
 }
+
+// WriteUptimeData sets tyk_uptime_up to the result of the last check of every host, and observes the latency of the checks
+func (p *PrometheusPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	p.log.Debug("Attempting to write ", len(data), " uptime records...")
+
+	for _, record := range data {
+		if p.UptimeMetrics != nil {
+			up := 0.0
+			if record.Up() {
+				up = 1
+			}
+			p.UptimeMetrics.WithLabelValues(p.labelValues("tyk_uptime_up", []string{"api", "org", "url"}, record.APIID, record.OrgID, record.URL)...).Set(up)
+		}
+		// the failed connections have no latency
+		if p.UptimeLatencyMetrics != nil && !record.TCPError {
+			p.UptimeLatencyMetrics.WithLabelValues(p.labelValues("tyk_uptime_latency", []string{"api", "url"}, record.APIID, record.URL)...).Observe(float64(record.RequestTime))
+		}
+	}
+	p.log.Info("Purged ", len(data), " uptime records...")
+
+	return nil
+}
+
+// init validates the metric and creates its vector
+func (pm *PrometheusMetric) init() error {
+	if pm.Name == "" {
+		return errors.New("custom metric name not set")
+	}
+	for _, label := range pm.Labels {
+		if _, found := prometheusLabelFields[label]; !found {
+			return fmt.Errorf("custom metric %s: unsupported label %q", pm.Name, label)
+		}
+	}
+
+	help := pm.Help
+	if help == "" {
+		help = pm.Name
+	}
+
+	switch pm.MetricType {
+	case prometheusCounterType:
+		pm.counterVec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: pm.Name, Help: help}, pm.Labels)
+	case prometheusHistogramType:
+		metricBuckets := pm.Buckets
+		if len(metricBuckets) == 0 {
+			metricBuckets = buckets
+		}
+		pm.histogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: pm.Name, Help: help, Buckets: metricBuckets}, pm.Labels)
+	default:
+		return fmt.Errorf("custom metric %s: unsupported metric_type %q, must be counter or histogram", pm.Name, pm.MetricType)
+	}
+	return nil
+}
+
+// labelValues normalizes the paths and limits the cardinality of the label values of the metric
+func (p *PrometheusPump) labelValues(metric string, labels []string, values ...string) []string {
+	if p.pathNormalizer != nil {
+		for i, label := range labels {
+			if label == "path" || label == "raw_path" {
+				values[i] = p.pathNormalizer.normalize(values[i])
+			}
+		}
+	}
+	if p.limiter != nil {
+		p.limiter.limit(metric, labels, values)
+	}
+	return values
+}
+
+func (pm *PrometheusMetric) observe(values []string, record *analytics.AnalyticsRecord) {
+	if pm.counterVec != nil {
+		pm.counterVec.WithLabelValues(values...).Inc()
+		return
+	}
+	pm.histogramVec.WithLabelValues(values...).Observe(float64(record.RequestTime))
+}
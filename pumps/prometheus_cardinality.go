@@ -0,0 +1,105 @@
+package pumps
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusOverflowValue replaces the label values over the max_label_values limit
+const prometheusOverflowValue = "other"
+
+const prometheusPathID = "{id}"
+
+var (
+	prometheusNumericSegment = regexp.MustCompile(`^[0-9]+$`)
+	prometheusUUIDSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	prometheusHexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// pathNormalizer replaces the path segments which look like identifiers with {id},
+// so /users/123 and /users/456 are counted in the same series
+type pathNormalizer struct {
+	patterns []*regexp.Regexp
+}
+
+func newPathNormalizer(extraPatterns []string) (*pathNormalizer, error) {
+	n := &pathNormalizer{
+		patterns: []*regexp.Regexp{prometheusNumericSegment, prometheusUUIDSegment, prometheusHexSegment},
+	}
+	for _, pattern := range extraPatterns {
+		// the patterns must match whole segments
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		n.patterns = append(n.patterns, re)
+	}
+	return n, nil
+}
+
+func (n *pathNormalizer) normalize(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		for _, re := range n.patterns {
+			if re.MatchString(segment) {
+				segments[i] = prometheusPathID
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// cardinalityLimiter caps the number of distinct values of every label of every metric.
+// Once a label reached the limit, its new values are replaced with "other".
+type cardinalityLimiter struct {
+	maxValues int
+	overflows *prometheus.CounterVec
+
+	mu     sync.Mutex
+	values map[string]map[string]struct{}
+}
+
+func newCardinalityLimiter(maxValues int) *cardinalityLimiter {
+	return &cardinalityLimiter{
+		maxValues: maxValues,
+		overflows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "tyk_prometheus_label_overflows",
+				Help: "Label values replaced with other because the label reached max_label_values",
+			},
+			[]string{"metric", "label"},
+		),
+		values: make(map[string]map[string]struct{}),
+	}
+}
+
+// limit replaces in place the values of the labels which reached the limit
+func (l *cardinalityLimiter) limit(metric string, labels []string, values []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, label := range labels {
+		key := metric + "/" + label
+		seen, found := l.values[key]
+		if !found {
+			seen = make(map[string]struct{})
+			l.values[key] = seen
+		}
+		if _, found := seen[values[i]]; found {
+			continue
+		}
+		if len(seen) >= l.maxValues {
+			values[i] = prometheusOverflowValue
+			l.overflows.WithLabelValues(metric, label).Inc()
+			continue
+		}
+		seen[values[i]] = struct{}{}
+	}
+}
@@ -0,0 +1,295 @@
+package pumps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	prometheusScrapeMode      = "scrape"
+	prometheusRemoteWriteMode = "remote_write"
+	prometheusPushgatewayMode = "pushgateway"
+
+	defaultPrometheusPushInterval = 15
+	defaultPrometheusPushJob      = "tyk-pump"
+	defaultPrometheusPushTimeout  = 10
+)
+
+type PrometheusPushConf struct {
+	// URL of the remote write endpoint, e.g. http://localhost:9090/api/v1/write, or of the Pushgateway
+	URL string `mapstructure:"url"`
+	// Seconds between pushes. Defaults to 15
+	Interval int `mapstructure:"interval"`
+	// Timeout of the push requests in seconds. Defaults to 10
+	Timeout int `mapstructure:"timeout"`
+	// Job of the metrics pushed to the Pushgateway. Defaults to tyk-pump
+	Job string `mapstructure:"job"`
+	// Labels added to all the series, e.g. {"instance": "pump-1"}. Grouping labels of the Pushgateway
+	Labels map[string]string `mapstructure:"labels"`
+	// Basic auth credentials
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Bearer token sent in the Authorization header
+	BearerToken string `mapstructure:"bearer_token"`
+	// Headers added to the push requests, e.g. X-Scope-OrgID for multi-tenant receivers
+	Headers               map[string]string `mapstructure:"headers"`
+	SSLCAFile             string            `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string            `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string            `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool              `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// prometheusPushTransport adds the authorization and the custom headers to the push requests
+type prometheusPushTransport struct {
+	conf      *PrometheusPushConf
+	transport http.RoundTripper
+}
+
+func (t *prometheusPushTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	if t.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.conf.BearerToken)
+	} else if t.conf.Username != "" {
+		req.SetBasicAuth(t.conf.Username, t.conf.Password)
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func getPrometheusPushClient(conf *PrometheusPushConf) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.SSLCAFile != "" || conf.SSLCertFile != "" || conf.SSLKeyFile != "" || conf.SSLInsecureSkipVerify {
+		tlsConfig, err := getTLSConfig(conf.SSLCAFile, conf.SSLCertFile, conf.SSLKeyFile, conf.SSLInsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultPrometheusPushTimeout
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: &prometheusPushTransport{conf: conf, transport: transport},
+	}, nil
+}
+
+// initPush validates the push configuration and starts pushing the metrics on schedule
+func (p *PrometheusPump) initPush() error {
+	conf := &p.conf.Push
+	if conf.URL == "" {
+		return errors.New("Prometheus push url not set")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = defaultPrometheusPushInterval
+	}
+	if conf.Job == "" {
+		conf.Job = defaultPrometheusPushJob
+	}
+
+	client, err := getPrometheusPushClient(conf)
+	if err != nil {
+		return err
+	}
+
+	if p.conf.Mode == prometheusPushgatewayMode {
+		pusher := push.New(conf.URL, conf.Job).Gatherer(p.registry).Client(client)
+		for name, value := range conf.Labels {
+			pusher = pusher.Grouping(name, value)
+		}
+		p.push = pusher.Push
+	} else {
+		p.push = func() error {
+			return p.remoteWrite(client)
+		}
+	}
+
+	p.log.Info("Pushing the metrics to ", conf.URL, " every ", conf.Interval, " seconds")
+	p.stopPush = make(chan struct{})
+	p.pushing.Add(1)
+	go p.pushLoop(time.Duration(conf.Interval) * time.Second)
+	return nil
+}
+
+func (p *PrometheusPump) pushLoop(interval time.Duration) {
+	defer p.pushing.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopPush:
+			return
+		case <-ticker.C:
+			if err := p.push(); err != nil {
+				p.log.WithError(err).Error("Couldn't push the metrics")
+			}
+		}
+	}
+}
+
+// Shutdown stops the push loop and pushes the metrics updated since its last push, so short-lived pumps don't lose them
+func (p *PrometheusPump) Shutdown() error {
+	if p.stopPush == nil {
+		return nil
+	}
+	close(p.stopPush)
+	p.pushing.Wait()
+	p.stopPush = nil
+
+	return p.push()
+}
+
+// remoteWrite sends all the series of the registry with the Prometheus remote write protocol
+func (p *PrometheusPump) remoteWrite(client *http.Client) error {
+	families, err := p.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	body := snappy.Encode(nil, encodeRemoteWriteRequest(families, p.conf.Push.Labels, time.Now()))
+	req, err := http.NewRequest(http.MethodPost, p.conf.Push.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "tyk-pump")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+type prometheusSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// getPrometheusSamples flattens the metric families in samples, the histograms and the summaries are expanded
+// in their _bucket, _sum and _count series as in the text exposition format
+func getPrometheusSamples(families []*dto.MetricFamily, externalLabels map[string]string) []prometheusSample {
+	var samples []prometheusSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			newSample := func(suffix string, value float64, extraLabels ...string) {
+				labels := make(map[string]string, len(externalLabels)+len(metric.GetLabel())+2)
+				for k, v := range externalLabels {
+					labels[k] = v
+				}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				for i := 0; i+1 < len(extraLabels); i += 2 {
+					labels[extraLabels[i]] = extraLabels[i+1]
+				}
+				labels["__name__"] = name + suffix
+				samples = append(samples, prometheusSample{labels: labels, value: value})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				newSample("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				newSample("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				newSample("", metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					newSample("_bucket", float64(bucket.GetCumulativeCount()), "le", formatPrometheusFloat(bucket.GetUpperBound()))
+				}
+				newSample("_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				newSample("_sum", histogram.GetSampleSum())
+				newSample("_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					newSample("", quantile.GetValue(), "quantile", formatPrometheusFloat(quantile.GetQuantile()))
+				}
+				newSample("_sum", summary.GetSampleSum())
+				newSample("_count", float64(summary.GetSampleCount()))
+			}
+		}
+	}
+	return samples
+}
+
+func formatPrometheusFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeRemoteWriteRequest encodes the metric families as a prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeRemoteWriteRequest(families []*dto.MetricFamily, externalLabels map[string]string, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	var request []byte
+	for _, sample := range getPrometheusSamples(families, externalLabels) {
+		// the labels of a series must be sorted by name
+		names := make([]string, 0, len(sample.labels))
+		for name := range sample.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, sample.labels[name])
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
@@ -0,0 +1,201 @@
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteStub is a remote write receiver decoding the series it receives
+type remoteWriteStub struct {
+	mu      sync.Mutex
+	headers http.Header
+	series  map[string]float64
+}
+
+func (s *remoteWriteStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.headers = r.Header
+	s.series = make(map[string]float64)
+
+	compressed, _ := ioutil.ReadAll(r.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for len(data) > 0 {
+		_, _, n := protowire.ConsumeTag(data)
+		series, m := protowire.ConsumeBytes(data[n:])
+		data = data[n+m:]
+
+		var labels []string
+		var value float64
+		for len(series) > 0 {
+			number, _, n := protowire.ConsumeTag(series)
+			field, m := protowire.ConsumeBytes(series[n:])
+			series = series[n+m:]
+
+			if number == 1 {
+				_, _, n := protowire.ConsumeTag(field)
+				name, m := protowire.ConsumeString(field[n:])
+				field = field[n+m:]
+				_, _, n = protowire.ConsumeTag(field)
+				labelValue, _ := protowire.ConsumeString(field[n:])
+				labels = append(labels, name+"="+labelValue)
+			} else {
+				_, _, n := protowire.ConsumeTag(field)
+				bits, _ := protowire.ConsumeFixed64(field[n:])
+				value = math.Float64frombits(bits)
+			}
+		}
+		s.series[strings.Join(labels, ",")] = value
+	}
+}
+
+func TestPrometheusPump_RemoteWrite(t *testing.T) {
+	stub := &remoteWriteStub{}
+	server := httptest.NewTLSServer(stub)
+	defer server.Close()
+
+	caFile := writeCAFile(t, server)
+	defer os.Remove(caFile)
+
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	err := p.Init(map[string]interface{}{
+		"mode": "remote_write",
+		"push": map[string]interface{}{
+			"url":          server.URL + "/api/v1/write",
+			"bearer_token": "secret",
+			"headers":      map[string]string{"X-Scope-OrgID": "tenant"},
+			"labels":       map[string]string{"instance": "pump-1"},
+			"ssl_ca_file":  caFile,
+		},
+		"disabled_metrics": []string{"tyk_request_size", "tyk_response_size"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api1", APIKey: "key1", Path: "/", Method: "GET", ResponseCode: 200, RequestTime: 3},
+	}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if stub.headers.Get("Content-Encoding") != "snappy" || stub.headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("unexpected headers %v", stub.headers)
+	}
+	if stub.headers.Get("Authorization") != "Bearer secret" || stub.headers.Get("X-Scope-OrgID") != "tenant" {
+		t.Errorf("expected the auth and custom headers, got %v", stub.headers)
+	}
+
+	expected := map[string]float64{
+		"__name__=tyk_http_status,api=api1,code=200,instance=pump-1":              1,
+		"__name__=tyk_latency_bucket,api=api1,instance=pump-1,le=2,type=total":    0,
+		"__name__=tyk_latency_bucket,api=api1,instance=pump-1,le=5,type=total":    1,
+		"__name__=tyk_latency_bucket,api=api1,instance=pump-1,le=+Inf,type=total": 1,
+		"__name__=tyk_latency_sum,api=api1,instance=pump-1,type=total":            3,
+		"__name__=tyk_latency_count,api=api1,instance=pump-1,type=total":          1,
+		"__name__=tyk_http_status_per_key,code=200,instance=pump-1,key=key1":      1,
+	}
+	for series, value := range expected {
+		if got, found := stub.series[series]; !found || got != value {
+			t.Errorf("expected series %s with value %v, got %v (found %v)", series, value, got, found)
+		}
+	}
+}
+
+func TestPrometheusPump_Pushgateway(t *testing.T) {
+	var mu sync.Mutex
+	var method, path, user, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		method, path = r.Method, r.URL.Path
+		user, _, _ = r.BasicAuth()
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	err := p.Init(map[string]interface{}{
+		"mode": "pushgateway",
+		"push": map[string]interface{}{
+			"url":      server.URL,
+			"username": "user",
+			"password": "pass",
+			"labels":   map[string]string{"instance": "pump-1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{analytics.AnalyticsRecord{APIID: "api1", ResponseCode: 200}}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	// the metrics since the last push are pushed on shutdown
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Shutdown(); err != nil {
+		t.Errorf("expected a second shutdown to do nothing, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if method != http.MethodPut || path != "/metrics/job/tyk-pump/instance/pump-1" {
+		t.Errorf("unexpected request %s %s", method, path)
+	}
+	if user != "user" {
+		t.Errorf("expected basic auth, got user %q", user)
+	}
+	if body == "" {
+		t.Error("expected the metrics to be pushed")
+	}
+}
+
+func TestPrometheusPump_InvalidModes(t *testing.T) {
+	tcs := []struct {
+		testName string
+		config   map[string]interface{}
+	}{
+		{"unknown mode", map[string]interface{}{"mode": "pull", "listen_address": "127.0.0.1:0"}},
+		{"scrape without address", map[string]interface{}{"mode": "scrape"}},
+		{"push without url", map[string]interface{}{"mode": "remote_write"}},
+		{"missing ca file", map[string]interface{}{"mode": "pushgateway", "push": map[string]interface{}{"url": "http://localhost:9091", "ssl_ca_file": "missing.pem"}}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			p := (&PrometheusPump{}).New()
+			if err := p.Init(tc.config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package pumps
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gatherPrometheusMetrics(t *testing.T, p *PrometheusPump) map[string]*dto.MetricFamily {
+	families, err := p.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		metrics[family.GetName()] = family
+	}
+	return metrics
+}
+
+func TestPrometheusPump_CustomMetrics(t *testing.T) {
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	err := p.Init(map[string]interface{}{
+		"listen_address":   "127.0.0.1:0",
+		"disabled_metrics": []string{"tyk_http_status_per_key", "tyk_http_status_per_path"},
+		"custom_metrics": []map[string]interface{}{
+			{"name": "tyk_requests", "metric_type": "counter", "labels": []string{"api_id", "method", "response_code"}},
+			{"name": "tyk_request_time", "metric_type": "histogram", "labels": []string{"org_id"}, "buckets": []float64{10, 100}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api1", OrgID: "org1", Method: "GET", ResponseCode: 200, RequestTime: 5},
+		analytics.AnalyticsRecord{APIID: "api1", OrgID: "org1", Method: "GET", ResponseCode: 200, RequestTime: 50},
+		analytics.AnalyticsRecord{APIID: "api2", OrgID: "org1", Method: "POST", ResponseCode: 500, RequestTime: 500},
+	}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gatherPrometheusMetrics(t, p)
+	for _, name := range []string{"tyk_http_status_per_key", "tyk_http_status_per_path"} {
+		if _, found := metrics[name]; found {
+			t.Errorf("expected %s to be disabled", name)
+		}
+	}
+	if _, found := metrics["tyk_http_status"]; !found {
+		t.Error("expected tyk_http_status to be enabled")
+	}
+
+	requests := metrics["tyk_requests"]
+	if requests == nil || len(requests.GetMetric()) != 2 {
+		t.Fatalf("expected 2 tyk_requests series, got %v", requests)
+	}
+	for _, metric := range requests.GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		expected := 1.0
+		if labels["api_id"] == "api1" {
+			expected = 2
+		}
+		if metric.GetCounter().GetValue() != expected {
+			t.Errorf("expected %v requests for %v, got %v", expected, labels, metric.GetCounter().GetValue())
+		}
+	}
+
+	requestTime := metrics["tyk_request_time"]
+	if requestTime == nil || len(requestTime.GetMetric()) != 1 {
+		t.Fatalf("expected 1 tyk_request_time series, got %v", requestTime)
+	}
+	histogram := requestTime.GetMetric()[0].GetHistogram()
+	if histogram.GetSampleCount() != 3 || len(histogram.GetBucket()) != 2 || histogram.GetBucket()[1].GetCumulativeCount() != 2 {
+		t.Errorf("unexpected histogram %v", histogram)
+	}
+}
+
+func TestPrometheusPump_MultipleInstances(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		p := (&PrometheusPump{}).New()
+		if err := p.Init(map[string]interface{}{"listen_address": "127.0.0.1:0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrometheusPump_InvalidCustomMetrics(t *testing.T) {
+	tcs := []struct {
+		testName string
+		metric   map[string]interface{}
+	}{
+		{"no name", map[string]interface{}{"metric_type": "counter"}},
+		{"unknown type", map[string]interface{}{"name": "tyk_requests", "metric_type": "gauge"}},
+		{"unknown label", map[string]interface{}{"name": "tyk_requests", "metric_type": "counter", "labels": []string{"unknown"}}},
+		{"duplicated name", map[string]interface{}{"name": "tyk_http_status", "metric_type": "counter"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			p := (&PrometheusPump{}).New()
+			err := p.Init(map[string]interface{}{
+				"listen_address": "127.0.0.1:0",
+				"custom_metrics": []map[string]interface{}{tc.metric},
+			})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestPrometheusPump_LatencyAndSize(t *testing.T) {
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	if err := p.Init(map[string]interface{}{"listen_address": "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api1", RequestTime: 40, Latency: analytics.Latency{Total: 40, Upstream: 30}, Network: analytics.NetworkStats{BytesIn: 100, BytesOut: 2000}},
+		// records of gateways which don't send the latencies and the network stats
+		analytics.AnalyticsRecord{APIID: "api1", RequestTime: 50, ContentLength: 300},
+	}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gatherPrometheusMetrics(t, p)
+	latencies := map[string]*dto.Histogram{}
+	for _, metric := range metrics["tyk_latency"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "type" {
+				latencies[label.GetValue()] = metric.GetHistogram()
+			}
+		}
+	}
+	expected := map[string]struct {
+		count uint64
+		sum   float64
+	}{
+		"total":    {2, 90},
+		"upstream": {1, 30},
+		"gateway":  {1, 10},
+	}
+	for latencyType, e := range expected {
+		h := latencies[latencyType]
+		if h.GetSampleCount() != e.count || h.GetSampleSum() != e.sum {
+			t.Errorf("expected %d %s latencies with sum %v, got %d with sum %v", e.count, latencyType, e.sum, h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+
+	requestSize := metrics["tyk_request_size"].GetMetric()[0].GetHistogram()
+	if requestSize.GetSampleCount() != 2 || requestSize.GetSampleSum() != 400 {
+		t.Errorf("unexpected request sizes %v", requestSize)
+	}
+	responseSize := metrics["tyk_response_size"].GetMetric()[0].GetHistogram()
+	if responseSize.GetSampleCount() != 1 || responseSize.GetSampleSum() != 2000 {
+		t.Errorf("unexpected response sizes %v", responseSize)
+	}
+}
+
+func TestPrometheusPump_SizeWithoutLatency(t *testing.T) {
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	err := p.Init(map[string]interface{}{
+		"listen_address":   "127.0.0.1:0",
+		"disabled_metrics": []string{"tyk_latency"},
+		"max_label_values": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api1", ContentLength: 100},
+		analytics.AnalyticsRecord{APIID: "api2", ContentLength: 200},
+	}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gatherPrometheusMetrics(t, p)
+	apis := map[string]uint64{}
+	for _, metric := range metrics["tyk_request_size"].GetMetric() {
+		apis[metric.GetLabel()[0].GetValue()] = metric.GetHistogram().GetSampleCount()
+	}
+	if len(apis) != 2 || apis["api1"] != 1 || apis[prometheusOverflowValue] != 1 {
+		t.Errorf("expected api1 and the other api folded, got %v", apis)
+	}
+
+	for _, metric := range metrics["tyk_prometheus_label_overflows"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "metric" && label.GetValue() == "tyk_latency" {
+				t.Errorf("expected no overflow of the disabled tyk_latency")
+			}
+		}
+	}
+}
+
+func TestPrometheusPump_CardinalityGuards(t *testing.T) {
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	err := p.Init(map[string]interface{}{
+		"listen_address":   "127.0.0.1:0",
+		"max_label_values": 2,
+		"normalize_paths":  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api1", APIKey: "key1", Path: "/users/123", Method: "GET", ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "api1", APIKey: "key2", Path: "/users/456", Method: "GET", ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "api1", APIKey: "key3", Path: "/users/789", Method: "GET", ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "api1", APIKey: "key4", Path: "/users/789", Method: "GET", ResponseCode: 200},
+	}
+	if err := p.WriteData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gatherPrometheusMetrics(t, p)
+	keys := map[string]float64{}
+	for _, metric := range metrics["tyk_http_status_per_key"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "key" {
+				keys[label.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	if len(keys) != 3 || keys["key1"] != 1 || keys["key2"] != 1 || keys[prometheusOverflowValue] != 2 {
+		t.Errorf("expected 2 keys and the others folded, got %v", keys)
+	}
+
+	paths := metrics["tyk_http_status_per_path"].GetMetric()
+	if len(paths) != 1 || paths[0].GetCounter().GetValue() != 4 {
+		t.Errorf("expected the paths to be normalized in one series, got %v", paths)
+	}
+
+	overflows := metrics["tyk_prometheus_label_overflows"].GetMetric()
+	if len(overflows) != 1 || overflows[0].GetCounter().GetValue() != 2 {
+		t.Errorf("expected 2 overflows, got %v", overflows)
+	}
+}
+
+func TestPathNormalizer(t *testing.T) {
+	n, err := newPathNormalizer([]string{"[a-z]+-[0-9]+"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		path     string
+		expected string
+	}{
+		{"/users", "/users"},
+		{"/users/123", "/users/{id}"},
+		{"/users/123/orders/456/", "/users/{id}/orders/{id}/"},
+		{"/orders/3fa85f64-5717-4562-b3fc-2c963f66afa6", "/orders/{id}"},
+		{"/keys/5f1a2b3c4d5e6f708192a3b4", "/keys/{id}"},
+		{"/v1/items", "/v1/items"},
+		{"/tickets/abc-42", "/tickets/{id}"},
+	}
+
+	for _, tc := range tcs {
+		if normalized := n.normalize(tc.path); normalized != tc.expected {
+			t.Errorf("expected %s to be normalized to %s, got %s", tc.path, tc.expected, normalized)
+		}
+	}
+
+	if _, err := newPathNormalizer([]string{"("}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestPrometheusPump_WriteUptimeData(t *testing.T) {
+	p := (&PrometheusPump{}).New().(*PrometheusPump)
+	if err := p.Init(map[string]interface{}{"listen_address": "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []analytics.UptimeReportData{
+		{APIID: "api1", OrgID: "org1", URL: "http://upstream1", RequestTime: 20},
+		{APIID: "api2", OrgID: "org1", URL: "http://upstream2", RequestTime: 30},
+		// the last check of the host wins
+		{APIID: "api2", OrgID: "org1", URL: "http://upstream2", TCPError: true},
+	}
+	if err := p.WriteUptimeData(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := gatherPrometheusMetrics(t, p)
+	up := metrics["tyk_uptime_up"]
+	if up == nil || len(up.GetMetric()) != 2 {
+		t.Fatalf("expected 2 tyk_uptime_up series, got %v", up)
+	}
+	for _, metric := range up.GetMetric() {
+		expected := 1.0
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "api" && label.GetValue() == "api2" {
+				expected = 0
+			}
+		}
+		if metric.GetGauge().GetValue() != expected {
+			t.Errorf("expected %v, got %v", expected, metric)
+		}
+	}
+
+	latency := metrics["tyk_uptime_latency"]
+	if latency == nil || len(latency.GetMetric()) != 2 {
+		t.Fatalf("expected 2 tyk_uptime_latency series, got %v", latency)
+	}
+	for _, metric := range latency.GetMetric() {
+		if metric.GetHistogram().GetSampleCount() != 1 {
+			t.Errorf("expected the failed connection not to be observed, got %v", metric)
+		}
+	}
+}
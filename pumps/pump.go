@@ -20,6 +20,11 @@ type Pump interface {
 	GetOmitDetailedRecording() bool
 }
 
+// ShutdownPump is implemented by the pumps which flush buffered records or release resources when the pump stops
+type ShutdownPump interface {
+	Shutdown() error
+}
+
 func GetPumpByName(name string) (Pump, error) {
 
 	if pump, ok := AvailablePumps[name]; ok && pump != nil {
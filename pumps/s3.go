@@ -0,0 +1,652 @@
+package pumps
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
+)
+
+// S3Pump archives the analytics records in NDJSON or Parquet files uploaded to an S3 compatible storage.
+// The records are staged on disk per partition until their file rolls by size or age.
+type S3Pump struct {
+	conf   *S3Conf
+	client *s3Client
+
+	mu         sync.Mutex
+	partitions map[string]*s3Partition
+	// serialises the uploads of the rolled files
+	uploadMu sync.Mutex
+	CommonPumpConfig
+}
+
+type S3Conf struct {
+	// Endpoint of the storage, e.g. http://localhost:9000 for MinIO. Defaults to https://s3.<region>.amazonaws.com
+	Endpoint string `mapstructure:"endpoint"`
+	// Defaults to us-east-1
+	Region string `mapstructure:"region"`
+	Bucket string `mapstructure:"bucket"`
+	// Credentials, read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN when not set
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	// Puts the bucket in the path of the URLs rather than in the host, as needed by MinIO
+	ForcePathStyle bool `mapstructure:"force_path_style"`
+	// Prefix of the keys of the files
+	Prefix string `mapstructure:"prefix"`
+	// Path of the files of a partition. Defaults to org_id={org_id}/api_id={api_id}/dt={dt}/hour={hour}
+	PathTemplate string `mapstructure:"path_template"`
+	// ndjson or parquet. Defaults to ndjson
+	Format string `mapstructure:"format"`
+	// gzip or none for ndjson, defaulting to gzip. snappy, gzip or none for parquet, defaulting to snappy
+	Compression string `mapstructure:"compression"`
+	// Directory of the staged records, which survive the restarts. Defaults to <temp dir>/tyk-pump-s3
+	StagingDir string `mapstructure:"staging_dir"`
+	// Size in bytes of the staged records of a partition rolling its file. Defaults to 67108864
+	MaxFileSize int64 `mapstructure:"max_file_size"`
+	// Seconds after which the file of a partition rolls. Defaults to 300
+	MaxFileAge int `mapstructure:"max_file_age"`
+	// Size in bytes of the parts of the multipart uploads, at least 5242880. Defaults to 8388608
+	PartSize int `mapstructure:"part_size"`
+	// Timeout of every request in seconds. Defaults to 60
+	RequestTimeout        int    `mapstructure:"request_timeout"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+var s3Prefix = "s3-pump"
+
+const (
+	s3NDJSONFormat  = "ndjson"
+	s3ParquetFormat = "parquet"
+
+	defaultS3Region         = "us-east-1"
+	defaultS3PathTemplate   = "org_id={org_id}/api_id={api_id}/dt={dt}/hour={hour}"
+	defaultS3MaxFileSize    = 64 * 1024 * 1024
+	defaultS3MaxFileAge     = 300
+	defaultS3PartSize       = 8 * 1024 * 1024
+	minS3PartSize           = 5 * 1024 * 1024
+	defaultS3RequestTimeout = 60
+	s3FlushInterval         = 5 * time.Second
+
+	// extensions of the staging files being written and waiting for their upload
+	s3StagingExt = ".ndjson"
+	s3ReadyExt   = ".ready"
+	// extension of the files which couldn't be uploaded, kept for inspection
+	s3CorruptExt = ".corrupt"
+)
+
+// s3ParquetSchema is the schema of the Parquet files, that of the canonical record of the serializers
+var s3ParquetSchema = getS3ParquetSchema()
+
+func getS3ParquetSchema() string {
+	type field struct {
+		Tag    string
+		Fields []field `json:",omitempty"`
+	}
+
+	root := field{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, f := range serializer.Fields() {
+		tag := "name=" + f.Name
+		switch f.Kind {
+		case reflect.String:
+			tag += ", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"
+		case reflect.Int64:
+			tag += ", type=INT64, repetitiontype=REQUIRED"
+			if f.Logical == "timestamp-millis" {
+				tag += ", convertedtype=TIMESTAMP_MILLIS"
+			}
+		case reflect.Float64:
+			tag += ", type=DOUBLE, repetitiontype=REQUIRED"
+		case reflect.Bool:
+			tag += ", type=BOOLEAN, repetitiontype=REQUIRED"
+		case reflect.Slice:
+			tag += ", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REPEATED"
+		}
+		root.Fields = append(root.Fields, field{Tag: tag})
+	}
+
+	schema, _ := json.Marshal(root)
+	return string(schema)
+}
+
+// s3CorruptFileError is returned for the staging files which can't be read, they are quarantined
+type s3CorruptFileError struct {
+	err error
+}
+
+func (e s3CorruptFileError) Error() string {
+	return "corrupt staging file: " + e.err.Error()
+}
+
+// s3Partition is the staging file of the records of a path
+type s3Partition struct {
+	file   *os.File
+	opened time.Time
+	size   int64
+}
+
+func (s *S3Pump) New() Pump {
+	newPump := S3Pump{}
+	return &newPump
+}
+
+func (s *S3Pump) GetName() string {
+	return "S3 Pump"
+}
+
+func (s *S3Pump) Init(config interface{}) error {
+	s.conf = &S3Conf{}
+	s.log = log.WithField("prefix", s3Prefix)
+
+	if err := mapstructure.Decode(config, &s.conf); err != nil {
+		return err
+	}
+	if err := s.setDefaults(); err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(s.conf.Endpoint)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := getTLSConfig(s.conf.SSLCAFile, "", "", s.conf.SSLInsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	s.client = &s3Client{
+		endpoint:        endpoint,
+		bucket:          s.conf.Bucket,
+		region:          s.conf.Region,
+		pathStyle:       s.conf.ForcePathStyle,
+		accessKeyID:     s.conf.AccessKeyID,
+		secretAccessKey: s.conf.SecretAccessKey,
+		sessionToken:    s.conf.SessionToken,
+		client: &http.Client{
+			Timeout:   time.Duration(s.conf.RequestTimeout) * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		now: time.Now,
+	}
+
+	if err := os.MkdirAll(s.conf.StagingDir, 0700); err != nil {
+		return err
+	}
+	if err := s.restore(); err != nil {
+		return err
+	}
+
+	go s.flushLoop()
+
+	s.log.Info(s.GetName() + " Initialized")
+	return nil
+}
+
+func (s *S3Pump) setDefaults() error {
+	if s.conf.Bucket == "" {
+		return errors.New("S3 bucket not set")
+	}
+	if s.conf.Region == "" {
+		s.conf.Region = defaultS3Region
+	}
+	if s.conf.Endpoint == "" {
+		s.conf.Endpoint = "https://s3." + s.conf.Region + ".amazonaws.com"
+	}
+	if s.conf.AccessKeyID == "" {
+		s.conf.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.conf.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.conf.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s.conf.AccessKeyID == "" || s.conf.SecretAccessKey == "" {
+		return errors.New("S3 credentials not set")
+	}
+	if s.conf.PathTemplate == "" {
+		s.conf.PathTemplate = defaultS3PathTemplate
+	}
+
+	switch s.conf.Format {
+	case "", s3NDJSONFormat:
+		s.conf.Format = s3NDJSONFormat
+		if s.conf.Compression == "" {
+			s.conf.Compression = "gzip"
+		}
+		if s.conf.Compression != "gzip" && s.conf.Compression != "none" {
+			return fmt.Errorf("unsupported S3 compression %q of ndjson, must be gzip or none", s.conf.Compression)
+		}
+	case s3ParquetFormat:
+		if s.conf.Compression == "" {
+			s.conf.Compression = "snappy"
+		}
+		if s.conf.Compression != "snappy" && s.conf.Compression != "gzip" && s.conf.Compression != "none" {
+			return fmt.Errorf("unsupported S3 compression %q of parquet, must be snappy, gzip or none", s.conf.Compression)
+		}
+	default:
+		return fmt.Errorf("unsupported S3 format %q, must be ndjson or parquet", s.conf.Format)
+	}
+
+	if s.conf.StagingDir == "" {
+		s.conf.StagingDir = filepath.Join(os.TempDir(), "tyk-pump-s3")
+	}
+	if s.conf.MaxFileSize <= 0 {
+		s.conf.MaxFileSize = defaultS3MaxFileSize
+	}
+	if s.conf.MaxFileAge <= 0 {
+		s.conf.MaxFileAge = defaultS3MaxFileAge
+	}
+	switch {
+	case s.conf.PartSize == 0:
+		s.conf.PartSize = defaultS3PartSize
+	case s.conf.PartSize < minS3PartSize:
+		return fmt.Errorf("S3 part_size must be at least %d bytes", minS3PartSize)
+	}
+	if s.conf.RequestTimeout <= 0 {
+		s.conf.RequestTimeout = defaultS3RequestTimeout
+	}
+	return nil
+}
+
+// restore reopens the staging files of the previous run, the extra files of a partition being rolled
+func (s *S3Pump) restore() error {
+	s.partitions = make(map[string]*s3Partition)
+
+	names, err := filepath.Glob(filepath.Join(s.conf.StagingDir, "*"+s3StagingExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path, opened, err := parseS3StagingName(name)
+		if err != nil {
+			s.log.Warning("Ignoring the staging file ", name, ": ", err)
+			continue
+		}
+		if _, found := s.partitions[path]; found {
+			if err := os.Rename(name, name+s3ReadyExt); err != nil {
+				return err
+			}
+			continue
+		}
+
+		size, err := truncateS3StagingFile(name)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.partitions[path] = &s3Partition{file: file, opened: opened, size: size}
+		s.log.Info("Restored ", size, " bytes of staged records of ", path)
+	}
+	return nil
+}
+
+// truncateS3StagingFile removes the line torn by a crash at the end of the staging file, so the next
+// records aren't appended to it, and returns the size of the file
+func truncateS3StagingFile(name string) (int64, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if size < int64(len(data)) {
+		if err := os.Truncate(name, size); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// stagingName returns the name of a new staging file of the path, holding the path, the time
+// and a random suffix making the keys of the pumps archiving to the same bucket unique
+func (s *S3Pump) stagingName(path string, opened time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	base := url.QueryEscape(path) + "@" + strconv.FormatInt(opened.UnixNano(), 10) + "-" + hex.EncodeToString(suffix)
+	return filepath.Join(s.conf.StagingDir, base+s3StagingExt)
+}
+
+func parseS3StagingName(name string) (string, time.Time, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), s3ReadyExt), s3StagingExt)
+	at := strings.LastIndex(base, "@")
+	if at < 0 {
+		return "", time.Time{}, errors.New("invalid staging file name")
+	}
+	path, err := url.QueryUnescape(base[:at])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(strings.SplitN(base[at+1:], "-", 2)[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return path, time.Unix(0, nanos).UTC(), nil
+}
+
+// partitionPath renders the path template with the values of the record
+func (s *S3Pump) partitionPath(record *analytics.AnalyticsRecord) string {
+	value := func(v string) string {
+		if v == "" {
+			return "unknown"
+		}
+		return url.PathEscape(v)
+	}
+	ts := record.TimeStamp.UTC()
+	return strings.NewReplacer(
+		"{org_id}", value(record.OrgID),
+		"{api_id}", value(record.APIID),
+		"{dt}", ts.Format("2006-01-02"),
+		"{year}", ts.Format("2006"),
+		"{month}", ts.Format("01"),
+		"{day}", ts.Format("02"),
+		"{hour}", ts.Format("15"),
+	).Replace(s.conf.PathTemplate)
+}
+
+func (s *S3Pump) WriteData(ctx context.Context, data []interface{}) error {
+	s.log.Debug("Attempting to write ", len(data), " records...")
+
+	var paths []string
+	lines := make(map[string][]byte)
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal(serializer.NewRecord(record))
+		if err != nil {
+			return err
+		}
+		path := s.partitionPath(&record)
+		if _, found := lines[path]; !found {
+			paths = append(paths, path)
+		}
+		lines[path] = append(append(lines[path], line...), '\n')
+	}
+
+	rolled, err := s.stage(paths, lines)
+	if err != nil {
+		s.log.Error("Failed to stage the records: ", err)
+		return err
+	}
+	s.log.Info("Purged ", len(data), " records...")
+
+	// the records are staged, a failed upload of the rolled files is retried by the next purges
+	if rolled {
+		if err := s.uploadReady(ctx); err != nil {
+			s.log.Error("Failed to upload the rolled files, retrying later: ", err)
+		}
+	}
+	return nil
+}
+
+// stage appends the lines to the staging files of their paths, and rolls the files reaching max_file_size
+func (s *S3Pump) stage(paths []string, lines map[string][]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rolled := false
+	for _, path := range paths {
+		partition, found := s.partitions[path]
+		if !found {
+			opened := time.Now()
+			file, err := os.OpenFile(s.stagingName(path, opened), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return rolled, err
+			}
+			partition = &s3Partition{file: file, opened: opened}
+			s.partitions[path] = partition
+		}
+
+		n, err := partition.file.Write(lines[path])
+		partition.size += int64(n)
+		if err != nil {
+			return rolled, err
+		}
+		if partition.size >= s.conf.MaxFileSize {
+			if err := s.roll(path); err != nil {
+				return rolled, err
+			}
+			rolled = true
+		}
+	}
+	return rolled, nil
+}
+
+// roll syncs and closes the staging file of the path and marks it ready for upload, the lock must be held
+func (s *S3Pump) roll(path string) error {
+	partition := s.partitions[path]
+	delete(s.partitions, path)
+
+	name := partition.file.Name()
+	err := partition.file.Sync()
+	if closeErr := partition.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(name, name+s3ReadyExt); err != nil {
+		return err
+	}
+	return syncDir(s.conf.StagingDir)
+}
+
+// syncDir persists the renames of the files of the directory
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rollExpired rolls the files older than max_file_age
+func (s *S3Pump) rollExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path, partition := range s.partitions {
+		if now.Sub(partition.opened) < time.Duration(s.conf.MaxFileAge)*time.Second {
+			continue
+		}
+		if err := s.roll(path); err != nil {
+			s.log.Error("Failed to roll the file of ", path, ": ", err)
+		}
+	}
+}
+
+func (s *S3Pump) flushLoop() {
+	ticker := time.NewTicker(s3FlushInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.rollExpired(now)
+		if err := s.uploadReady(context.Background()); err != nil {
+			s.log.Error("Failed to upload the rolled files, retrying later: ", err)
+		}
+	}
+}
+
+// uploadReady uploads the rolled files and deletes them, the failed ones being kept for the next attempt
+func (s *S3Pump) uploadReady(ctx context.Context) error {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	names, err := filepath.Glob(filepath.Join(s.conf.StagingDir, "*"+s3ReadyExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key, err := s.objectKey(name)
+		if err != nil {
+			s.quarantine(name, err)
+			continue
+		}
+		err = s.upload(ctx, key, name)
+		if corrupt, ok := err.(s3CorruptFileError); ok {
+			s.quarantine(name, corrupt)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		s.log.Info("Uploaded ", key)
+	}
+	return nil
+}
+
+// quarantine renames the file which can't be uploaded, so the next files are still uploaded
+func (s *S3Pump) quarantine(name string, reason error) {
+	s.log.Error("Quarantining the staging file ", name, ": ", reason)
+	if err := os.Rename(name, name+s3CorruptExt); err != nil {
+		s.log.Error("Failed to quarantine the staging file ", name, ": ", err)
+	}
+}
+
+// objectKey returns the key of the staging file, the same on every attempt
+func (s *S3Pump) objectKey(name string) (string, error) {
+	path, opened, err := parseS3StagingName(name)
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), s3ReadyExt), s3StagingExt)
+	suffix := base[strings.LastIndex(base, "-")+1:]
+
+	ext := ".ndjson"
+	if s.conf.Format == s3ParquetFormat {
+		ext = ".parquet"
+		if s.conf.Compression != "none" {
+			ext = "." + s.conf.Compression + ext
+		}
+	} else if s.conf.Compression == "gzip" {
+		ext += ".gz"
+	}
+
+	key := path + "/part-" + opened.Format(s3DateFormat) + "-" + suffix + ext
+	if s.conf.Prefix != "" {
+		key = strings.Trim(s.conf.Prefix, "/") + "/" + key
+	}
+	return key, nil
+}
+
+func (s *S3Pump) upload(ctx context.Context, key, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the file is converted while it's uploaded
+	convert, contentType := s.writeNDJSON, "application/x-ndjson"
+	if s.conf.Format == s3ParquetFormat {
+		convert, contentType = s.writeParquet, "application/vnd.apache.parquet"
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(convert(pw, file))
+	}()
+	err = s.client.upload(ctx, key, pr, s.conf.PartSize, contentType)
+	pr.CloseWithError(err)
+	return err
+}
+
+// scanStaged calls add with every record of the staging file, skipping the lines which aren't records
+func (s *S3Pump) scanStaged(staged io.Reader, add func(line []byte, record *serializer.Record) error) error {
+	scanner := bufio.NewScanner(staged)
+	scanner.Buffer(make([]byte, 64*1024), int(s.conf.MaxFileSize)+1024*1024)
+	skipped := 0
+	for scanner.Scan() {
+		record := serializer.Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			skipped++
+			continue
+		}
+		if err := add(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3CorruptFileError{err}
+	}
+	if skipped > 0 {
+		s.log.Warning("Skipped ", skipped, " invalid staged records")
+	}
+	return nil
+}
+
+// writeNDJSON copies the staged records, compressed with gzip unless the compression is none
+func (s *S3Pump) writeNDJSON(out io.Writer, staged io.Reader) error {
+	w := out
+	var zw *gzip.Writer
+	if s.conf.Compression == "gzip" {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+
+	err := s.scanStaged(staged, func(line []byte, record *serializer.Record) error {
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte{'\n'})
+		return err
+	})
+	if zw != nil {
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writeParquet converts the staged records to a Parquet file
+func (s *S3Pump) writeParquet(out io.Writer, staged io.Reader) error {
+	pw, err := writer.NewJSONWriterFromWriter(s3ParquetSchema, out, 1)
+	if err != nil {
+		return err
+	}
+	switch s.conf.Compression {
+	case "snappy":
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	case "gzip":
+		pw.CompressionType = parquet.CompressionCodec_GZIP
+	default:
+		pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	}
+
+	err = s.scanStaged(staged, func(line []byte, record *serializer.Record) error {
+		return pw.Write(string(line))
+	})
+	if err != nil {
+		return err
+	}
+	return pw.WriteStop()
+}
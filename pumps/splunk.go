@@ -13,6 +13,7 @@ import (
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
 )
 
 const (
@@ -88,8 +89,9 @@ func (c *SplunkClient) Send(ctx context.Context, event map[string]interface{}, t
 
 // SplunkPump is a Tyk Pump driver for Splunk.
 type SplunkPump struct {
-	client *SplunkClient
-	config *SplunkPumpConfig
+	client     *SplunkClient
+	config     *SplunkPumpConfig
+	serializer serializer.Serializer
 	CommonPumpConfig
 }
 
@@ -104,6 +106,8 @@ type SplunkPumpConfig struct {
 	ObfuscateAPIKeys       bool     `mapstructure:"obfuscate_api_keys"`
 	ObfuscateAPIKeysLength int      `mapstructure:"obfuscate_api_keys_length"`
 	Fields                 []string `mapstructure:"fields"`
+	// Send the events in the canonical json format of the serializer instead of the fields
+	Serialization serializer.Config `mapstructure:"serialization"`
 }
 
 // New initializes a new pump.
@@ -127,6 +131,11 @@ func (p *SplunkPump) Init(config interface{}) error {
 	}
 	p.log.Infof("%s Endpoint: %s", splunkPumpName, p.config.CollectorURL)
 
+	p.serializer, err = getJSONSerializer(p.config.Serialization)
+	if err != nil {
+		return err
+	}
+
 	p.client, err = NewSplunkClient(p.config.CollectorToken, p.config.CollectorURL, p.config.SSLInsecureSkipVerify, p.config.SSLCertFile, p.config.SSLKeyFile, p.config.SSLServerName)
 	if err != nil {
 		return err
@@ -152,6 +161,16 @@ func (p *SplunkPump) WriteData(ctx context.Context, data []interface{}) error {
 			apiKey = "****" + apiKey[len(apiKey)-p.config.ObfuscateAPIKeysLength:]
 		}
 
+		if p.serializer != nil {
+			decoded.APIKey = apiKey
+			event, err := canonicalSplunkEvent(p.serializer, decoded)
+			if err != nil {
+				return err
+			}
+			p.client.Send(ctx, event, decoded.TimeStamp)
+			continue
+		}
+
 		mapping := map[string]interface{}{
 			"method":         decoded.Method,
 			"host":           decoded.Host,
@@ -216,3 +235,16 @@ func (p *SplunkPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	return nil
 }
+
+// canonicalSplunkEvent returns the event of the record in the canonical json format, its numbers being kept as is
+func canonicalSplunkEvent(s serializer.Serializer, record analytics.AnalyticsRecord) (map[string]interface{}, error) {
+	payload, err := s.Encode(record)
+	if err != nil {
+		return nil, err
+	}
+	event := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	err = decoder.Decode(&event)
+	return event, err
+}
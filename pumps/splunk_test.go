@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 const (
@@ -89,3 +91,51 @@ func TestSplunkSend(t *testing.T) {
 		t.Fatalf("Bad status")
 	}
 }
+
+func TestSplunkPump_Serialization(t *testing.T) {
+	var events []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Event map[string]interface{} `json:"event"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		events = append(events, body.Event)
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer server.Close()
+
+	pmp := &SplunkPump{}
+	err := pmp.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+		"obfuscate_api_keys":       true,
+		"serialization":            map[string]interface{}{"format": "json"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := analytics.AnalyticsRecord{APIID: "api", APIKey: "secret", RequestTime: 12, TimeStamp: time.Unix(1583057730, 0)}
+	if err := pmp.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	if event["api_id"] != "api" || event["api_key"] != "****" || event["request_time_ms"] != float64(12) || event["timestamp"] != float64(1583057730000) {
+		t.Errorf("expected the canonical record, got %v", event)
+	}
+
+	// the binary formats can't be sent as events
+	err = (&SplunkPump{}).Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+		"serialization":            map[string]interface{}{"format": "avro"},
+	})
+	if err == nil {
+		t.Error("expected an error for the avro serialization")
+	}
+}
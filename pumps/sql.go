@@ -0,0 +1,447 @@
+package pumps
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/lib/pq"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+
+	// database/sql drivers of the dialects
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqlPrefix = "sql-pump"
+
+const (
+	defaultSQLTableName       = "tyk_analytics"
+	defaultSQLUptimeTableName = "tyk_uptime_analytics"
+	defaultSQLBatchSize       = 500
+	// maximum number of parameters of a statement, below the limits of the three databases
+	sqlMaxParameters = 30000
+
+	sqlPartitionDaily   = "daily"
+	sqlPartitionMonthly = "monthly"
+)
+
+// SQLConf is the configuration shared by the SQL pumps
+type SQLConf struct {
+	// Database type: postgres, mysql or sqlite
+	Type string `mapstructure:"type"`
+	// DSN of the database, a file name for sqlite
+	ConnectionString string `mapstructure:"connection_string"`
+	TableName        string `mapstructure:"table_name"`
+	// Writes the rows in a table per day (<table>_YYYYMMDD) or month (<table>_YYYYMM) of their timestamp
+	TablePartitioning string `mapstructure:"table_partitioning"`
+	// Maximum number of rows of the multi-row inserts. Defaults to 500
+	BatchSize    int `mapstructure:"batch_size"`
+	MaxOpenConns int `mapstructure:"max_open_conns"`
+	MaxIdleConns int `mapstructure:"max_idle_conns"`
+}
+
+// SQLPumpConf is the configuration of the SQL pump writing the raw records
+type SQLPumpConf struct {
+	SQLConf
+	// Columns of the records to store, all of them by default. timestamp, org_id and api_id are always stored.
+	Columns []string `mapstructure:"columns"`
+	// Writes the records with COPY instead of multi-row inserts, postgres only
+	UseCopy bool `mapstructure:"use_copy"`
+	// Table of the uptime checks when used as an uptime pump. Defaults to tyk_uptime_analytics
+	UptimeTableName string `mapstructure:"uptime_table_name"`
+}
+
+// SQLPump writes the raw analytics records and the uptime checks to PostgreSQL, MySQL or SQLite
+type SQLPump struct {
+	conf    *SQLPumpConf
+	store   *sqlStore
+	columns []sqlRecordColumn
+	table   sqlTable
+	CommonPumpConfig
+}
+
+type sqlRecordColumn struct {
+	sqlColumn
+	value func(record *analytics.AnalyticsRecord) interface{}
+}
+
+var sqlRecordColumns = []sqlRecordColumn{
+	{sqlColumn{Name: "timestamp", Type: sqlTimestamp}, func(r *analytics.AnalyticsRecord) interface{} { return r.TimeStamp.UTC() }},
+	{sqlColumn{Name: "org_id", Type: sqlKey}, func(r *analytics.AnalyticsRecord) interface{} { return r.OrgID }},
+	{sqlColumn{Name: "api_id", Type: sqlKey}, func(r *analytics.AnalyticsRecord) interface{} { return r.APIID }},
+	{sqlColumn{Name: "api_name", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.APIName }},
+	{sqlColumn{Name: "api_version", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.APIVersion }},
+	{sqlColumn{Name: "api_key", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.APIKey }},
+	{sqlColumn{Name: "oauth_id", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.OauthID }},
+	{sqlColumn{Name: "method", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.Method }},
+	{sqlColumn{Name: "host", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.Host }},
+	{sqlColumn{Name: "path", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.Path }},
+	{sqlColumn{Name: "raw_path", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.RawPath }},
+	{sqlColumn{Name: "response_code", Type: sqlInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.ResponseCode }},
+	{sqlColumn{Name: "request_time", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.RequestTime }},
+	{sqlColumn{Name: "latency_total", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.Latency.Total }},
+	{sqlColumn{Name: "latency_upstream", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.Latency.Upstream }},
+	{sqlColumn{Name: "content_length", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.ContentLength }},
+	{sqlColumn{Name: "bytes_in", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.Network.BytesIn }},
+	{sqlColumn{Name: "bytes_out", Type: sqlBigInt}, func(r *analytics.AnalyticsRecord) interface{} { return r.Network.BytesOut }},
+	{sqlColumn{Name: "user_agent", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.UserAgent }},
+	{sqlColumn{Name: "ip_address", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.IPAddress }},
+	{sqlColumn{Name: "geo_country", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.Geo.Country.ISOCode }},
+	{sqlColumn{Name: "alias", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.Alias }},
+	{sqlColumn{Name: "tags", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return strings.Join(r.Tags, ",") }},
+	{sqlColumn{Name: "raw_request", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.RawRequest }},
+	{sqlColumn{Name: "raw_response", Type: sqlText}, func(r *analytics.AnalyticsRecord) interface{} { return r.RawResponse }},
+}
+
+// sqlRequiredColumns are stored whatever the column selection, they are indexed
+var sqlRequiredColumns = []string{"timestamp", "org_id", "api_id"}
+
+var sqlUptimeTable = sqlTable{
+	Columns: []sqlColumn{
+		{Name: "timestamp", Type: sqlTimestamp},
+		{Name: "org_id", Type: sqlKey},
+		{Name: "api_id", Type: sqlKey},
+		{Name: "url", Type: sqlText},
+		{Name: "request_time", Type: sqlBigInt},
+		{Name: "response_code", Type: sqlInt},
+		{Name: "tcp_error", Type: sqlBool},
+		{Name: "server_error", Type: sqlBool},
+		{Name: "up", Type: sqlBool},
+	},
+	Indexes: [][]string{{"org_id", "api_id", "timestamp"}, {"timestamp"}},
+}
+
+func (s *SQLPump) New() Pump {
+	newPump := SQLPump{}
+	return &newPump
+}
+
+func (s *SQLPump) GetName() string {
+	return "SQL Pump"
+}
+
+func (s *SQLPump) Init(config interface{}) error {
+	s.conf = &SQLPumpConf{}
+	s.log = log.WithField("prefix", sqlPrefix)
+
+	err := mapstructure.Decode(config, &s.conf)
+	if err == nil {
+		err = mapstructure.Decode(config, &s.conf.SQLConf)
+	}
+	if err != nil {
+		return err
+	}
+	if s.conf.TableName == "" {
+		s.conf.TableName = defaultSQLTableName
+	}
+	if s.conf.UptimeTableName == "" {
+		s.conf.UptimeTableName = defaultSQLUptimeTableName
+	}
+
+	s.columns, err = selectSQLRecordColumns(s.conf.Columns)
+	if err != nil {
+		return err
+	}
+	s.table = sqlTable{Indexes: [][]string{{"org_id", "api_id", "timestamp"}, {"timestamp"}}}
+	for _, column := range s.columns {
+		s.table.Columns = append(s.table.Columns, column.sqlColumn)
+	}
+
+	s.store, err = openSQLStore(&s.conf.SQLConf, s.log)
+	if err != nil {
+		return err
+	}
+	if s.conf.UseCopy && s.store.dialect.name != sqlPostgres {
+		return errors.New("use_copy is only supported by postgres")
+	}
+
+	if err := s.store.migrate(context.Background(), s.store.tableName(s.conf.TableName, time.Now()), s.table); err != nil {
+		return err
+	}
+
+	s.log.Info(s.GetName() + " Initialized")
+	return nil
+}
+
+// selectSQLRecordColumns returns the columns of the selection in the order of the table, with the required ones
+func selectSQLRecordColumns(names []string) ([]sqlRecordColumn, error) {
+	if len(names) == 0 {
+		return sqlRecordColumns, nil
+	}
+
+	selected := make(map[string]bool, len(names)+len(sqlRequiredColumns))
+	for _, name := range sqlRequiredColumns {
+		selected[name] = true
+	}
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	var columns []sqlRecordColumn
+	for _, column := range sqlRecordColumns {
+		if selected[column.Name] {
+			columns = append(columns, column)
+			delete(selected, column.Name)
+		}
+	}
+	for name := range selected {
+		return nil, fmt.Errorf("unknown SQL column %q", name)
+	}
+	return columns, nil
+}
+
+func (s *SQLPump) WriteData(ctx context.Context, data []interface{}) error {
+	s.log.Debug("Attempting to write ", len(data), " records...")
+
+	rows := make([]sqlRow, 0, len(data))
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+		values := make([]interface{}, len(s.columns))
+		for i, column := range s.columns {
+			values[i] = column.value(&record)
+		}
+		rows = append(rows, sqlRow{time: record.TimeStamp, values: values})
+	}
+
+	write := s.store.insert
+	if s.conf.UseCopy {
+		write = s.store.copyIn
+	}
+	if err := s.store.write(ctx, s.conf.TableName, s.table, rows, write); err != nil {
+		s.log.Error("Failed to write the records: ", err)
+		return err
+	}
+
+	s.log.Info("Purged ", len(rows), " records...")
+	return nil
+}
+
+// WriteUptimeData writes the uptime checks to the uptime table
+func (s *SQLPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	s.log.Debug("Attempting to write ", len(data), " uptime records...")
+
+	rows := make([]sqlRow, len(data))
+	for i := range data {
+		record := &data[i]
+		rows[i] = sqlRow{
+			time: record.TimeStamp,
+			values: []interface{}{
+				record.TimeStamp.UTC(), record.OrgID, record.APIID, record.URL, record.RequestTime,
+				record.ResponseCode, record.TCPError, record.ServerError, record.Up(),
+			},
+		}
+	}
+
+	if err := s.store.write(ctx, s.conf.UptimeTableName, sqlUptimeTable, rows, s.store.insert); err != nil {
+		s.log.Error("Failed to write the uptime records: ", err)
+		return err
+	}
+
+	s.log.Info("Purged ", len(rows), " uptime records...")
+	return nil
+}
+
+// sqlRow is a row to write with the time choosing its partition table
+type sqlRow struct {
+	time   time.Time
+	values []interface{}
+}
+
+// sqlStore is the database of the SQL pumps, creating and migrating their tables on their first use
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	conf    *SQLConf
+	// tables created and migrated
+	migrated sync.Map
+	log      *logrus.Entry
+}
+
+func openSQLStore(conf *SQLConf, log *logrus.Entry) (*sqlStore, error) {
+	dialect, err := getSQLDialect(conf.Type)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ConnectionString == "" {
+		return nil, errors.New("SQL connection_string not set")
+	}
+	switch conf.TablePartitioning {
+	case "", sqlPartitionDaily, sqlPartitionMonthly:
+	default:
+		return nil, fmt.Errorf("unsupported table_partitioning %q, must be daily or monthly", conf.TablePartitioning)
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultSQLBatchSize
+	}
+
+	db, err := sql.Open(dialect.driver(), conf.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite locks the database on writes
+	if dialect.name == sqlSQLite {
+		conf.MaxOpenConns = 1
+	}
+	if conf.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+	}
+	if conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: dialect, conf: conf, log: log}, nil
+}
+
+// tableName returns the name of the partition table of the time
+func (s *sqlStore) tableName(base string, t time.Time) string {
+	switch s.conf.TablePartitioning {
+	case sqlPartitionDaily:
+		return base + "_" + t.UTC().Format("20060102")
+	case sqlPartitionMonthly:
+		return base + "_" + t.UTC().Format("200601")
+	default:
+		return base
+	}
+}
+
+// migrate creates the table and its indexes, and adds the columns missing from an existing table
+func (s *sqlStore) migrate(ctx context.Context, table string, spec sqlTable) error {
+	if _, done := s.migrated.Load(table); done {
+		return nil
+	}
+
+	for _, statement := range s.dialect.createTable(table, spec) {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("creating table %s: %v", table, err)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT * FROM "+s.dialect.quote(table)+" WHERE 1 = 0")
+	if err != nil {
+		return err
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[strings.ToLower(name)] = true
+	}
+	for _, column := range spec.Columns {
+		if found[column.Name] {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, s.dialect.addColumn(table, column)); err != nil {
+			return fmt.Errorf("adding column %s to table %s: %v", column.Name, table, err)
+		}
+		s.log.Info("Added column ", column.Name, " to table ", table)
+	}
+
+	s.migrated.Store(table, true)
+	return nil
+}
+
+// write groups the rows by partition table, migrates the tables and writes their rows
+func (s *sqlStore) write(ctx context.Context, base string, spec sqlTable, rows []sqlRow, write func(context.Context, string, sqlTable, [][]interface{}) error) error {
+	var tables []string
+	values := make(map[string][][]interface{})
+	for _, row := range rows {
+		table := s.tableName(base, row.time)
+		if _, found := values[table]; !found {
+			tables = append(tables, table)
+		}
+		values[table] = append(values[table], row.values)
+	}
+
+	for _, table := range tables {
+		if err := s.migrate(ctx, table, spec); err != nil {
+			return err
+		}
+		if err := write(ctx, table, spec, values[table]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert writes the rows with multi-row inserts of up to batch_size rows, in a single transaction
+func (s *sqlStore) insert(ctx context.Context, table string, spec sqlTable, rows [][]interface{}) error {
+	batchSize := s.conf.BatchSize
+	if batchSize*len(spec.Columns) > sqlMaxParameters {
+		batchSize = sqlMaxParameters / len(spec.Columns)
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		args := make([]interface{}, 0, (end-start)*len(spec.Columns))
+		for _, row := range rows[start:end] {
+			args = append(args, row...)
+		}
+		if _, err := txn.ExecContext(ctx, s.dialect.insert(table, spec, end-start), args...); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// copyIn writes the rows with COPY, postgres only
+func (s *sqlStore) copyIn(ctx context.Context, table string, spec sqlTable, rows [][]interface{}) error {
+	names := make([]string, len(spec.Columns))
+	for i, column := range spec.Columns {
+		names[i] = column.Name
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn(table, names...))
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			txn.Rollback()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
@@ -0,0 +1,163 @@
+package pumps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+var sqlAggregatePrefix = "sql-aggregate-pump"
+
+const defaultSQLAggregateTableName = "tyk_aggregated"
+
+// SQLAggregateConf is the configuration of the SQL pump writing the aggregates
+type SQLAggregateConf struct {
+	SQLConf
+	TrackAllPaths       bool     `mapstructure:"track_all_paths"`
+	IgnoreTagPrefixList []string `mapstructure:"ignore_tag_prefix_list"`
+	// Dimensions not stored, as the ignore_aggregations of the Mongo aggregate pump
+	IgnoreAggregationsList []string `mapstructure:"ignore_aggregations"`
+	// Size of the aggregation buckets: 1m, 5m, 15m, 1h or 1d. Defaults to 1h
+	AggregationGranularity string `mapstructure:"aggregation_granularity"`
+}
+
+// SQLAggregatePump writes the aggregates of the records to PostgreSQL, MySQL or SQLite, a row per
+// organisation, bucket, dimension and value whose counters are summed with the stored ones
+type SQLAggregatePump struct {
+	conf        *SQLAggregateConf
+	store       *sqlStore
+	granularity time.Duration
+	CommonPumpConfig
+}
+
+var sqlAggregateTable = sqlTable{
+	Columns: []sqlColumn{
+		{Name: "org_id", Type: sqlKey},
+		{Name: "timestamp", Type: sqlTimestamp},
+		{Name: "granularity", Type: sqlInt},
+		{Name: "dimension", Type: sqlKey},
+		// the endpoints can be longer than the indexes allow, the rows are upserted on the hash of their name
+		{Name: "name", Type: sqlText},
+		{Name: "name_hash", Type: sqlHash},
+		{Name: "human_identifier", Type: sqlText},
+		{Name: "hits", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "success", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "error_total", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "total_request_time", Type: sqlFloat, Merge: sqlSum},
+		{Name: "total_latency", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "max_latency", Type: sqlBigInt, Merge: sqlMax},
+		{Name: "min_latency", Type: sqlBigInt, Merge: sqlMinNonZero},
+		{Name: "total_upstream_latency", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "max_upstream_latency", Type: sqlBigInt, Merge: sqlMax},
+		{Name: "min_upstream_latency", Type: sqlBigInt, Merge: sqlMinNonZero},
+		{Name: "bytes_in", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "bytes_out", Type: sqlBigInt, Merge: sqlSum},
+		{Name: "last_time", Type: sqlTimestamp},
+	},
+	Key:     []string{"org_id", "granularity", "timestamp", "dimension", "name_hash"},
+	Indexes: [][]string{{"timestamp"}},
+}
+
+func (s *SQLAggregatePump) New() Pump {
+	newPump := SQLAggregatePump{}
+	return &newPump
+}
+
+func (s *SQLAggregatePump) GetName() string {
+	return "SQL Aggregate Pump"
+}
+
+func (s *SQLAggregatePump) Init(config interface{}) error {
+	s.conf = &SQLAggregateConf{}
+	s.log = log.WithField("prefix", sqlAggregatePrefix)
+
+	err := mapstructure.Decode(config, &s.conf)
+	if err == nil {
+		err = mapstructure.Decode(config, &s.conf.SQLConf)
+	}
+	if err != nil {
+		return err
+	}
+	if s.conf.TableName == "" {
+		s.conf.TableName = defaultSQLAggregateTableName
+	}
+	if s.conf.AggregationGranularity == "" {
+		s.conf.AggregationGranularity = "1h"
+	}
+	s.granularity, err = analytics.ParseGranularity(s.conf.AggregationGranularity)
+	if err != nil {
+		return err
+	}
+
+	s.store, err = openSQLStore(&s.conf.SQLConf, s.log)
+	if err != nil {
+		return err
+	}
+	if err := s.store.migrate(context.Background(), s.store.tableName(s.conf.TableName, time.Now()), sqlAggregateTable); err != nil {
+		return err
+	}
+
+	s.log.Info(s.GetName() + " Initialized")
+	return nil
+}
+
+func (s *SQLAggregatePump) WriteData(ctx context.Context, data []interface{}) error {
+	s.log.Debug("Attempting to write ", len(data), " records...")
+
+	aggregates := analytics.AggregateDataWithGranularity(data, s.conf.TrackAllPaths, s.conf.IgnoreTagPrefixList, nil, s.granularity)
+
+	var rows []sqlRow
+	for _, aggregate := range aggregates {
+		if len(s.conf.IgnoreAggregationsList) > 0 {
+			aggregate.DiscardAggregations(s.conf.IgnoreAggregationsList)
+		}
+		rows = append(rows, sqlAggregateRows(aggregate)...)
+	}
+
+	if err := s.store.write(ctx, s.conf.TableName, sqlAggregateTable, rows, s.store.insert); err != nil {
+		s.log.Error("Failed to write the aggregates: ", err)
+		return err
+	}
+
+	s.log.Info("Purged ", len(data), " records...")
+	return nil
+}
+
+// sqlAggregateRows returns the rows of the counters of the aggregate
+func sqlAggregateRows(aggregate analytics.AnalyticsRecordAggregate) []sqlRow {
+	timestamp := aggregate.TimeStamp.UTC()
+	counters := aggregate.Flatten()
+
+	rows := make([]sqlRow, len(counters))
+	for i, dc := range counters {
+		c := dc.Counter
+		// the latencies of the errors don't lower the minimum, as in the Mongo aggregates
+		minLatency, minUpstreamLatency := c.MinLatency, c.MinUpstreamLatency
+		if c.Hits == c.ErrorTotal {
+			minLatency, minUpstreamLatency = 0, 0
+		}
+
+		rows[i] = sqlRow{
+			time: timestamp,
+			values: []interface{}{
+				aggregate.OrgID, timestamp, aggregate.Granularity, dc.Dimension, dc.Name, sqlHashKey(dc.Name), c.HumanIdentifier,
+				c.Hits, c.Success, c.ErrorTotal, c.TotalRequestTime,
+				c.TotalLatency, c.MaxLatency, minLatency,
+				c.TotalUpstreamLatency, c.MaxUpstreamLatency, minUpstreamLatency,
+				c.BytesIn, c.BytesOut, c.LastTime.UTC(),
+			},
+		}
+	}
+	return rows
+}
+
+// sqlHashKey returns the value of the sqlHash column of a text
+func sqlHashKey(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,264 @@
+package pumps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sqlPostgres = "postgres"
+	sqlMySQL    = "mysql"
+	sqlSQLite   = "sqlite"
+)
+
+type sqlType int
+
+const (
+	sqlText sqlType = iota
+	// sqlKey is a text used in the indexes, MySQL can't index TEXT columns
+	sqlKey
+	// sqlHash is the hex SHA-256 indexed instead of a text of any length
+	sqlHash
+	sqlInt
+	sqlBigInt
+	sqlFloat
+	sqlBool
+	sqlTimestamp
+)
+
+// sqlMerge is how a column of an upserted row is merged with the stored one
+type sqlMerge int
+
+const (
+	// sqlReplace sets the new value. The key columns are never updated.
+	sqlReplace sqlMerge = iota
+	sqlSum
+	sqlMax
+	// sqlMinNonZero keeps the minimum, ignoring the zeros of the rows without latency
+	sqlMinNonZero
+)
+
+type sqlColumn struct {
+	Name  string
+	Type  sqlType
+	Merge sqlMerge
+}
+
+// sqlTable describes the columns and the indexes of the tables written by the SQL pumps
+type sqlTable struct {
+	Columns []sqlColumn
+	// Key are the columns of the unique index the rows are upserted on, the rows are only inserted without key
+	Key     []string
+	Indexes [][]string
+}
+
+// sqlDialect generates the statements of the database types supported by the SQL pumps
+type sqlDialect struct {
+	name string
+}
+
+func getSQLDialect(name string) (sqlDialect, error) {
+	switch name {
+	case sqlPostgres, sqlMySQL, sqlSQLite:
+		return sqlDialect{name: name}, nil
+	default:
+		return sqlDialect{}, fmt.Errorf("unsupported SQL type %q, must be one of postgres, mysql or sqlite", name)
+	}
+}
+
+// driver returns the name of the database/sql driver of the dialect
+func (d sqlDialect) driver() string {
+	if d.name == sqlSQLite {
+		return "sqlite3"
+	}
+	return d.name
+}
+
+func (d sqlDialect) quote(identifier string) string {
+	if d.name == sqlMySQL {
+		return "`" + strings.Replace(identifier, "`", "``", -1) + "`"
+	}
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+func (d sqlDialect) placeholder(i int) string {
+	if d.name == sqlPostgres {
+		return "$" + strconv.Itoa(i)
+	}
+	return "?"
+}
+
+func (d sqlDialect) columnType(t sqlType) string {
+	switch t {
+	case sqlKey:
+		if d.name == sqlMySQL {
+			return "VARCHAR(255)"
+		}
+		return "TEXT"
+	case sqlHash:
+		if d.name == sqlMySQL {
+			return "CHAR(64)"
+		}
+		return "TEXT"
+	case sqlInt:
+		return "INTEGER"
+	case sqlBigInt:
+		if d.name == sqlSQLite {
+			return "INTEGER"
+		}
+		return "BIGINT"
+	case sqlFloat:
+		switch d.name {
+		case sqlPostgres:
+			return "DOUBLE PRECISION"
+		case sqlMySQL:
+			return "DOUBLE"
+		}
+		return "REAL"
+	case sqlBool:
+		return "BOOLEAN"
+	case sqlTimestamp:
+		switch d.name {
+		case sqlPostgres:
+			return "TIMESTAMP WITH TIME ZONE"
+		case sqlMySQL:
+			return "DATETIME(6)"
+		}
+		return "TIMESTAMP"
+	default:
+		return "TEXT"
+	}
+}
+
+func (d sqlDialect) columnDefinition(column sqlColumn) string {
+	definition := d.quote(column.Name) + " " + d.columnType(column.Type)
+	// the counters are summed on conflict, NULL would stay NULL
+	if column.Merge != sqlReplace {
+		definition += " NOT NULL DEFAULT 0"
+	}
+	return definition
+}
+
+func (d sqlDialect) indexName(table string, i int) string {
+	return fmt.Sprintf("idx_%s_%d", table, i)
+}
+
+// createTable returns the statements creating the table and its indexes if they don't exist.
+// MySQL has no CREATE INDEX IF NOT EXISTS, the indexes are created with the table.
+func (d sqlDialect) createTable(table string, spec sqlTable) []string {
+	definitions := make([]string, len(spec.Columns))
+	for i, column := range spec.Columns {
+		definitions[i] = d.columnDefinition(column)
+	}
+
+	var statements []string
+	if d.name == sqlMySQL {
+		if len(spec.Key) > 0 {
+			definitions = append(definitions, "UNIQUE KEY "+d.quote(d.indexName(table, 0))+" ("+d.quoteAll(spec.Key)+")")
+		}
+		for i, index := range spec.Indexes {
+			definitions = append(definitions, "KEY "+d.quote(d.indexName(table, i+1))+" ("+d.quoteAll(index)+")")
+		}
+		return append(statements, "CREATE TABLE IF NOT EXISTS "+d.quote(table)+" ("+strings.Join(definitions, ", ")+")")
+	}
+
+	statements = append(statements, "CREATE TABLE IF NOT EXISTS "+d.quote(table)+" ("+strings.Join(definitions, ", ")+")")
+	if len(spec.Key) > 0 {
+		statements = append(statements, "CREATE UNIQUE INDEX IF NOT EXISTS "+d.quote(d.indexName(table, 0))+" ON "+d.quote(table)+" ("+d.quoteAll(spec.Key)+")")
+	}
+	for i, index := range spec.Indexes {
+		statements = append(statements, "CREATE INDEX IF NOT EXISTS "+d.quote(d.indexName(table, i+1))+" ON "+d.quote(table)+" ("+d.quoteAll(index)+")")
+	}
+	return statements
+}
+
+func (d sqlDialect) addColumn(table string, column sqlColumn) string {
+	return "ALTER TABLE " + d.quote(table) + " ADD COLUMN " + d.columnDefinition(column)
+}
+
+func (d sqlDialect) quoteAll(identifiers []string) string {
+	quoted := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		quoted[i] = d.quote(identifier)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// insert returns the multi-row insert of the rows, upserting them on the key of the table if it has one
+func (d sqlDialect) insert(table string, spec sqlTable, rows int) string {
+	names := make([]string, len(spec.Columns))
+	for i, column := range spec.Columns {
+		names[i] = column.Name
+	}
+
+	var b strings.Builder
+	b.WriteString("INSERT INTO " + d.quote(table) + " (" + d.quoteAll(names) + ") VALUES ")
+	n := 1
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for i := range spec.Columns {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(d.placeholder(n))
+			n++
+		}
+		b.WriteString(")")
+	}
+
+	if len(spec.Key) > 0 {
+		b.WriteString(d.upsert(table, spec))
+	}
+	return b.String()
+}
+
+func (d sqlDialect) upsert(table string, spec sqlTable) string {
+	key := make(map[string]bool, len(spec.Key))
+	for _, name := range spec.Key {
+		key[name] = true
+	}
+
+	var assignments []string
+	for _, column := range spec.Columns {
+		if key[column.Name] {
+			continue
+		}
+		assignments = append(assignments, d.quote(column.Name)+" = "+d.merge(table, column))
+	}
+
+	if d.name == sqlMySQL {
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+	}
+	return " ON CONFLICT (" + d.quoteAll(spec.Key) + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+// merge returns the expression merging the new value of the column with the stored one.
+// MySQL evaluates the assignments in order, so they only reference the column they set.
+func (d sqlDialect) merge(table string, column sqlColumn) string {
+	stored := d.quote(table) + "." + d.quote(column.Name)
+	value := "excluded." + d.quote(column.Name)
+	greatest, least := "GREATEST", "LEAST"
+	switch d.name {
+	case sqlMySQL:
+		stored = d.quote(column.Name)
+		value = "VALUES(" + d.quote(column.Name) + ")"
+	case sqlSQLite:
+		// the multi-argument max and min are the scalar functions of SQLite
+		greatest, least = "MAX", "MIN"
+	}
+
+	switch column.Merge {
+	case sqlSum:
+		return stored + " + " + value
+	case sqlMax:
+		return greatest + "(" + stored + ", " + value + ")"
+	case sqlMinNonZero:
+		return "CASE WHEN " + stored + " = 0 THEN " + value + " WHEN " + value + " = 0 THEN " + stored + " ELSE " + least + "(" + stored + ", " + value + ") END"
+	default:
+		return value
+	}
+}
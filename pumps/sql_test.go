@@ -0,0 +1,325 @@
+package pumps
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func sqliteConf(t *testing.T, extra map[string]interface{}) (map[string]interface{}, string, func()) {
+	dir, err := ioutil.TempDir("", "sql-pump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "analytics.db")
+	conf := map[string]interface{}{
+		"type":              "sqlite",
+		"connection_string": file,
+	}
+	for k, v := range extra {
+		conf[k] = v
+	}
+	return conf, file, func() { os.RemoveAll(dir) }
+}
+
+func sqliteColumns(t *testing.T, db *sql.DB, table string) []string {
+	rows, err := db.Query(`SELECT * FROM "` + table + `" WHERE 1 = 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return columns
+}
+
+func sqliteTables(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	return tables
+}
+
+func TestSQLPump_Init(t *testing.T) {
+	for name, conf := range map[string]map[string]interface{}{
+		"unknown type":         {"type": "oracle", "connection_string": "x"},
+		"no connection string": {"type": "sqlite"},
+		"unknown column":       {"type": "sqlite", "connection_string": ":memory:", "columns": []string{"nope"}},
+		"partitioning":         {"type": "sqlite", "connection_string": ":memory:", "table_partitioning": "weekly"},
+		"copy":                 {"type": "sqlite", "connection_string": ":memory:", "use_copy": true},
+	} {
+		if err := (&SQLPump{}).Init(conf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSQLPump_WriteData(t *testing.T) {
+	conf, file, cleanup := sqliteConf(t, map[string]interface{}{
+		"columns":    []string{"path", "response_code", "tags"},
+		"batch_size": 2,
+	})
+	defer cleanup()
+
+	s := &SQLPump{}
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var data []interface{}
+	for i := 0; i < 5; i++ {
+		data = append(data, analytics.AnalyticsRecord{
+			TimeStamp:    now,
+			OrgID:        "org1",
+			APIID:        "api1",
+			Path:         "/get",
+			ResponseCode: 200 + i,
+			Tags:         []string{"a", "b"},
+			RawRequest:   "not stored",
+		})
+	}
+	if err := s.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// only the selected and the required columns are created
+	columns := sqliteColumns(t, db, "tyk_analytics")
+	if strings.Join(columns, ",") != "timestamp,org_id,api_id,path,response_code,tags" {
+		t.Errorf("unexpected columns %v", columns)
+	}
+
+	var count, codes int
+	var tags string
+	if err := db.QueryRow(`SELECT COUNT(*), SUM(response_code), MAX(tags) FROM tyk_analytics WHERE org_id = 'org1' AND path = '/get'`).Scan(&count, &codes, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 || codes != 1010 || tags != "a,b" {
+		t.Errorf("unexpected rows: count %d, codes %d, tags %s", count, codes, tags)
+	}
+}
+
+func TestSQLPump_Migration(t *testing.T) {
+	conf, file, cleanup := sqliteConf(t, map[string]interface{}{"columns": []string{"path"}})
+	defer cleanup()
+
+	if err := (&SQLPump{}).Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// selecting more columns adds them to the existing table
+	conf["columns"] = []string{"path", "method"}
+	s := &SQLPump{}
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	columns := sqliteColumns(t, db, "tyk_analytics")
+	if strings.Join(columns, ",") != "timestamp,org_id,api_id,path,method" {
+		t.Errorf("unexpected columns %v", columns)
+	}
+	if err := s.WriteData(context.Background(), []interface{}{analytics.AnalyticsRecord{TimeStamp: time.Now(), OrgID: "org1", Method: "GET"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLPump_TablePartitioning(t *testing.T) {
+	conf, file, cleanup := sqliteConf(t, map[string]interface{}{"table_partitioning": "daily"})
+	defer cleanup()
+
+	s := &SQLPump{}
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 3, 1, 23, 30, 0, 0, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{TimeStamp: day, OrgID: "org1"},
+		analytics.AnalyticsRecord{TimeStamp: day.Add(time.Hour), OrgID: "org1"},
+		analytics.AnalyticsRecord{TimeStamp: day.Add(2 * time.Hour), OrgID: "org1"},
+	}
+	if err := s.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	uptime := []analytics.UptimeReportData{{TimeStamp: day, OrgID: "org1", URL: "http://upstream", TCPError: true}}
+	if err := s.WriteUptimeData(context.Background(), uptime); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tables := strings.Join(sqliteTables(t, db), ",")
+	if !strings.Contains(tables, "tyk_analytics_20200301,tyk_analytics_20200302") || !strings.Contains(tables, "tyk_uptime_analytics_20200301") {
+		t.Fatalf("unexpected tables %s", tables)
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM tyk_analytics_20200302`).Scan(&count)
+	if count != 2 {
+		t.Errorf("expected 2 records on the second day, got %d", count)
+	}
+	var up bool
+	if err := db.QueryRow(`SELECT up FROM tyk_uptime_analytics_20200301`).Scan(&up); err != nil || up {
+		t.Errorf("expected a failed check, got %v %v", up, err)
+	}
+}
+
+func TestSQLAggregatePump_WriteData(t *testing.T) {
+	conf, file, cleanup := sqliteConf(t, map[string]interface{}{"aggregation_granularity": "1h"})
+	defer cleanup()
+
+	s := &SQLAggregatePump{}
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2020, 3, 1, 10, 15, 0, 0, time.UTC)
+	record := func(code int, latency int64) analytics.AnalyticsRecord {
+		return analytics.AnalyticsRecord{
+			TimeStamp:    ts,
+			OrgID:        "org1",
+			APIID:        "api1",
+			APIName:      "API 1",
+			ResponseCode: code,
+			RequestTime:  latency,
+			Latency:      analytics.Latency{Total: latency, Upstream: latency / 2},
+		}
+	}
+	// the second purge is merged into the rows of the first one, the error does not lower the minimum
+	purges := [][]interface{}{
+		{record(200, 100), record(500, 10)},
+		{record(200, 40), record(200, 300)},
+	}
+	for _, data := range purges {
+		if err := s.WriteData(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var hits, success, errors, maxLatency, minLatency, granularity int
+	var human string
+	err = db.QueryRow(`SELECT hits, success, error_total, max_latency, min_latency, granularity, human_identifier
+		FROM tyk_aggregated WHERE org_id = 'org1' AND dimension = 'apiid' AND name = 'api1'`).
+		Scan(&hits, &success, &errors, &maxLatency, &minLatency, &granularity, &human)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 4 || success != 3 || errors != 1 || maxLatency != 300 || minLatency != 40 || granularity != 3600 || human != "API 1" {
+		t.Errorf("unexpected api counters: hits %d, success %d, errors %d, max %d, min %d, granularity %d, name %s",
+			hits, success, errors, maxLatency, minLatency, granularity, human)
+	}
+
+	// the errors-only counters don't lower the minimum
+	if err := db.QueryRow(`SELECT hits, min_latency FROM tyk_aggregated WHERE dimension = 'errors' AND name = '500'`).Scan(&hits, &minLatency); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 1 || minLatency != 0 {
+		t.Errorf("unexpected error counters: hits %d, min %d", hits, minLatency)
+	}
+
+	var total int
+	db.QueryRow(`SELECT hits FROM tyk_aggregated WHERE dimension = 'total'`).Scan(&total)
+	if total != 4 {
+		t.Errorf("expected 4 hits in total, got %d", total)
+	}
+}
+
+func TestSQLAggregatePump_LongNames(t *testing.T) {
+	conf, file, cleanup := sqliteConf(t, nil)
+	defer cleanup()
+
+	s := &SQLAggregatePump{}
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	apiID := strings.Repeat("a", 300)
+	record := analytics.AnalyticsRecord{TimeStamp: time.Now(), OrgID: "org1", APIID: apiID, ResponseCode: 200}
+	for i := 0; i < 2; i++ {
+		if err := s.WriteData(context.Background(), []interface{}{record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var hits int
+	var hash string
+	if err := db.QueryRow(`SELECT hits, name_hash FROM tyk_aggregated WHERE dimension = 'apiid' AND name = ?`, apiID).Scan(&hits, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2 || hash != sqlHashKey(apiID) {
+		t.Errorf("expected the purges to be merged on the hash of the name, got %d hits and hash %s", hits, hash)
+	}
+
+	mysql, _ := getSQLDialect(sqlMySQL)
+	statement := mysql.createTable("t", sqlAggregateTable)[0]
+	if !strings.Contains(statement, "`name` TEXT") || !strings.Contains(statement, "`name_hash` CHAR(64)") || !strings.Contains(statement, "`dimension`, `name_hash`)") {
+		t.Errorf("unexpected mysql aggregate table %s", statement)
+	}
+}
+
+func TestSQLDialect_Statements(t *testing.T) {
+	spec := sqlTable{
+		Columns: []sqlColumn{{Name: "id", Type: sqlKey}, {Name: "hits", Type: sqlBigInt, Merge: sqlSum}, {Name: "max", Type: sqlBigInt, Merge: sqlMax}},
+		Key:     []string{"id"},
+	}
+
+	postgres, _ := getSQLDialect(sqlPostgres)
+	expected := `INSERT INTO "t" ("id", "hits", "max") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT ("id") DO UPDATE SET "hits" = "t"."hits" + excluded."hits", "max" = GREATEST("t"."max", excluded."max")`
+	if got := postgres.insert("t", spec, 2); got != expected {
+		t.Errorf("unexpected postgres insert\n%s", got)
+	}
+
+	mysql, _ := getSQLDialect(sqlMySQL)
+	expected = "INSERT INTO `t` (`id`, `hits`, `max`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `hits` = `hits` + VALUES(`hits`), `max` = GREATEST(`max`, VALUES(`max`))"
+	if got := mysql.insert("t", spec, 1); got != expected {
+		t.Errorf("unexpected mysql insert\n%s", got)
+	}
+	statements := mysql.createTable("t", spec)
+	if len(statements) != 1 || !strings.Contains(statements[0], "UNIQUE KEY `idx_t_0` (`id`)") || !strings.Contains(statements[0], "`id` VARCHAR(255)") {
+		t.Errorf("unexpected mysql tables %v", statements)
+	}
+}
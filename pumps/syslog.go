@@ -8,10 +8,12 @@ import (
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/serializer"
 )
 
 type SyslogPump struct {
 	syslogConf *SyslogConf
+	serializer serializer.Serializer
 	writer     *syslog.Writer
 	filters    analytics.AnalyticsFilters
 	timeout    int
@@ -27,6 +29,8 @@ type SyslogConf struct {
 	NetworkAddr string `mapstructure:"network_addr"`
 	LogLevel    int    `mapstructure:"log_level"`
 	Tag         string `mapstructure:"tag"`
+	// Write the records in the canonical json format of the serializer instead of the default fields
+	Serialization serializer.Config `mapstructure:"serialization"`
 }
 
 func (s *SyslogPump) GetName() string {
@@ -50,6 +54,10 @@ func (s *SyslogPump) Init(config interface{}) error {
 
 	// Init the configs
 	s.initConfigs()
+	s.serializer, err = getJSONSerializer(s.syslogConf.Serialization)
+	if err != nil {
+		return err
+	}
 
 	// Init the Syslog writer
 	s.initWriter()
@@ -115,6 +123,15 @@ func (s *SyslogPump) WriteData(ctx context.Context, data []interface{}) error {
 		default:
 			// Decode the raw analytics into Form
 			decoded := v.(analytics.AnalyticsRecord)
+			if s.serializer != nil {
+				message, err := s.serializer.Encode(decoded)
+				if err != nil {
+					return err
+				}
+				_, _ = s.writer.Write(message)
+				continue
+			}
+
 			message := Json{
 				"timestamp":       decoded.TimeStamp,
 				"method":          decoded.Method,
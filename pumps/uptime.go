@@ -0,0 +1,53 @@
+package pumps
+
+import (
+	"context"
+	"errors"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// UptimePump is implemented by the pumps which can write the uptime checks of the gateways, configured in uptime_pumps
+type UptimePump interface {
+	Pump
+	WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error
+}
+
+// UptimeAggregatePump is implemented by the uptime pumps storing the rollups of the checks, when uptime_aggregation is enabled
+type UptimeAggregatePump interface {
+	WriteUptimeAggregates(ctx context.Context, aggregates []analytics.UptimeAggregate) error
+}
+
+// UptimeEventPump is implemented by the uptime pumps forwarding the outages detected when uptime_aggregation is enabled
+type UptimeEventPump interface {
+	WriteUptimeEvents(ctx context.Context, events []analytics.UptimeEvent) error
+}
+
+// GetUptimePumpByName returns the pump of the name, or an error if it doesn't support the uptime data
+func GetUptimePumpByName(name string) (UptimePump, error) {
+	pump, err := GetPumpByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uptimePump, ok := pump.(UptimePump)
+	if !ok {
+		return nil, errors.New(name + " doesn't support uptime data")
+	}
+	return uptimePump, nil
+}
+
+// getUptimeMapping returns the fields of the uptime check, as written by the document based pumps
+func getUptimeMapping(record analytics.UptimeReportData) map[string]interface{} {
+	return map[string]interface{}{
+		"timestamp":       record.TimeStamp,
+		"url":             record.URL,
+		"request_time_ms": record.RequestTime,
+		"response_code":   record.ResponseCode,
+		"tcp_error":       record.TCPError,
+		"server_error":    record.ServerError,
+		"up":              record.Up(),
+		"api_id":          record.APIID,
+		"org_id":          record.OrgID,
+	}
+}
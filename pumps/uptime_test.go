@@ -0,0 +1,67 @@
+package pumps
+
+import (
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestGetUptimePumpByName(t *testing.T) {
+	for _, name := range []string{"mongo", "mongo-pump-selective", "csv", "elasticsearch", "prometheus", "kafka", "webhook", "sql"} {
+		if _, err := GetUptimePumpByName(name); err != nil {
+			t.Errorf("expected %s to support uptime data, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"mongo-pump-aggregate", "sql-aggregate", "unknown"} {
+		if _, err := GetUptimePumpByName(name); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+func TestCSVPump_WriteUptimeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv-uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &CSVPump{}
+	if err := c.Init(map[string]interface{}{"csv_dir": dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []analytics.UptimeReportData{{URL: "http://upstream", APIID: "api1", ResponseCode: 200, ServerError: true}}
+	for i := 0; i < 2; i++ {
+		if err := c.WriteUptimeData(context.Background(), records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "uptime-*.csv"))
+	if len(files) != 1 {
+		t.Fatalf("expected one uptime file, got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the headers are only written once
+	if len(lines) != 3 || lines[0][0] != "URL" {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+	if lines[1][0] != "http://upstream" || lines[1][4] != "true" || lines[1][12] != "api1" {
+		t.Errorf("unexpected uptime record %v", lines[1])
+	}
+}
@@ -0,0 +1,183 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// WebhookPump posts the analytics records, and the outage events when it's an uptime pump, to an HTTP endpoint
+type WebhookPump struct {
+	conf   *WebhookConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+type WebhookConf struct {
+	URL string `mapstructure:"url"`
+	// HTTP method of the requests. Defaults to POST
+	Method  string            `mapstructure:"method"`
+	Headers map[string]string `mapstructure:"headers"`
+	// Timeout of every request in seconds. Defaults to 10
+	RequestTimeout int `mapstructure:"request_timeout"`
+	// Number of retries of the requests failing with a network error or a 5xx status. Defaults to 2, -1 disables the retries
+	MaxRetries int `mapstructure:"max_retries"`
+	// Initial delay in milliseconds before retrying a request, doubled on each retry. Defaults to 500
+	RetryBackoff          int  `mapstructure:"retry_backoff"`
+	SSLInsecureSkipVerify bool `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+var webhookPrefix = "webhook-pump"
+
+const (
+	defaultWebhookRequestTimeout = 10
+	defaultWebhookMaxRetries     = 2
+	defaultWebhookRetryBackoff   = 500
+)
+
+func (w *WebhookPump) New() Pump {
+	newPump := WebhookPump{}
+	return &newPump
+}
+
+func (w *WebhookPump) GetName() string {
+	return "Webhook Pump"
+}
+
+func (w *WebhookPump) Init(config interface{}) error {
+	w.conf = &WebhookConf{}
+	w.log = log.WithField("prefix", webhookPrefix)
+
+	if err := mapstructure.Decode(config, &w.conf); err != nil {
+		return err
+	}
+	if w.conf.URL == "" {
+		return errors.New("webhook url not set")
+	}
+	if w.conf.Method == "" {
+		w.conf.Method = http.MethodPost
+	}
+	if w.conf.RequestTimeout == 0 {
+		w.conf.RequestTimeout = defaultWebhookRequestTimeout
+	}
+	switch {
+	case w.conf.MaxRetries == 0:
+		w.conf.MaxRetries = defaultWebhookMaxRetries
+	case w.conf.MaxRetries < 0:
+		w.conf.MaxRetries = 0
+	}
+	if w.conf.RetryBackoff == 0 {
+		w.conf.RetryBackoff = defaultWebhookRetryBackoff
+	}
+
+	w.client = &http.Client{
+		Timeout: time.Duration(w.conf.RequestTimeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: w.conf.SSLInsecureSkipVerify},
+		},
+	}
+
+	w.log.Info(w.GetName() + " Initialized")
+	return nil
+}
+
+// WriteData posts the records as a JSON array
+func (w *WebhookPump) WriteData(ctx context.Context, data []interface{}) error {
+	w.log.Debug("Attempting to write ", len(data), " records...")
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := w.send(ctx, data); err != nil {
+		w.log.Error("Failed to send the records: ", err)
+		return err
+	}
+	w.log.Info("Purged ", len(data), " records...")
+	return nil
+}
+
+// WriteUptimeData ignores the checks, the webhook only forwards the outage events of the uptime data
+func (w *WebhookPump) WriteUptimeData(ctx context.Context, data []analytics.UptimeReportData) error {
+	w.log.Debug("Skipping ", len(data), " uptime records, only the outage events are sent")
+	return nil
+}
+
+// WriteUptimeEvents posts every outage event on its own, a failed event not stopping the next ones
+func (w *WebhookPump) WriteUptimeEvents(ctx context.Context, events []analytics.UptimeEvent) error {
+	var errs []string
+	for _, event := range events {
+		if err := w.send(ctx, event); err != nil {
+			w.log.WithField("url", event.URL).Error("Failed to send the ", event.Event, " event: ", err)
+			errs = append(errs, fmt.Sprintf("%s of %s: %s", event.Event, event.URL, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d outage events couldn't be sent: %s", len(errs), len(events), strings.Join(errs, "; "))
+	}
+	w.log.Info("Sent ", len(events), " outage events")
+	return nil
+}
+
+// send encodes the payload as JSON and sends it, retrying the network errors and the 5xx responses
+func (w *WebhookPump) send(ctx context.Context, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Duration(w.conf.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = w.do(ctx, body)
+		if err == nil || !retry || attempt >= w.conf.MaxRetries {
+			return err
+		}
+
+		w.log.WithError(err).Debug("Retrying the request in ", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// do sends the request once. It returns true if the error can be retried.
+func (w *WebhookPump) do(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(w.conf.Method, w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.conf.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestWebhookPump_WriteUptimeEvents(t *testing.T) {
+	var mu sync.Mutex
+	var received []analytics.UptimeEvent
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		// the first attempt fails and is retried
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		event := analytics.UptimeEvent{}
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	w := &WebhookPump{}
+	err := w.Init(map[string]interface{}{
+		"url":           server.URL,
+		"headers":       map[string]string{"Authorization": "Bearer token"},
+		"retry_backoff": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolvedAt := time.Now()
+	events := []analytics.UptimeEvent{
+		{Event: analytics.UptimeOutageStarted, APIID: "api1", URL: "http://upstream", Failures: 3},
+		{Event: analytics.UptimeOutageResolved, APIID: "api1", URL: "http://upstream", ResolvedAt: &resolvedAt, Duration: 60},
+	}
+	if err := w.WriteUptimeEvents(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 || len(received) != 2 {
+		t.Fatalf("expected 2 events after a retry, got %d attempts and %v", attempts, received)
+	}
+	if received[0].Event != analytics.UptimeOutageStarted || received[1].Duration != 60 || received[1].ResolvedAt == nil {
+		t.Errorf("unexpected events %+v", received)
+	}
+}
+
+func TestWebhookPump_WriteUptimeEventsFailure(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := analytics.UptimeEvent{}
+		json.NewDecoder(r.Body).Decode(&event)
+		// the events of the first host are rejected
+		if event.URL == "http://upstream1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, event.URL)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	w := &WebhookPump{}
+	if err := w.Init(map[string]interface{}{"url": server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []analytics.UptimeEvent{
+		{Event: analytics.UptimeOutageStarted, URL: "http://upstream1"},
+		{Event: analytics.UptimeOutageStarted, URL: "http://upstream2"},
+	}
+	err := w.WriteUptimeEvents(context.Background(), events)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 outage events") {
+		t.Errorf("expected the failed event to be reported, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0] != "http://upstream2" {
+		t.Errorf("expected the event of upstream2 to be sent after the failure, got %v", received)
+	}
+}
+
+func TestWebhookPump_WriteDataErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	w := &WebhookPump{}
+	if err := w.Init(map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error without url")
+	}
+	if err := w.Init(map[string]interface{}{"url": server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	// the client errors aren't retried
+	if err := w.WriteData(context.Background(), []interface{}{analytics.AnalyticsRecord{APIID: "api1"}}); err == nil {
+		t.Error("expected the bad request to be returned")
+	}
+}
@@ -0,0 +1,78 @@
+package serializer
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// avroSerializer encodes the records with the Avro binary encoding of the schema returned by getAvroSchema
+type avroSerializer struct{}
+
+func (avroSerializer) Encode(record analytics.AnalyticsRecord) ([]byte, error) {
+	value := reflect.ValueOf(NewRecord(record))
+
+	buf := make([]byte, 0, 512)
+	for _, f := range recordFields {
+		field := value.Field(f.index)
+		switch f.kind {
+		case reflect.String:
+			buf = appendAvroString(buf, field.String())
+		case reflect.Int64:
+			buf = appendAvroLong(buf, field.Int())
+		case reflect.Float64:
+			buf = appendAvroDouble(buf, field.Float())
+		case reflect.Bool:
+			buf = appendAvroBoolean(buf, field.Bool())
+		case reflect.Slice:
+			// arrays are encoded as a block of items followed by an empty block
+			if field.Len() > 0 {
+				buf = appendAvroLong(buf, int64(field.Len()))
+				for i := 0; i < field.Len(); i++ {
+					buf = appendAvroString(buf, field.Index(i).String())
+				}
+			}
+			buf = appendAvroLong(buf, 0)
+		}
+	}
+	return buf, nil
+}
+
+func (avroSerializer) Format() string {
+	return FormatAvro
+}
+
+func (avroSerializer) SchemaType() string {
+	return "AVRO"
+}
+
+func (avroSerializer) Schema() string {
+	return avroSchema
+}
+
+// appendAvroLong appends v as a zig-zag encoded variable length integer
+func appendAvroLong(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = appendAvroLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+func appendAvroDouble(buf []byte, v float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	return append(buf, tmp[:]...)
+}
+
+func appendAvroBoolean(buf []byte, v bool) []byte {
+	if v {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
@@ -0,0 +1,80 @@
+package serializer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// Config is the serialization configuration of the streaming pumps
+type Config struct {
+	// Format of the messages: json, avro or protobuf
+	Format string `mapstructure:"format"`
+	// Prefix the messages with the Confluent wire format header: a zero magic byte and the schema id
+	ConfluentFraming bool `mapstructure:"confluent_framing"`
+	// Schema id written in the Confluent header when no schema registry is configured
+	SchemaID int `mapstructure:"schema_id"`
+	// Registry the schema is registered in to get its id
+	SchemaRegistry SchemaRegistryConfig `mapstructure:"schema_registry"`
+}
+
+// Encoder encodes the records with the configured serializer and framing
+type Encoder struct {
+	serializer Serializer
+	conf       Config
+	registry   *SchemaRegistryClient
+}
+
+func NewEncoder(conf Config) (*Encoder, error) {
+	s, err := NewSerializer(conf.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{serializer: s, conf: conf}
+	if conf.SchemaRegistry.URL != "" {
+		e.registry = NewSchemaRegistryClient(conf.SchemaRegistry)
+	} else if conf.ConfluentFraming && conf.SchemaID <= 0 {
+		return nil, errors.New("confluent_framing requires either a schema_id or a schema_registry")
+	}
+	return e, nil
+}
+
+// Serializer returns the serializer used by the encoder
+func (e *Encoder) Serializer() Serializer {
+	return e.serializer
+}
+
+// Encode serializes the record, framing it with the Confluent header when enabled.
+// The subject is the schema registry subject, e.g. "<topic>-value".
+func (e *Encoder) Encode(ctx context.Context, subject string, record analytics.AnalyticsRecord) ([]byte, error) {
+	payload, err := e.serializer.Encode(record)
+	if err != nil {
+		return nil, err
+	}
+	if !e.conf.ConfluentFraming {
+		return payload, nil
+	}
+
+	schemaID := e.conf.SchemaID
+	if e.registry != nil {
+		schemaID, err = e.registry.Register(ctx, subject, e.serializer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frame(e.serializer.Format(), schemaID, payload), nil
+}
+
+// frame prefixes the payload with the Confluent wire format header
+func frame(format string, schemaID int, payload []byte) []byte {
+	buf := make([]byte, 5, len(payload)+6)
+	binary.BigEndian.PutUint32(buf[1:], uint32(schemaID))
+	if format == FormatProtobuf {
+		// message indexes: 0 is the shortcut of [0], the first message of the schema
+		buf = append(buf, 0)
+	}
+	return append(buf, payload...)
+}
@@ -0,0 +1,63 @@
+package serializer
+
+import (
+	"math"
+	"reflect"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufSerializer encodes the records as the AnalyticsRecord message returned by getProtobufSchema
+type protobufSerializer struct{}
+
+func (protobufSerializer) Encode(record analytics.AnalyticsRecord) ([]byte, error) {
+	value := reflect.ValueOf(NewRecord(record))
+
+	buf := make([]byte, 0, 512)
+	for _, f := range recordFields {
+		field := value.Field(f.index)
+		number := protowire.Number(f.number)
+		// proto3 doesn't encode the default values
+		switch f.kind {
+		case reflect.String:
+			if field.Len() > 0 {
+				buf = protowire.AppendTag(buf, number, protowire.BytesType)
+				buf = protowire.AppendString(buf, field.String())
+			}
+		case reflect.Int64:
+			if field.Int() != 0 {
+				buf = protowire.AppendTag(buf, number, protowire.VarintType)
+				buf = protowire.AppendVarint(buf, uint64(field.Int()))
+			}
+		case reflect.Float64:
+			if field.Float() != 0 {
+				buf = protowire.AppendTag(buf, number, protowire.Fixed64Type)
+				buf = protowire.AppendFixed64(buf, math.Float64bits(field.Float()))
+			}
+		case reflect.Bool:
+			if field.Bool() {
+				buf = protowire.AppendTag(buf, number, protowire.VarintType)
+				buf = protowire.AppendVarint(buf, protowire.EncodeBool(true))
+			}
+		case reflect.Slice:
+			for i := 0; i < field.Len(); i++ {
+				buf = protowire.AppendTag(buf, number, protowire.BytesType)
+				buf = protowire.AppendString(buf, field.Index(i).String())
+			}
+		}
+	}
+	return buf, nil
+}
+
+func (protobufSerializer) Format() string {
+	return FormatProtobuf
+}
+
+func (protobufSerializer) SchemaType() string {
+	return "PROTOBUF"
+}
+
+func (protobufSerializer) Schema() string {
+	return protobufSchema
+}
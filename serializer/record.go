@@ -0,0 +1,172 @@
+package serializer
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// SchemaVersion is the version of the canonical schema. Bump it whenever Record changes:
+// fields can only be added, with new protobuf field numbers, so older consumers keep working.
+const SchemaVersion = 1
+
+// Record is the canonical, flat representation of an analytics record shared by all the formats.
+// The json tag is the field name and the proto tag the protobuf field number.
+// Timestamps are milliseconds since the Unix epoch.
+type Record struct {
+	Timestamp               int64    `json:"timestamp" proto:"1" logical:"timestamp-millis"`
+	Method                  string   `json:"method" proto:"2"`
+	Host                    string   `json:"host" proto:"3"`
+	Path                    string   `json:"path" proto:"4"`
+	RawPath                 string   `json:"raw_path" proto:"5"`
+	ContentLength           int64    `json:"content_length" proto:"6"`
+	UserAgent               string   `json:"user_agent" proto:"7"`
+	ResponseCode            int64    `json:"response_code" proto:"8"`
+	APIKey                  string   `json:"api_key" proto:"9"`
+	APIVersion              string   `json:"api_version" proto:"10"`
+	APIName                 string   `json:"api_name" proto:"11"`
+	APIID                   string   `json:"api_id" proto:"12"`
+	OrgID                   string   `json:"org_id" proto:"13"`
+	OauthID                 string   `json:"oauth_id" proto:"14"`
+	RequestTimeMs           int64    `json:"request_time_ms" proto:"15"`
+	RawRequest              string   `json:"raw_request" proto:"16"`
+	RawResponse             string   `json:"raw_response" proto:"17"`
+	IPAddress               string   `json:"ip_address" proto:"18"`
+	GeoCountry              string   `json:"geo_country" proto:"19"`
+	GeoRegion               string   `json:"geo_region" proto:"20"`
+	GeoCity                 string   `json:"geo_city" proto:"21"`
+	GeoLatitude             float64  `json:"geo_latitude" proto:"22"`
+	GeoLongitude            float64  `json:"geo_longitude" proto:"23"`
+	GeoASN                  int64    `json:"geo_asn" proto:"24"`
+	UserAgentBrowser        string   `json:"user_agent_browser" proto:"25"`
+	UserAgentBrowserVersion string   `json:"user_agent_browser_version" proto:"26"`
+	UserAgentOS             string   `json:"user_agent_os" proto:"27"`
+	UserAgentOSVersion      string   `json:"user_agent_os_version" proto:"28"`
+	UserAgentDevice         string   `json:"user_agent_device" proto:"29"`
+	UserAgentBot            bool     `json:"user_agent_bot" proto:"30"`
+	LatencyTotal            int64    `json:"latency_total" proto:"31"`
+	LatencyUpstream         int64    `json:"latency_upstream" proto:"32"`
+	BytesIn                 int64    `json:"bytes_in" proto:"33"`
+	BytesOut                int64    `json:"bytes_out" proto:"34"`
+	Tags                    []string `json:"tags" proto:"35"`
+	Alias                   string   `json:"alias" proto:"36"`
+	TrackPath               bool     `json:"track_path" proto:"37"`
+	ExpireAt                int64    `json:"expire_at" proto:"38" logical:"timestamp-millis"`
+}
+
+// NewRecord converts an analytics record to its canonical representation
+func NewRecord(r analytics.AnalyticsRecord) Record {
+	tags := r.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return Record{
+		Timestamp:               unixMillis(r.TimeStamp),
+		Method:                  r.Method,
+		Host:                    r.Host,
+		Path:                    r.Path,
+		RawPath:                 r.RawPath,
+		ContentLength:           r.ContentLength,
+		UserAgent:               r.UserAgent,
+		ResponseCode:            int64(r.ResponseCode),
+		APIKey:                  r.APIKey,
+		APIVersion:              r.APIVersion,
+		APIName:                 r.APIName,
+		APIID:                   r.APIID,
+		OrgID:                   r.OrgID,
+		OauthID:                 r.OauthID,
+		RequestTimeMs:           r.RequestTime,
+		RawRequest:              r.RawRequest,
+		RawResponse:             r.RawResponse,
+		IPAddress:               r.IPAddress,
+		GeoCountry:              r.Geo.Country.ISOCode,
+		GeoRegion:               r.Geo.Region(),
+		GeoCity:                 r.Geo.City.Names["en"],
+		GeoLatitude:             r.Geo.Location.Latitude,
+		GeoLongitude:            r.Geo.Location.Longitude,
+		GeoASN:                  int64(r.Geo.ASN.Number),
+		UserAgentBrowser:        r.UserAgentInfo.Browser,
+		UserAgentBrowserVersion: r.UserAgentInfo.BrowserVersion,
+		UserAgentOS:             r.UserAgentInfo.OS,
+		UserAgentOSVersion:      r.UserAgentInfo.OSVersion,
+		UserAgentDevice:         r.UserAgentInfo.DeviceType,
+		UserAgentBot:            r.UserAgentInfo.Bot,
+		LatencyTotal:            r.Latency.Total,
+		LatencyUpstream:         r.Latency.Upstream,
+		BytesIn:                 r.Network.BytesIn,
+		BytesOut:                r.Network.BytesOut,
+		Tags:                    tags,
+		Alias:                   r.Alias,
+		TrackPath:               r.TrackPath,
+		ExpireAt:                unixMillis(r.ExpireAt),
+	}
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Field describes a field of Record, for the pumps deriving their own schema from the canonical one
+type Field struct {
+	Name string
+	// String, Int64, Float64, Bool, or Slice for the arrays of strings
+	Kind reflect.Kind
+	// timestamp-millis for the timestamps
+	Logical string
+}
+
+// Fields returns the fields of Record, in the order of Values
+func Fields() []Field {
+	fields := make([]Field, len(recordFields))
+	for i, f := range recordFields {
+		fields[i] = Field{Name: f.name, Kind: f.kind, Logical: f.logical}
+	}
+	return fields
+}
+
+// Values returns the values of the fields of the record, in the order of Fields
+func (r Record) Values() []interface{} {
+	value := reflect.ValueOf(r)
+	values := make([]interface{}, len(recordFields))
+	for i, f := range recordFields {
+		values[i] = value.Field(f.index).Interface()
+	}
+	return values
+}
+
+// recordField describes a field of Record, the schemas and the encoders are generated from them
+type recordField struct {
+	index   int
+	name    string
+	number  int
+	kind    reflect.Kind
+	logical string
+}
+
+var recordFields = getRecordFields()
+
+func getRecordFields() []recordField {
+	t := reflect.TypeOf(Record{})
+	fields := make([]recordField, t.NumField())
+	for i := range fields {
+		f := t.Field(i)
+		number, err := strconv.Atoi(f.Tag.Get("proto"))
+		if err != nil {
+			panic("serializer: invalid proto tag of field " + f.Name)
+		}
+		fields[i] = recordField{
+			index:   i,
+			name:    f.Tag.Get("json"),
+			number:  number,
+			kind:    f.Type.Kind(),
+			logical: f.Tag.Get("logical"),
+		}
+	}
+	return fields
+}
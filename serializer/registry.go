@@ -0,0 +1,121 @@
+package serializer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schemaRegistryContentType    = "application/vnd.schemaregistry.v1+json"
+	defaultSchemaRegistryTimeout = 10
+)
+
+type SchemaRegistryConfig struct {
+	// URL of a Confluent compatible schema registry, e.g. http://localhost:8081
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Timeout of the registry requests in seconds. Defaults to 10
+	Timeout               int  `mapstructure:"timeout"`
+	SSLInsecureSkipVerify bool `mapstructure:"ssl_insecure_skip_verify"`
+}
+
+// SchemaRegistryClient registers the schemas in a Confluent compatible schema registry
+// and caches their ids by subject
+type SchemaRegistryClient struct {
+	conf       SchemaRegistryConfig
+	httpClient *http.Client
+
+	mu  sync.Mutex
+	ids map[string]int
+}
+
+func NewSchemaRegistryClient(conf SchemaRegistryConfig) *SchemaRegistryClient {
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultSchemaRegistryTimeout
+	}
+
+	return &SchemaRegistryClient{
+		conf: conf,
+		httpClient: &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.SSLInsecureSkipVerify},
+			},
+		},
+		ids: make(map[string]int),
+	}
+}
+
+// Register registers the schema of the serializer under the subject, unless it's already registered,
+// and returns its id. The registry returns the id of the existing schema when it was registered before.
+func (c *SchemaRegistryClient) Register(ctx context.Context, subject string, s Serializer) (int, error) {
+	c.mu.Lock()
+	id, found := c.ids[subject]
+	c.mu.Unlock()
+	if found {
+		return id, nil
+	}
+
+	body := map[string]interface{}{"schema": s.Schema()}
+	// the registry defaults to AVRO and older versions reject the schemaType field
+	if s.SchemaType() != "AVRO" {
+		body["schemaType"] = s.SchemaType()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint := strings.TrimSuffix(c.conf.URL, "/") + "/subjects/" + url.PathEscape(subject) + "/versions"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID        int    `json:"id"`
+		ErrorCode int    `json:"error_code"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Message != "" {
+			return 0, fmt.Errorf("schema registry error %d: %s", result.ErrorCode, result.Message)
+		}
+		return 0, fmt.Errorf("schema registry returned status %d", resp.StatusCode)
+	}
+	if result.ID == 0 {
+		return 0, errors.New("schema registry didn't return the schema id")
+	}
+
+	c.mu.Lock()
+	c.ids[subject] = result.ID
+	c.mu.Unlock()
+	return result.ID, nil
+}
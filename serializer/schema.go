@@ -0,0 +1,118 @@
+package serializer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	avroNamespace   = "io.tyk.pump"
+	protobufPackage = "tyk.pump.v1"
+	recordName      = "AnalyticsRecord"
+)
+
+var (
+	avroSchema     = getAvroSchema()
+	protobufSchema = getProtobufSchema()
+	jsonSchema     = getJSONSchema()
+)
+
+// getAvroSchema returns the Avro schema of Record. Every field has a default value,
+// so the readers can resolve records written with an older version of the schema.
+func getAvroSchema() string {
+	fields := make([]map[string]interface{}, len(recordFields))
+	for i, f := range recordFields {
+		var fieldType interface{}
+		var fieldDefault interface{}
+		switch f.kind {
+		case reflect.String:
+			fieldType, fieldDefault = "string", ""
+		case reflect.Int64:
+			fieldType, fieldDefault = "long", 0
+		case reflect.Float64:
+			fieldType, fieldDefault = "double", 0
+		case reflect.Bool:
+			fieldType, fieldDefault = "boolean", false
+		case reflect.Slice:
+			fieldType, fieldDefault = map[string]interface{}{"type": "array", "items": "string"}, []string{}
+		}
+		if f.logical != "" {
+			fieldType = map[string]interface{}{"type": fieldType, "logicalType": f.logical}
+		}
+		fields[i] = map[string]interface{}{"name": f.name, "type": fieldType, "default": fieldDefault}
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      recordName,
+		"namespace": avroNamespace,
+		"doc":       fmt.Sprintf("Tyk analytics record, schema version %d", SchemaVersion),
+		"fields":    fields,
+	})
+	return string(schema)
+}
+
+// getProtobufSchema returns the proto3 definition of Record
+func getProtobufSchema() string {
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\n")
+	b.WriteString("package " + protobufPackage + ";\n\n")
+	fmt.Fprintf(&b, "// Tyk analytics record, schema version %d\n", SchemaVersion)
+	b.WriteString("message " + recordName + " {\n")
+	for _, f := range recordFields {
+		var fieldType string
+		switch f.kind {
+		case reflect.String:
+			fieldType = "string"
+		case reflect.Int64:
+			fieldType = "int64"
+		case reflect.Float64:
+			fieldType = "double"
+		case reflect.Bool:
+			fieldType = "bool"
+		case reflect.Slice:
+			fieldType = "repeated string"
+		}
+		fmt.Fprintf(&b, "  %s %s = %d;\n", fieldType, f.name, f.number)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// getJSONSchema returns the JSON Schema of the JSON encoding of Record
+func getJSONSchema() string {
+	properties := make(map[string]interface{}, len(recordFields))
+	required := make([]string, len(recordFields))
+	for i, f := range recordFields {
+		var property map[string]interface{}
+		switch f.kind {
+		case reflect.String:
+			property = map[string]interface{}{"type": "string"}
+		case reflect.Int64:
+			property = map[string]interface{}{"type": "integer"}
+		case reflect.Float64:
+			property = map[string]interface{}{"type": "number"}
+		case reflect.Bool:
+			property = map[string]interface{}{"type": "boolean"}
+		case reflect.Slice:
+			property = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+		}
+		if f.logical == "timestamp-millis" {
+			property["description"] = "milliseconds since the Unix epoch"
+		}
+		properties[f.name] = property
+		required[i] = f.name
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       recordName,
+		"description": fmt.Sprintf("Tyk analytics record, schema version %d", SchemaVersion),
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	})
+	return string(schema)
+}
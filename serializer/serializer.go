@@ -0,0 +1,59 @@
+// Package serializer encodes the analytics records in canonical, versioned formats (Avro, Protobuf
+// and JSON described by a JSON Schema) so the streaming pumps can offer typed contracts to their consumers.
+package serializer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// Serializer encodes analytics records in one of the canonical formats
+type Serializer interface {
+	Encode(record analytics.AnalyticsRecord) ([]byte, error)
+	// Format returns json, avro or protobuf
+	Format() string
+	// SchemaType returns the schema type used by the schema registry: JSON, AVRO or PROTOBUF
+	SchemaType() string
+	// Schema returns the definition of the schema
+	Schema() string
+}
+
+// NewSerializer returns the serializer of the given format
+func NewSerializer(format string) (Serializer, error) {
+	switch format {
+	case FormatJSON:
+		return jsonSerializer{}, nil
+	case FormatAvro:
+		return avroSerializer{}, nil
+	case FormatProtobuf:
+		return protobufSerializer{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q, must be one of json, avro or protobuf", format)
+	}
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Encode(record analytics.AnalyticsRecord) ([]byte, error) {
+	return json.Marshal(NewRecord(record))
+}
+
+func (jsonSerializer) Format() string {
+	return FormatJSON
+}
+
+func (jsonSerializer) SchemaType() string {
+	return "JSON"
+}
+
+func (jsonSerializer) Schema() string {
+	return jsonSchema
+}
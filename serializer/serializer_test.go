@@ -0,0 +1,323 @@
+package serializer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testRecord() analytics.AnalyticsRecord {
+	record := analytics.AnalyticsRecord{
+		Method:        "POST",
+		Host:          "api.example.com",
+		Path:          "/v1/resource",
+		ContentLength: 123,
+		ResponseCode:  201,
+		APIKey:        "APIKEY123",
+		TimeStamp:     time.Date(2020, time.November, 10, 23, 0, 0, 0, time.UTC),
+		APIID:         "API123",
+		OrgID:         "ORG123",
+		RequestTime:   -5,
+		Tags:          []string{"tag-1", "tag-2"},
+		Latency:       analytics.Latency{Total: 40, Upstream: 30},
+		TrackPath:     true,
+	}
+	record.Geo.Location.Latitude = 51.5
+	record.Geo.Location.Longitude = -0.12
+	record.UserAgentInfo.Bot = true
+	return record
+}
+
+// decodeAvro decodes the Avro binary encoding of Record
+func decodeAvro(t *testing.T, data []byte) Record {
+	var record Record
+	value := reflect.ValueOf(&record).Elem()
+
+	readLong := func() int64 {
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			t.Fatal("invalid avro long")
+		}
+		data = data[n:]
+		return v
+	}
+	readString := func() string {
+		l := readLong()
+		s := string(data[:l])
+		data = data[l:]
+		return s
+	}
+
+	for _, f := range recordFields {
+		field := value.Field(f.index)
+		switch f.kind {
+		case reflect.String:
+			field.SetString(readString())
+		case reflect.Int64:
+			field.SetInt(readLong())
+		case reflect.Float64:
+			field.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case reflect.Bool:
+			field.SetBool(data[0] == 1)
+			data = data[1:]
+		case reflect.Slice:
+			items := []string{}
+			for count := readLong(); count != 0; count = readLong() {
+				for i := int64(0); i < count; i++ {
+					items = append(items, readString())
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes left after decoding", len(data))
+	}
+	return record
+}
+
+// decodeProtobuf decodes the protobuf encoding of Record
+func decodeProtobuf(t *testing.T, data []byte) Record {
+	record := Record{Tags: []string{}}
+	value := reflect.ValueOf(&record).Elem()
+
+	fields := make(map[protowire.Number]recordField)
+	for _, f := range recordFields {
+		fields[protowire.Number(f.number)] = f
+	}
+
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		f, found := fields[number]
+		if !found {
+			t.Fatalf("unknown field %d", number)
+		}
+		field := value.Field(f.index)
+		switch wireType {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			data = data[n:]
+			if f.kind == reflect.Slice {
+				field.Set(reflect.Append(field, reflect.ValueOf(v)))
+			} else {
+				field.SetString(v)
+			}
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			data = data[n:]
+			if f.kind == reflect.Bool {
+				field.SetBool(protowire.DecodeBool(v))
+			} else {
+				field.SetInt(int64(v))
+			}
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			data = data[n:]
+			field.SetFloat(math.Float64frombits(v))
+		default:
+			t.Fatalf("unexpected wire type %d", wireType)
+		}
+	}
+	return record
+}
+
+func TestSerializers(t *testing.T) {
+	record := testRecord()
+	expected := NewRecord(record)
+
+	tcs := []struct {
+		format string
+		decode func(t *testing.T, data []byte) Record
+	}{
+		{FormatJSON, func(t *testing.T, data []byte) Record {
+			var r Record
+			if err := json.Unmarshal(data, &r); err != nil {
+				t.Fatal(err)
+			}
+			return r
+		}},
+		{FormatAvro, decodeAvro},
+		{FormatProtobuf, decodeProtobuf},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.format, func(t *testing.T) {
+			s, err := NewSerializer(tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := s.Encode(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded := tc.decode(t, data); !reflect.DeepEqual(decoded, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, decoded)
+			}
+		})
+	}
+
+	if _, err := NewSerializer("xml"); err == nil {
+		t.Fatal("expected an error for an unsupported format")
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	r := NewRecord(testRecord())
+	if r.Timestamp != 1605049200000 {
+		t.Errorf("expected the timestamp in milliseconds, got %d", r.Timestamp)
+	}
+	if r.ExpireAt != 0 {
+		t.Errorf("expected a zero expire_at, got %d", r.ExpireAt)
+	}
+	if r.ResponseCode != 201 || r.LatencyUpstream != 30 || !r.UserAgentBot {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestRecordValues(t *testing.T) {
+	fields := Fields()
+	values := NewRecord(testRecord()).Values()
+	if len(values) != len(fields) || fields[0].Name != "timestamp" || fields[0].Logical != "timestamp-millis" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	for i, f := range fields {
+		if kind := reflect.TypeOf(values[i]).Kind(); kind != f.Kind {
+			t.Errorf("expected a %s value of %s, got %s", f.Kind, f.Name, kind)
+		}
+	}
+	if values[0] != int64(1605049200000) {
+		t.Errorf("expected the timestamp in milliseconds, got %v", values[0])
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	var avro map[string]interface{}
+	if err := json.Unmarshal([]byte(avroSchema), &avro); err != nil {
+		t.Fatal("invalid avro schema: ", err)
+	}
+	if fields := avro["fields"].([]interface{}); len(fields) != len(recordFields) {
+		t.Errorf("expected %d avro fields, got %d", len(recordFields), len(fields))
+	}
+
+	var jsonSchemaDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonSchema), &jsonSchemaDoc); err != nil {
+		t.Fatal("invalid json schema: ", err)
+	}
+	if properties := jsonSchemaDoc["properties"].(map[string]interface{}); len(properties) != len(recordFields) {
+		t.Errorf("expected %d json schema properties, got %d", len(recordFields), len(properties))
+	}
+
+	numbers := make(map[int]bool)
+	for _, f := range recordFields {
+		if numbers[f.number] {
+			t.Errorf("duplicated protobuf field number %d", f.number)
+		}
+		numbers[f.number] = true
+	}
+}
+
+type registryStub struct {
+	requests int
+	body     map[string]interface{}
+	user     string
+}
+
+func (s *registryStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	s.user, _, _ = r.BasicAuth()
+	if r.Method != http.MethodPost || r.URL.Path != "/subjects/tyk-analytics-value/versions" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error_code":40401,"message":"Subject not found"}`))
+		return
+	}
+	s.body = nil
+	json.NewDecoder(r.Body).Decode(&s.body)
+	w.Header().Set("Content-Type", schemaRegistryContentType)
+	w.Write([]byte(`{"id":42}`))
+}
+
+func TestEncoder(t *testing.T) {
+	stub := &registryStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	tcs := []struct {
+		testName       string
+		conf           Config
+		expectedHeader []byte
+		expectedType   interface{}
+	}{
+		{"no framing", Config{Format: FormatAvro}, []byte{}, nil},
+		{"static schema id", Config{Format: FormatAvro, ConfluentFraming: true, SchemaID: 7}, []byte{0, 0, 0, 0, 7}, nil},
+		{"avro with registry", Config{Format: FormatAvro, ConfluentFraming: true, SchemaRegistry: SchemaRegistryConfig{URL: server.URL, Username: "user"}}, []byte{0, 0, 0, 0, 42}, nil},
+		{"protobuf with registry", Config{Format: FormatProtobuf, ConfluentFraming: true, SchemaRegistry: SchemaRegistryConfig{URL: server.URL}}, []byte{0, 0, 0, 0, 42, 0}, "PROTOBUF"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			stub.requests = 0
+			encoder, err := NewEncoder(tc.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload, _ := encoder.Serializer().Encode(testRecord())
+			for i := 0; i < 2; i++ {
+				data, err := encoder.Encode(context.Background(), "tyk-analytics-value", testRecord())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != string(append(tc.expectedHeader, payload...)) {
+					t.Fatalf("expected header %v, got %v", tc.expectedHeader, data[:len(tc.expectedHeader)])
+				}
+			}
+
+			if tc.conf.SchemaRegistry.URL == "" {
+				return
+			}
+			if stub.requests != 1 {
+				t.Errorf("expected the schema id to be cached, got %d requests", stub.requests)
+			}
+			if stub.body["schemaType"] != tc.expectedType {
+				t.Errorf("expected schema type %v, got %v", tc.expectedType, stub.body["schemaType"])
+			}
+			if stub.body["schema"] != encoder.Serializer().Schema() {
+				t.Error("expected the schema to be registered")
+			}
+			if stub.user != tc.conf.SchemaRegistry.Username {
+				t.Errorf("expected user %q, got %q", tc.conf.SchemaRegistry.Username, stub.user)
+			}
+		})
+	}
+
+	t.Run("registry error", func(t *testing.T) {
+		encoder, err := NewEncoder(Config{Format: FormatJSON, ConfluentFraming: true, SchemaRegistry: SchemaRegistryConfig{URL: server.URL}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := encoder.Encode(context.Background(), "unknown-value", testRecord()); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("framing without schema id", func(t *testing.T) {
+		if _, err := NewEncoder(Config{Format: FormatAvro, ConfluentFraming: true}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
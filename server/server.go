@@ -1,11 +1,14 @@
 package server
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/logger"
+	"github.com/TykTechnologies/tyk-pump/pumps"
 
 	"github.com/gocraft/web"
 )
@@ -15,7 +18,11 @@ var defaultHealthPort = 8083
 var serverPrefix = "server"
 var log = logger.GetLogger()
 
-func ServeHealthCheck(configHealthEndpoint string, configHealthPort int) {
+// adminSecretHeader carries the admin_api_secret in the requests of the admin API
+const adminSecretHeader = "X-Tyk-Authorization"
+
+// ServeHealthCheck serves the health check endpoint, and the admin API when enabled
+func ServeHealthCheck(configHealthEndpoint string, configHealthPort int, adminAPIEnable bool, adminAPISecret string) {
 	healthEndpoint := configHealthEndpoint
 	if healthEndpoint == "" {
 		healthEndpoint = defaultHealthEndpoint
@@ -25,20 +32,48 @@ func ServeHealthCheck(configHealthEndpoint string, configHealthPort int) {
 		healthPort = defaultHealthPort
 	}
 
-	router := web.New(Context{}).
-		Get("/"+healthEndpoint, (*Context).Healthcheck)
+	if adminAPIEnable && adminAPISecret == "" {
+		log.WithFields(logrus.Fields{
+			"prefix": serverPrefix,
+		}).Error("admin_api_secret is required by the admin API, it won't be served")
+		adminAPIEnable = false
+	}
 
 	log.WithFields(logrus.Fields{
 		"prefix": serverPrefix,
 	}).Info("Serving health check endpoint at http://localhost:", healthPort, "/", healthEndpoint, " ...")
 
-	if err := http.ListenAndServe(":"+fmt.Sprint(healthPort), router); err != nil {
+	if err := http.ListenAndServe(":"+fmt.Sprint(healthPort), newRouter(healthEndpoint, adminAPIEnable, adminAPISecret)); err != nil {
 		log.WithFields(logrus.Fields{
 			"prefix": serverPrefix,
 		}).Fatal("Error serving health check endpoint", err)
 	}
 }
 
+func newRouter(healthEndpoint string, adminAPIEnable bool, adminAPISecret string) *web.Router {
+	router := web.New(Context{}).
+		Get("/"+healthEndpoint, (*Context).Healthcheck)
+
+	if adminAPIEnable {
+		router.Subrouter(Context{}, "/tag-explosions").
+			Middleware(requireSecret(adminAPISecret)).
+			Get("", (*Context).TagExplosions).
+			Delete("/:org_id", (*Context).ResetTagExplosion)
+	}
+	return router
+}
+
+// requireSecret rejects the requests without the secret in the X-Tyk-Authorization header
+func requireSecret(secret string) func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc) {
+	return func(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get(adminSecretHeader)), []byte(secret)) != 1 {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(rw, req)
+	}
+}
+
 type Context struct{}
 
 func (c *Context) Healthcheck(rw web.ResponseWriter, req *web.Request) {
@@ -46,3 +81,19 @@ func (c *Context) Healthcheck(rw web.ResponseWriter, req *web.Request) {
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte(`{"status": "ok"}`))
 }
+
+// TagExplosions lists the organisations whose aggregates crossed threshold_len_tag_list
+func (c *Context) TagExplosions(rw web.ResponseWriter, req *web.Request) {
+	rw.Header().Set("Content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(pumps.TagExplosions())
+}
+
+// ResetTagExplosion aggregates all the tags of the organisation again
+func (c *Context) ResetTagExplosion(rw web.ResponseWriter, req *web.Request) {
+	if !pumps.ResetTagExplosion(req.PathParams["org_id"]) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
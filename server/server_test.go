@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPISecret(t *testing.T) {
+	router := newRouter("health", true, "secret")
+
+	tcs := []struct {
+		testName string
+		method   string
+		path     string
+		secret   string
+		expected int
+	}{
+		{"health without secret", http.MethodGet, "/health", "", http.StatusOK},
+		{"list without secret", http.MethodGet, "/tag-explosions", "", http.StatusForbidden},
+		{"reset with a wrong secret", http.MethodDelete, "/tag-explosions/org1", "wrong", http.StatusForbidden},
+		{"list", http.MethodGet, "/tag-explosions", "secret", http.StatusOK},
+		{"reset", http.MethodDelete, "/tag-explosions/org1", "secret", http.StatusNotFound},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.testName, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.secret != "" {
+				req.Header.Set(adminSecretHeader, tc.secret)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
@@ -289,6 +289,20 @@ func (r *RedisClusterStorageManager) SetKey(keyName, session string, timeout int
 	return nil
 }
 
+// GetKey returns the value of a key, or ErrKeyNotFound if it doesn't exist
+func (r *RedisClusterStorageManager) GetKey(keyName string) (string, error) {
+	r.ensureConnection()
+	value, err := r.db.Get(ctx, r.fixKey(keyName)).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	if err != nil {
+		log.Error("Error trying to get value: ", err)
+		return "", err
+	}
+	return value, nil
+}
+
 func (r *RedisClusterStorageManager) SetExp(keyName string, timeout int64) error {
 	err := r.db.Expire(ctx, r.fixKey(keyName), time.Duration(timeout)*time.Second).Err()
 	if err != nil {
@@ -1,6 +1,12 @@
 package storage
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+// ErrKeyNotFound is returned by GetKey when the key doesn't exist
+var ErrKeyNotFound = errors.New("key not found")
 
 type AnalyticsStorage interface {
 	Init(config interface{}) error